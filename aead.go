@@ -0,0 +1,125 @@
+package nestedaes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"slices"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/mu"
+)
+
+// UpdatableAEAD is a [cipher.AEAD] whose ciphertexts can be re-encrypted
+// (rotated) under a fresh key-encryption key.
+type UpdatableAEAD interface {
+	cipher.AEAD
+	// Reencrypt appends the re-encryption of blob to dst and returns the
+	// updated slice along with an UpdatableAEAD for the new KEK.  The input
+	// blob is not modified.
+	Reencrypt(dst, blob []byte) ([]byte, UpdatableAEAD, error)
+}
+
+// AEAD adapts the nested encryption scheme to the [cipher.AEAD] interface.
+// The nonce passed to Seal and Open is the blob's BaseIV, and thus is
+// [aes256.IVSize] bytes; the ciphertext is the full blob (header and
+// payload).
+//
+// As with [Encrypt], a nonce must never be used more than once with the same
+// KEK.
+type AEAD struct {
+	kek []byte
+}
+
+// NewAEAD returns an [AEAD] that seals and opens blobs under the given
+// key-encryption key (KEK).
+func NewAEAD(kek []byte) (*AEAD, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+	a := &AEAD{kek: AllocKey(aes256.KeySize)}
+	copy(a.kek, kek)
+	return a, nil
+}
+
+// KEK returns a copy of the AEAD's key-encryption key.  The copy is allocated
+// with [AllocKey]; the caller should release it with [FreeKey].
+func (a *AEAD) KEK() []byte {
+	kek := AllocKey(len(a.kek))
+	copy(kek, a.kek)
+	return kek
+}
+
+// Wipe zeroes and releases the AEAD's key-encryption key.  The AEAD must not
+// be used afterwards.
+func (a *AEAD) Wipe() {
+	FreeKey(a.kek)
+	a.kek = nil
+}
+
+// NonceSize satisfies the [cipher.AEAD] interface.
+func (a *AEAD) NonceSize() int {
+	return aes256.IVSize
+}
+
+// Overhead satisfies the [cipher.AEAD] interface.  It returns the overhead
+// of a single-layer blob; see [Overhead].
+func (a *AEAD) Overhead() int {
+	return Overhead
+}
+
+// Seal satisfies the [cipher.AEAD] interface.  It encrypts and authenticates
+// plaintext and additionalData, appends the resulting blob to dst, and
+// returns the updated slice.
+func (a *AEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != aes256.IVSize {
+		mu.Panicf("nestedaes: incorrect nonce length given to AEAD.Seal")
+	}
+
+	ret, err := AppendEncrypt(dst, plaintext, a.kek, nonce, additionalData)
+	if err != nil {
+		mu.Panicf("nestedaes.AEAD.Seal: %v", err)
+	}
+	return ret
+}
+
+// Open satisfies the [cipher.AEAD] interface.  It decrypts and authenticates
+// the blob and additionalData, appends the plaintext to dst, and returns the
+// updated slice.  The nonce must match the blob's BaseIV.  Unlike [Decrypt],
+// Open does not modify the blob.
+func (a *AEAD) Open(dst, nonce, blob, additionalData []byte) ([]byte, error) {
+	if len(nonce) != aes256.IVSize {
+		mu.Panicf("nestedaes: incorrect nonce length given to AEAD.Open")
+	}
+
+	if len(blob) < 4+aes256.IVSize {
+		return nil, fmt.Errorf("blob (%d bytes) is too small to contain a header", len(blob))
+	}
+	if !bytes.Equal(nonce, blob[4:4+aes256.IVSize]) {
+		return nil, fmt.Errorf("nonce does not match the blob's BaseIV")
+	}
+
+	return DecryptTo(dst, blob, a.kek, additionalData)
+}
+
+// Reencrypt satisfies the [UpdatableAEAD] interface.  The new KEK is randomly
+// generated and may be retrieved with the returned AEAD's KEK method.
+func (a *AEAD) Reencrypt(dst, blob []byte) ([]byte, UpdatableAEAD, error) {
+	// copy the blob to dst, leaving room for the new DEK entry, and
+	// re-encrypt the copy in place
+	ret := slices.Grow(dst, len(blob)+aes256.KeySize)
+	ret = append(ret, blob...)
+
+	newKEK := newRandomKey()
+	newDEK := newRandomKey()
+	defer FreeKey(newDEK)
+	newBlob, err := ReencryptInto(ret[len(dst):], a.kek, newKEK, newDEK)
+	if err != nil {
+		FreeKey(newKEK)
+		return nil, nil, err
+	}
+	return ret[:len(dst)+len(newBlob)], &AEAD{kek: newKEK}, nil
+}
+
+var _ UpdatableAEAD = (*AEAD)(nil)
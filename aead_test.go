@@ -0,0 +1,100 @@
+package nestedaes
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/etclab/aes256"
+)
+
+func TestAEADSealOpen(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	orig := bytes.Clone(plain)
+	ad := []byte("object-name")
+
+	a, err := NewAEAD(aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := aes256.NewRandomIV()
+
+	prefix := []byte("prefix")
+	blob := a.Seal(bytes.Clone(prefix), nonce, plain, ad)
+	if !bytes.Equal(plain, orig) {
+		t.Fatalf("Seal modified the plaintext")
+	}
+	if !bytes.HasPrefix(blob, prefix) {
+		t.Fatalf("Seal did not append to dst")
+	}
+	blob = blob[len(prefix):]
+	if len(blob) != len(plain)+a.Overhead() {
+		t.Fatalf("expected blob of %d bytes, got %d", len(plain)+a.Overhead(), len(blob))
+	}
+
+	sealed := bytes.Clone(blob)
+	got, err := a.Open(prefix, nonce, blob, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blob, sealed) {
+		t.Fatalf("Open modified the blob")
+	}
+	if !bytes.Equal(got, append(prefix, plain...)) {
+		t.Fatalf("expected Open to produce %q, got %q", append(prefix, plain...), got)
+	}
+
+	if _, err := a.Open(nil, nonce, blob, []byte("other")); err == nil {
+		t.Fatalf("Open succeeded with the wrong additional data")
+	}
+	if _, err := a.Open(nil, aes256.NewRandomIV(), blob, ad); err == nil {
+		t.Fatalf("Open succeeded with the wrong nonce")
+	}
+}
+
+func TestAEADSealEmpty(t *testing.T) {
+	a, err := NewAEAD(aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := aes256.NewRandomIV()
+
+	blob := a.Seal(nil, nonce, nil, nil)
+	got, err := a.Open(nil, nonce, blob, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected empty plaintext, got %x", got)
+	}
+}
+
+func TestAEADReencrypt(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+
+	a, err := NewAEAD(aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := aes256.NewRandomIV()
+	blob := a.Seal(nil, nonce, plain, nil)
+
+	var u UpdatableAEAD = a
+	for i := 0; i < 10; i++ {
+		blob, u, err = u.Reencrypt(nil, blob)
+		if err != nil {
+			t.Fatalf("reencrypt #%d failed: %v", i, err)
+		}
+	}
+
+	if _, err := a.Open(nil, nonce, blob, nil); err == nil {
+		t.Fatalf("Open succeeded with the old KEK")
+	}
+
+	got, err := u.Open(nil, nonce, blob, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("expected Open to produce %q, got %q", plain, got)
+	}
+}
@@ -0,0 +1,143 @@
+package nestedaes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+
+	"github.com/etclab/aes256"
+)
+
+// applyChunkSize is the size of the chunks of payload in which
+// [ApplyTokens] applies the keystreams: each chunk stays in the cache while
+// all the keystreams are XORed with it, and the chunks are the unit of work
+// of [ApplyTokensConcurrent].  It is a multiple of the AES block size.
+const applyChunkSize = 64 * 1024
+
+// ApplyTokens re-encrypts the blob in place with a chain of tokens, as
+// applying them one after the other with [ApplyToken] would, but in a
+// single pass over the payload: the tokens' keystreams are XORed with each
+// chunk of the payload in turn.  This is how a server catches up on the
+// rotations a blob missed.
+//
+// The first token must apply to the blob, and each following token to the
+// header of the one before (see [ApplyToken]); otherwise, ApplyTokens fails
+// with a [*TokenError] before it modifies the blob.  The blob's header is
+// replaced with the last token's header.
+//
+// If blob has enough spare capacity for the new header (the tokens add
+// [KeySize] bytes each), ApplyTokens does not allocate a buffer for the new
+// blob, and the returned slice shares blob's storage.  In either case, the
+// contents of blob are overwritten.
+func ApplyTokens(blob []byte, tokens ...*Token) ([]byte, error) {
+	return ApplyTokensConcurrent(blob, 1, tokens...)
+}
+
+// ApplyTokensConcurrent is like [ApplyTokens], but spreads the chunks of the
+// payload over the given number of goroutines.  With one worker (or a
+// payload of a single chunk), it runs in the calling goroutine.
+func ApplyTokensConcurrent(blob []byte, workers int, tokens ...*Token) ([]byte, error) {
+	if len(tokens) == 0 {
+		return blob, nil
+	}
+	hSize, err := checkTokenChain(blob, tokens)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	newHSize := len(last.Header)
+
+	// make room for the new header by shifting the payload
+	ret, _ := sliceForAppend(blob, newHSize-hSize, 0)
+	payload := ret[newHSize:]
+	copy(payload, ret[hSize:len(blob)])
+
+	baseIV := last.Header[4:plainHeaderSize]
+	chunks := (len(payload) + applyChunkSize - 1) / applyChunkSize
+	workers = min(workers, chunks)
+	if workers <= 1 {
+		xorKeystreams(payload, baseIV, tokens)
+	} else {
+		var wg sync.WaitGroup
+		next := make(chan int)
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for c := range next {
+					off := c * applyChunkSize
+					chunk := payload[off:min(off+applyChunkSize, len(payload))]
+					xorKeystreamsAt(chunk, baseIV, tokens, off)
+				}
+			}()
+		}
+		for c := range chunks {
+			next <- c
+		}
+		close(next)
+		wg.Wait()
+	}
+
+	copy(ret, last.Header)
+	return ret, nil
+}
+
+// checkTokenChain checks that the tokens form a chain that applies to blob,
+// and returns the size of the blob's header.
+func checkTokenChain(blob []byte, tokens []*Token) (int, error) {
+	hSize, _, err := checkToken(blob, tokens[0])
+	if err != nil {
+		return 0, err
+	}
+	for i := 1; i < len(tokens); i++ {
+		if _, _, err := checkToken(tokens[i-1].Header, tokens[i]); err != nil {
+			var te *TokenError
+			if errors.As(err, &te) {
+				return 0, tokenError(te.Reason, "token %d does not follow token %d: %s", i, i-1, te.Detail)
+			}
+			return 0, err
+		}
+	}
+	return hSize, nil
+}
+
+// xorKeystreams XORs the keystreams of the tokens' layers with the payload,
+// chunk by chunk.
+func xorKeystreams(payload, baseIV []byte, tokens []*Token) {
+	var iv [aes256.IVSize]byte
+	streams := make([]cipher.Stream, len(tokens))
+	for i, t := range tokens {
+		layerIV(&iv, baseIV, t.Layer)
+		streams[i] = aes256.NewCTR(t.DEK, iv[:])
+	}
+	for off := 0; off < len(payload); off += applyChunkSize {
+		chunk := payload[off:min(off+applyChunkSize, len(payload))]
+		for _, s := range streams {
+			s.XORKeyStream(chunk, chunk)
+		}
+	}
+}
+
+// xorKeystreamsAt XORs the keystreams of the tokens' layers with a chunk
+// that starts at offset off of the payload.  off must be a multiple of the
+// AES block size.
+func xorKeystreamsAt(chunk, baseIV []byte, tokens []*Token, off int) {
+	var iv [aes256.IVSize]byte
+	for _, t := range tokens {
+		layerIV(&iv, baseIV, t.Layer)
+		addCounter(&iv, uint64(off/aes.BlockSize))
+		aes256.NewCTR(t.DEK, iv[:]).XORKeyStream(chunk, chunk)
+	}
+}
+
+// addCounter adds n to the CTR counter block iv, modulo 2^128, which seeks
+// the keystream by n blocks.
+func addCounter(iv *[aes256.IVSize]byte, n uint64) {
+	hi := binary.BigEndian.Uint64(iv[:8])
+	lo, carry := bits.Add64(binary.BigEndian.Uint64(iv[8:]), n, 0)
+	binary.BigEndian.PutUint64(iv[:8], hi+carry)
+	binary.BigEndian.PutUint64(iv[8:], lo)
+}
@@ -0,0 +1,152 @@
+package nestedaes
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/etclab/aes256"
+)
+
+// tokenChain returns k tokens that re-encrypt blob in turn, and the final
+// KEK.
+func tokenChain(t *testing.T, blob, kek []byte, k int) ([]*Token, []byte) {
+	t.Helper()
+	hdr, _, err := SplitHeaderPayload(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []*Token
+	for range k {
+		tok, newKEK, err := ReKeyGen(hdr, kek)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tok)
+		hdr, kek = tok.Header, newKEK
+	}
+	return tokens, kek
+}
+
+func TestApplyTokens(t *testing.T) {
+	plain := make([]byte, 5*applyChunkSize+100)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, newKEK := tokenChain(t, blob, kek, 5)
+
+	want := bytes.Clone(blob)
+	for _, tok := range tokens {
+		if want, err = ApplyToken(want, tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, 3, 16} {
+		got, err := ApplyTokensConcurrent(bytes.Clone(blob), workers, tokens...)
+		if err != nil {
+			t.Fatalf("workers=%d: ApplyTokensConcurrent failed: %v", workers, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("workers=%d: ApplyTokensConcurrent and ApplyToken differ", workers)
+		}
+	}
+
+	got, err := ApplyTokens(blob, tokens...)
+	if err != nil {
+		t.Fatalf("ApplyTokens failed: %v", err)
+	}
+	pt, err := Decrypt(got, newKEK, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pt, plain) {
+		t.Fatalf("decrypt produced the wrong plaintext")
+	}
+}
+
+func TestApplyTokensBrokenChain(t *testing.T) {
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, _ := tokenChain(t, blob, kek, 3)
+
+	tests := []struct {
+		name   string
+		tokens []*Token
+		reason error
+	}{
+		{"gap", []*Token{tokens[0], tokens[2]}, ErrTokenOutOfOrder},
+		{"missing first", tokens[1:], ErrTokenOutOfOrder},
+		{"reordered", []*Token{tokens[0], tokens[2], tokens[1]}, ErrTokenOutOfOrder},
+		{"repeated", []*Token{tokens[0], tokens[1], tokens[1]}, ErrTokenApplied},
+	}
+	for _, tt := range tests {
+		orig := bytes.Clone(blob)
+		if _, err := ApplyTokens(orig, tt.tokens...); !errors.Is(err, tt.reason) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.reason, err)
+		}
+		if !bytes.Equal(orig, blob) {
+			t.Fatalf("%s: the rejected chain modified the blob", tt.name)
+		}
+	}
+}
+
+func BenchmarkApplyTokens(b *testing.B) {
+	const size = 16 * 1024 * 1024
+	const k = 8
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(make([]byte, size), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	hdr, _, _ := SplitHeaderPayload(blob)
+	var tokens []*Token
+	for range k {
+		tok, newKEK, err := ReKeyGen(hdr, kek)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tokens = append(tokens, tok)
+		hdr, kek = tok.Header, newKEK
+	}
+
+	work := make([]byte, 0, len(blob)+k*KeySize)
+	run := func(b *testing.B, apply func([]byte) ([]byte, error)) {
+		b.SetBytes(size)
+		for b.Loop() {
+			b.StopTimer()
+			work = append(work[:0], blob...)
+			b.StartTimer()
+			if _, err := apply(work); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("Sequential", func(b *testing.B) {
+		run(b, func(blob []byte) ([]byte, error) {
+			var err error
+			for _, tok := range tokens {
+				if blob, err = ApplyToken(blob, tok); err != nil {
+					return nil, err
+				}
+			}
+			return blob, nil
+		})
+	})
+	b.Run("OnePass", func(b *testing.B) {
+		run(b, func(blob []byte) ([]byte, error) { return ApplyTokens(blob, tokens...) })
+	})
+	b.Run("Concurrent", func(b *testing.B) {
+		run(b, func(blob []byte) ([]byte, error) { return ApplyTokensConcurrent(blob, 4, tokens...) })
+	})
+}
@@ -0,0 +1,285 @@
+// Package audit keeps a tamper-evident, append-only log of the events of a
+// blob's life: encryption, re-encryption, token application, KEK rotation,
+// compaction, and shredding.
+//
+// The log is a file of JSON events, one per line.  Each event records the
+// hash of the line before it (see [Event.Prev]), so that changing, removing,
+// or reordering any event breaks the chain at the next one, which [Verify]
+// detects.
+//
+// The chain is not keyed: whoever can write the log can also rewrite it
+// from any point on, and recompute a valid chain; appending events, or
+// truncating the log, doesn't even break it.  The log is thus tamper-evident
+// only with respect to a head (see [Log.Head]) that was recorded somewhere
+// the log's writer can't change, such as another machine or a transparency
+// log, and that is checked with [Verify].  An event up to an anchored head
+// can't be changed, nor the log truncated before it, without [Verify]
+// detecting it; the events appended since are covered by the next anchored
+// head.
+//
+// Events never carry key material: keys are identified by their
+// fingerprints (see [nestedaes.Fingerprint]), and headers by their hashes
+// (see [nestedaes.HeaderHash]).
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of events.
+const (
+	// KindEncrypt records a blob's encryption under a new KEK.
+	KindEncrypt = "encrypt"
+	// KindReEncrypt records a layer added to a blob, under a new KEK.
+	KindReEncrypt = "reencrypt"
+	// KindApplyToken records a re-encryption token applied to a blob by a
+	// store, which doesn't know the blob's KEKs.
+	KindApplyToken = "apply_token"
+	// KindRotateKEK records the replacement of a blob's KEK, without a new
+	// layer.
+	KindRotateKEK = "rotate_kek"
+	// KindCompact records the replacement of a blob's layers with a single
+	// layer, under a new KEK.
+	KindCompact = "compact"
+	// KindShred records the destruction of a blob's KEK, which makes the
+	// blob unreadable.
+	KindShred = "shred"
+	// KindPut records a blob stored (or replaced) by a store.
+	KindPut = "put"
+	// KindPutHeader records a blob's header replaced by a store.
+	KindPutHeader = "put_header"
+	// KindPutKEK records a KEK set for a blob by a KEK store.
+	KindPutKEK = "put_kek"
+)
+
+// ErrChain is returned by [Verify] and [Open] for a log whose chain is
+// broken, or that is malformed.
+var ErrChain = errors.New("audit: broken chain")
+
+// genesis is the Prev of the first event of a log.
+var genesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+// Event is an entry of the log.
+type Event struct {
+	// Seq is the event's position in the log, starting at 1.
+	Seq uint64 `json:"seq"`
+	// Time is when the event was recorded.
+	Time time.Time `json:"time"`
+	// Kind is the kind of event, such as [KindEncrypt].
+	Kind string `json:"kind"`
+	// Blob names the blob, such as a file's path or a store's name for it.
+	Blob string `json:"blob,omitempty"`
+	// Actor names who caused the event, such as a user, a service, or the
+	// signer of a token.
+	Actor string `json:"actor,omitempty"`
+	// KEKID is the fingerprint of the blob's KEK after the event.
+	KEKID string `json:"kek_id,omitempty"`
+	// PrevKEKID is the fingerprint of the blob's KEK before the event.
+	PrevKEKID string `json:"prev_kek_id,omitempty"`
+	// HeaderHash is the hex [nestedaes.HeaderHash] of the blob's header
+	// after the event.
+	HeaderHash string `json:"header_hash,omitempty"`
+	// Layers is the number of layers of the blob after the event.
+	Layers int `json:"layers,omitempty"`
+	// Detail describes the event further.
+	Detail string `json:"detail,omitempty"`
+	// Prev is the hex SHA-256 hash of the log's previous line, or 64 zeros
+	// for the first event.
+	Prev string `json:"prev"`
+}
+
+// hashLine returns the hash of a line of the log, without its newline.
+func hashLine(line []byte) string {
+	h := sha256.Sum256(line)
+	return hex.EncodeToString(h[:])
+}
+
+// Log is an audit log open for appending.  Its methods are safe for
+// concurrent use, but a log file must not be appended to by more than one
+// Log at a time.
+type Log struct {
+	// Actor is the Actor of the appended events that don't have one.
+	Actor string
+
+	mu   sync.Mutex
+	f    *os.File
+	seq  uint64
+	head string
+}
+
+// Open opens the log file at path for appending, creating it if it doesn't
+// exist.  It verifies the log's chain first.  A last line that a crash left
+// incomplete is discarded.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f, head: genesis}
+	valid, err := l.scan()
+	if err == nil {
+		err = f.Truncate(valid)
+	}
+	if err == nil {
+		_, err = f.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit: can't open %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// scan verifies the log's chain, sets the log's head and sequence number,
+// and returns the size of its complete lines.
+func (l *Log) scan() (int64, error) {
+	var valid int64
+	r := bufio.NewReader(l.f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// an incomplete line
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		e, err := checkLine(line[:len(line)-1], l.seq+1, l.head)
+		if err != nil {
+			return 0, err
+		}
+		l.seq, l.head = e.Seq, hashLine(line[:len(line)-1])
+		valid += int64(len(line))
+	}
+}
+
+// checkLine decodes a line of the log, and checks that it is the event seq,
+// and follows the line whose hash is prev.
+func checkLine(line []byte, seq uint64, prev string) (*Event, error) {
+	e := new(Event)
+	if err := json.Unmarshal(line, e); err != nil {
+		return nil, fmt.Errorf("%w: event %d is malformed: %v", ErrChain, seq, err)
+	}
+	if e.Seq != seq {
+		return nil, fmt.Errorf("%w: event %d has sequence number %d", ErrChain, seq, e.Seq)
+	}
+	if e.Prev != prev {
+		return nil, fmt.Errorf("%w: event %d doesn't follow event %d", ErrChain, seq, seq-1)
+	}
+	return e, nil
+}
+
+// Append durably appends an event to the log.  It sets the event's Seq and
+// Prev, its Time if it is zero, and its Actor if it is empty.
+func (l *Log) Append(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return errors.New("audit: log is closed")
+	}
+	e.Seq, e.Prev = l.seq+1, l.head
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Actor == "" {
+		e.Actor = l.Actor
+	}
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	// a single write, so that a crash leaves at most an incomplete last
+	// line
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("audit: can't append event: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("audit: can't append event: %w", err)
+	}
+	l.seq, l.head = e.Seq, hashLine(line)
+	return nil
+}
+
+// Head returns the hash of the log's last line, which commits to every
+// event of the log.
+func (l *Log) Head() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Verify reads a log from r and verifies its chain, calling fn, if it is not
+// nil, with each event in order; an error from fn stops Verify.  It returns
+// the log's current head, which is 64 zeros for an empty log.  If head is
+// not empty, Verify also checks that the chain passes through the event whose
+// line has that hash (or, for 64 zeros, through the empty log), which proves
+// that the log, up to that event, is the one whose head was recorded: a head
+// anchored earlier still verifies after more events are appended, but not
+// after the events before it were changed or truncated.
+func Verify(r io.Reader, head string, fn func(*Event) error) (string, error) {
+	seq, cur := uint64(0), genesis
+	anchored := head == "" || head == genesis
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				return "", fmt.Errorf("%w: event %d is incomplete", ErrChain, seq+1)
+			}
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		e, err := checkLine(line, seq+1, cur)
+		if err != nil {
+			return "", err
+		}
+		seq, cur = e.Seq, hashLine(line)
+		if cur == head {
+			anchored = true
+		}
+		if fn != nil {
+			if err := fn(e); err != nil {
+				return "", err
+			}
+		}
+	}
+	if !anchored {
+		return "", fmt.Errorf("%w: no event of the log has the hash %s", ErrChain, head)
+	}
+	return cur, nil
+}
+
+// VerifyFile verifies the log file at path (see [Verify]).
+func VerifyFile(path, head string, fn func(*Event) error) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return Verify(f, head, fn)
+}
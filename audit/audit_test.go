@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLog appends n events to a new log, and returns its path and head.
+func writeLog(t *testing.T, n int) (string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Actor = "alice"
+	for i := range n {
+		e := Event{Kind: KindEncrypt, Blob: "b", KEKID: "sha256:0123456789abcdef"}
+		if i%2 == 1 {
+			e.Kind, e.Actor = KindShred, "bob"
+		}
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path, l.Head()
+}
+
+func readEvents(t *testing.T, path, head string) []*Event {
+	t.Helper()
+	var events []*Event
+	_, err := VerifyFile(path, head, func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VerifyFile failed: %v", err)
+	}
+	return events
+}
+
+func TestLog(t *testing.T) {
+	path, head := writeLog(t, 3)
+	events := readEvents(t, path, head)
+	if len(events) != 3 {
+		t.Fatalf("read %d events, expected 3", len(events))
+	}
+	for i, e := range events {
+		if e.Seq != uint64(i+1) || e.Time.IsZero() {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+	if events[0].Actor != "alice" || events[1].Actor != "bob" {
+		t.Fatal("the events have the wrong actors")
+	}
+	if events[0].Prev != genesis {
+		t.Fatal("the first event doesn't follow the genesis hash")
+	}
+
+	// reopening continues the chain
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Head() != head {
+		t.Fatal("the reopened log has the wrong head")
+	}
+	if err := l.Append(Event{Kind: KindCompact, Blob: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	head = l.Head()
+	l.Close()
+	if events := readEvents(t, path, head); len(events) != 4 || events[3].Seq != 4 {
+		t.Fatal("the appended event doesn't continue the chain")
+	}
+}
+
+func TestAnchoredHead(t *testing.T) {
+	path, anchor := writeLog(t, 2)
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := l.Append(Event{Kind: KindReEncrypt, Blob: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := l.Head()
+	l.Close()
+
+	for _, h := range []string{anchor, head, genesis} {
+		got, err := VerifyFile(path, h, nil)
+		if err != nil {
+			t.Fatalf("VerifyFile with head %s failed: %v", h, err)
+		}
+		if got != head {
+			t.Fatalf("VerifyFile returned the head %s, expected %s", got, head)
+		}
+	}
+
+	// a log truncated before the anchor doesn't verify
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := data[:bytes.IndexByte(data, '\n')+1]
+	if _, err := Verify(bytes.NewReader(first), anchor, nil); !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain for a log truncated before the anchor, got %v", err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	path, head := writeLog(t, 4)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines = lines[:len(lines)-1]
+
+	for name, tampered := range map[string][]byte{
+		"changed":   bytes.Join([][]byte{lines[0], bytes.Replace(lines[1], []byte("bob"), []byte("eve"), 1), lines[2], lines[3]}, nil),
+		"removed":   bytes.Join([][]byte{lines[0], lines[2], lines[3]}, nil),
+		"reordered": bytes.Join([][]byte{lines[1], lines[0], lines[2], lines[3]}, nil),
+		"malformed": bytes.Join([][]byte{lines[0], []byte("{\n"), lines[2], lines[3]}, nil),
+		"truncated": bytes.Join(lines[:3], nil),
+		"appended":  bytes.Join(append(lines, lines[3]), nil),
+	} {
+		if _, err := Verify(bytes.NewReader(tampered), head, nil); !errors.Is(err, ErrChain) {
+			t.Errorf("%s: expected ErrChain, got %v", name, err)
+		}
+		p := filepath.Join(t.TempDir(), "audit.log")
+		if err := os.WriteFile(p, tampered, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if name == "truncated" || name == "appended" {
+			// only the head detects these
+			continue
+		}
+		if _, err := Open(p); !errors.Is(err, ErrChain) {
+			t.Errorf("%s: expected Open to fail with ErrChain, got %v", name, err)
+		}
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	path, head := writeLog(t, 2)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"kind":"enc`)
+	f.Close()
+
+	if _, err := VerifyFile(path, "", nil); !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain for an incomplete event, got %v", err)
+	}
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if l.Head() != head {
+		t.Fatal("Open didn't discard the incomplete event")
+	}
+	if err := l.Append(Event{Kind: KindEncrypt}); err != nil {
+		t.Fatal(err)
+	}
+	head = l.Head()
+	l.Close()
+	if events := readEvents(t, path, head); len(events) != 3 {
+		t.Fatalf("read %d events, expected 3", len(events))
+	}
+}
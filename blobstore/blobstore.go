@@ -0,0 +1,315 @@
+// Package blobstore stores nestedaes blobs on the server side, where
+// re-encryption tokens are applied.
+//
+// The [BlobStore] interface has an in-memory implementation, [Memory], and
+// one backed by a directory, [Dir].  A [Rotator] re-encrypts every blob of a
+// store, tracking the blobs' KEKs in a [KEKStore].  A [Scheduler] applies
+// rotation policies, such as "rotate every blob at least every 90 days", to
+// a store, within a rate limit.
+//
+// A [Dir] keeps each blob in a file under a directory.  Besides applying a
+// token right away, it can apply tokens lazily (see [Dir.QueueToken]): the
+// blob's new header is committed at once, but the token's layer of
+// encryption is only recorded as pending, and is applied to the payload, in
+// a single pass with any other pending layers, the next time the blob is
+// read or by a background flusher (see [Dir.RunFlusher]).  Rotating cold
+// data thus costs a small write per blob, rather than a rewrite of it.  A
+// Dir is also a [Streamer]: it can read and write blobs without holding
+// them in memory.
+//
+// A [Dir] and a [DirKEKs] can record their updates in an audit log (see
+// package [audit]): together, they record which blobs were re-encrypted
+// when, and under which KEK IDs.
+package blobstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+var (
+	// ErrNotFound is returned for a blob (or a KEK) that doesn't exist.
+	ErrNotFound = errors.New("blobstore: blob not found")
+	// ErrInvalid matches (with [errors.Is]) the errors for an invalid
+	// argument: a malformed blob name, blob, header, or key.
+	ErrInvalid = errors.New("blobstore: invalid argument")
+	// ErrConflict matches (with [errors.Is]) the errors for an update that
+	// lost a race: the blob changed since the caller read it, so that the
+	// update's expectation (see [Expect]), or the token's previous header,
+	// no longer holds.  The caller can read the blob's header again, and
+	// retry.
+	ErrConflict = errors.New("blobstore: conflict")
+)
+
+// invalidError is an error that matches [ErrInvalid].
+type invalidError struct {
+	err error
+}
+
+// invalidf is like [fmt.Errorf], but the error matches [ErrInvalid].
+func invalidf(format string, a ...any) error {
+	return &invalidError{fmt.Errorf(format, a...)}
+}
+
+func (e *invalidError) Error() string        { return e.err.Error() }
+func (e *invalidError) Unwrap() error        { return e.err }
+func (e *invalidError) Is(target error) bool { return target == ErrInvalid }
+
+// conflictError is an error that matches [ErrConflict].
+type conflictError struct {
+	err error
+}
+
+// conflictf is like [fmt.Errorf], but the error matches [ErrConflict].
+func conflictf(format string, a ...any) error {
+	return &conflictError{fmt.Errorf(format, a...)}
+}
+
+func (e *conflictError) Error() string        { return e.err.Error() }
+func (e *conflictError) Unwrap() error        { return e.err }
+func (e *conflictError) Is(target error) bool { return target == ErrConflict }
+
+// Expect is the expected state of a blob, for a compare-and-swap update
+// (see [BlobStore.PutIf] and [BlobStore.PutHeaderIf]).  The zero Expect
+// expects nothing.
+type Expect struct {
+	// HeaderHash, if not nil, is the [nestedaes.HeaderHash] of the blob's
+	// latest header.
+	HeaderHash []byte
+	// Layers, if positive, is the number of layers of the blob.
+	Layers int
+	// Absent, if true, expects that there is no blob under the name.
+	Absent bool
+}
+
+// ExpectHeader returns the Expect for a blob whose latest header is header.
+func ExpectHeader(header []byte) (Expect, error) {
+	h, err := nestedaes.HeaderHash(header)
+	if err != nil {
+		return Expect{}, invalidf("blobstore: invalid header: %w", err)
+	}
+	return Expect{HeaderHash: h}, nil
+}
+
+// none reports whether the Expect expects nothing.
+func (e Expect) none() bool {
+	return e.HeaderHash == nil && e.Layers <= 0 && !e.Absent
+}
+
+// check checks the expectation against the latest header of the blob name,
+// or nil if there is no such blob.  A failed expectation is an error that
+// matches [ErrConflict] (and, for a missing blob, [ErrNotFound]).
+func (e Expect) check(name string, header []byte) error {
+	if header == nil {
+		if e.HeaderHash != nil || e.Layers > 0 {
+			return &conflictError{fmt.Errorf("%w: %s", ErrNotFound, name)}
+		}
+		return nil
+	}
+	if e.Absent {
+		return conflictf("blobstore: %s exists", name)
+	}
+	if e.HeaderHash != nil {
+		h, err := nestedaes.HeaderHash(header)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(h, e.HeaderHash) {
+			return conflictf("blobstore: the header of %s changed", name)
+		}
+	}
+	if e.Layers > 0 {
+		ph, err := nestedaes.UnmarshalPlainHeader(header)
+		if err != nil {
+			return err
+		}
+		if ph.Layers() != e.Layers {
+			return conflictf("blobstore: %s has %d layers, expected %d", name, ph.Layers(), e.Layers)
+		}
+	}
+	return nil
+}
+
+// tokenConflict returns err, a token's rejection for the blob name whose
+// latest header is header, as an error that also matches [ErrConflict] if
+// the token was derived from another header of the same blob: the blob was
+// updated since the token's header was read.
+func tokenConflict(name string, header []byte, t *nestedaes.Token, err error) error {
+	var te *nestedaes.TokenError
+	if !errors.As(err, &te) {
+		return err
+	}
+	switch te.Reason {
+	case nestedaes.ErrTokenApplied, nestedaes.ErrTokenOutOfOrder:
+	case nestedaes.ErrTokenWrongBlob:
+		// a token for another blob is not a conflict
+		old, err1 := nestedaes.UnmarshalPlainHeader(header)
+		h, err2 := nestedaes.UnmarshalPlainHeader(t.Header)
+		if err1 != nil || err2 != nil || !bytes.Equal(old.BaseIV, h.BaseIV) {
+			return err
+		}
+	default:
+		return err
+	}
+	return &conflictError{fmt.Errorf("blobstore: %s: %w", name, err)}
+}
+
+// BlobStore stores blobs under names.  A name is a slash-separated path, as
+// in "tenant42/photos/1.jpg", whose elements don't start with a dot.
+//
+// Implementations must be safe for concurrent use.
+type BlobStore interface {
+	// Get returns the blob stored under name, or an error that wraps
+	// [ErrNotFound].
+	Get(name string) ([]byte, error)
+	// Put stores a blob under name, replacing any blob it had.
+	Put(name string, blob []byte) error
+	// PutIf is like Put, but only stores the blob if the blob it replaces
+	// (if any) meets the expectation; otherwise, the error matches
+	// [ErrConflict].
+	PutIf(name string, blob []byte, expect Expect) error
+	// GetHeader returns the header of the blob stored under name.
+	GetHeader(name string) ([]byte, error)
+	// PutHeader replaces the header of the blob stored under name, keeping
+	// its payload, as after [nestedaes.RotateKEK].  The new header must have
+	// the blob's BaseIV and number of layers.
+	PutHeader(name string, header []byte) error
+	// PutHeaderIf is like PutHeader, but only replaces the header if the
+	// blob meets the expectation; otherwise, the error matches
+	// [ErrConflict].  A header from [nestedaes.RotateKEK] should be put with
+	// the expectation of the header it was derived from (see
+	// [ExpectHeader]), so that a concurrent update of the blob is not
+	// silently overwritten.
+	PutHeaderIf(name string, header []byte, expect Expect) error
+	// ApplyToken re-encrypts the blob stored under name with a token (see
+	// [nestedaes.ApplyToken]).  The token is not wiped.  A token derived
+	// from an earlier header of the blob (because the blob was updated
+	// concurrently) is rejected with an error that matches both
+	// [ErrConflict] and the [*nestedaes.TokenError].
+	ApplyToken(name string, t *nestedaes.Token) error
+	// List returns the names of the blobs whose names start with prefix, in
+	// lexical order.
+	List(prefix string) ([]string, error)
+}
+
+// Sizer is implemented by the blob stores that can report the size of a
+// blob without reading it, such as [Dir] and [Memory].  A [Scheduler] needs
+// it to bound its rate of re-encryption.
+type Sizer interface {
+	// Size returns the size in bytes of the blob stored under name, with
+	// its pending layers, if any, applied.
+	Size(name string) (int64, error)
+}
+
+// Streamer is implemented by the blob stores that can read and write a blob
+// as a stream, without holding it in memory, such as [Dir].
+type Streamer interface {
+	// Open returns a reader of the blob stored under name, at its latest
+	// header.  The caller must close it.
+	Open(name string) (io.ReadCloser, error)
+	// PutStreamIf is like [BlobStore.PutIf], but reads the blob from r.
+	// If reading r fails, the blob is not stored.
+	PutStreamIf(name string, r io.Reader, expect Expect) error
+}
+
+// KEKStore keeps the KEK of each blob of a store.  So that a crash in the
+// middle of a rotation never loses a KEK, a rotation first stages the new
+// KEK, then re-encrypts the blob, and finally commits the new KEK; until
+// then, the store holds both.  A blob may have several staged KEKs, from
+// concurrent rotations of which at most one updates the blob (see
+// [ErrConflict]), or from rotations that crashed.
+//
+// The KEKs returned are allocated with [nestedaes.AllocKey]; the caller
+// should release them with [nestedaes.FreeKey].  Implementations must be
+// safe for concurrent use.
+type KEKStore interface {
+	// GetKEK returns the KEK of the blob stored under name, and the KEKs
+	// staged for it.  If there is no KEK for the blob, the error wraps
+	// [ErrNotFound].
+	GetKEK(name string) (kek []byte, staged [][]byte, err error)
+	// PutKEK sets the KEK of the blob stored under name, discarding any
+	// staged KEKs.
+	PutKEK(name string, kek []byte) error
+	// StageKEK adds a KEK that may replace the KEK of the blob stored under
+	// name.
+	StageKEK(name string, kek []byte) error
+	// CommitKEK replaces the KEK of the blob stored under name with the
+	// staged KEK kek, and discards the other staged KEKs.  If kek is already
+	// the blob's KEK, CommitKEK does nothing.
+	CommitKEK(name string, kek []byte) error
+	// DeleteKEK destroys the KEK of the blob stored under name, and its
+	// staged KEKs, which makes the blob unreadable (crypto-shredding).  If
+	// there is no KEK for the blob, the error wraps [ErrNotFound].
+	DeleteKEK(name string) error
+}
+
+// record appends an event about the blob name, whose header after the event
+// is header, to log, if it is not nil.  The event's KEK IDs are left to the
+// caller.
+func record(log *audit.Log, kind, name string, header []byte, e audit.Event) error {
+	if log == nil {
+		return nil
+	}
+	e.Kind, e.Blob = kind, name
+	if header != nil {
+		if h, err := nestedaes.HeaderHash(header); err == nil {
+			e.HeaderHash = hex.EncodeToString(h)
+		}
+		if ph, err := nestedaes.UnmarshalPlainHeader(header); err == nil {
+			e.Layers = ph.Layers()
+		}
+	}
+	if err := log.Append(e); err != nil {
+		return fmt.Errorf("blobstore: %s was updated, but can't record it: %w", name, err)
+	}
+	return nil
+}
+
+// checkHeaderReplacement checks that newHeader can replace the header of
+// blob (which may be just the header) with PutHeader.
+func checkHeaderReplacement(blob, newHeader []byte) error {
+	old, err := nestedaes.UnmarshalPlainHeader(blob)
+	if err != nil {
+		return err
+	}
+	h, err := nestedaes.UnmarshalPlainHeader(newHeader)
+	if err != nil {
+		return invalidf("blobstore: invalid header: %w", err)
+	}
+	if int(h.Size) != len(newHeader) {
+		return invalidf("blobstore: header size field is %d but the header is %d bytes", h.Size, len(newHeader))
+	}
+	if !bytes.Equal(h.BaseIV, old.BaseIV) {
+		return invalidf("blobstore: header has a different BaseIV than the blob")
+	}
+	if h.Layers() != old.Layers() {
+		return invalidf("blobstore: header has %d layers, but the blob has %d", h.Layers(), old.Layers())
+	}
+	return nil
+}
+
+// checkName checks that name is a valid blob name: a slash-separated path
+// whose elements are not empty, ".", or "..", and don't start with a dot
+// (names that start with a dot are reserved for the store's own files).
+func checkName(name string) error {
+	if name == "" {
+		return invalidf("blobstore: empty blob name")
+	}
+	if !path.IsAbs("/"+name) || path.Clean("/"+name) != "/"+name {
+		return invalidf("blobstore: invalid blob name %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || strings.HasPrefix(elem, ".") || strings.ContainsRune(elem, '\\') {
+			return invalidf("blobstore: invalid blob name %q", name)
+		}
+	}
+	return nil
+}
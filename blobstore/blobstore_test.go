@@ -0,0 +1,535 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+// testBlobStore checks the behavior that all BlobStore implementations
+// share.
+func testBlobStore(t *testing.T, s BlobStore) {
+	blob, kek := newBlob(t)
+	for _, name := range []string{"b", "a/x", "a/y", "a.z"} {
+		if err := s.Put(name, blob); err != nil {
+			t.Fatalf("Put(%q) failed: %v", name, err)
+		}
+	}
+
+	names, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.z", "a/x", "a/y", "b"}; !slices.Equal(names, want) {
+		t.Fatalf("List returned %q, expected %q", names, want)
+	}
+	names, err = s.List("a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/x", "a/y"}; !slices.Equal(names, want) {
+		t.Fatalf("List(\"a/\") returned %q, expected %q", names, want)
+	}
+
+	// the store keeps its own copy
+	got, err := s.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[len(got)-1] ^= 1
+	checkBlob(t, s, "b", kek)
+
+	// ApplyToken
+	tok, newKEK := rekey(t, s, "b", kek)
+	if err := s.ApplyToken("b", tok); err != nil {
+		t.Fatalf("ApplyToken failed: %v", err)
+	}
+	checkBlob(t, s, "b", newKEK)
+	if err := s.ApplyToken("b", tok); !errors.Is(err, nestedaes.ErrTokenApplied) {
+		t.Fatalf("expected ErrTokenApplied for a replayed token, got %v", err)
+	}
+	checkBlob(t, s, "b", newKEK)
+	checkSize(t, s, "b")
+
+	// PutHeader
+	hdr, err := s.GetHeader("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotKEK := aes256.NewRandomKey()
+	rotated, err := nestedaes.RotateKEK(bytes.Clone(hdr), newKEK, rotKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutHeader("b", rotated); err != nil {
+		t.Fatalf("PutHeader failed: %v", err)
+	}
+	checkBlob(t, s, "b", rotKEK)
+	// a header of another blob, with a different BaseIV
+	other, _ := newBlob(t)
+	otherHdr, _, err := nestedaes.SplitHeaderPayload(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutHeader("b", otherHdr); err == nil {
+		t.Fatal("expected PutHeader to reject the header of another blob")
+	}
+	// a header with a different number of layers
+	if err := s.PutHeader("b", hdr[:len(hdr)-aes256.KeySize]); err == nil {
+		t.Fatal("expected PutHeader to reject a truncated header")
+	}
+	checkBlob(t, s, "b", rotKEK)
+
+	testConflicts(t, s)
+
+	for _, f := range []func() error{
+		func() error { _, err := s.Get("missing"); return err },
+		func() error { _, err := s.GetHeader("missing"); return err },
+		func() error { return s.PutHeader("missing", hdr) },
+		func() error { return s.ApplyToken("missing", tok) },
+	} {
+		if err := f(); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if sizer, ok := s.(Sizer); ok {
+		if _, err := sizer.Size("missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if err := s.Put("../escape", blob); err == nil {
+		t.Fatal("expected Put to reject an invalid name")
+	}
+	if err := s.Put("c", []byte("not a blob")); err == nil {
+		t.Fatal("expected Put to reject an invalid blob")
+	}
+}
+
+// testConflicts checks the compare-and-swap updates of a store.
+func testConflicts(t *testing.T, s BlobStore) {
+	blob, kek := newBlob(t)
+	if err := s.PutIf("cas", blob, Expect{Absent: true}); err != nil {
+		t.Fatalf("PutIf of a new blob failed: %v", err)
+	}
+	if err := s.PutIf("cas", blob, Expect{Absent: true}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for an existing blob, got %v", err)
+	}
+	if err := s.PutIf("cas", blob, Expect{Layers: 2}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for the wrong number of layers, got %v", err)
+	}
+	if err := s.PutIf("cas-missing", blob, Expect{Layers: 1}); !errors.Is(err, ErrConflict) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrConflict and ErrNotFound for a missing blob, got %v", err)
+	}
+
+	// two rotations race from the same header
+	hdr, err := s.GetHeader("cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok1, kek1, err := nestedaes.ReKeyGen(hdr, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok2, _, err := nestedaes.ReKeyGen(hdr, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyToken("cas", tok1); err != nil {
+		t.Fatal(err)
+	}
+	err = s.ApplyToken("cas", tok2)
+	var te *nestedaes.TokenError
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &te) {
+		t.Fatalf("expected ErrConflict and a TokenError for the losing token, got %v", err)
+	}
+	checkBlob(t, s, "cas", kek1)
+
+	// the same race with RotateKEK
+	expect, err := ExpectHeader(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := nestedaes.RotateKEK(bytes.Clone(hdr), kek, aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (the losing header has the blob's old number of layers)
+	if err := s.PutHeaderIf("cas", stale, Expect{HeaderHash: expect.HeaderHash}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a stale header, got %v", err)
+	}
+	checkBlob(t, s, "cas", kek1)
+	latest, err := s.GetHeader("cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err = ExpectHeader(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek2 := aes256.NewRandomKey()
+	rotated, err := nestedaes.RotateKEK(bytes.Clone(latest), kek1, kek2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutHeaderIf("cas", rotated, expect); err != nil {
+		t.Fatalf("PutHeaderIf failed: %v", err)
+	}
+	checkBlob(t, s, "cas", kek2)
+
+	// a token for another blob is not a conflict
+	other, otherKEK := newBlob(t)
+	tok3, _, err := nestedaes.ReKeyGen(other, otherKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ApplyToken("cas", tok3)
+	if !errors.Is(err, nestedaes.ErrTokenWrongBlob) || errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrTokenWrongBlob without ErrConflict, got %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBlobStore(t, NewMemory())
+}
+
+// checkSize checks the size that a store that is a [Sizer] reports for the
+// blob name.
+func checkSize(t *testing.T, s BlobStore, name string) {
+	t.Helper()
+	sizer, ok := s.(Sizer)
+	if !ok {
+		return
+	}
+	size, err := sizer.Size(name)
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	}
+	blob, err := s.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(blob)) {
+		t.Fatalf("Size returned %d, expected %d", size, len(blob))
+	}
+}
+
+func TestDirBlobStore(t *testing.T) {
+	d, err := OpenDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, d)
+}
+
+func TestDirPutHeaderPending(t *testing.T) {
+	d := newDir(t)
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, newKEK := rekey(t, d, "a", kek)
+	if err := d.QueueToken("a", tok); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := d.GetHeader("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotKEK := aes256.NewRandomKey()
+	if _, err := nestedaes.RotateKEK(hdr, newKEK, rotKEK); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutHeader("a", hdr); err != nil {
+		t.Fatalf("PutHeader failed: %v", err)
+	}
+	checkPending(t, d, "a", 0)
+	checkBlob(t, d, "a", rotKEK)
+}
+
+// testKEKStore checks the behavior that all KEKStore implementations share.
+func testKEKStore(t *testing.T, s KEKStore) {
+	k1, k2, k3, k4 := aes256.NewRandomKey(), aes256.NewRandomKey(), aes256.NewRandomKey(), aes256.NewRandomKey()
+	check := func(wantKEK []byte, wantStaged ...[]byte) {
+		t.Helper()
+		kek, staged, err := s.GetKEK("a/b")
+		if err != nil {
+			t.Fatalf("GetKEK failed: %v", err)
+		}
+		if !bytes.Equal(kek, wantKEK) {
+			t.Fatalf("GetKEK returned the wrong KEK")
+		}
+		if len(staged) != len(wantStaged) {
+			t.Fatalf("GetKEK returned %d staged KEKs, expected %d", len(staged), len(wantStaged))
+		}
+		for _, w := range wantStaged {
+			if !slices.ContainsFunc(staged, func(s []byte) bool { return bytes.Equal(s, w) }) {
+				t.Fatalf("GetKEK returned the wrong staged KEKs")
+			}
+		}
+	}
+
+	if _, _, err := s.GetKEK("a/b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.StageKEK("a/b", k2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected StageKEK without a KEK to fail with ErrNotFound, got %v", err)
+	}
+	if err := s.PutKEK("a/b", k1); err != nil {
+		t.Fatal(err)
+	}
+	check(k1)
+	if err := s.CommitKEK("a/b", k2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected CommitKEK of a KEK that isn't staged to fail with ErrNotFound, got %v", err)
+	}
+
+	// concurrent rotations stage a KEK each; one of them commits
+	if err := s.StageKEK("a/b", k2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StageKEK("a/b", k3); err != nil {
+		t.Fatal(err)
+	}
+	check(k1, k2, k3)
+	if err := s.CommitKEK("a/b", k3); err != nil {
+		t.Fatal(err)
+	}
+	check(k3)
+	// committing the current KEK again does nothing
+	if err := s.CommitKEK("a/b", k3); err != nil {
+		t.Fatalf("CommitKEK of the current KEK failed: %v", err)
+	}
+	if err := s.CommitKEK("a/b", k2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected CommitKEK of a discarded KEK to fail with ErrNotFound, got %v", err)
+	}
+
+	if err := s.StageKEK("a/b", k1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutKEK("a/b", k4); err != nil {
+		t.Fatal(err)
+	}
+	check(k4)
+
+	if err := s.StageKEK("a/b", k1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteKEK("a/b"); err != nil {
+		t.Fatalf("DeleteKEK failed: %v", err)
+	}
+	if _, _, err := s.GetKEK("a/b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a deleted KEK, got %v", err)
+	}
+	if err := s.DeleteKEK("a/b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	// a new KEK has no staged KEKs left over
+	if err := s.PutKEK("a/b", k2); err != nil {
+		t.Fatal(err)
+	}
+	check(k2)
+
+	if err := s.PutKEK("a/c", k1[:16]); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected PutKEK to reject a short key with ErrInvalid, got %v", err)
+	}
+
+	// every method rejects invalid names, as the blob stores do
+	for _, name := range []string{"", "/a", "a/", "../a", ".pending/a"} {
+		errs := map[string]error{
+			"PutKEK":    s.PutKEK(name, k1),
+			"StageKEK":  s.StageKEK(name, k1),
+			"CommitKEK": s.CommitKEK(name, k1),
+			"DeleteKEK": s.DeleteKEK(name),
+		}
+		_, _, errs["GetKEK"] = s.GetKEK(name)
+		for method, err := range errs {
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("expected %s to reject the invalid name %q with ErrInvalid, got %v", method, name, err)
+			}
+		}
+	}
+}
+
+func TestMemoryKEKs(t *testing.T) {
+	testKEKStore(t, NewMemoryKEKs())
+}
+
+func TestDirKEKs(t *testing.T) {
+	d, err := OpenDirKEKs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKEKStore(t, d)
+}
+
+// TestDirConcurrentTokens races tokens through two Dirs over the same
+// directory, as two processes would: every token is either applied or
+// rejected as a conflict, and the blob stays consistent.
+func TestDirConcurrentTokens(t *testing.T) {
+	root := t.TempDir()
+	var dirs [2]*Dir
+	for i := range dirs {
+		d, err := OpenDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs[i] = d
+	}
+	blob, kek := newBlob(t)
+	if err := dirs[0].Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+
+	// the KEKs of the headers, by header hash
+	var mu sync.Mutex
+	keks := map[string][]byte{headerKey(t, blob): kek}
+
+	const workers, rounds = 4, 5
+	var applied atomic.Int32
+	var wg sync.WaitGroup
+	for i := range workers {
+		d := dirs[i%len(dirs)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				hdr, err := d.GetHeader("a")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				kek := keks[headerKey(t, hdr)]
+				mu.Unlock()
+				if kek == nil {
+					// another worker applied the header's token, but
+					// hasn't recorded its KEK yet
+					continue
+				}
+				tok, newKEK, err := nestedaes.ReKeyGen(hdr, kek)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				keks[headerKey(t, tok.Header)] = newKEK
+				mu.Unlock()
+				err = d.ApplyToken("a", tok)
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("ApplyToken failed: %v", err)
+					return
+				}
+				applied.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	hdr, err := dirs[1].GetHeader("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ph, err := nestedaes.UnmarshalPlainHeader(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ph.Layers(), 1+int(applied.Load()); got != want {
+		t.Fatalf("the blob has %d layers, expected %d", got, want)
+	}
+	checkBlob(t, dirs[0], "a", keks[headerKey(t, hdr)])
+}
+
+// headerKey returns the hex HeaderHash of a blob or header.
+func headerKey(t *testing.T, blob []byte) string {
+	h, err := nestedaes.HeaderHash(blob)
+	if err != nil {
+		t.Error(err)
+	}
+	return hex.EncodeToString(h)
+}
+
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+	log, err := audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	log.Actor = "rotator"
+	d, err := OpenDir(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keks, err := OpenDirKEKs(filepath.Join(dir, "keks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Audit, keks.Audit = log, log
+
+	populate(t, d, keks, "a")
+	old := currentKEK(t, keks, "a")
+	r := &Rotator{Store: d, KEKs: keks}
+	if _, err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	kek := currentKEK(t, keks, "a")
+	if err := keks.DeleteKEK("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*audit.Event
+	_, err = audit.VerifyFile(filepath.Join(dir, "audit.log"), log.Head(), func(e *audit.Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VerifyFile failed: %v", err)
+	}
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+		if e.Blob != "a" || e.Actor != "rotator" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+	want := []string{audit.KindPut, audit.KindPutKEK, audit.KindApplyToken, audit.KindRotateKEK, audit.KindShred}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("recorded %q, expected %q", kinds, want)
+	}
+	if e := events[2]; e.Layers != 2 || e.HeaderHash == "" {
+		t.Fatalf("unexpected apply_token event %+v", e)
+	}
+	if e := events[3]; e.PrevKEKID != nestedaes.Fingerprint(old) || e.KEKID != nestedaes.Fingerprint(kek) {
+		t.Fatalf("unexpected rotate_kek event %+v", e)
+	}
+	if e := events[4]; e.PrevKEKID != nestedaes.Fingerprint(kek) {
+		t.Fatalf("unexpected shred event %+v", e)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range [][]byte{old, kek} {
+		if bytes.Contains(data, []byte(hex.EncodeToString(k))) || bytes.Contains(data, k) {
+			t.Fatal("the audit log contains a KEK")
+		}
+	}
+}
@@ -0,0 +1,650 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+var (
+	_ BlobStore = (*Dir)(nil)
+	_ Sizer     = (*Dir)(nil)
+	_ Streamer  = (*Dir)(nil)
+)
+
+// pendingDir is the subdirectory of a [Dir] that holds the pending files,
+// under the blobs' names.
+const pendingDir = ".pending"
+
+// Dir is a blob store in a directory: each blob is a file, under its name.
+// A blob's pending tokens (see [Dir.QueueToken]) are kept in a file of the
+// same name under the .pending subdirectory.  All writes are atomic and
+// durable, and ordered so that a crash never leaves a blob's header and
+// payload out of sync: a blob file is only ever replaced by a blob with more
+// of its pending layers applied, and pending tokens that a crash left behind
+// after they were applied are recognized as such.
+//
+// Each blob is locked while it is updated, so that updates of the same blob
+// are serialized, and updates of different blobs run concurrently.  The
+// methods of a Dir are safe for concurrent use.  On Unix, the locks are also
+// file locks (under the .locks subdirectory), so that several processes can
+// share a directory; elsewhere, a directory must not be used by more than
+// one Dir at a time.
+type Dir struct {
+	root  string
+	locks blobLocks
+
+	// Logger logs the failures of the background flusher.  If it is nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+	// Audit, if not nil, records the store's updates: the blobs it stores,
+	// the headers it replaces, and the tokens it applies or queues.  An
+	// update that can't be recorded is reported as failed, although it was
+	// made.
+	Audit *audit.Log
+	// TokenKey is the X25519 key for which queued tokens are sealed at rest
+	// (see [Dir.QueueToken]); it is typically the key of the server that
+	// received them.  It is needed to queue tokens, and to read or flush
+	// blobs that have pending layers.
+	TokenKey *ecdh.PrivateKey
+}
+
+// OpenDir returns the blob store in the directory root, which is created if
+// it doesn't exist.
+func OpenDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root}, nil
+}
+
+// Root returns the store's directory.
+func (d *Dir) Root() string {
+	return d.root
+}
+
+func (d *Dir) blobPath(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
+
+func (d *Dir) pendingPath(name string) string {
+	return filepath.Join(d.root, pendingDir, filepath.FromSlash(name))
+}
+
+// Put stores a blob under name, replacing any blob (and discarding any
+// pending tokens) it had.
+func (d *Dir) Put(name string, blob []byte) error {
+	return d.PutIf(name, blob, Expect{})
+}
+
+// PutIf is like Put, but only stores the blob if the blob it replaces meets
+// the expectation, which applies to the blob's latest header.
+func (d *Dir) PutIf(name string, blob []byte, expect Expect) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if _, err := nestedaes.HeaderHash(blob); err != nil {
+		return invalidf("blobstore: invalid blob: %w", err)
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !expect.none() {
+		latest, err := d.latestHeader(name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := expect.check(name, latest); err != nil {
+			return err
+		}
+	}
+	// a crash between the two leaves pending tokens that don't chain from
+	// the new blob, which load discards
+	if err := writeFileAtomic(d.blobPath(name), blob); err != nil {
+		return err
+	}
+	if err := removeFile(d.pendingPath(name)); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindPut, name, blob, audit.Event{})
+}
+
+// PutStreamIf is like PutIf, but reads the blob from r, into a temporary
+// file: the blob is never held in memory.  If reading r fails, the blob is
+// not stored.
+func (d *Dir) PutStreamIf(name string, r io.Reader, expect Expect) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	hdr, err := nestedaes.ReadHeader(r)
+	if err != nil {
+		return invalidf("blobstore: invalid blob: %w", err)
+	}
+	if _, err := nestedaes.HeaderHash(hdr); err != nil {
+		return invalidf("blobstore: invalid blob: %w", err)
+	}
+	path := d.blobPath(name)
+	tmp, err := writeTemp(path, io.MultiReader(bytes.NewReader(hdr), r))
+	if err != nil {
+		return err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	defer unlock()
+	if !expect.none() {
+		latest, err := d.latestHeader(name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			os.Remove(tmp)
+			return err
+		}
+		if err := expect.check(name, latest); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := renameTemp(tmp, path); err != nil {
+		return err
+	}
+	if err := removeFile(d.pendingPath(name)); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindPut, name, hdr, audit.Event{})
+}
+
+// Get returns the blob stored under name, with its pending layers applied:
+// the blob is always at its latest header.  If the blob had pending layers,
+// Get also writes the result back to the store.
+func (d *Dir) Get(name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return d.get(name)
+}
+
+// Open returns a reader of the blob file of name, once its pending layers
+// are applied (see [Dir.Get]).  Unless the blob has pending layers, Open
+// doesn't read the blob into memory.  The reader is an [*os.File], which
+// keeps reading the same blob if the blob is updated; the caller must close
+// it.
+func (d *Dir) Open(name string) (io.ReadCloser, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	_, pending, err := d.loadHeader(name)
+	if err != nil {
+		return nil, err
+	}
+	wipeTokens(pending)
+	if len(pending) > 0 {
+		if _, err := d.get(name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(d.blobPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// get is Get, with the blob locked.
+func (d *Dir) get(name string) ([]byte, error) {
+	blob, pending, err := d.load(name)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeTokens(pending)
+	if len(pending) == 0 {
+		return blob, nil
+	}
+	if blob, err = nestedaes.ApplyTokens(blob, pending...); err != nil {
+		return nil, err
+	}
+	if err := d.commit(name, blob); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// GetHeader returns the latest header of the blob stored under name, which
+// is the header of its last pending token, if it has any.  GetHeader only
+// reads the header from the blob file.
+func (d *Dir) GetHeader(name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return d.latestHeader(name)
+}
+
+// PutHeader replaces the header of the blob stored under name, keeping its
+// payload (see [BlobStore]).  The blob's pending layers, if any, are applied
+// first.
+func (d *Dir) PutHeader(name string, header []byte) error {
+	return d.PutHeaderIf(name, header, Expect{})
+}
+
+// PutHeaderIf is like PutHeader, but only replaces the header if the blob
+// meets the expectation, which applies to its latest header.
+func (d *Dir) PutHeaderIf(name string, header []byte, expect Expect) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	blob, pending, err := d.load(name)
+	if errors.Is(err, ErrNotFound) {
+		if err := expect.check(name, nil); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer wipeTokens(pending)
+	if err := expect.check(name, latest(blob, pending)); err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		if blob, err = nestedaes.ApplyTokens(blob, pending...); err != nil {
+			return err
+		}
+	}
+	if err := checkHeaderReplacement(blob, header); err != nil {
+		return err
+	}
+	_, payload, err := nestedaes.SplitHeaderPayload(blob)
+	if err != nil {
+		return err
+	}
+	if err := d.commit(name, append(bytes.Clone(header), payload...)); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindPutHeader, name, header, audit.Event{})
+}
+
+// List returns the names of the blobs whose names start with prefix, in
+// lexical order.
+func (d *Dir) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(d.root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == d.root {
+			return nil
+		}
+		if strings.HasPrefix(de.Name(), ".") {
+			// the pending files, and temporary files
+			if de.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if de.IsDir() || !de.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// WalkDir visits "a/b" before "a.b", which sorts first
+	slices.Sort(names)
+	return names, nil
+}
+
+// Size returns the size of the blob stored under name, once its pending
+// layers are applied.  Size only reads the header from the blob file.
+func (d *Dir) Size(name string) (int64, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	fi, err := os.Stat(d.blobPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	hdr, pending, err := d.loadHeader(name)
+	if err != nil {
+		return 0, err
+	}
+	defer wipeTokens(pending)
+	// the pending tokens only grow the header
+	return fi.Size() + int64(len(latest(hdr, pending))-len(hdr)), nil
+}
+
+// Pending returns the number of pending layers of the blob stored under
+// name.
+func (d *Dir) Pending(name string) (int, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	_, pending, err := d.loadHeader(name)
+	wipeTokens(pending)
+	return len(pending), err
+}
+
+// ApplyToken applies a token to the blob stored under name right away,
+// along with any pending tokens, in a single pass.  The token must follow
+// the blob's latest header (see [nestedaes.ApplyToken]); a rejected token is
+// reported as a [*nestedaes.TokenError] (which also matches [ErrConflict] if
+// the blob was updated since the token's header was read).  The token is
+// not wiped.
+func (d *Dir) ApplyToken(name string, t *nestedaes.Token) error {
+	return d.ApplyTokenAs(name, t, "")
+}
+
+// ApplyTokenAs is like [Dir.ApplyToken], but records actor as the Actor of
+// the audit event, such as the signer of the token; if actor is empty, the
+// log's Actor is recorded.
+func (d *Dir) ApplyTokenAs(name string, t *nestedaes.Token, actor string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	blob, pending, err := d.load(name)
+	if err != nil {
+		return err
+	}
+	defer wipeTokens(pending)
+	hdr := latest(blob, pending)
+	if blob, err = nestedaes.ApplyTokens(blob, append(pending, t)...); err != nil {
+		return tokenConflict(name, hdr, t, err)
+	}
+	if err := d.commit(name, blob); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindApplyToken, name, t.Header, audit.Event{Actor: actor})
+}
+
+// QueueToken applies a token to the blob stored under name lazily: the
+// token's header is committed as the blob's latest header (so that, for
+// instance, the blob's old KEK can be discarded as soon as QueueToken
+// returns), but its layer is only applied to the payload when the blob is
+// next read, or flushed (see [Dir.Flush]).  The token must follow the blob's
+// latest header; a rejected token is reported as for [Dir.ApplyToken].
+//
+// The store keeps a copy of the token, sealed for the Dir's TokenKey (see
+// [nestedaes.SealToken]), so that its DEK is not at rest in the clear; the
+// token is opened again when it is applied.  QueueToken fails if the Dir has
+// no TokenKey.  Anyone with the TokenKey can open the pending tokens, so it
+// should not be kept in the store's directory.
+func (d *Dir) QueueToken(name string, t *nestedaes.Token) error {
+	return d.QueueTokenAs(name, t, "")
+}
+
+// QueueTokenAs is like [Dir.QueueToken], but records actor as the Actor of
+// the audit event (see [Dir.ApplyTokenAs]).
+func (d *Dir) QueueTokenAs(name string, t *nestedaes.Token, actor string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if d.TokenKey == nil {
+		return errors.New("blobstore: QueueToken needs a Dir with a TokenKey")
+	}
+
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	hdr, pending, err := d.loadHeader(name)
+	if err != nil {
+		return err
+	}
+	defer wipeTokens(pending)
+
+	// applying the token to the latest header alone checks it
+	hdr = latest(hdr, pending)
+	if _, err := nestedaes.ApplyToken(bytes.Clone(hdr), t); err != nil {
+		return tokenConflict(name, hdr, t, err)
+	}
+	if t.PrevHeaderHash == nil {
+		// sealing needs it; the token was just checked to follow hdr
+		tc := *t
+		if tc.PrevHeaderHash, err = nestedaes.HeaderHash(hdr); err != nil {
+			return err
+		}
+		t = &tc
+	}
+	if err := writePending(d.pendingPath(name), append(pending, t), d.TokenKey); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindApplyToken, name, t.Header, audit.Event{Actor: actor, Detail: "queued"})
+}
+
+// Flush applies the pending layers of the blob stored under name, if it has
+// any, and writes the blob back.
+func (d *Dir) Flush(name string) error {
+	_, err := d.Get(name)
+	return err
+}
+
+// FlushAll flushes every blob that has pending layers (see [Dir.Flush]), and
+// returns the number of blobs it flushed.  It stops early if ctx is
+// canceled.  Failures to flush a blob don't stop it; they are joined in the
+// returned error.
+func (d *Dir) FlushAll(ctx context.Context) (int, error) {
+	var names []string
+	root := filepath.Join(d.root, pendingDir)
+	err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if de.IsDir() || strings.HasPrefix(de.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	n := 0
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := d.Flush(name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+// RunFlusher flushes the store's pending layers (see [Dir.FlushAll]) every
+// interval, until ctx is canceled.  Failures are logged to the Logger.
+func (d *Dir) RunFlusher(ctx context.Context, interval time.Duration) {
+	logger := d.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := d.FlushAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("blobstore: flush failed", "dir", d.root, "err", err)
+		}
+		if n > 0 {
+			logger.Debug("blobstore: flushed pending layers", "dir", d.root, "blobs", n)
+		}
+	}
+}
+
+// latestHeader returns the latest header of name.
+func (d *Dir) latestHeader(name string) ([]byte, error) {
+	hdr, pending, err := d.loadHeader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeTokens(pending)
+	return latest(hdr, pending), nil
+}
+
+// latest returns the latest header of a blob whose file is blob (or just its
+// header), with the given pending tokens: the header of the last token, if
+// any.
+func latest(blob []byte, pending []*nestedaes.Token) []byte {
+	if len(pending) > 0 {
+		return pending[len(pending)-1].Header
+	}
+	return blob
+}
+
+// load reads the blob file of name, and its pending tokens.  Pending tokens
+// that don't chain from the blob file are discarded.
+func (d *Dir) load(name string) ([]byte, []*nestedaes.Token, error) {
+	blob, err := os.ReadFile(d.blobPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr, _, err := nestedaes.SplitHeaderPayload(blob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("blobstore: %s: %w", name, err)
+	}
+	pending, err := d.loadPending(name, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blob, pending, nil
+}
+
+// loadHeader is like load, but only reads the blob file's header.
+func (d *Dir) loadHeader(name string) ([]byte, []*nestedaes.Token, error) {
+	f, err := os.Open(d.blobPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	hdr, err := nestedaes.ReadHeader(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("blobstore: %s: %w", name, err)
+	}
+	pending, err := d.loadPending(name, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, pending, nil
+}
+
+// loadPending returns the tokens pending for a blob whose file has the
+// header hdr.
+func (d *Dir) loadPending(name string, hdr []byte) ([]*nestedaes.Token, error) {
+	tokens, err := readPending(d.pendingPath(name), d.TokenKey)
+	if err != nil {
+		return nil, err
+	}
+	rest, ok := unapplied(hdr, tokens)
+	if !ok {
+		// the blob was replaced after the tokens were queued
+		wipeTokens(tokens)
+		return nil, removeFile(d.pendingPath(name))
+	}
+	// wipe the tokens that are already applied
+	wipeTokens(tokens[:len(tokens)-len(rest)])
+	return rest, nil
+}
+
+// commit writes a blob that has all its pending layers applied, and then
+// removes its pending file.
+func (d *Dir) commit(name string, blob []byte) error {
+	if err := writeFileAtomic(d.blobPath(name), blob); err != nil {
+		return err
+	}
+	return removeFile(d.pendingPath(name))
+}
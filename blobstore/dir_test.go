@@ -0,0 +1,384 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+)
+
+var testPlaintext = bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000)
+
+func newBlob(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	kek := aes256.NewRandomKey()
+	blob, err := nestedaes.Encrypt(testPlaintext, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob, kek
+}
+
+// rekey derives a token from the store's latest header of name.
+func rekey(t *testing.T, d BlobStore, name string, kek []byte) (*nestedaes.Token, []byte) {
+	t.Helper()
+	hdr, err := d.GetHeader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, newKEK, err := nestedaes.ReKeyGen(hdr, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok, newKEK
+}
+
+func checkBlob(t *testing.T, d BlobStore, name string, kek []byte) {
+	t.Helper()
+	blob, err := d.Get(name)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, err := nestedaes.Decrypt(blob, kek, nil)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if !bytes.Equal(got, testPlaintext) {
+		t.Fatalf("Decrypt produced the wrong plaintext")
+	}
+}
+
+// newDir returns a Dir in a temporary directory, with a TokenKey, so that it
+// can queue tokens.
+func newDir(t *testing.T) *Dir {
+	t.Helper()
+	d, err := OpenDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TokenKey, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func checkPending(t *testing.T, d *Dir, name string, want int) {
+	t.Helper()
+	n, err := d.Pending(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want {
+		t.Fatalf("expected %d pending layers, got %d", want, n)
+	}
+}
+
+func TestDirQueueToken(t *testing.T) {
+	d := newDir(t)
+	blob, kek := newBlob(t)
+	if err := d.Put("tenant/a", blob); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		tok, newKEK := rekey(t, d, "tenant/a", kek)
+		if err := d.QueueToken("tenant/a", tok); err != nil {
+			t.Fatalf("QueueToken failed: %v", err)
+		}
+		if err := d.QueueToken("tenant/a", tok); !errors.Is(err, nestedaes.ErrTokenApplied) {
+			t.Fatalf("expected %v for a token queued twice, got %v", nestedaes.ErrTokenApplied, err)
+		}
+		kek = newKEK
+		checkPending(t, d, "tenant/a", i+1)
+	}
+
+	// the latest header opens with the latest KEK
+	hdr, err := d.GetHeader("tenant/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nestedaes.UnmarshalHeader(kek, hdr); err != nil {
+		t.Fatalf("latest header doesn't open with the latest KEK: %v", err)
+	}
+
+	// an eager token applies the pending ones too
+	tok, newKEK := rekey(t, d, "tenant/a", kek)
+	if err := d.ApplyToken("tenant/a", tok); err != nil {
+		t.Fatalf("ApplyToken failed: %v", err)
+	}
+	kek = newKEK
+	checkPending(t, d, "tenant/a", 0)
+	checkBlob(t, d, "tenant/a", kek)
+
+	// a read applies pending layers, and writes the blob back
+	tok, kek = rekey(t, d, "tenant/a", kek)
+	if err := d.QueueToken("tenant/a", tok); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, d, "tenant/a", kek)
+	checkPending(t, d, "tenant/a", 0)
+}
+
+func TestDirFlushAll(t *testing.T) {
+	d := newDir(t)
+	keks := map[string][]byte{}
+	for _, name := range []string{"a", "b", "x/c"} {
+		blob, kek := newBlob(t)
+		if err := d.Put(name, blob); err != nil {
+			t.Fatal(err)
+		}
+		keks[name] = kek
+	}
+	for _, name := range []string{"a", "x/c"} {
+		tok, newKEK := rekey(t, d, name, keks[name])
+		if err := d.QueueToken(name, tok); err != nil {
+			t.Fatal(err)
+		}
+		keks[name] = newKEK
+	}
+
+	n, err := d.FlushAll(context.Background())
+	if err != nil {
+		t.Fatalf("FlushAll failed: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected FlushAll to flush 2 blobs, got %d", n)
+	}
+	for name, kek := range keks {
+		checkPending(t, d, name, 0)
+		checkBlob(t, d, name, kek)
+	}
+}
+
+func TestDirStreams(t *testing.T) {
+	d := newDir(t)
+	blob, kek := newBlob(t)
+	if err := d.PutStreamIf("a", bytes.NewReader(blob), Expect{Absent: true}); err != nil {
+		t.Fatalf("PutStreamIf failed: %v", err)
+	}
+	checkBlob(t, d, "a", kek)
+	if err := d.PutStreamIf("a", bytes.NewReader(blob), Expect{Absent: true}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if err := d.PutStreamIf("b", bytes.NewReader([]byte("not a blob")), Expect{}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+	// a failed read stores nothing
+	failing := io.MultiReader(bytes.NewReader(blob[:100]), iotest.ErrReader(errors.New("boom")))
+	if err := d.PutStreamIf("b", failing, Expect{}); err == nil {
+		t.Fatal("expected a failed read to fail PutStreamIf")
+	}
+	if _, err := d.GetHeader("b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after a failed PutStreamIf, got %v", err)
+	}
+
+	// Open applies the pending layers
+	tok, newKEK := rekey(t, d, "a", kek)
+	if err := d.QueueToken("a", tok); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := d.Open("a")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	streamed, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPending(t, d, "a", 0)
+	if got, err := nestedaes.Decrypt(streamed, newKEK, nil); err != nil || !bytes.Equal(got, testPlaintext) {
+		t.Fatalf("Decrypt of the opened blob failed: %v", err)
+	}
+	if _, err := d.Open("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDirPendingSealed(t *testing.T) {
+	d := newDir(t)
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, newKEK := rekey(t, d, "a", kek)
+	if err := d.QueueToken("a", tok); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(d.pendingPath("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, enc := range []string{base64.StdEncoding.EncodeToString(tok.DEK), string(tok.DEK)} {
+		if bytes.Contains(data, []byte(enc)) {
+			t.Fatalf("the pending file holds the token's DEK in the clear")
+		}
+	}
+
+	// without the TokenKey, the pending layers can't be applied
+	other, err := OpenDir(d.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get("a"); err == nil {
+		t.Fatalf("Get applied sealed pending tokens without the TokenKey")
+	}
+	tok2, _ := rekey(t, d, "a", newKEK)
+	if err := other.QueueToken("a", tok2); err == nil {
+		t.Fatalf("QueueToken succeeded without a TokenKey")
+	}
+	checkBlob(t, d, "a", newKEK)
+}
+
+func TestDirPendingV1(t *testing.T) {
+	d := newDir(t)
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, newKEK := rekey(t, d, "a", kek)
+
+	// a pending file from before the tokens were sealed
+	data, err := json.Marshal(pendingFileV1{Version: 1, Tokens: []pendingTokenV1{{
+		Layer:          tok.Layer,
+		PrevHeaderHash: tok.PrevHeaderHash,
+		Header:         tok.Header,
+		DEK:            tok.DEK,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(d.pendingPath("a")), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(d.pendingPath("a"), data); err != nil {
+		t.Fatal(err)
+	}
+	checkPending(t, d, "a", 1)
+	checkBlob(t, d, "a", newKEK)
+}
+
+// A crash after the blob file was written back, but before the pending file
+// was removed, leaves tokens that are already applied.
+func TestDirCrashAfterWriteBack(t *testing.T) {
+	d := newDir(t)
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	var tokens []*nestedaes.Token
+	for range 3 {
+		tok, newKEK := rekey(t, d, "a", kek)
+		if err := d.QueueToken("a", tok); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tok)
+		kek = newKEK
+	}
+
+	// write back the first two layers only, as an older flush would have
+	// had, and keep the pending file
+	partial, err := nestedaes.ApplyTokens(bytes.Clone(blob), tokens[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(d.blobPath("a"), partial); err != nil {
+		t.Fatal(err)
+	}
+	checkPending(t, d, "a", 1)
+	checkBlob(t, d, "a", kek)
+}
+
+// A crash after Put wrote the new blob, but before it removed the pending
+// file, leaves tokens for the old blob.
+func TestDirStalePending(t *testing.T) {
+	d := newDir(t)
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, _ := rekey(t, d, "a", kek)
+	if err := d.QueueToken("a", tok); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, kek = newBlob(t)
+	if err := writeFileAtomic(d.blobPath("a"), blob); err != nil {
+		t.Fatal(err)
+	}
+	checkPending(t, d, "a", 0)
+	checkBlob(t, d, "a", kek)
+	if _, err := os.Stat(d.pendingPath("a")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the stale pending file was not removed")
+	}
+}
+
+func TestDirErrors(t *testing.T) {
+	d := newDir(t)
+	if _, err := d.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	for _, name := range []string{"", "/a", "a/", "a//b", "../a", "a/../b", ".pending/a", "a/.b"} {
+		if err := d.Put(name, nil); err == nil {
+			t.Fatalf("Put accepted the invalid name %q", name)
+		}
+	}
+
+	blob, kek := newBlob(t)
+	other, _ := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("b", other); err != nil {
+		t.Fatal(err)
+	}
+	tok, _ := rekey(t, d, "a", kek)
+	if err := d.QueueToken("b", tok); !errors.Is(err, nestedaes.ErrTokenWrongBlob) {
+		t.Fatalf("expected %v, got %v", nestedaes.ErrTokenWrongBlob, err)
+	}
+}
+
+func TestDirLockFiles(t *testing.T) {
+	d, err := OpenDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := OpenDirKEKs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, kek := newBlob(t)
+	for i := range 2 * lockStripes {
+		name := fmt.Sprintf("blob%d", i)
+		if err := d.Put(name, blob); err != nil {
+			t.Fatal(err)
+		}
+		if err := k.PutKEK(name, kek); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the lock files are a fixed set, however many names were locked
+	for _, root := range []string{d.Root(), k.root} {
+		entries, err := os.ReadDir(filepath.Join(root, locksDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) > lockStripes {
+			t.Fatalf("expected at most %d lock files in %s, got %d", lockStripes, root, len(entries))
+		}
+	}
+}
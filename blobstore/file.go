@@ -0,0 +1,89 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// tempPattern names the temporary files that writeFileAtomic creates; the
+// leading dot keeps them out of the blob namespace.
+const tempPattern = ".tmp-*"
+
+// writeFileAtomic durably replaces the file at path with data: it writes
+// data to a temporary file in the same directory, syncs it, renames it into
+// place, and syncs the directory.  A crash leaves either the old or the new
+// file (and possibly a stray temporary file).
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := writeTemp(path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return renameTemp(tmp, path)
+}
+
+// writeTemp writes what it reads from r to a new temporary file in the
+// directory of path, which it creates if needed, and syncs the file.  The
+// caller moves the file into place with renameTemp, or removes it.
+func writeTemp(path string, r io.Reader) (string, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, tempPattern)
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// renameTemp durably moves a file written by writeTemp to path, or removes
+// it if it can't.
+func renameTemp(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// removeFile durably removes the file at path, if it exists.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory, which makes the renames and removals of its
+// entries durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
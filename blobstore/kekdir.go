@@ -0,0 +1,276 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+var _ KEKStore = (*DirKEKs)(nil)
+
+// stagedDir is the subdirectory of a [DirKEKs] that holds the staged KEKs,
+// in a directory per blob, under the blob's name.
+const stagedDir = ".staged"
+
+// DirKEKs is a [KEKStore] in a directory: the KEK of each blob is a raw
+// 32-byte key file (as written by "nestedaes keygen") under the blob's name,
+// and the staged KEKs of a blob are key files in the directory of the same
+// name under the .staged subdirectory.  All writes are atomic and durable;
+// committing a staged KEK renames it over the old one.
+//
+// Each blob's KEKs are locked while they are read or changed, as the blobs
+// of a [Dir] are, and the methods of a DirKEKs are safe for concurrent use.
+// On Unix, the locks are also file locks (under the .locks subdirectory), so
+// that several processes can share a directory; elsewhere, a directory must
+// not be used by more than one DirKEKs at a time.
+type DirKEKs struct {
+	root  string
+	locks blobLocks
+
+	// Audit, if not nil, records the changes of the blobs' KEKs, by KEK
+	// fingerprint: the KEKs set, committed, and deleted.  A change that
+	// can't be recorded is reported as failed, although it was made.
+	Audit *audit.Log
+}
+
+// OpenDirKEKs returns the KEK store in the directory root, which is created
+// if it doesn't exist.
+func OpenDirKEKs(root string) (*DirKEKs, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &DirKEKs{root: root}, nil
+}
+
+// lock locks the KEKs of name (see lockName), and returns the function that
+// unlocks them.
+func (d *DirKEKs) lock(name string) (func(), error) {
+	return lockName(d.root, &d.locks, name)
+}
+
+func (d *DirKEKs) kekPath(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
+
+// stagedPath returns the directory of the staged KEKs of name.
+func (d *DirKEKs) stagedPath(name string) string {
+	return filepath.Join(d.root, stagedDir, filepath.FromSlash(name))
+}
+
+// stagedFile returns the file of a staged KEK of name.  Its name starts with
+// a dot, so that it can't collide with the staged directory of a blob under
+// name.
+func (d *DirKEKs) stagedFile(name string, kek []byte) string {
+	h := sha256.Sum256(kek)
+	return filepath.Join(d.stagedPath(name), "."+hex.EncodeToString(h[:16]))
+}
+
+// GetKEK returns the KEK of the blob stored under name, and the KEKs staged
+// for it.
+func (d *DirKEKs) GetKEK(name string) (kek []byte, staged [][]byte, err error) {
+	if err := checkName(name); err != nil {
+		return nil, nil, err
+	}
+	unlock, err := d.lock(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+	kek, err = nestedaes.ReadKeyFile(d.kekPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := d.stagedFiles(name)
+	if err != nil {
+		nestedaes.FreeKey(kek)
+		return nil, nil, err
+	}
+	for _, f := range files {
+		s, err := nestedaes.ReadKeyFile(f)
+		if err != nil {
+			nestedaes.FreeKey(kek)
+			for _, s := range staged {
+				nestedaes.FreeKey(s)
+			}
+			return nil, nil, err
+		}
+		staged = append(staged, s)
+	}
+	return kek, staged, nil
+}
+
+// PutKEK sets the KEK of the blob stored under name, discarding any staged
+// KEKs.
+func (d *DirKEKs) PutKEK(name string, kek []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if len(kek) != aes256.KeySize {
+		return invalidf("blobstore: invalid KEK size %d", len(kek))
+	}
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	prev := d.fingerprint(name)
+	if err := writeFileAtomic(d.kekPath(name), kek); err != nil {
+		return err
+	}
+	if err := d.discardStaged(name); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindPutKEK, name, nil, audit.Event{KEKID: nestedaes.Fingerprint(kek), PrevKEKID: prev})
+}
+
+// StageKEK adds a KEK that may replace the KEK of the blob stored under
+// name.
+func (d *DirKEKs) StageKEK(name string, kek []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if len(kek) != aes256.KeySize {
+		return invalidf("blobstore: invalid KEK size %d", len(kek))
+	}
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(d.kekPath(name)); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	return writeFileAtomic(d.stagedFile(name, kek), kek)
+}
+
+// CommitKEK replaces the KEK of the blob stored under name with the staged
+// KEK kek, and discards the other staged KEKs.
+func (d *DirKEKs) CommitKEK(name string, kek []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	dst := d.kekPath(name)
+	old, err := nestedaes.ReadKeyFile(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return err
+	}
+	same, prev := bytes.Equal(old, kek), nestedaes.Fingerprint(old)
+	nestedaes.FreeKey(old)
+	if same {
+		return nil
+	}
+
+	err = os.Rename(d.stagedFile(name, kek), dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: KEK %s is not staged for %s", ErrNotFound, nestedaes.Fingerprint(kek), name)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := d.discardStaged(name); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindRotateKEK, name, nil, audit.Event{KEKID: nestedaes.Fingerprint(kek), PrevKEKID: prev})
+}
+
+// DeleteKEK removes the KEK of the blob stored under name, and its staged
+// KEKs.  The key files are removed, not overwritten, which doesn't erase
+// them from storage that keeps old data, such as SSDs and snapshots; keep
+// the directory on encrypted storage.
+func (d *DirKEKs) DeleteKEK(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	unlock, err := d.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path := d.kekPath(name)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	prev := d.fingerprint(name)
+	if err := d.discardStaged(name); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return record(d.Audit, audit.KindShred, name, nil, audit.Event{PrevKEKID: prev})
+}
+
+// fingerprint returns the fingerprint of the KEK of name, or "" if it can't
+// be read.
+func (d *DirKEKs) fingerprint(name string) string {
+	kek, err := nestedaes.ReadKeyFile(d.kekPath(name))
+	if err != nil {
+		return ""
+	}
+	defer nestedaes.FreeKey(kek)
+	return nestedaes.Fingerprint(kek)
+}
+
+// stagedFiles returns the files of the staged KEKs of name.
+func (d *DirKEKs) stagedFiles(name string) ([]string, error) {
+	dir := d.stagedPath(name)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		// skip the staged directories of other blobs, and temporary files
+		if e.Type().IsRegular() && strings.HasPrefix(e.Name(), ".") && !strings.HasPrefix(e.Name(), ".tmp-") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// discardStaged durably removes the staged KEKs of name.
+func (d *DirKEKs) discardStaged(name string) error {
+	files, err := d.stagedFiles(name)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	return syncDir(d.stagedPath(name))
+}
@@ -0,0 +1,86 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// locksDir is the subdirectory of a [Dir] or a [DirKEKs] that holds the
+// lock files.
+const locksDir = ".locks"
+
+// blobLocks are the in-process locks of the blobs of a store, one per blob
+// name, so that updates of different blobs don't wait for each other.
+type blobLocks struct {
+	mu    sync.Mutex
+	locks map[string]*blobLock
+}
+
+type blobLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks the blob name, and returns the function that unlocks it.
+func (l *blobLocks) lock(name string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*blobLock)
+	}
+	bl := l.locks[name]
+	if bl == nil {
+		bl = new(blobLock)
+		l.locks[name] = bl
+	}
+	bl.refs++
+	l.mu.Unlock()
+
+	bl.mu.Lock()
+	return func() {
+		bl.mu.Unlock()
+		l.mu.Lock()
+		if bl.refs--; bl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// lockStripes is the number of lock files of a store directory.  Names are
+// hashed onto this fixed set of lock files, which thus never need to be
+// removed (removing a lock file would race with another process opening
+// it), and don't accumulate as blobs come and go.  Two names that share a
+// lock file only wait for each other across processes.
+const lockStripes = 256
+
+// lockName locks name against the other goroutines (with locks) and, where
+// file locks are supported, the other processes that use the directory
+// root, and returns the function that unlocks it.  A goroutine must not
+// hold more than one name's lock at a time.
+func lockName(root string, locks *blobLocks, name string) (func(), error) {
+	unlock := locks.lock(name)
+	h := sha256.Sum256([]byte(name))
+	path := filepath.Join(root, locksDir, fmt.Sprintf("%02x", int(h[0])%lockStripes))
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		unlock()
+		return nil, err
+	}
+	f, err := lockFile(path)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		unlock()
+	}, nil
+}
+
+// lock locks the blob name (see lockName), and returns the function that
+// unlocks it.
+func (d *Dir) lock(name string) (func(), error) {
+	return lockName(d.root, &d.locks, name)
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package blobstore
+
+import "os"
+
+// lockFile does nothing where flock(2) is not available: a [Dir] then only
+// locks its blobs against the other goroutines of its process.
+func lockFile(path string) (*os.File, error) {
+	return nil, nil
+}
+
+func unlockFile(f *os.File) {}
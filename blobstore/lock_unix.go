@@ -0,0 +1,35 @@
+//go:build unix
+
+package blobstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens (creating it if needed) and exclusively locks the file at
+// path, with flock(2).  The lock is advisory: it only excludes the other
+// users of lockFile.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	return f, nil
+}
+
+// unlockFile unlocks and closes a file locked by lockFile.
+func unlockFile(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
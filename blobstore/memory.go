@@ -0,0 +1,302 @@
+package blobstore
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+)
+
+var (
+	_ BlobStore = (*Memory)(nil)
+	_ Sizer     = (*Memory)(nil)
+	_ KEKStore  = (*MemoryKEKs)(nil)
+)
+
+// Memory is a blob store in memory, for tests and for caches in front of
+// other stores.  It keeps copies of the blobs it is given, and returns
+// copies of the blobs it holds.
+type Memory struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewMemory returns an empty in-memory blob store.
+func NewMemory() *Memory {
+	return &Memory{blobs: make(map[string][]byte)}
+}
+
+// Get returns a copy of the blob stored under name.
+func (m *Memory) Get(name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blob, ok := m.blobs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return bytes.Clone(blob), nil
+}
+
+// Put stores a copy of blob under name.
+func (m *Memory) Put(name string, blob []byte) error {
+	return m.PutIf(name, blob, Expect{})
+}
+
+// PutIf stores a copy of blob under name, if the blob it replaces meets the
+// expectation.
+func (m *Memory) PutIf(name string, blob []byte, expect Expect) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if _, err := nestedaes.HeaderHash(blob); err != nil {
+		return invalidf("blobstore: invalid blob: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := expect.check(name, m.blobs[name]); err != nil {
+		return err
+	}
+	m.blobs[name] = bytes.Clone(blob)
+	return nil
+}
+
+// GetHeader returns a copy of the header of the blob stored under name.
+func (m *Memory) GetHeader(name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blob, ok := m.blobs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	hdr, _, err := nestedaes.SplitHeaderPayload(blob)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(hdr), nil
+}
+
+// PutHeader replaces the header of the blob stored under name, keeping its
+// payload (see [BlobStore]).
+func (m *Memory) PutHeader(name string, header []byte) error {
+	return m.PutHeaderIf(name, header, Expect{})
+}
+
+// PutHeaderIf replaces the header of the blob stored under name, if the
+// blob meets the expectation.
+func (m *Memory) PutHeaderIf(name string, header []byte, expect Expect) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blob, ok := m.blobs[name]
+	if !ok {
+		if err := expect.check(name, nil); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err := expect.check(name, blob); err != nil {
+		return err
+	}
+	if err := checkHeaderReplacement(blob, header); err != nil {
+		return err
+	}
+	_, payload, err := nestedaes.SplitHeaderPayload(blob)
+	if err != nil {
+		return err
+	}
+	m.blobs[name] = append(bytes.Clone(header), payload...)
+	return nil
+}
+
+// ApplyToken applies a token to the blob stored under name (see
+// [nestedaes.ApplyToken]).  A rejected token is reported as a
+// [*nestedaes.TokenError] (which also matches [ErrConflict] if the blob was
+// updated since the token's header was read), and leaves the blob
+// unchanged.
+func (m *Memory) ApplyToken(name string, t *nestedaes.Token) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blob, ok := m.blobs[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	// ApplyToken works in place, and may fail after changing the blob
+	newBlob, err := nestedaes.ApplyToken(bytes.Clone(blob), t)
+	if err != nil {
+		return tokenConflict(name, blob, t, err)
+	}
+	m.blobs[name] = newBlob
+	return nil
+}
+
+// Size returns the size of the blob stored under name.
+func (m *Memory) Size(name string) (int64, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blob, ok := m.blobs[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return int64(len(blob)), nil
+}
+
+// List returns the names of the blobs whose names start with prefix, in
+// lexical order.
+func (m *Memory) List(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var names []string
+	for name := range m.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// MemoryKEKs is a [KEKStore] in memory.  The keys it holds are allocated
+// with [nestedaes.AllocKey].
+type MemoryKEKs struct {
+	mu     sync.Mutex
+	keks   map[string][]byte
+	staged map[string][][]byte
+}
+
+// NewMemoryKEKs returns an empty in-memory KEK store.
+func NewMemoryKEKs() *MemoryKEKs {
+	return &MemoryKEKs{
+		keks:   make(map[string][]byte),
+		staged: make(map[string][][]byte),
+	}
+}
+
+// GetKEK returns copies of the KEK of the blob stored under name and of the
+// KEKs staged for it.
+func (m *MemoryKEKs) GetKEK(name string) (kek []byte, staged [][]byte, err error) {
+	if err := checkName(name); err != nil {
+		return nil, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keks[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	for _, s := range m.staged[name] {
+		staged = append(staged, cloneKey(s))
+	}
+	return cloneKey(k), staged, nil
+}
+
+// PutKEK sets the KEK of the blob stored under name, discarding any staged
+// KEKs.
+func (m *MemoryKEKs) PutKEK(name string, kek []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if len(kek) != aes256.KeySize {
+		return invalidf("blobstore: invalid KEK size %d", len(kek))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.keks[name]; ok {
+		nestedaes.FreeKey(old)
+	}
+	m.keks[name] = cloneKey(kek)
+	m.discardStaged(name)
+	return nil
+}
+
+// StageKEK adds a KEK that may replace the KEK of the blob stored under
+// name.
+func (m *MemoryKEKs) StageKEK(name string, kek []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if len(kek) != aes256.KeySize {
+		return invalidf("blobstore: invalid KEK size %d", len(kek))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keks[name]; !ok {
+		return fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	m.staged[name] = append(m.staged[name], cloneKey(kek))
+	return nil
+}
+
+// CommitKEK replaces the KEK of the blob stored under name with the staged
+// KEK kek, and discards the other staged KEKs.
+func (m *MemoryKEKs) CommitKEK(name string, kek []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.keks[name]
+	if !ok {
+		return fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	if bytes.Equal(old, kek) {
+		return nil
+	}
+	i := slices.IndexFunc(m.staged[name], func(s []byte) bool { return bytes.Equal(s, kek) })
+	if i < 0 {
+		return fmt.Errorf("%w: KEK %s is not staged for %s", ErrNotFound, nestedaes.Fingerprint(kek), name)
+	}
+	nestedaes.FreeKey(old)
+	m.keks[name] = m.staged[name][i]
+	m.staged[name] = slices.Delete(m.staged[name], i, i+1)
+	m.discardStaged(name)
+	return nil
+}
+
+// DeleteKEK wipes and removes the KEK of the blob stored under name, and
+// its staged KEKs.
+func (m *MemoryKEKs) DeleteKEK(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kek, ok := m.keks[name]
+	if !ok {
+		return fmt.Errorf("%w: no KEK for %s", ErrNotFound, name)
+	}
+	nestedaes.FreeKey(kek)
+	delete(m.keks, name)
+	m.discardStaged(name)
+	return nil
+}
+
+func (m *MemoryKEKs) discardStaged(name string) {
+	for _, s := range m.staged[name] {
+		nestedaes.FreeKey(s)
+	}
+	delete(m.staged, name)
+}
+
+func cloneKey(key []byte) []byte {
+	k := nestedaes.AllocKey(len(key))
+	copy(k, key)
+	return k
+}
@@ -0,0 +1,148 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/etclab/nestedaes"
+)
+
+// pendingVersion is the version of the pending file format.  Version 1
+// files held the tokens' DEKs in the clear; they are still read, and are
+// rewritten in the current format when a token is next queued.
+const pendingVersion = 2
+
+// pendingFile is the list of tokens that were queued for a blob but not yet
+// applied to its payload, oldest first.  The tokens are sealed (see
+// [nestedaes.SealToken]) for the Dir's TokenKey, so that the file doesn't
+// hold their DEKs in the clear.
+//
+// The pending file is written atomically, after the blob file (when both
+// change), and the blob file is never changed in a way that drops pending
+// layers: the blob file is always at one of the headers in the chain
+// (before the first token, or at one of the tokens' headers).  On load,
+// the tokens up to the blob file's header are thus known to be applied, and
+// only the rest are pending.
+type pendingFile struct {
+	Version int                      `json:"version"`
+	Tokens  []*nestedaes.SealedToken `json:"tokens"`
+}
+
+// pendingFileV1 is a version 1 pending file.
+type pendingFileV1 struct {
+	Version int              `json:"version"`
+	Tokens  []pendingTokenV1 `json:"tokens"`
+}
+
+type pendingTokenV1 struct {
+	Layer          int    `json:"layer"`
+	PrevHeaderHash []byte `json:"prev_header_hash"`
+	Header         []byte `json:"header"`
+	DEK            []byte `json:"dek"`
+}
+
+// readPending reads a pending file, and opens its tokens with key.
+func readPending(path string, key *ecdh.PrivateKey) ([]*nestedaes.Token, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer nestedaes.Wipe(data)
+
+	var pf pendingFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("can't parse pending file %s: %w", path, err)
+	}
+	switch pf.Version {
+	case pendingVersion:
+	case 1:
+		return readPendingV1(path, data)
+	default:
+		return nil, fmt.Errorf("pending file %s has unsupported version %d", path, pf.Version)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("pending file %s holds sealed tokens, but the store has no TokenKey", path)
+	}
+
+	tokens := make([]*nestedaes.Token, 0, len(pf.Tokens))
+	for _, st := range pf.Tokens {
+		t, err := nestedaes.OpenToken(st, key)
+		if err != nil {
+			wipeTokens(tokens)
+			return nil, fmt.Errorf("can't open token in pending file %s: %w", path, err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// readPendingV1 decodes the data of a version 1 pending file.
+func readPendingV1(path string, data []byte) ([]*nestedaes.Token, error) {
+	var pf pendingFileV1
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("can't parse pending file %s: %w", path, err)
+	}
+	tokens := make([]*nestedaes.Token, len(pf.Tokens))
+	for i, pt := range pf.Tokens {
+		dek := nestedaes.AllocKey(len(pt.DEK))
+		copy(dek, pt.DEK)
+		nestedaes.Wipe(pt.DEK)
+		tokens[i] = &nestedaes.Token{
+			Header:         pt.Header,
+			DEK:            dek,
+			Layer:          pt.Layer,
+			PrevHeaderHash: pt.PrevHeaderHash,
+		}
+	}
+	return tokens, nil
+}
+
+// writePending writes a pending file with the tokens sealed for key.
+func writePending(path string, tokens []*nestedaes.Token, key *ecdh.PrivateKey) error {
+	pf := pendingFile{Version: pendingVersion}
+	for _, t := range tokens {
+		st, err := nestedaes.SealToken(t, key.PublicKey())
+		if err != nil {
+			return err
+		}
+		pf.Tokens = append(pf.Tokens, st)
+	}
+	data, err := json.Marshal(&pf)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// unapplied returns the suffix of the tokens that are not yet applied to a
+// blob with the given header.  If the tokens don't chain from the header
+// (because the blob was replaced after they were queued), ok is false.
+func unapplied(header []byte, tokens []*nestedaes.Token) (rest []*nestedaes.Token, ok bool) {
+	if len(tokens) == 0 {
+		return nil, true
+	}
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if bytes.Equal(tokens[i].Header, header) {
+			return tokens[i+1:], true
+		}
+	}
+	h, err := nestedaes.HeaderHash(header)
+	if err != nil || !bytes.Equal(tokens[0].PrevHeaderHash, h) {
+		return nil, false
+	}
+	return tokens, true
+}
+
+func wipeTokens(tokens []*nestedaes.Token) {
+	for _, t := range tokens {
+		t.Wipe()
+	}
+}
@@ -0,0 +1,383 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/etclab/mu"
+	"github.com/etclab/nestedaes"
+)
+
+// The statuses of a blob in a rotation checkpoint.
+const (
+	rotateOK     = "ok"
+	rotateFailed = "failed"
+)
+
+// Rotator re-encrypts every blob of a store under a new KEK, with a pool of
+// workers.  Each blob is rotated as by [nestedaes.Reencrypt] (or, with
+// HeaderOnly, [nestedaes.RotateKEK]), but with the token split: the Rotator
+// reads only the blob's header, derives a token from it (see
+// [nestedaes.ReKeyGen]), and has the store apply the token (see
+// [BlobStore.ApplyToken]), so that the payload never leaves the store.  The
+// new KEK is staged in the KEKStore before the token is applied, and
+// committed after, so that a crash at any point leaves a KEK that opens the
+// blob; the next run finishes the blob's rotation.  Unless HeaderOnly is
+// set, the new header records the time of the rotation (see
+// [nestedaes.MetaRotatedAt]).  Updates are compare-and-swap (see
+// [ErrConflict]), so that Rotators can run concurrently on the same blobs: a
+// blob whose update loses a race is retried.
+//
+// The zero values of the optional fields give a rotation of every blob, with
+// one worker, and no checkpoint.
+type Rotator struct {
+	Store BlobStore
+	KEKs  KEKStore
+
+	// Prefix selects the blobs to rotate by name (see [BlobStore.List]).
+	Prefix string
+	// Workers is the number of blobs rotated concurrently; if it is less
+	// than 1, one is.
+	Workers int
+	// HeaderOnly rotates only the blobs' KEKs, with [nestedaes.RotateKEK],
+	// rather than adding a layer of encryption.  This is cheaper, but does
+	// not change the blobs' DEKs.
+	HeaderOnly bool
+
+	// Checkpoint is the path of a file that records the outcome of each
+	// blob, one JSON object per line, durably.  If it is "", no checkpoint
+	// is kept.  Unless Resume is true, the file must not already exist.
+	Checkpoint string
+	// Resume continues the rotation recorded in Checkpoint: the blobs that
+	// it records as rotated are skipped.
+	Resume bool
+
+	// OnResult, if not nil, is called with the outcome of each blob, from a
+	// single goroutine.
+	OnResult func(Result)
+
+	// now returns the time recorded in the rotated headers; if it is nil,
+	// time.Now is used.
+	now func() time.Time
+}
+
+// Result is the outcome of rotating a single blob.
+type Result struct {
+	Name string
+	// Err is nil if the blob was rotated.
+	Err error
+	// Resumed is true if the blob was rotated by an earlier, interrupted
+	// run, and only its new KEK had to be committed.
+	Resumed bool
+}
+
+// Report summarizes a rotation.
+type Report struct {
+	// Rotated is the number of blobs rotated.
+	Rotated int
+	// Skipped is the number of blobs that the checkpoint records as rotated
+	// by an earlier run.
+	Skipped int
+	// Failed lists the blobs that could not be rotated.
+	Failed []Result
+}
+
+// checkpointEntry is a line of a rotation checkpoint.  The KEK fingerprint
+// (see [nestedaes.Fingerprint]) identifies the new KEK without revealing it.
+type checkpointEntry struct {
+	Name           string    `json:"name"`
+	Status         string    `json:"status"`
+	KEKFingerprint string    `json:"kek_fingerprint,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// Run rotates the selected blobs, and reports the outcome.  The failure of a
+// blob doesn't stop the rotation; it is reported in the Report's Failed
+// list.  Run returns an error only if it can't list the blobs or use the
+// checkpoint, or if ctx is canceled, in which case the blobs not yet started
+// are left alone, and the Report covers the rest.
+func (r *Rotator) Run(ctx context.Context) (*Report, error) {
+	names, err := r.Store.List(r.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var done map[string]bool
+	if r.Resume && r.Checkpoint != "" {
+		if done, err = loadCheckpoint(r.Checkpoint); err != nil {
+			return nil, err
+		}
+	}
+	var cp *checkpointWriter
+	if r.Checkpoint != "" {
+		if cp, err = openCheckpoint(r.Checkpoint, r.Resume); err != nil {
+			return nil, err
+		}
+		defer cp.close()
+	}
+
+	report := &Report{}
+	var todo []string
+	for _, name := range names {
+		if done[name] {
+			report.Skipped++
+			continue
+		}
+		todo = append(todo, name)
+	}
+
+	workers := max(r.Workers, 1)
+	jobs := make(chan string)
+	type result struct {
+		Result
+		fingerprint string
+	}
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				fp, resumed, err := r.rotate(name)
+				results <- result{Result{Name: name, Err: err, Resumed: resumed}, fp}
+			}
+		}()
+	}
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(results)
+		}()
+		for _, name := range todo {
+			select {
+			case jobs <- name:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var cpErr error
+	for res := range results {
+		if cp != nil && cpErr == nil {
+			e := &checkpointEntry{Name: res.Name, Status: rotateOK, Time: time.Now().UTC()}
+			if res.Err != nil {
+				e.Status = rotateFailed
+				e.Error = res.Err.Error()
+			} else {
+				e.KEKFingerprint = res.fingerprint
+			}
+			// without the checkpoint, a resumed run can't tell what was
+			// done; the blobs already started still finish
+			cpErr = cp.write(e)
+		}
+		if res.Err != nil {
+			report.Failed = append(report.Failed, res.Result)
+		} else {
+			report.Rotated++
+		}
+		if r.OnResult != nil {
+			r.OnResult(res.Result)
+		}
+	}
+
+	if cpErr != nil {
+		return report, fmt.Errorf("blobstore: can't write checkpoint: %w", cpErr)
+	}
+	return report, ctx.Err()
+}
+
+// maxConflicts is the number of times a Rotator tries a blob whose update
+// conflicts with a concurrent update (see [ErrConflict]).
+const maxConflicts = 5
+
+// rotate rotates a single blob, and returns the fingerprint of its new KEK.
+// If an earlier run was interrupted after the blob was rotated, but before
+// its new KEK was committed, rotate only commits the KEK.  If the blob is
+// updated concurrently, rotate starts over.
+func (r *Rotator) rotate(name string) (fingerprint string, resumed bool, err error) {
+	for range maxConflicts {
+		fingerprint, resumed, err = r.rotateOnce(name)
+		if !errors.Is(err, ErrConflict) {
+			break
+		}
+	}
+	return fingerprint, resumed, err
+}
+
+func (r *Rotator) rotateOnce(name string) (fingerprint string, resumed bool, err error) {
+	kek, staged, err := r.KEKs.GetKEK(name)
+	if err != nil {
+		return "", false, err
+	}
+	defer nestedaes.FreeKey(kek)
+	for _, s := range staged {
+		defer nestedaes.FreeKey(s)
+	}
+
+	hdr, err := r.Store.GetHeader(name)
+	if err != nil {
+		return "", false, err
+	}
+	if !headerOpens(hdr, kek) {
+		for _, s := range staged {
+			if headerOpens(hdr, s) {
+				if err := r.KEKs.CommitKEK(name, s); err != nil {
+					return "", false, err
+				}
+				return nestedaes.Fingerprint(s), true, nil
+			}
+		}
+		// a concurrent rotation may have committed its KEK since GetKEK
+		return "", false, conflictf("blobstore: the header of %s doesn't authenticate under its KEK or a staged KEK", name)
+	}
+
+	var newKEK []byte
+	if r.HeaderOnly {
+		newKEK = nestedaes.AllocKey(len(kek))
+		if _, err := rand.Read(newKEK); err != nil {
+			mu.Panicf("blobstore: rand.Read failed: %v", err)
+		}
+		defer nestedaes.FreeKey(newKEK)
+		expect, err := ExpectHeader(hdr)
+		if err != nil {
+			return "", false, err
+		}
+		newHdr, err := nestedaes.RotateKEK(bytes.Clone(hdr), kek, newKEK)
+		if err != nil {
+			return "", false, err
+		}
+		if err := r.KEKs.StageKEK(name, newKEK); err != nil {
+			return "", false, err
+		}
+		if err := r.Store.PutHeaderIf(name, newHdr, expect); err != nil {
+			return "", false, err
+		}
+	} else {
+		md := nestedaes.Metadata{nestedaes.MetaRotatedAt: nestedaes.RotationTime(r.clock())}
+		t, k, err := nestedaes.ReKeyGenWithMetadata(hdr, kek, md)
+		if err != nil {
+			return "", false, err
+		}
+		defer t.Wipe()
+		newKEK = k
+		defer nestedaes.FreeKey(newKEK)
+		if err := r.KEKs.StageKEK(name, newKEK); err != nil {
+			return "", false, err
+		}
+		// the token is bound to hdr, so that it is rejected if the blob
+		// was updated since
+		if err := r.Store.ApplyToken(name, t); err != nil {
+			return "", false, err
+		}
+	}
+	if err := r.KEKs.CommitKEK(name, newKEK); err != nil {
+		return "", false, err
+	}
+	return nestedaes.Fingerprint(newKEK), false, nil
+}
+
+func (r *Rotator) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// headerOpens reports whether a blob's header authenticates under kek.
+func headerOpens(hdr, kek []byte) bool {
+	h, err := nestedaes.UnmarshalHeader(kek, hdr)
+	if err != nil {
+		return false
+	}
+	h.Wipe()
+	return true
+}
+
+// loadCheckpoint returns the blobs that a checkpoint records as rotated.  A
+// later entry for a blob supersedes an earlier one.  A final line without a
+// newline was torn by an interruption, and is ignored.
+func loadCheckpoint(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(data[:bytes.LastIndexByte(data, '\n')+1], []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var e checkpointEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		done[e.Name] = e.Status == rotateOK
+	}
+	return done, nil
+}
+
+// checkpointWriter appends entries to a checkpoint, making each durable
+// before the next.
+type checkpointWriter struct {
+	f *os.File
+}
+
+// openCheckpoint opens the checkpoint for appending.  Unless resume is true,
+// the checkpoint must not already exist.
+func openCheckpoint(path string, resume bool) (*checkpointWriter, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !resume {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("blobstore: checkpoint %s exists: resume the rotation, or remove it to start over", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// drop a line torn by an interruption, so that the next entry starts on
+	// a line of its own
+	data, err := os.ReadFile(path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &checkpointWriter{f: f}, nil
+}
+
+func (c *checkpointWriter) write(e *checkpointEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := c.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return c.f.Sync()
+}
+
+func (c *checkpointWriter) close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,289 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+)
+
+// populate stores a blob, and its KEK, under each name.
+func populate(t *testing.T, s BlobStore, keks KEKStore, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		blob, kek := newBlob(t)
+		if err := s.Put(name, blob); err != nil {
+			t.Fatal(err)
+		}
+		if err := keks.PutKEK(name, kek); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// currentKEK returns the committed KEK of name, and checks that there is no
+// staged one.
+func currentKEK(t *testing.T, keks KEKStore, name string) []byte {
+	t.Helper()
+	kek, staged, err := keks.GetKEK(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 0 {
+		t.Fatalf("%s has %d staged KEKs", name, len(staged))
+	}
+	return kek
+}
+
+func TestRotator(t *testing.T) {
+	for _, headerOnly := range []bool{false, true} {
+		s, keks := NewMemory(), NewMemoryKEKs()
+		names := []string{"t/1", "t/2", "t/3", "t/4", "t/5"}
+		populate(t, s, keks, append(names, "other")...)
+		otherKEK := currentKEK(t, keks, "other")
+		old := make(map[string][]byte)
+		for _, name := range names {
+			old[name] = currentKEK(t, keks, name)
+		}
+
+		var results []Result
+		r := &Rotator{
+			Store:      s,
+			KEKs:       keks,
+			Prefix:     "t/",
+			Workers:    3,
+			HeaderOnly: headerOnly,
+			OnResult:   func(res Result) { results = append(results, res) },
+		}
+		report, err := r.Run(context.Background())
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if report.Rotated != len(names) || report.Skipped != 0 || len(report.Failed) != 0 {
+			t.Fatalf("unexpected report %+v", report)
+		}
+		if len(results) != len(names) {
+			t.Fatalf("OnResult was called %d times, expected %d", len(results), len(names))
+		}
+
+		for _, name := range names {
+			kek := currentKEK(t, keks, name)
+			checkBlob(t, s, name, kek)
+			if _, err := nestedaes.Decrypt(mustGet(t, s, name), old[name], nil); err == nil {
+				t.Fatalf("%s still decrypts under its old KEK", name)
+			}
+			hdr, err := s.GetHeader(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ph, err := nestedaes.UnmarshalPlainHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 2
+			if headerOnly {
+				want = 1
+			}
+			if ph.Layers() != want {
+				t.Fatalf("HeaderOnly=%v: %s has %d layers, expected %d", headerOnly, name, ph.Layers(), want)
+			}
+		}
+		// blobs outside the prefix are left alone
+		checkBlob(t, s, "other", otherKEK)
+	}
+}
+
+func mustGet(t *testing.T, s BlobStore, name string) []byte {
+	t.Helper()
+	blob, err := s.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestRotatorCheckpoint(t *testing.T) {
+	d, err := OpenDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keks, err := OpenDirKEKs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	populate(t, d, keks, "a", "b", "c")
+	// a blob without a KEK fails, without stopping the others
+	blob, kek := newBlob(t)
+	if err := d.Put("d", blob); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := filepath.Join(t.TempDir(), "rotation.jsonl")
+	r := &Rotator{Store: d, KEKs: keks, Workers: 2, Checkpoint: checkpoint}
+	report, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Rotated != 3 || len(report.Failed) != 1 || report.Failed[0].Name != "d" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if !errors.Is(report.Failed[0].Err, ErrNotFound) {
+		t.Fatalf("expected the failure to wrap ErrNotFound, got %v", report.Failed[0].Err)
+	}
+
+	f, err := os.Open(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e checkpointEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		status[e.Name] = e.Status
+	}
+	f.Close()
+	if len(status) != 4 || status["a"] != rotateOK || status["d"] != rotateFailed {
+		t.Fatalf("unexpected checkpoint %v", status)
+	}
+
+	// the checkpoint must not be overwritten by accident
+	if _, err := r.Run(context.Background()); err == nil {
+		t.Fatal("expected Run to refuse an existing checkpoint")
+	}
+
+	// a resumed run only retries the failed blob
+	if err := keks.PutKEK("d", kek); err != nil {
+		t.Fatal(err)
+	}
+	// with a torn line from an interruption
+	cf, err := os.OpenFile(checkpoint, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.WriteString(`{"name":"a","sta`)
+	cf.Close()
+
+	r.Resume = true
+	report, err = r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("resumed Run failed: %v", err)
+	}
+	if report.Rotated != 1 || report.Skipped != 3 || len(report.Failed) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		checkBlob(t, d, name, currentKEK(t, keks, name))
+	}
+	if done, err := loadCheckpoint(checkpoint); err != nil || len(done) != 4 || !done["d"] {
+		t.Fatalf("unexpected checkpoint %v (err %v)", done, err)
+	}
+}
+
+func TestRotatorStagedKEK(t *testing.T) {
+	s, keks := NewMemory(), NewMemoryKEKs()
+	populate(t, s, keks, "applied", "stale")
+
+	// a crash after the token was applied, but before the KEK was committed
+	kek := currentKEK(t, keks, "applied")
+	tok, newKEK := rekey(t, s, "applied", kek)
+	if err := keks.StageKEK("applied", newKEK); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyToken("applied", tok); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash after the KEK was staged, but before the token was applied
+	if err := keks.StageKEK("stale", aes256.NewRandomKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := make(map[string]bool)
+	r := &Rotator{Store: s, KEKs: keks, OnResult: func(res Result) { resumed[res.Name] = res.Resumed }}
+	report, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Rotated != 2 || len(report.Failed) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if !resumed["applied"] || resumed["stale"] {
+		t.Fatalf("unexpected Resumed flags %v", resumed)
+	}
+
+	// the interrupted rotation was only completed, not repeated
+	got := currentKEK(t, keks, "applied")
+	if !bytes.Equal(got, newKEK) {
+		t.Fatal("the staged KEK was not committed")
+	}
+	checkBlob(t, s, "applied", got)
+	checkBlob(t, s, "stale", currentKEK(t, keks, "stale"))
+}
+
+func TestRotatorCanceled(t *testing.T) {
+	s, keks := NewMemory(), NewMemoryKEKs()
+	populate(t, s, keks, "a", "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &Rotator{Store: s, KEKs: keks}
+	report, err := r.Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if report.Rotated+len(report.Failed) > 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+// TestRotatorConcurrent runs two Rotators over the same blobs and KEKs at
+// once: whichever rotation of a blob loses the race retries, so that every
+// blob ends up under its committed KEK.
+func TestRotatorConcurrent(t *testing.T) {
+	for _, headerOnly := range []bool{false, true} {
+		d, err := OpenDir(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keks := NewMemoryKEKs()
+		names := []string{"1", "2", "3", "4", "5", "6"}
+		populate(t, d, keks, names...)
+
+		var wg sync.WaitGroup
+		reports := make([]*Report, 2)
+		for i := range reports {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := &Rotator{Store: d, KEKs: keks, Workers: 3, HeaderOnly: headerOnly}
+				report, err := r.Run(context.Background())
+				if err != nil {
+					t.Errorf("Run failed: %v", err)
+				}
+				reports[i] = report
+			}()
+		}
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
+		for _, report := range reports {
+			if report.Rotated != len(names) || len(report.Failed) != 0 {
+				t.Fatalf("unexpected report %+v", report)
+			}
+		}
+		for _, name := range names {
+			checkBlob(t, d, name, currentKEK(t, keks, name))
+		}
+	}
+}
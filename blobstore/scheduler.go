@@ -0,0 +1,652 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/mu"
+	"github.com/etclab/nestedaes"
+)
+
+// Policy is the rotation policy of the blobs whose names start with Prefix.
+type Policy struct {
+	// Prefix selects the blobs by name; "" selects every blob.  A blob
+	// follows the policy with the longest prefix that matches its name.
+	Prefix string
+	// MaxAge is the longest that a blob may go without a rotation, as
+	// recorded in its header (see [nestedaes.MetaRotatedAt]).  A blob whose
+	// header records no rotation, or a rotation in the future, is due at
+	// once.  If MaxAge is 0, the blobs are not rotated by age.
+	MaxAge time.Duration
+	// MaxLayers is the most layers that a blob may have; a blob with more
+	// is compacted (see [nestedaes.Compact]).  If MaxLayers is 0, the blobs
+	// are not compacted.
+	MaxLayers int
+}
+
+// policyJSON is the JSON form of a Policy.
+type policyJSON struct {
+	Prefix    string `json:"prefix"`
+	MaxAge    string `json:"max_age,omitempty"`
+	MaxLayers int    `json:"max_layers,omitempty"`
+}
+
+// UnmarshalJSON parses a policy of the form
+//
+//	{"prefix": "tenant/", "max_age": "90d", "max_layers": 32}
+//
+// where max_age is a Go duration, such as "36h", or a number of days, such
+// as "90d".
+func (p *Policy) UnmarshalJSON(data []byte) error {
+	var j policyJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	var maxAge time.Duration
+	if j.MaxAge != "" {
+		var err error
+		if maxAge, err = parseAge(j.MaxAge); err != nil {
+			return err
+		}
+	}
+	if j.MaxLayers < 0 {
+		return fmt.Errorf("blobstore: policy %q: max_layers is negative", j.Prefix)
+	}
+	*p = Policy{Prefix: j.Prefix, MaxAge: maxAge, MaxLayers: j.MaxLayers}
+	return nil
+}
+
+// parseAge parses a Go duration, or a number of days, such as "90d".
+func parseAge(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("blobstore: invalid max_age %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("blobstore: invalid max_age %q", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("blobstore: max_age %q is not positive", s)
+	}
+	return d, nil
+}
+
+// Schedule is a policy file: the policies of a [Scheduler], and its rate
+// limit.  In JSON, it has the form
+//
+//	{
+//	  "max_bytes_per_hour": 10737418240,
+//	  "policies": [
+//	    {"prefix": "", "max_age": "90d", "max_layers": 32},
+//	    {"prefix": "hot/", "max_age": "7d"}
+//	  ]
+//	}
+type Schedule struct {
+	Policies        []Policy `json:"policies"`
+	MaxBytesPerHour int64    `json:"max_bytes_per_hour,omitempty"`
+}
+
+// ReadSchedule reads a policy file (see [Schedule]).  Two policies may not
+// have the same prefix.
+func ReadSchedule(path string) (*Schedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sched Schedule
+	if err := json.Unmarshal(data, &sched); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if sched.MaxBytesPerHour < 0 {
+		return nil, fmt.Errorf("%s: max_bytes_per_hour is negative", path)
+	}
+	seen := make(map[string]bool)
+	for _, p := range sched.Policies {
+		if seen[p.Prefix] {
+			return nil, fmt.Errorf("%s: two policies have the prefix %q", path, p.Prefix)
+		}
+		seen[p.Prefix] = true
+	}
+	return &sched, nil
+}
+
+// Action is what a [Scheduler] does to a blob.
+type Action string
+
+const (
+	// ActionRotate adds a layer of encryption under a new KEK, as a
+	// [Rotator] does.
+	ActionRotate Action = "rotate"
+	// ActionCompact replaces the blob with a single-layer encryption under
+	// a new KEK (see [nestedaes.Compact]).  A compacted blob is also
+	// rotated.
+	ActionCompact Action = "compact"
+)
+
+// ScheduleResult is the outcome of a [Scheduler]'s action on a single blob.
+type ScheduleResult struct {
+	Result
+	Action Action
+	// Size is the size of the blob, as charged to the rate limit.
+	Size int64
+}
+
+// ScheduleReport summarizes a run of a [Scheduler].
+type ScheduleReport struct {
+	// Rotated is the number of blobs rotated.
+	Rotated int
+	// Compacted is the number of blobs compacted.
+	Compacted int
+	// UpToDate is the number of blobs that their policies don't require
+	// any action on yet.
+	UpToDate int
+	// Deferred is the number of blobs that were due, but were left to a
+	// later run by the rate limit.
+	Deferred int
+	// Unmanaged is the number of blobs that no policy selects.
+	Unmanaged int
+	// Bytes is the total size of the blobs rotated or compacted.
+	Bytes int64
+	// Failed lists the blobs whose action failed.
+	Failed []ScheduleResult
+}
+
+// Scheduler applies rotation policies to the blobs of a store: it rotates
+// the blobs that have gone longer than their policy's MaxAge without a
+// rotation, and compacts the blobs that have more than its MaxLayers layers,
+// within a limit on the bytes re-encrypted per hour.  The time of a blob's
+// last rotation is read from its header's authenticated metadata (see
+// [nestedaes.MetaRotatedAt]), which the Scheduler records with each rotation
+// and compaction, so the Scheduler keeps no state of its own besides the
+// KEKStore and its rate limit's StateFile: it can be run from cron (see
+// [Scheduler.RunOnce]) or as a daemon (see [Scheduler.Run]).
+//
+// Rotations are as by a [Rotator], and compactions follow the same protocol
+// (the new KEK is staged before the blob is replaced, and committed after,
+// and the replacement is compare-and-swap), so a Scheduler can run alongside
+// other Rotators and Schedulers.
+//
+// A Scheduler must not be copied after first use.
+type Scheduler struct {
+	Store BlobStore
+	KEKs  KEKStore
+
+	// Policies are the rotation policies; a blob that no policy selects is
+	// left alone.
+	Policies []Policy
+	// MaxBytesPerHour, if positive, bounds the rate of re-encryption: no
+	// hour sees more than MaxBytesPerHour bytes of blobs rotated or
+	// compacted, and the blobs that would exceed it are deferred to a
+	// later run.  The bytes are charged when an action starts, and
+	// refunded if it fails; a blob larger than the limit is re-encrypted
+	// once nothing was charged in the last hour.  The limit needs a Store
+	// that is a [Sizer].
+	MaxBytesPerHour int64
+	// StateFile, if not empty, is the file that keeps the rate limit's
+	// record of the bytes charged in the last hour, so that the limit holds
+	// across runs and restarts of the program (for instance, from cron).
+	// It is read at the start of each run, and written after each charge.
+	// Without it, the record is kept in memory, and a new Scheduler doesn't
+	// know what an earlier one charged.  Two Schedulers must not share a
+	// StateFile at the same time.
+	StateFile string
+	// Workers is the number of blobs rotated or compacted concurrently; if
+	// it is less than 1, one is.
+	Workers int
+	// AdditionalData, if not nil, returns the additional data of the blob
+	// name, which compaction needs (see [nestedaes.Compact]).  If it is
+	// nil, the blobs have none.
+	AdditionalData func(name string) []byte
+
+	// OnResult, if not nil, is called with the outcome of each action,
+	// from a single goroutine.
+	OnResult func(ScheduleResult)
+	// Logger logs the runs of [Scheduler.Run].  If it is nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+
+	// now returns the current time; if it is nil, time.Now is used.
+	now func() time.Time
+
+	mu sync.Mutex
+	// charges are the bytes charged to the rate limit, by Unix minute
+	charges map[int64]int64
+}
+
+// job is an action that the rate limit let through, with the minute it was
+// charged to.
+type job struct {
+	ScheduleResult
+	minute int64
+}
+
+// task is a blob that is due for an action.
+type task struct {
+	name      string
+	action    Action
+	rotatedAt time.Time
+}
+
+// RunOnce applies the policies once: it lists the blobs, works out which
+// are due, and rotates or compacts them, compactions first, and then the
+// rotations of the blobs that have gone longest without one.  The failure
+// of a blob doesn't stop the run; it is reported in the report's Failed
+// list.  RunOnce returns an error only if it can't list the blobs, or if
+// ctx is canceled, in which case the blobs not yet started are left alone,
+// and the report covers the rest.
+func (s *Scheduler) RunOnce(ctx context.Context) (*ScheduleReport, error) {
+	var sizer Sizer
+	if s.MaxBytesPerHour > 0 {
+		var ok bool
+		if sizer, ok = s.Store.(Sizer); !ok {
+			return nil, fmt.Errorf("blobstore: a rate limit needs a store that can report the sizes of blobs")
+		}
+	}
+
+	if sizer != nil {
+		if err := s.loadState(); err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := s.Store.List(s.listPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScheduleReport{}
+	var tasks []task
+	for _, name := range names {
+		p := s.policy(name)
+		if p == nil {
+			report.Unmanaged++
+			continue
+		}
+		t, err := s.plan(name, p)
+		if err != nil {
+			s.report(report, ScheduleResult{Result: Result{Name: name, Err: err}})
+			continue
+		}
+		if t == nil {
+			report.UpToDate++
+			continue
+		}
+		tasks = append(tasks, *t)
+	}
+	slices.SortStableFunc(tasks, func(a, b task) int {
+		if a.action != b.action {
+			if a.action == ActionCompact {
+				return -1
+			}
+			return 1
+		}
+		return a.rotatedAt.Compare(b.rotatedAt)
+	})
+
+	workers := max(s.Workers, 1)
+	jobs := make(chan job)
+	results := make(chan ScheduleResult)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.Err = s.do(j.Name, j.Action)
+				if j.Err != nil && sizer != nil {
+					s.refund(j.minute, j.Size)
+				}
+				results <- j.ScheduleResult
+			}
+		}()
+	}
+	var deferred int
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(results)
+		}()
+		for _, t := range tasks {
+			j := job{ScheduleResult: ScheduleResult{Result: Result{Name: t.name}, Action: t.action}}
+			if sizer != nil {
+				var ok bool
+				j.Size, j.Err = sizer.Size(t.name)
+				if j.Err == nil {
+					j.minute, ok, j.Err = s.take(j.Size)
+				}
+				if j.Err != nil {
+					select {
+					case results <- j.ScheduleResult:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				if !ok {
+					deferred++
+					continue
+				}
+			}
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				if sizer != nil {
+					s.refund(j.minute, j.Size)
+				}
+				return
+			}
+		}
+	}()
+
+	for res := range results {
+		s.report(report, res)
+	}
+	report.Deferred = deferred
+	return report, ctx.Err()
+}
+
+// report adds the outcome of an action to the report, and passes it to
+// OnResult.
+func (s *Scheduler) report(report *ScheduleReport, res ScheduleResult) {
+	switch {
+	case res.Err != nil:
+		report.Failed = append(report.Failed, res)
+	case res.Action == ActionCompact:
+		report.Compacted++
+		report.Bytes += res.Size
+	default:
+		report.Rotated++
+		report.Bytes += res.Size
+	}
+	if s.OnResult != nil {
+		s.OnResult(res)
+	}
+}
+
+// Run applies the policies (see [Scheduler.RunOnce]) right away, and then
+// every interval, until ctx is canceled.  The outcome of each run is logged
+// to the Logger.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := s.RunOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Error("blobstore: scheduled rotation failed", "err", err)
+		} else {
+			logger.Info("blobstore: scheduled rotation done",
+				"rotated", report.Rotated, "compacted", report.Compacted,
+				"up_to_date", report.UpToDate, "deferred", report.Deferred,
+				"failed", len(report.Failed), "bytes", report.Bytes)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// listPrefix returns the prefix of the names that the policies can select:
+// the longest common prefix of the policies' prefixes.
+func (s *Scheduler) listPrefix() string {
+	if len(s.Policies) == 0 {
+		return ""
+	}
+	prefix := s.Policies[0].Prefix
+	for _, p := range s.Policies[1:] {
+		n := 0
+		for n < len(prefix) && n < len(p.Prefix) && prefix[n] == p.Prefix[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+// policy returns the policy of the blob name, or nil if none selects it.
+func (s *Scheduler) policy(name string) *Policy {
+	var best *Policy
+	for i := range s.Policies {
+		p := &s.Policies[i]
+		if strings.HasPrefix(name, p.Prefix) && (best == nil || len(p.Prefix) > len(best.Prefix)) {
+			best = p
+		}
+	}
+	return best
+}
+
+// plan returns the action that the policy p requires on the blob name, or
+// nil if it requires none.  A blob whose header doesn't open under its KEK
+// is rotated, so that the rotation of an interrupted run is finished.
+func (s *Scheduler) plan(name string, p *Policy) (*task, error) {
+	kek, staged, err := s.KEKs.GetKEK(name)
+	if err != nil {
+		return nil, err
+	}
+	defer nestedaes.FreeKey(kek)
+	for _, k := range staged {
+		nestedaes.FreeKey(k)
+	}
+	hdr, err := s.Store.GetHeader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := nestedaes.UnmarshalHeader(kek, hdr)
+	if err != nil {
+		return &task{name: name, action: ActionRotate}, nil
+	}
+	defer h.Wipe()
+
+	now := s.clock()
+	var rotatedAt time.Time
+	if v, ok := h.Metadata[nestedaes.MetaRotatedAt]; ok {
+		if rotatedAt, err = nestedaes.ParseRotationTime(v); err != nil {
+			return nil, fmt.Errorf("blobstore: %s: %w", name, err)
+		}
+	}
+	// a rotation time in the future, from a clock that was ahead, is not
+	// trusted to put off the next rotation: the blob is due at once, and
+	// the rotation records the right time
+	if rotatedAt.After(now) {
+		rotatedAt = time.Time{}
+	}
+	switch {
+	case p.MaxLayers > 0 && len(h.DEKs) > p.MaxLayers:
+		return &task{name: name, action: ActionCompact, rotatedAt: rotatedAt}, nil
+	case p.MaxAge > 0 && !now.Before(rotatedAt.Add(p.MaxAge)):
+		return &task{name: name, action: ActionRotate, rotatedAt: rotatedAt}, nil
+	}
+	return nil, nil
+}
+
+// rateState is the JSON form of the rate limit's StateFile.
+type rateState struct {
+	// Charges are the bytes charged to the rate limit, by Unix minute.
+	Charges map[int64]int64 `json:"charges"`
+}
+
+// loadState reads the rate limit's record from the StateFile, if there is
+// one.  A missing file is an empty record.
+func (s *Scheduler) loadState() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.StateFile == "" {
+		if s.charges == nil {
+			s.charges = make(map[int64]int64)
+		}
+		return nil
+	}
+	data, err := os.ReadFile(s.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.charges = make(map[int64]int64)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st rateState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("blobstore: invalid rate limit state file %s: %w", s.StateFile, err)
+	}
+	if st.Charges == nil {
+		st.Charges = make(map[int64]int64)
+	}
+	s.charges = st.Charges
+	return nil
+}
+
+// saveState writes the rate limit's record to the StateFile, if there is
+// one.  The caller holds s.mu.
+func (s *Scheduler) saveState() error {
+	if s.StateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(rateState{Charges: s.charges})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.StateFile, data)
+}
+
+// take charges size bytes to the rate limit, if that keeps the last hour
+// within the limit, and returns the minute it charged them to.  The charges
+// are kept by minute, and a minute's charges count until the whole minute
+// is an hour old, so that the limit is never exceeded.
+func (s *Scheduler) take(size int64) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	minute := s.clock().Unix() / 60
+	var spent int64
+	for m, n := range s.charges {
+		if minute-m > 60 {
+			delete(s.charges, m)
+			continue
+		}
+		spent += n
+	}
+	if spent > 0 && spent+size > s.MaxBytesPerHour {
+		return 0, false, nil
+	}
+	s.charges[minute] += size
+	if err := s.saveState(); err != nil {
+		s.charges[minute] -= size
+		return 0, false, fmt.Errorf("blobstore: can't save the rate limit's state: %w", err)
+	}
+	return minute, true, nil
+}
+
+// refund returns the bytes of a failed action to the rate limit.  A refund
+// that can't be saved only makes the limit stricter, and is not reported.
+func (s *Scheduler) refund(minute, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.charges[minute] -= size; s.charges[minute] <= 0 {
+		delete(s.charges, minute)
+	}
+	s.saveState()
+}
+
+// do carries out an action on the blob name.
+func (s *Scheduler) do(name string, action Action) error {
+	if action == ActionRotate {
+		r := &Rotator{Store: s.Store, KEKs: s.KEKs, now: s.clock}
+		_, _, err := r.rotate(name)
+		return err
+	}
+	var err error
+	for range maxConflicts {
+		err = s.compact(name)
+		if !errors.Is(err, ErrConflict) {
+			break
+		}
+	}
+	return err
+}
+
+// compact compacts the blob name under a new KEK.  Like a rotation, the new
+// KEK is staged before the blob is replaced, and committed after.
+func (s *Scheduler) compact(name string) error {
+	kek, staged, err := s.KEKs.GetKEK(name)
+	if err != nil {
+		return err
+	}
+	defer nestedaes.FreeKey(kek)
+	for _, k := range staged {
+		nestedaes.FreeKey(k)
+	}
+
+	blob, err := s.Store.Get(name)
+	if err != nil {
+		return err
+	}
+	hdr, _, err := nestedaes.SplitHeaderPayload(blob)
+	if err != nil {
+		return err
+	}
+	if !headerOpens(hdr, kek) {
+		// a concurrent rotation may have committed its KEK since GetKEK
+		return conflictf("blobstore: the header of %s doesn't authenticate under its KEK", name)
+	}
+	expect, err := ExpectHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	newKEK := nestedaes.AllocKey(aes256.KeySize)
+	defer nestedaes.FreeKey(newKEK)
+	if _, err := rand.Read(newKEK); err != nil {
+		mu.Panicf("blobstore: rand.Read failed: %v", err)
+	}
+	var ad []byte
+	if s.AdditionalData != nil {
+		ad = s.AdditionalData(name)
+	}
+	md := nestedaes.Metadata{nestedaes.MetaRotatedAt: nestedaes.RotationTime(s.clock())}
+	blob, err = nestedaes.CompactWithMetadata(blob, kek, newKEK, aes256.NewRandomIV(), ad, md)
+	if err != nil {
+		return fmt.Errorf("blobstore: can't compact %s: %w", name, err)
+	}
+
+	if err := s.KEKs.StageKEK(name, newKEK); err != nil {
+		return err
+	}
+	if err := s.Store.PutIf(name, blob, expect); err != nil {
+		return err
+	}
+	return s.KEKs.CommitKEK(name, newKEK)
+}
+
+func (s *Scheduler) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,288 @@
+package blobstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+)
+
+// rotatedAt returns the number of layers of the blob name, and the rotation
+// time that its header records.
+func rotatedAt(t *testing.T, s BlobStore, keks KEKStore, name string) (int, time.Time) {
+	t.Helper()
+	hdr, err := s.GetHeader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := nestedaes.UnmarshalHeader(currentKEK(t, keks, name), hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Wipe()
+	when, err := nestedaes.ParseRotationTime(h.Metadata[nestedaes.MetaRotatedAt])
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return len(h.DEKs), when
+}
+
+func TestScheduler(t *testing.T) {
+	s, keks := NewMemory(), NewMemoryKEKs()
+	populate(t, s, keks, "a/1", "a/2", "b/1", "c/1")
+	now := time.Unix(1700000000, 0).UTC()
+	sched := &Scheduler{
+		Store: s,
+		KEKs:  keks,
+		Policies: []Policy{
+			{Prefix: "a/", MaxAge: 90 * 24 * time.Hour, MaxLayers: 3},
+			{Prefix: "b/", MaxAge: 7 * 24 * time.Hour},
+		},
+		Workers: 2,
+		now:     func() time.Time { return now },
+	}
+	run := func() *ScheduleReport {
+		t.Helper()
+		report, err := sched.RunOnce(context.Background())
+		if err != nil {
+			t.Fatalf("RunOnce failed: %v", err)
+		}
+		if len(report.Failed) != 0 {
+			t.Fatalf("RunOnce failed on %v", report.Failed)
+		}
+		return report
+	}
+
+	// the blobs record no rotation, and are due at once
+	if r := run(); r.Rotated != 3 || r.Unmanaged != 1 || r.UpToDate != 0 {
+		t.Fatalf("unexpected first report %+v", r)
+	}
+	for _, name := range []string{"a/1", "a/2", "b/1"} {
+		if layers, when := rotatedAt(t, s, keks, name); layers != 2 || !when.Equal(now) {
+			t.Fatalf("%s has %d layers, rotated at %v", name, layers, when)
+		}
+	}
+	checkBlob(t, s, "c/1", currentKEK(t, keks, "c/1"))
+
+	now = now.Add(24 * time.Hour)
+	if r := run(); r.Rotated != 0 || r.UpToDate != 3 {
+		t.Fatalf("expected no rotations a day later, got %+v", r)
+	}
+	now = now.Add(7 * 24 * time.Hour)
+	if r := run(); r.Rotated != 1 || r.UpToDate != 2 {
+		t.Fatalf("expected b/1 to be rotated, got %+v", r)
+	}
+	if _, when := rotatedAt(t, s, keks, "b/1"); !when.Equal(now) {
+		t.Fatalf("b/1 was rotated at %v", when)
+	}
+
+	// a/1 grows beyond 3 layers
+	r := &Rotator{Store: s, KEKs: keks, Prefix: "a/1"}
+	for range 2 {
+		if _, err := r.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(time.Hour)
+	if r := run(); r.Compacted != 1 || r.Rotated != 0 {
+		t.Fatalf("expected a/1 to be compacted, got %+v", r)
+	}
+	if layers, when := rotatedAt(t, s, keks, "a/1"); layers != 1 || !when.Equal(now) {
+		t.Fatalf("a/1 has %d layers, rotated at %v", layers, when)
+	}
+	checkBlob(t, s, "a/1", currentKEK(t, keks, "a/1"))
+}
+
+// A rotation time in the future doesn't put off the next rotation.
+func TestSchedulerFutureRotation(t *testing.T) {
+	s, keks := NewMemory(), NewMemoryKEKs()
+	populate(t, s, keks, "a")
+	now := time.Unix(1700000000, 0).UTC()
+	r := &Rotator{Store: s, KEKs: keks, now: func() time.Time { return now.Add(365 * 24 * time.Hour) }}
+	if _, err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sched := &Scheduler{
+		Store:    s,
+		KEKs:     keks,
+		Policies: []Policy{{MaxAge: 90 * 24 * time.Hour}},
+		now:      func() time.Time { return now },
+	}
+	report, err := sched.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rotated != 1 || len(report.Failed) != 0 {
+		t.Fatalf("expected the blob to be rotated, got %+v", report)
+	}
+	if _, when := rotatedAt(t, s, keks, "a"); !when.Equal(now) {
+		t.Fatalf("a was rotated at %v, expected %v", when, now)
+	}
+}
+
+func TestSchedulerRateLimit(t *testing.T) {
+	s, keks := NewMemory(), NewMemoryKEKs()
+	populate(t, s, keks, "a", "b", "c")
+	size, err := s.Size("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	sched := &Scheduler{
+		Store:           s,
+		KEKs:            keks,
+		Policies:        []Policy{{MaxAge: 2 * time.Hour}},
+		MaxBytesPerHour: size * 3 / 2,
+		StateFile:       filepath.Join(t.TempDir(), "rate-limit"),
+		now:             func() time.Time { return now },
+	}
+
+	// each hour has the budget for one blob; by the third run, "a" is due
+	// again, but "c" has waited longer
+	for i, deferred := range []int{2, 1, 1} {
+		report, err := sched.RunOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Rotated != 1 || report.Deferred != deferred || report.Bytes != size {
+			t.Fatalf("run %d: unexpected report %+v", i, report)
+		}
+
+		// a run within the hour, even by another Scheduler that shares the
+		// state file, has no budget left
+		now = now.Add(59 * time.Minute)
+		other := &Scheduler{
+			Store:           s,
+			KEKs:            keks,
+			Policies:        sched.Policies,
+			MaxBytesPerHour: sched.MaxBytesPerHour,
+			StateFile:       sched.StateFile,
+			now:             sched.now,
+		}
+		report, err = other.RunOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Rotated != 0 || report.Deferred == 0 {
+			t.Fatalf("run %d: expected the blobs to be deferred within the hour, got %+v", i, report)
+		}
+		now = now.Add(2 * time.Minute)
+	}
+
+	// without a Sizer, the limit can't be kept
+	sched.Store = struct{ BlobStore }{s}
+	if _, err := sched.RunOnce(context.Background()); err == nil {
+		t.Fatal("expected a rate limit to need a Sizer")
+	}
+}
+
+// A failed action is not charged to the rate limit.
+func TestSchedulerRateLimitRefund(t *testing.T) {
+	s, keks := NewMemory(), NewMemoryKEKs()
+	populate(t, s, keks, "b")
+	size, err := s.Size("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "b" can't be rotated without its KEK
+	if err := keks.PutKEK("b", aes256.NewRandomKey()); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	sched := &Scheduler{
+		Store:           s,
+		KEKs:            keks,
+		Policies:        []Policy{{MaxAge: time.Hour}},
+		MaxBytesPerHour: size * 3 / 2,
+		now:             func() time.Time { return now },
+	}
+	report, err := sched.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 1 || report.Bytes != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	populate(t, s, keks, "a")
+	report, err = sched.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rotated != 1 || report.Deferred != 1 || len(report.Failed) != 0 {
+		t.Fatalf("expected the failed rotation to be refunded, got %+v", report)
+	}
+}
+
+func TestSchedulerResume(t *testing.T) {
+	s, keks := NewMemory(), NewMemoryKEKs()
+	populate(t, s, keks, "a")
+	kek := currentKEK(t, keks, "a")
+
+	// a rotation that was interrupted before its KEK was committed
+	tok, newKEK := rekey(t, s, "a", kek)
+	if err := keks.StageKEK("a", newKEK); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyToken("a", tok); err != nil {
+		t.Fatal(err)
+	}
+
+	sched := &Scheduler{Store: s, KEKs: keks, Policies: []Policy{{MaxAge: time.Hour}}}
+	report, err := sched.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rotated != 1 || len(report.Failed) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	checkBlob(t, s, "a", currentKEK(t, keks, "a"))
+}
+
+func TestReadSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"max_bytes_per_hour": 1000, "policies": [
+		{"prefix": "", "max_age": "90d", "max_layers": 32},
+		{"prefix": "hot/", "max_age": "36h"}
+	]}`)
+	sched, err := ReadSchedule(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Policy{
+		{Prefix: "", MaxAge: 90 * 24 * time.Hour, MaxLayers: 32},
+		{Prefix: "hot/", MaxAge: 36 * time.Hour},
+	}
+	if sched.MaxBytesPerHour != 1000 || len(sched.Policies) != len(want) {
+		t.Fatalf("unexpected schedule %+v", sched)
+	}
+	for i := range want {
+		if sched.Policies[i] != want[i] {
+			t.Fatalf("policy %d is %+v, expected %+v", i, sched.Policies[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{
+		`{"policies": [{"prefix": "a", "max_age": "soon"}]}`,
+		`{"policies": [{"prefix": "a", "max_age": "-1d"}]}`,
+		`{"policies": [{"prefix": "a", "max_layers": -1}]}`,
+		`{"policies": [{"prefix": "a"}, {"prefix": "a"}]}`,
+		`{"max_bytes_per_hour": -1}`,
+	} {
+		write(bad)
+		if _, err := ReadSchedule(path); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package nestedaes
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+
+	"github.com/etclab/aes256"
+)
+
+// scratchSize is the initial capacity of a pooled scratch buffer; it is
+// enough to hold the decrypted header of a blob with over 100 layers.
+const scratchSize = 4096
+
+// scratchPool holds *[]byte buffers for decrypted header material, so that
+// parsing a header does not allocate on every operation.
+var scratchPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, scratchSize)
+		return &b
+	},
+}
+
+func getScratch() *[]byte {
+	return scratchPool.Get().(*[]byte)
+}
+
+// putScratch wipes the scratch buffer, which may hold decrypted header
+// material, and returns it to the pool.
+func putScratch(p *[]byte) {
+	Wipe((*p)[:cap(*p)])
+	*p = (*p)[:0]
+	scratchPool.Put(p)
+}
+
+// sliceForAppend takes a slice and a requested number of bytes.  It returns a
+// slice with the contents of the given slice followed by that many bytes and
+// a second slice that aliases into it and contains only the extra bytes.  The
+// returned slices have at least extra bytes of spare capacity beyond their
+// length.  If the original slice has sufficient capacity then no allocation
+// is performed.
+func sliceForAppend(in []byte, n, extra int) (head, tail []byte) {
+	total := len(in) + n
+	if cap(in) >= total+extra {
+		head = in[:total]
+	} else {
+		head = make([]byte, total, total+extra)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// layerIV sets iv to the IV for the given layer: the BaseIV plus the layer
+// number, modulo 2^128.  Unlike [aes256.AddIV], layerIV does not allocate.
+func layerIV(iv *[aes256.IVSize]byte, baseIV []byte, layer int) {
+	hi := binary.BigEndian.Uint64(baseIV[:8])
+	lo := binary.BigEndian.Uint64(baseIV[8:aes256.IVSize])
+	lo, carry := bits.Add64(lo, uint64(layer), 0)
+	hi += carry
+	binary.BigEndian.PutUint64(iv[:8], hi)
+	binary.BigEndian.PutUint64(iv[8:], lo)
+}
+
+// layerNonce sets nonce to the GCM nonce for the given layer's header
+// encryption: the layer's IV truncated to [aes256.NonceSize], as with
+// [aes256.IVToNonce].
+func layerNonce(nonce *[aes256.NonceSize]byte, baseIV []byte, layer int) {
+	var iv [aes256.IVSize]byte
+	layerIV(&iv, baseIV, layer)
+	copy(nonce[:], iv[aes256.IVSize-aes256.NonceSize:])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/etclab/nestedaes"
+)
+
+// aadUsage documents the options registered by [aadOptions.register].
+const aadUsage = `  -aad STRING
+    Use STRING as the additional authenticated data (AAD).  A blob encrypted
+    with AAD only decrypts and verifies with the same AAD.
+
+  -aad-file PATH
+    Use the contents of the file PATH as the AAD.
+
+  -aad-from-filename
+    Use the base name of the encrypted file (for instance, "foo.enc" for
+    dir/foo.enc) as the AAD, binding the blob to its name.  The encrypted file
+    can then not be renamed, so re-encrypt it in place.`
+
+// aadOptions are the options that select the additional authenticated data
+// of a blob.  At most one of them may be given.
+type aadOptions struct {
+	value        string
+	file         string
+	fromFilename bool
+}
+
+func (o *aadOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.value, "aad", "", "")
+	fs.StringVar(&o.file, "aad-file", "", "")
+	fs.BoolVar(&o.fromFilename, "aad-from-filename", false, "")
+}
+
+// check rejects conflicting options.
+func (o *aadOptions) check() {
+	n := 0
+	for _, set := range []bool{o.value != "", o.file != "", o.fromFilename} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		fatalf("only one of -aad, -aad-file, and -aad-from-filename may be given")
+	}
+}
+
+// given returns true if any of the options was given.
+func (o *aadOptions) given() bool {
+	return o.value != "" || o.file != "" || o.fromFilename
+}
+
+// resolve returns the AAD for the encrypted file blobFile, or nil if no
+// option was given.
+func (o *aadOptions) resolve(blobFile string) ([]byte, error) {
+	switch {
+	case o.value != "":
+		return []byte(o.value), nil
+	case o.file != "":
+		aad, err := os.ReadFile(o.file)
+		if err != nil {
+			return nil, fmt.Errorf("can't read AAD file: %w", err)
+		}
+		return aad, nil
+	case o.fromFilename:
+		if blobFile == "-" {
+			return nil, fmt.Errorf("-aad-from-filename needs a named encrypted file, not stdin or stdout")
+		}
+		return []byte(filepath.Base(blobFile)), nil
+	default:
+		return nil, nil
+	}
+}
+
+// mustResolve is like resolve, but exits on error.
+func (o *aadOptions) mustResolve(blobFile string) []byte {
+	aad, err := o.resolve(blobFile)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return aad
+}
+
+// aadMetadata returns the header metadata that records the hash of aad.
+func aadMetadata(aad []byte) nestedaes.Metadata {
+	return nestedaes.Metadata{nestedaes.MetaAADHash: nestedaes.AADHash(aad)}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAADResolve(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"aad.bin": "tenant42"})
+
+	for _, tc := range []struct {
+		name string
+		opts aadOptions
+		blob string
+		want string
+		err  bool
+	}{
+		{"none", aadOptions{}, "foo.enc", "", false},
+		{"value", aadOptions{value: "tenant42"}, "foo.enc", "tenant42", false},
+		{"file", aadOptions{file: filepath.Join(dir, "aad.bin")}, "foo.enc", "tenant42", false},
+		{"missing file", aadOptions{file: filepath.Join(dir, "none.bin")}, "foo.enc", "", true},
+		{"file name", aadOptions{fromFilename: true}, "dir/foo.enc", "foo.enc", false},
+		{"file name of stdin", aadOptions{fromFilename: true}, "-", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			aad, err := tc.opts.resolve(tc.blob)
+			if (err != nil) != tc.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if string(aad) != tc.want || (tc.want == "" && aad != nil) {
+				t.Fatalf("expected the AAD %q, got %q", tc.want, aad)
+			}
+		})
+	}
+}
+
+func TestAADOptions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"foo.txt": "hello"})
+	mustRun(t, dir, "encrypt", "-aad", "tenant42", "-record-aad-hash", "-outkek", "kek.key", "-out", "foo.enc", "foo.txt")
+	mustRun(t, dir, "encrypt", "-aad-from-filename", "-outkek", "bar.key", "-out", "bar.enc", "foo.txt")
+
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		status int
+		output string
+	}{
+		{"decrypt", []string{"decrypt", "-aad", "tenant42", "-out", "-", "foo.enc"}, 0, "hello"},
+		{"decrypt without AAD", []string{"decrypt", "-out", "-", "foo.enc"}, 1, "does not match the AAD hash"},
+		{"decrypt with the wrong AAD", []string{"decrypt", "-aad", "tenant7", "-out", "-", "foo.enc"}, 1, "does not match the AAD hash"},
+		{"verify", []string{"verify", "-aad", "tenant42", "foo.enc"}, 0, "1 OK"},
+		{"verify with the wrong AAD", []string{"verify", "-aad", "tenant7", "foo.enc"}, exitVerifyFailed, "foo.enc: FAIL"},
+		{"verify by file name", []string{"verify", "-inkek", "bar.key", "-aad-from-filename", "bar.enc"}, 0, "1 OK"},
+		{"conflicting options", []string{"decrypt", "-aad", "x", "-aad-from-filename", "-out", "-", "foo.enc"}, 1, "only one of"},
+		{"hash without AAD", []string{"encrypt", "-record-aad-hash", "-outkek", "baz.key", "-out", "baz.enc", "foo.txt"}, 1, "requires"},
+		{"compact renaming the file", []string{"compact", "-aad-from-filename", "-inkek", "bar.key", "-outkek", "bar2.key", "-out", "baz.enc", "bar.enc"}, 1, "another name"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, status := run(t, dir, tc.args...)
+			if status != tc.status {
+				t.Fatalf("expected exit status %d, got %d:\n%s", tc.status, status, out)
+			}
+			if !strings.Contains(out, tc.output) {
+				t.Fatalf("expected the output to contain %q:\n%s", tc.output, out)
+			}
+		})
+	}
+
+	// compact keeps the blob bound to its AAD
+	mustRun(t, dir, "compact", "-aad", "tenant42", "-inkek", "kek.key", "-outkek", "kek2.key", "foo.enc")
+	if out := mustRun(t, dir, "decrypt", "-aad", "tenant42", "-inkek", "kek2.key", "-out", "-", "foo.enc"); out != "hello" {
+		t.Fatalf("the compacted blob decrypted to %q", out)
+	}
+	if _, status := run(t, dir, "decrypt", "-inkek", "kek2.key", "-out", "-", "foo.enc"); status != 1 {
+		t.Fatalf("the compacted blob decrypted without its AAD")
+	}
+}
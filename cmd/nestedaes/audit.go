@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+const auditUsage = `Usage: nestedaes audit [options] LOG_FILE
+
+Verify the hash chain of an audit log (as written with the -audit option of
+encrypt, reencrypt, rotate-kek, compact, and shred, or by the blobstore
+package),
+and print its events.  The log's events are only printed if the whole chain
+verifies.  The log identifies keys by their fingerprints; it never holds key
+material.
+
+Verification detects events that were changed, removed, or reordered by
+someone who didn't recompute the chain.  The chain is not keyed, though:
+whoever can write the log can rewrite it with a valid chain, or extend or
+truncate it.  The log is only tamper-evident up to a head (printed last)
+that was recorded somewhere its writer can't change, and that is checked
+with -head.
+
+positional arguments:
+  LOG_FILE
+    The audit log
+
+options:
+  -blob NAME
+    Only print the events of the blob NAME.
+
+  -kind KIND
+    Only print the events of kind KIND, such as encrypt, reencrypt,
+    apply_token, rotate_kek, compact, or shred.
+
+  -head HASH
+    Check that the log contains the event whose line has the hash HASH, as
+    printed by an earlier run: the events up to it are then unchanged, and
+    those appended since are shown too.  The log's current head is printed
+    last, to be recorded for the next check.
+
+  -json
+    Print the events as JSON, one per line, without the summary.
+
+  -h|-help
+    Display this usage statement and exit.
+
+examples:
+  $ nestedaes audit audit.log
+  $ nestedaes audit -blob foo.enc -kind reencrypt audit.log
+`
+
+// auditOptionsUsage documents the options registered by
+// [auditOptions.register].
+const auditOptionsUsage = `  -audit LOG_FILE
+    Record the operation in the audit log LOG_FILE, which is created if it
+    doesn't exist (see 'nestedaes audit -h').
+
+  -actor NAME
+    The actor that the audit log records.
+
+    Default: the current user's name`
+
+// auditOptions are the options that record an operation in an audit log.
+type auditOptions struct {
+	file  string
+	actor string
+}
+
+func (o *auditOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.file, "audit", "", "")
+	fs.StringVar(&o.actor, "actor", "", "")
+}
+
+// open opens the audit log, or returns nil if -audit wasn't given.  The log
+// is opened before the operation, so that a log that can't be written stops
+// the operation.
+func (o *auditOptions) open() *audit.Log {
+	if o.file == "" {
+		return nil
+	}
+	log, err := audit.Open(o.file)
+	if err != nil {
+		fatalf("can't open audit log: %v", err)
+	}
+	log.Actor = o.actor
+	if log.Actor == "" {
+		if u, err := user.Current(); err == nil {
+			log.Actor = u.Username
+		}
+	}
+	return log
+}
+
+// recordFile records an event about the blob file path in log, if it is not
+// nil.  The KEK IDs are fingerprints (see [nestedaes.Fingerprint]).
+func recordFile(log *audit.Log, kind, path, prevKEKID, kekID string) {
+	if log == nil {
+		return
+	}
+	e := audit.Event{Kind: kind, Blob: path, KEKID: kekID, PrevKEKID: prevKEKID}
+	if path != "-" {
+		if hdr, err := readFileHeader(path); err == nil {
+			if h, err := nestedaes.HeaderHash(hdr); err == nil {
+				e.HeaderHash = hex.EncodeToString(h)
+			}
+			if ph, err := nestedaes.UnmarshalPlainHeader(hdr); err == nil {
+				e.Layers = ph.Layers()
+			}
+		}
+	}
+	if err := log.Append(e); err != nil {
+		fatalf("%s succeeded, but can't record it in the audit log: %v", kind, err)
+	}
+}
+
+// readFileHeader reads the header of the blob in the file path.
+func readFileHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return nestedaes.ReadHeader(f)
+}
+
+func auditMain(args []string) {
+	var blob, kind, head string
+	var asJSON bool
+
+	fs := newFlagSet("audit", auditUsage)
+	fs.StringVar(&blob, "blob", "", "")
+	fs.StringVar(&kind, "kind", "", "")
+	fs.StringVar(&head, "head", "", "")
+	fs.BoolVar(&asJSON, "json", false, "")
+	logFile := parseOneFile(fs, args)
+
+	var events []*audit.Event
+	total := 0
+	head, err := audit.VerifyFile(logFile, head, func(e *audit.Event) error {
+		total++
+		if (blob == "" || e.Blob == blob) && (kind == "" || e.Kind == kind) {
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		fatalf("audit log verification failed: %v", err)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range events {
+			enc.Encode(e)
+		}
+		return
+	}
+	for _, e := range events {
+		printEvent(e)
+	}
+	fmt.Printf("%d event(s) verified, %d shown; head %s\n", total, len(events), head)
+}
+
+func printEvent(e *audit.Event) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s %s %s", e.Seq, e.Time.Format(time.RFC3339), e.Kind, e.Blob)
+	for _, f := range []struct{ name, value string }{
+		{"actor", e.Actor},
+		{"kek", e.KEKID},
+		{"prev_kek", e.PrevKEKID},
+		{"detail", e.Detail},
+	} {
+		if f.value != "" {
+			fmt.Fprintf(&b, " %s=%q", f.name, f.value)
+		}
+	}
+	if e.Layers != 0 {
+		fmt.Fprintf(&b, " layers=%d", e.Layers)
+	}
+	fmt.Println(b.String())
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+// exitBatchFailed is the exit status when a batch re-encryption fails for
+// some of its files.  As with [exitVerifyFailed], it is distinct from the
+// status of [mu.Fatalf] and of flag parsing errors.
+const exitBatchFailed = 3
+
+// The statuses of a file in a batch manifest.
+const (
+	batchOK     = "ok"
+	batchFailed = "failed"
+)
+
+// batchOptions are the options of 'nestedaes reencrypt -r'.
+type batchOptions struct {
+	dir       string
+	workers   int
+	include   string
+	exclude   string
+	kekSuffix string
+	// sharedKEK is the path of the KEK of every file, or "" if each file's
+	// KEK is in its own KEK file
+	sharedKEK string
+	manifest  string
+	resume    bool
+	dryRun    bool
+	quiet     bool
+	// audit, if not nil, records each file that is re-encrypted
+	audit *audit.Log
+}
+
+// manifestEntry is a line of a batch manifest, which records the outcome of
+// re-encrypting a file.  The KEK fingerprint (see [nestedaes.Fingerprint])
+// identifies the new KEK without revealing it.
+type manifestEntry struct {
+	File           string    `json:"file"`
+	Status         string    `json:"status"`
+	KEKFile        string    `json:"kek_file,omitempty"`
+	KEKFingerprint string    `json:"kek_fingerprint,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// batchResult is the outcome of a single file of a batch.
+type batchResult struct {
+	file    string
+	kekFile string
+	// fingerprint is the fingerprint of the new KEK
+	fingerprint string
+	// prevFingerprint is the fingerprint of the old KEK
+	prevFingerprint string
+	// resumed is true if the file had already been re-encrypted by an
+	// interrupted run
+	resumed bool
+	err     error
+}
+
+// matchGlob reports whether the slash-separated path rel matches pattern.  A
+// pattern without a "/" is matched against the base name, so that "*.enc"
+// matches in every directory.
+func matchGlob(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := path.Match(pattern, rel)
+	return ok
+}
+
+// checkGlob rejects a malformed glob pattern.
+func checkGlob(option, pattern string) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		fatalf("%s: invalid pattern %q: %v", option, pattern, err)
+	}
+}
+
+// batchFiles returns the files under opts.dir to re-encrypt, as
+// slash-separated paths relative to opts.dir.  KEK files, the manifest, and
+// the temporary files and journals of in-progress operations are never
+// included.
+func batchFiles(opts *batchOptions) ([]string, error) {
+	manifest, err := filepath.Abs(opts.manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err = filepath.WalkDir(opts.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		name := d.Name()
+		if strings.HasSuffix(name, opts.kekSuffix) || strings.Contains(name, tempSuffix) || strings.HasSuffix(name, journalSuffix) {
+			return nil
+		}
+		if abs, err := filepath.Abs(p); err == nil && abs == manifest {
+			return nil
+		}
+
+		rel, err := filepath.Rel(opts.dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !matchGlob(opts.include, rel) {
+			return nil
+		}
+		if opts.exclude != "" && matchGlob(opts.exclude, rel) {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	return files, err
+}
+
+// loadManifest returns the files that a manifest records as successfully
+// re-encrypted.  A later entry for a file supersedes an earlier one.  A final
+// line without a newline was torn by an interruption, and is ignored.
+func loadManifest(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(data[:bytes.LastIndexByte(data, '\n')+1], []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var e manifestEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		done[e.File] = e.Status == batchOK
+	}
+	return done, nil
+}
+
+// manifestWriter appends entries to a manifest, making each durable before
+// the next.
+type manifestWriter struct {
+	f *os.File
+}
+
+// openManifest opens the manifest for appending.  Unless resume is true, the
+// manifest must not already exist.
+func openManifest(path string, resume bool) (*manifestWriter, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !resume {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0660)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("manifest %s exists: use -resume to continue the batch, or remove it to start over", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// drop a line torn by an interruption, so that the next entry starts on
+	// a line of its own
+	data, err := os.ReadFile(path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &manifestWriter{f: f}, nil
+}
+
+func (m *manifestWriter) write(e *manifestEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := m.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return m.f.Sync()
+}
+
+func (m *manifestWriter) close() error {
+	return m.f.Close()
+}
+
+// batchReencrypt re-encrypts every selected file under opts.dir with a pool
+// of workers.  Each file gets its own new KEK, which is written to the file's
+// KEK file.
+func batchReencrypt(opts *batchOptions) {
+	checkGlob("-include", opts.include)
+	if opts.exclude != "" {
+		checkGlob("-exclude", opts.exclude)
+	}
+	if opts.workers < 1 {
+		fatalf("-j must be at least 1")
+	}
+
+	files, err := batchFiles(opts)
+	if err != nil {
+		fatalf("can't list %s: %v", opts.dir, err)
+	}
+
+	var done map[string]bool
+	if opts.resume {
+		done, err = loadManifest(opts.manifest)
+		if err != nil {
+			fatalf("can't read manifest: %v", err)
+		}
+	}
+
+	var sharedKEK []byte
+	if opts.sharedKEK != "" {
+		sharedKEK = readKEK(opts.sharedKEK)
+		defer freeKey(sharedKEK)
+	}
+
+	var manifest *manifestWriter
+	if !opts.dryRun {
+		manifest, err = openManifest(opts.manifest, opts.resume)
+		if err != nil {
+			fatalf("can't open manifest: %v", err)
+		}
+		defer manifest.close()
+	}
+
+	var todo []string
+	var skipped int
+	for _, rel := range files {
+		if done[rel] {
+			skipped++
+			continue
+		}
+		todo = append(todo, rel)
+	}
+
+	jobs := make(chan string)
+	results := make(chan *batchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				results <- reencryptBatchFile(opts, rel, sharedKEK)
+			}
+		}()
+	}
+	go func() {
+		for _, rel := range todo {
+			jobs <- rel
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var ok, failed int
+	var failures []*batchResult
+	for r := range results {
+		if manifest != nil {
+			e := &manifestEntry{File: r.file, Status: batchOK, Time: time.Now().UTC()}
+			if r.err != nil {
+				e.Status = batchFailed
+				e.Error = r.err.Error()
+			} else {
+				e.KEKFile = r.kekFile
+				e.KEKFingerprint = r.fingerprint
+			}
+			if err := manifest.write(e); err != nil {
+				// without the manifest, a resumed run can't tell what was done
+				fatalf("can't write manifest: %v", err)
+			}
+		}
+
+		if r.err != nil {
+			failed++
+			failures = append(failures, r)
+			fmt.Printf("%s: FAIL: %v\n", r.file, r.err)
+			continue
+		}
+		ok++
+		if !r.resumed && !opts.dryRun {
+			recordFile(opts.audit, audit.KindReEncrypt, filepath.Join(opts.dir, filepath.FromSlash(r.file)), r.prevFingerprint, r.fingerprint)
+		}
+		switch {
+		case opts.quiet:
+		case r.resumed:
+			fmt.Printf("%s: OK (completed by an earlier run)\n", r.file)
+		case opts.dryRun:
+			fmt.Printf("%s: would re-encrypt\n", r.file)
+		default:
+			fmt.Printf("%s: OK\n", r.file)
+		}
+	}
+
+	verb := "re-encrypted"
+	if opts.dryRun {
+		verb = "would re-encrypt"
+	}
+	fmt.Printf("%s %d file(s): %d OK, %d FAILED, %d skipped (already done)\n", verb, len(todo), ok, failed, skipped)
+	if len(failures) > 0 {
+		fmt.Printf("failed:\n")
+		for _, r := range failures {
+			fmt.Printf("  %s\n", r.file)
+		}
+		os.Exit(exitBatchFailed)
+	}
+}
+
+// reencryptBatchFile re-encrypts a single file of a batch in place, under a
+// new KEK that replaces the file's KEK file.  In a dry run, it only checks
+// that the file's header authenticates under its current KEK.
+func reencryptBatchFile(opts *batchOptions, rel string, sharedKEK []byte) *batchResult {
+	file := filepath.Join(opts.dir, filepath.FromSlash(rel))
+	kekFile := file + opts.kekSuffix
+	r := &batchResult{file: rel, kekFile: rel + opts.kekSuffix}
+
+	if opts.resume && !opts.dryRun {
+		if _, err := os.Stat(journalPath(file)); err == nil {
+			if _, err := recoverFile(file); err != nil {
+				r.err = fmt.Errorf("can't recover interrupted operation: %w", err)
+				return r
+			}
+		}
+	}
+
+	kek := sharedKEK
+	if kek == nil {
+		var err error
+		kek, err = readKeyFile(kekFile)
+		if err != nil {
+			r.err = fmt.Errorf("can't read KEK file: %w", err)
+			return r
+		}
+		defer freeKey(kek)
+	}
+
+	// with a shared KEK, a file that a previous run re-encrypted (but didn't
+	// record in the manifest) has a KEK file under which it authenticates
+	if sharedKEK != nil && opts.resume {
+		if fileKEK, err := readKeyFile(kekFile); err == nil {
+			authenticated := headerAuthenticates(file, fileKEK) == nil
+			if authenticated {
+				r.fingerprint = nestedaes.Fingerprint(fileKEK)
+				r.resumed = true
+			}
+			freeKey(fileKEK)
+			if authenticated {
+				return r
+			}
+		}
+	}
+
+	if opts.dryRun {
+		r.err = headerAuthenticates(file, kek)
+		return r
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer in.Close()
+
+	nextKEK := newKEK()
+	defer freeKey(nextKEK)
+	newDEK := newKEK()
+	defer freeKey(newDEK)
+
+	r.err = replaceFiles("reencrypt", file, kekFile, nextKEK, func(f *os.File) error {
+		_, err := nestedaes.ReencryptStream(f, in, kek, nextKEK, newDEK)
+		return err
+	})
+	if r.err == nil {
+		r.fingerprint = nestedaes.Fingerprint(nextKEK)
+		r.prevFingerprint = nestedaes.Fingerprint(kek)
+	}
+	return r
+}
+
+// headerAuthenticates checks that the header of the blob in file
+// authenticates under kek, without reading the payload.
+func headerAuthenticates(file string, kek []byte) error {
+	hdr, err := readFileHeader(file)
+	if err != nil {
+		return err
+	}
+	h, err := nestedaes.UnmarshalHeader(kek, hdr)
+	if err != nil {
+		return err
+	}
+	h.Wipe()
+	return nil
+}
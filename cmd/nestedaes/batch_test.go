@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readManifest returns the status of each file in a batch manifest, by file.
+func readManifest(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	statuses := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e manifestEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		statuses[e.File] = e.Status
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return statuses
+}
+
+func TestBatchPartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	if err := os.MkdirAll(filepath.Join(archive, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"plain.txt": "hello"})
+	for _, name := range []string{"a.enc", "sub/b.enc", "c.enc"} {
+		mustRun(t, dir, "encrypt", "-outkek", "archive/"+name+".key", "-out", "archive/"+name, "plain.txt")
+	}
+	// c.enc's KEK file is another file's, so c.enc fails
+	cKEK := filepath.Join(archive, "c.enc.key")
+	good, err := os.ReadFile(cKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(archive, "a.enc.key"), cKEK); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, dir, "encrypt", "-outkek", "archive/a.enc.key", "-out", "archive/a.enc", "plain.txt")
+	oldC, err := os.ReadFile(filepath.Join(archive, "c.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, status := run(t, dir, "reencrypt", "-r", "archive", "-n")
+	if status != exitBatchFailed || !strings.Contains(out, "2 OK, 1 FAILED") {
+		t.Fatalf("dry run: expected exit status %d and one failure, got %d:\n%s", exitBatchFailed, status, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "reencrypt-manifest.jsonl")); err == nil {
+		t.Fatal("the dry run wrote a manifest")
+	}
+
+	out, status = run(t, dir, "reencrypt", "-r", "archive", "-j", "2")
+	if status != exitBatchFailed || !strings.Contains(out, "2 OK, 1 FAILED") || !strings.Contains(out, "c.enc: FAIL") {
+		t.Fatalf("expected exit status %d and c.enc to fail, got %d:\n%s", exitBatchFailed, status, out)
+	}
+	manifest := filepath.Join(dir, "reencrypt-manifest.jsonl")
+	statuses := readManifest(t, manifest)
+	want := map[string]string{"a.enc": batchOK, "sub/b.enc": batchOK, "c.enc": batchFailed}
+	for file, status := range want {
+		if statuses[file] != status {
+			t.Fatalf("the manifest records %s as %q, expected %q", file, statuses[file], status)
+		}
+	}
+	// the failed file is untouched, and the others decrypt under their new
+	// KEKs
+	if data, err := os.ReadFile(filepath.Join(archive, "c.enc")); err != nil || string(data) != string(oldC) {
+		t.Fatalf("the failed file was changed (%v)", err)
+	}
+	for _, name := range []string{"a.enc", "sub/b.enc"} {
+		if got := mustRun(t, dir, "decrypt", "-inkek", "archive/"+name+".key", "-out", "-", "archive/"+name); got != "hello" {
+			t.Fatalf("%s decrypted to %q", name, got)
+		}
+	}
+
+	// the manifest must not be overwritten, unless the batch is resumed
+	if _, status := run(t, dir, "reencrypt", "-r", "archive"); status != 1 {
+		t.Fatalf("expected exit status 1 for an existing manifest, got %d", status)
+	}
+
+	if err := os.WriteFile(cKEK, good, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out = mustRun(t, dir, "reencrypt", "-r", "archive", "-resume")
+	if !strings.Contains(out, "re-encrypted 1 file(s): 1 OK, 0 FAILED, 2 skipped") {
+		t.Fatalf("the resumed batch didn't re-encrypt only c.enc:\n%s", out)
+	}
+	if readManifest(t, manifest)["c.enc"] != batchOK {
+		t.Fatal("the manifest doesn't record c.enc as re-encrypted")
+	}
+}
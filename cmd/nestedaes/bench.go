@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/mu"
+	"github.com/etclab/nestedaes"
+)
+
+const benchUsage = `Usage: nestedaes bench [options]
+
+Measure the library's operations over a sweep of payload sizes and layer
+counts, and print a report as CSV or JSON, for plotting.
+
+Each operation is run on a blob with the given payload size and number of
+layers (encrypt always produces a single layer, so it is measured once per
+size).  Preparing the input of each iteration (for instance, copying the
+blob) is not timed.  The operations are:
+
+  encrypt    Encrypt the payload (nestedaes.AppendEncrypt)
+  reencrypt  Add a layer under a fresh KEK and DEK (nestedaes.Reencrypt)
+  rekeygen   Derive a re-encryption token from the header (nestedaes.ReKeyGen)
+  apply      Apply a re-encryption token to the blob (nestedaes.ApplyToken)
+  decrypt    Decrypt the blob in place (nestedaes.Decrypt)
+  compact    Replace all layers with one (nestedaes.Compact)
+
+For each operation, size, and layer count, the report has the number of
+iterations; the mean, minimum, maximum, and 50th, 90th, and 99th percentile
+latencies (in nanoseconds); the throughput (in MB/s, computed from the mean
+latency and the payload size); and the mean number of heap allocations and
+bytes allocated per operation.
+
+options:
+  -ops OPS
+    A comma-separated list of the operations to measure.
+
+    Default: encrypt,reencrypt,apply,decrypt,compact
+
+  -sizes SIZES
+    A comma-separated list of payload sizes, in bytes, optionally with a
+    KiB, MiB, or GiB suffix.
+
+    Default: 1KiB,64KiB,1MiB
+
+  -layers LAYERS
+    A comma-separated list of layer counts.
+
+    Default: 1,8,32
+
+  -n N
+    The number of timed iterations of each measurement, after one untimed
+    warm-up iteration.
+
+    Default: 20
+
+  -format csv|json
+    The format of the report.
+
+    Default: csv
+
+  -out OUT_FILE
+    The file to write the report to, or "-" for stdout.
+
+    Default: -
+
+  -h|-help
+    Display this usage statement and exit.
+
+examples:
+  $ nestedaes bench -sizes 1MiB,16MiB -layers 1,2,4,8,16,32,64 > decrypt.csv
+  $ nestedaes bench -ops decrypt,compact -format json -out bench.json
+`
+
+// benchOps are the measurable operations, in report order.
+var benchOps = []string{"encrypt", "reencrypt", "rekeygen", "apply", "decrypt", "compact"}
+
+// benchResult is a row of the benchmark report.
+type benchResult struct {
+	Op             string  `json:"op"`
+	Size           int     `json:"size"`
+	Layers         int     `json:"layers"`
+	Iterations     int     `json:"iterations"`
+	MeanNs         int64   `json:"mean_ns"`
+	MinNs          int64   `json:"min_ns"`
+	P50Ns          int64   `json:"p50_ns"`
+	P90Ns          int64   `json:"p90_ns"`
+	P99Ns          int64   `json:"p99_ns"`
+	MaxNs          int64   `json:"max_ns"`
+	ThroughputMBps float64 `json:"throughput_mbps"`
+	AllocsPerOp    float64 `json:"allocs_per_op"`
+	BytesPerOp     float64 `json:"bytes_per_op"`
+}
+
+var benchCSVHeader = []string{
+	"op", "size", "layers", "iterations",
+	"mean_ns", "min_ns", "p50_ns", "p90_ns", "p99_ns", "max_ns",
+	"throughput_mbps", "allocs_per_op", "bytes_per_op",
+}
+
+func (r *benchResult) csvRecord() []string {
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	return []string{
+		r.Op, strconv.Itoa(r.Size), strconv.Itoa(r.Layers), strconv.Itoa(r.Iterations),
+		i(r.MeanNs), i(r.MinNs), i(r.P50Ns), i(r.P90Ns), i(r.P99Ns), i(r.MaxNs),
+		f(r.ThroughputMBps), f(r.AllocsPerOp), f(r.BytesPerOp),
+	}
+}
+
+// parseSize parses a size such as "4096", "64KiB", or "1MiB".
+func parseSize(s string) (int, error) {
+	mult := 1
+	for _, u := range []struct {
+		suffix string
+		mult   int
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// parseList parses a comma-separated list with parse.
+func parseList(option, list string, parse func(string) (int, error)) []int {
+	var vals []int
+	for _, s := range strings.Split(list, ",") {
+		v, err := parse(strings.TrimSpace(s))
+		if err != nil {
+			fatalf("%s: %v", option, err)
+		}
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+func parseLayerCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid layer count %q", s)
+	}
+	return n, nil
+}
+
+func benchMain(args []string) {
+	var opList, sizeList, layerList, format, outFile string
+	var iterations int
+
+	fs := newFlagSet("bench", benchUsage)
+	fs.StringVar(&opList, "ops", "encrypt,reencrypt,apply,decrypt,compact", "")
+	fs.StringVar(&sizeList, "sizes", "1KiB,64KiB,1MiB", "")
+	fs.StringVar(&layerList, "layers", "1,8,32", "")
+	fs.IntVar(&iterations, "n", 20, "")
+	fs.StringVar(&format, "format", "csv", "")
+	fs.StringVar(&outFile, "out", "-", "")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fatalf("bench: expected no positional arguments but got %d", fs.NArg())
+	}
+	if format != "csv" && format != "json" {
+		fatalf("invalid value for -format; must be \"csv\" or \"json\"")
+	}
+	if iterations < 1 {
+		fatalf("-n must be at least 1")
+	}
+
+	ops := strings.Split(opList, ",")
+	for _, op := range ops {
+		if !slices.Contains(benchOps, op) {
+			fatalf("-ops: unknown operation %q", op)
+		}
+	}
+	sizes := parseList("-sizes", sizeList, parseSize)
+	layers := parseList("-layers", layerList, parseLayerCount)
+
+	var results []*benchResult
+	for _, op := range benchOps {
+		if !slices.Contains(ops, op) {
+			continue
+		}
+		for _, size := range sizes {
+			counts := layers
+			if op == "encrypt" {
+				counts = []int{1}
+			}
+			for _, nl := range counts {
+				r := runBench(op, size, nl, iterations)
+				fmt.Fprintf(os.Stderr, "%s size=%d layers=%d: %d ns/op\n", r.Op, r.Size, r.Layers, r.MeanNs)
+				results = append(results, r)
+			}
+		}
+	}
+
+	out := createOutput(outFile)
+	var err error
+	if format == "json" {
+		err = writeBenchJSON(out.f, results)
+	} else {
+		err = writeBenchCSV(out.f, results)
+	}
+	if err != nil {
+		out.abort()
+		fatalf("can't write report: %v", err)
+	}
+	out.commit()
+}
+
+func writeBenchCSV(w io.Writer, results []*benchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write(benchCSVHeader)
+	for _, r := range results {
+		cw.Write(r.csvRecord())
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeBenchJSON(w io.Writer, results []*benchResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// makeBlob returns a blob with the given payload size and number of layers,
+// and its KEK.
+func makeBlob(size, layers int) ([]byte, []byte) {
+	kek := aes256.NewRandomKey()
+	blob, err := nestedaes.Encrypt(make([]byte, size), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		fatalf("bench: Encrypt failed: %v", err)
+	}
+	for i := 1; i < layers; i++ {
+		newKEK := aes256.NewRandomKey()
+		blob, err = nestedaes.ReencryptWithKeys(blob, kek, newKEK, aes256.NewRandomKey())
+		if err != nil {
+			fatalf("bench: Reencrypt failed: %v", err)
+		}
+		kek = newKEK
+	}
+	return blob, kek
+}
+
+// runBench measures an operation on a blob of the given payload size and
+// number of layers.
+func runBench(op string, size, layers, iterations int) *benchResult {
+	blob, kek := makeBlob(size, layers)
+	plaintext := make([]byte, size)
+	// the working copy has room for an extra layer, or for the GCM tag when
+	// encrypting or decrypting, so that operations can run in place
+	work := make([]byte, 0, len(blob)+nestedaes.Overhead)
+
+	var tok *nestedaes.Token
+	if op == "apply" {
+		hdr, _, err := nestedaes.SplitHeaderPayload(blob)
+		if err != nil {
+			fatalf("bench: %v", err)
+		}
+		tok, _, err = nestedaes.ReKeyGen(hdr, kek)
+		if err != nil {
+			fatalf("bench: ReKeyGen failed: %v", err)
+		}
+		defer tok.Wipe()
+	}
+
+	// prepare sets up the input of an iteration; run is the timed operation
+	var iv []byte
+	prepare := func() {
+		work = append(work[:0], blob...)
+		iv = aes256.NewRandomIV()
+	}
+	run := func() error {
+		var err error
+		switch op {
+		case "encrypt":
+			_, err = nestedaes.AppendEncrypt(work[:0], plaintext, kek, iv, nil)
+		case "reencrypt":
+			var newKEK []byte
+			_, newKEK, err = nestedaes.Reencrypt(work, kek)
+			freeKey(newKEK)
+		case "rekeygen":
+			var t *nestedaes.Token
+			var newKEK []byte
+			t, newKEK, err = nestedaes.ReKeyGen(work, kek)
+			if err == nil {
+				t.Wipe()
+				freeKey(newKEK)
+			}
+		case "apply":
+			_, err = nestedaes.ApplyToken(work, tok)
+		case "decrypt":
+			_, err = nestedaes.Decrypt(work, kek, nil)
+		case "compact":
+			_, err = nestedaes.Compact(work, kek, kek, iv, nil)
+		default:
+			mu.BUG("invalid op: %s", op)
+		}
+		return err
+	}
+
+	// warm up
+	prepare()
+	if err := run(); err != nil {
+		fatalf("bench: %s failed: %v", op, err)
+	}
+
+	durations := make([]time.Duration, iterations)
+	var allocs, bytes uint64
+	var before, after runtime.MemStats
+	for i := range durations {
+		prepare()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		err := run()
+		durations[i] = time.Since(start)
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			fatalf("bench: %s failed: %v", op, err)
+		}
+		allocs += after.Mallocs - before.Mallocs
+		bytes += after.TotalAlloc - before.TotalAlloc
+	}
+
+	return summarize(op, size, layers, durations, allocs, bytes)
+}
+
+// summarize computes the statistics of a measurement.
+func summarize(op string, size, layers int, durations []time.Duration, allocs, bytes uint64) *benchResult {
+	slices.Sort(durations)
+	n := len(durations)
+
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	mean := total / time.Duration(n)
+	// nearest-rank percentile
+	pct := func(p int) int64 {
+		rank := (p*n + 99) / 100
+		return int64(durations[max(rank, 1)-1])
+	}
+
+	r := &benchResult{
+		Op:          op,
+		Size:        size,
+		Layers:      layers,
+		Iterations:  n,
+		MeanNs:      int64(mean),
+		MinNs:       int64(durations[0]),
+		P50Ns:       pct(50),
+		P90Ns:       pct(90),
+		P99Ns:       pct(99),
+		MaxNs:       int64(durations[n-1]),
+		AllocsPerOp: float64(allocs) / float64(n),
+		BytesPerOp:  float64(bytes) / float64(n),
+	}
+	if mean > 0 {
+		r.ThroughputMBps = float64(size) / 1e6 / mean.Seconds()
+	}
+	return r
+}
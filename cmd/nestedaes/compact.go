@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+const compactUsage = `Usage: nestedaes compact [options] FILE
+
+Replace all layers of encryption of an encrypted file with a single, fresh
+layer under a newly generated key-encrypting key (KEK).  Decryption time grows
+with the number of layers; compacting resets it.
+
+positional arguments:
+  FILE
+    The encrypted file
+
+options:
+  -out OUT_FILE
+    The output file.  If not given, then FILE is compacted in place.
+
+  -inkek INPUT_KEK_FILE
+    The file containing FILE's current KEK.
+
+    Default: kek.key
+
+  -outkek OUTPUT_KEK_FILE
+    The file to write the new KEK to.  If this is the same as -inkek, the file
+    is overwritten.
+
+    Default: kek.key
+
+` + aadUsage + `
+
+` + auditOptionsUsage + `
+
+  -mlock
+    Keep keys in locked memory (see 'nestedaes encrypt -h').
+
+  -h|-help
+    Display this usage statement and exit.
+
+examples:
+  $ nestedaes compact -inkek kek.key -outkek kek2.key foo.enc
+  $ nestedaes compact -aad tenant42 -inkek kek.key -outkek kek2.key foo.enc
+`
+
+func compactMain(args []string) {
+	var outFile, inKEK, outKEK string
+	var mlock bool
+	var aadOpts aadOptions
+	var auditOpts auditOptions
+
+	fs := newFlagSet("compact", compactUsage)
+	fs.StringVar(&outFile, "out", "", "")
+	fs.StringVar(&inKEK, "inkek", "kek.key", "")
+	fs.StringVar(&outKEK, "outkek", "kek.key", "")
+	aadOpts.register(fs)
+	fs.BoolVar(&mlock, "mlock", false, "")
+	auditOpts.register(fs)
+	inFile := parseOneFile(fs, args)
+
+	if outFile == "" {
+		outFile = inFile
+	}
+	checkKEKPath("-inkek", inKEK)
+	checkKEKPath("-outkek", outKEK)
+	aadOpts.check()
+	aad := aadOpts.mustResolve(inFile)
+	if aadOpts.fromFilename && filepath.Base(outFile) != filepath.Base(inFile) {
+		fatalf("-aad-from-filename: can't compact %s to a file with another name", inFile)
+	}
+
+	log := auditOpts.open()
+	enableMlock(mlock)
+
+	blob, err := os.ReadFile(inFile)
+	if err != nil {
+		fatalf("can't read input file: %v", err)
+	}
+
+	kek := readKEK(inKEK)
+	defer freeKey(kek)
+	nextKEK := newKEK()
+	defer freeKey(nextKEK)
+
+	blob, err = nestedaes.Compact(blob, kek, nextKEK, aes256.NewRandomIV(), aad)
+	if err != nil {
+		fatalf("compact failed: %v", err)
+	}
+
+	replaceBlobAndKEK("compact", outFile, inKEK, outKEK, nextKEK, func(f *os.File) error {
+		_, err := f.Write(blob)
+		return err
+	})
+	recordFile(log, audit.KindCompact, outFile, nestedaes.Fingerprint(kek), nestedaes.Fingerprint(nextKEK))
+}
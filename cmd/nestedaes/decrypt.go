@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/etclab/nestedaes"
+)
+
+const decryptUsage = `Usage: nestedaes decrypt [options] FILE
+
+Decrypt an encrypted file.
+
+positional arguments:
+  FILE
+    The file to decrypt, or "-" for stdin.  The payload is authenticated
+    before any plaintext is output; thus, it is buffered in memory (and
+    decrypted in place, then wiped): decrypting takes about as much memory
+    as the size of FILE.
+
+options:
+  -out OUT_FILE
+    The output file, or "-" for stdout.  If not given, then FILE is decrypted
+    in place (or, if FILE is "-", the output is written to stdout).
+
+  -inkek INPUT_KEK_FILE
+    The file containing FILE's current KEK.
+
+    Default: kek.key
+
+` + aadUsage + `
+
+  -mlock
+    Keep keys in locked memory (see 'nestedaes encrypt -h').
+
+  -h|-help
+    Display this usage statement and exit.
+
+examples:
+  $ nestedaes decrypt -inkek kek2.key -out foo.txt foo.renc
+  $ download dir.tar.enc | nestedaes decrypt -inkek kek.key - | tar x
+  $ nestedaes decrypt -aad tenant42 -out foo.txt foo.enc
+`
+
+func decryptMain(args []string) {
+	var outFile, inKEK string
+	var mlock bool
+	var aadOpts aadOptions
+
+	fs := newFlagSet("decrypt", decryptUsage)
+	fs.StringVar(&outFile, "out", "", "")
+	fs.StringVar(&inKEK, "inkek", "kek.key", "")
+	aadOpts.register(fs)
+	fs.BoolVar(&mlock, "mlock", false, "")
+	inFile := parseOneFile(fs, args)
+
+	if outFile == "" {
+		outFile = inFile
+	}
+	checkKEKPath("-inkek", inKEK)
+	aadOpts.check()
+	aad := aadOpts.mustResolve(inFile)
+
+	enableMlock(mlock)
+	doDecrypt(inFile, outFile, inKEK, aad)
+}
+
+// doDecrypt decrypts inFile to outFile with the additional data aad.
+func doDecrypt(inFile, outFile, inKEK string, aad []byte) {
+	in := openInput(inFile)
+	defer in.Close()
+
+	kek := readKEK(inKEK)
+	defer freeKey(kek)
+
+	// DecryptStream authenticates the payload before writing any of it
+	out := createOutput(outFile)
+	_, err := nestedaes.DecryptStream(out.f, in, kek, aad)
+	if err != nil {
+		out.abort()
+		fatalf("decrypt failed: %v", err)
+	}
+	out.commit()
+}
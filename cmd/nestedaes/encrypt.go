@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+const encryptUsage = `Usage: nestedaes encrypt [options] FILE
+
+Encrypt a file under a newly generated key-encrypting key (KEK).
+
+positional arguments:
+  FILE
+    The file to encrypt, or "-" for stdin
+
+options:
+  -out OUT_FILE
+    The output file, or "-" for stdout.  If not given, then FILE is encrypted
+    in place (or, if FILE is "-", the output is written to stdout).  Since
+    the blob's header depends on the entire payload, the plaintext is
+    buffered in memory (and encrypted in place, then wiped): encrypting
+    takes about as much memory as the size of FILE, and FILE can't exceed
+    the AES-GCM limit of about 64 GiB.
+
+  -outkek OUTPUT_KEK_FILE
+    The file to write the new KEK to.
+
+    Default: kek.key
+
+` + aadUsage + `
+
+  -record-aad-hash
+    Record the SHA-256 hash of the AAD in the blob's header, so that
+    decrypting or verifying with the wrong AAD fails with a clear error
+    rather than a generic authentication failure.  The hash is not secret:
+    anyone with the file can test guesses of a low-entropy AAD against it.
+
+` + auditOptionsUsage + `
+
+  -mlock
+    Keep keys in memory that is locked into RAM and excluded from core dumps
+    (Linux only).  If the memory can't be locked (for instance, because
+    RLIMIT_MEMLOCK is too small), keys fall back to ordinary memory.
+
+  -h|-help
+    Display this usage statement and exit.
+
+examples:
+  $ nestedaes encrypt -outkek kek.key -out foo.enc foo.txt
+  $ tar c dir | nestedaes encrypt -outkek kek.key - > dir.tar.enc
+  $ nestedaes encrypt -aad tenant42 -record-aad-hash -out foo.enc foo.txt
+`
+
+func encryptMain(args []string) {
+	var outFile, outKEK string
+	var recordHash, mlock bool
+	var aadOpts aadOptions
+	var auditOpts auditOptions
+
+	fs := newFlagSet("encrypt", encryptUsage)
+	fs.StringVar(&outFile, "out", "", "")
+	fs.StringVar(&outKEK, "outkek", "kek.key", "")
+	aadOpts.register(fs)
+	fs.BoolVar(&recordHash, "record-aad-hash", false, "")
+	fs.BoolVar(&mlock, "mlock", false, "")
+	auditOpts.register(fs)
+	inFile := parseOneFile(fs, args)
+
+	if outFile == "" {
+		outFile = inFile
+	}
+	checkKEKPath("-outkek", outKEK)
+	aadOpts.check()
+	if recordHash && !aadOpts.given() {
+		fatalf("-record-aad-hash requires -aad, -aad-file, or -aad-from-filename")
+	}
+
+	aad := aadOpts.mustResolve(outFile)
+	var md nestedaes.Metadata
+	if recordHash {
+		md = aadMetadata(aad)
+	}
+
+	log := auditOpts.open()
+	enableMlock(mlock)
+	doEncrypt(inFile, outFile, outKEK, aad, md, log)
+}
+
+// doEncrypt encrypts inFile to outFile with the additional data aad,
+// recording md in the header, and records the encryption in log, if it is
+// not nil.
+func doEncrypt(inFile, outFile, outKEK string, aad []byte, md nestedaes.Metadata, log *audit.Log) {
+	in := openInput(inFile)
+	defer in.Close()
+
+	kek := newKEK()
+	defer freeKey(kek)
+	iv := aes256.NewRandomIV()
+
+	replaceBlobAndKEK("encrypt", outFile, "", outKEK, kek, func(f *os.File) error {
+		_, err := nestedaes.EncryptStreamWithMetadata(f, in, kek, iv, aad, md)
+		return err
+	})
+	recordFile(log, audit.KindEncrypt, outFile, "", nestedaes.Fingerprint(kek))
+}
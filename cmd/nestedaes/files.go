@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempSuffix is part of the names of the temporary files that hold a file's
+// new contents until they are renamed into place: a temporary file for path
+// is named path + tempSuffix + "-" + a random string (see createTemp), so
+// that an operation never uses, or removes, another operation's temporary
+// file.  An operation that replaces several files records the names of its
+// temporary files in its journal (see [txn]).
+const tempSuffix = ".nestedaes-new"
+
+// openInput opens path for reading.  The path "-" denotes stdin.
+func openInput(path string) *os.File {
+	if path == "-" {
+		return os.Stdin
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fatalf("can't open input file: %v", err)
+	}
+	return f
+}
+
+// syncDir fsyncs the directory containing path, so that a rename or removal
+// in it is durable.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// createTemp creates a new temporary file for path, in path's directory.  If
+// path exists, the temporary file gets its permissions, so that replacing
+// the file keeps them; otherwise, it is only accessible to its owner (mode
+// 0600).
+func createTemp(path string) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+tempSuffix+"-*")
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if err := f.Chmod(fi.Mode().Perm()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// isTempFor reports whether temp is the name of a temporary file for path.
+func isTempFor(temp, path string) bool {
+	return filepath.Dir(temp) == filepath.Dir(path) && strings.HasPrefix(filepath.Base(temp), filepath.Base(path)+tempSuffix)
+}
+
+// writeAndClose durably writes data to f, and closes it.
+func writeAndClose(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeTemp durably writes data to a new temporary file for path, without
+// renaming it into place, and returns the temporary file's name.
+func writeTemp(path string, data []byte) (string, error) {
+	f, err := createTemp(path)
+	if err != nil {
+		return "", err
+	}
+	if err := writeAndClose(f, data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// renameTemp moves the temporary file temp into place at path and makes the
+// rename durable.
+func renameTemp(temp, path string) error {
+	if err := os.Rename(temp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// writeFileAtomic replaces the file at path with data, such that after a
+// crash the file has either its old or its new contents.
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	if err := renameTemp(temp, path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// output is an output file of a subcommand.  Unless it is stdout, the data
+// is written to a temporary file for the path, and only moved into place by
+// commit (or by a [txn]); thus, an output file that is also the input file is
+// not truncated while it is being read, and a failed operation leaves the
+// existing file untouched.
+type output struct {
+	// f is the file to write to
+	f *os.File
+	// path is the final path of the output, or "-" for stdout
+	path string
+	// temp is the name of f, unless the output is stdout
+	temp string
+}
+
+// createOutput creates the output for path, where "-" denotes stdout.
+func createOutput(path string) *output {
+	if path == "-" {
+		return &output{f: os.Stdout, path: path}
+	}
+
+	f, err := createTemp(path)
+	if err != nil {
+		fatalf("can't create output file: %v", err)
+	}
+	return &output{f: f, path: path, temp: f.Name()}
+}
+
+// finish makes the output's data durable.  For a file, the data remains in
+// the temporary file.
+func (o *output) finish() error {
+	if o.f == os.Stdout {
+		return nil
+	}
+	if err := o.f.Sync(); err != nil {
+		o.f.Close()
+		return err
+	}
+	return o.f.Close()
+}
+
+// commit finishes the output and, for a file, renames it into place.
+func (o *output) commit() {
+	if err := o.finish(); err != nil {
+		o.abort()
+		fatalf("can't write output: %v", err)
+	}
+	if o.path == "-" {
+		return
+	}
+	if err := renameTemp(o.temp, o.path); err != nil {
+		o.abort()
+		fatalf("can't write output file: %v", err)
+	}
+}
+
+// abort discards the output.  Data already written to stdout can't be taken
+// back.
+func (o *output) abort() {
+	if o.f == os.Stdout {
+		return
+	}
+	o.f.Close()
+	os.Remove(o.temp)
+}
+
+// sameFile reports whether the paths a and b name the same file, which need
+// not exist.
+func sameFile(a, b string) bool {
+	fa, errA := os.Stat(a)
+	fb, errB := os.Stat(b)
+	if errA == nil && errB == nil {
+		return os.SameFile(fa, fb)
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// checkKEKPath rejects "-" as a KEK file, so that stdout only ever carries
+// data.
+func checkKEKPath(option, path string) {
+	if path == "-" {
+		fatalf("%s: KEKs must be read from or written to a file, not stdin or stdout", option)
+	}
+}
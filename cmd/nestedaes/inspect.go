@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+)
+
+const inspectUsage = `Usage: nestedaes inspect [options] FILE
+
+Print the structure of an encrypted file.
+
+Without a KEK, only the plain header is examined: the header size, BaseIV,
+metadata (such as a recorded AAD hash), the number of layers implied by the
+header size, the payload size, and a map of the byte offsets of each field.
+The metadata is then labeled unauthenticated, since anyone could have
+changed it.
+
+With a KEK, the encrypted part of the header is also authenticated and
+printed: the number of DEKs, the DataTag, and the DEK fingerprints; the
+metadata is authenticated along with it.  The DEKs themselves are never
+printed.
+
+positional arguments:
+  FILE
+    The encrypted file to inspect
+
+options:
+  -inkek INPUT_KEK_FILE
+    The file containing FILE's current KEK.
+
+  -json
+    Print the report as JSON.
+
+  -h|-help
+    Display this usage statement and exit.
+
+examples:
+  $ nestedaes inspect foo.enc
+  $ nestedaes inspect -inkek kek.key -json foo.enc
+`
+
+// region is an entry in the byte-offset map of a blob.
+type region struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// encryptedReport describes the authenticated, encrypted part of a header.
+type encryptedReport struct {
+	Layers          int      `json:"layers"`
+	DataTag         string   `json:"data_tag"`
+	DEKFingerprints []string `json:"dek_fingerprints"`
+}
+
+type inspectReport struct {
+	File       string          `json:"file"`
+	FileSize   int             `json:"file_size"`
+	HeaderSize int             `json:"header_size"`
+	BaseIV     string          `json:"base_iv"`
+	Metadata   []metadataEntry `json:"metadata,omitempty"`
+	// MetadataAuthenticated is true if the header was opened with -inkek,
+	// which authenticates its metadata.
+	MetadataAuthenticated bool             `json:"metadata_authenticated"`
+	Layers                int              `json:"layers"`
+	PayloadSize           int              `json:"payload_size"`
+	Regions               []region         `json:"regions"`
+	Encrypted             *encryptedReport `json:"encrypted_header,omitempty"`
+	Error                 string           `json:"error,omitempty"`
+}
+
+// metadataEntry is an entry of a header's metadata.  The metadata is
+// authenticated only when the header is (that is, with a KEK).
+type metadataEntry struct {
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+	// Time is the value of a rotation time, as RFC 3339.  Unless the
+	// header is opened with -inkek, it is not authenticated.
+	Time string `json:"time,omitempty"`
+}
+
+// regions returns the byte-offset map of a blob with the given header size,
+// metadata section size, number of layers, and total size.  Since the header
+// is encrypted with GCM (a stream mode), the encrypted fields are at the same
+// offsets as their plaintexts.
+func regions(hSize, metaSize, layers, size int) []region {
+	var rs []region
+	off := 0
+	add := func(name string, n int) {
+		rs = append(rs, region{Name: name, Offset: off, Length: n})
+		off += n
+	}
+
+	add("size", 4)
+	add("base_iv", aes256.IVSize)
+	if metaSize > 0 {
+		add("metadata", metaSize)
+	}
+	add("data_tag (encrypted)", aes256.TagSize)
+	for i := 0; i < layers; i++ {
+		add(fmt.Sprintf("dek[%d] (encrypted)", i), aes256.KeySize)
+	}
+	add("header_tag", aes256.TagSize)
+	add("payload", size-hSize)
+	return rs
+}
+
+func inspectMain(args []string) {
+	var inKEK string
+	var asJSON bool
+
+	fs := newFlagSet("inspect", inspectUsage)
+	fs.StringVar(&inKEK, "inkek", "", "")
+	fs.BoolVar(&asJSON, "json", false, "")
+	inFile := parseOneFile(fs, args)
+
+	// only the header is read, so that inspecting a large blob is cheap
+	f, err := os.Open(inFile)
+	if err != nil {
+		fatalf("can't read input file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		fatalf("can't read input file: %v", err)
+	}
+	hdr, err := nestedaes.ReadHeader(f)
+	f.Close()
+	if err != nil {
+		fatalf("inspect failed: %v", err)
+	}
+	fileSize := int(fi.Size())
+
+	ph, err := nestedaes.UnmarshalPlainHeader(hdr)
+	if err != nil {
+		fatalf("inspect failed: %v", err)
+	}
+
+	// whatever of the header isn't the fixed fields or DEKs is metadata
+	metaSize := int(ph.Size) - (nestedaes.Overhead - nestedaes.KeySize) - ph.Layers()*nestedaes.KeySize
+
+	r := &inspectReport{
+		File:        inFile,
+		FileSize:    fileSize,
+		HeaderSize:  int(ph.Size),
+		BaseIV:      hex.EncodeToString(ph.BaseIV),
+		Layers:      ph.Layers(),
+		PayloadSize: fileSize - int(ph.Size),
+		Regions:     regions(int(ph.Size), metaSize, ph.Layers(), fileSize),
+	}
+	for _, tag := range slices.Sorted(maps.Keys(ph.Metadata)) {
+		e := metadataEntry{
+			Tag:   tag.String(),
+			Value: hex.EncodeToString(ph.Metadata[tag]),
+		}
+		if tag == nestedaes.MetaRotatedAt {
+			if t, err := nestedaes.ParseRotationTime(ph.Metadata[tag]); err == nil {
+				e.Time = t.Format(time.RFC3339)
+			}
+		}
+		r.Metadata = append(r.Metadata, e)
+	}
+
+	if inKEK != "" {
+		kek := readKEK(inKEK)
+		h, err := nestedaes.UnmarshalHeader(kek, hdr)
+		freeKey(kek)
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			r.MetadataAuthenticated = true
+			r.Encrypted = &encryptedReport{
+				Layers:  len(h.DEKs),
+				DataTag: hex.EncodeToString(h.DataTag),
+			}
+			for _, dek := range h.DEKs {
+				r.Encrypted.DEKFingerprints = append(r.Encrypted.DEKFingerprints, nestedaes.Fingerprint(dek))
+			}
+			h.Wipe()
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		printInspectReport(r)
+	}
+
+	if r.Error != "" {
+		os.Exit(1)
+	}
+}
+
+func printInspectReport(r *inspectReport) {
+	fmt.Printf("file:         %s (%d bytes)\n", r.File, r.FileSize)
+	fmt.Printf("header size:  %d bytes\n", r.HeaderSize)
+	fmt.Printf("base IV:      %s\n", r.BaseIV)
+	for _, e := range r.Metadata {
+		var notes []string
+		if e.Time != "" {
+			notes = append(notes, e.Time)
+		}
+		if !r.MetadataAuthenticated {
+			notes = append(notes, "unauthenticated")
+		}
+		if len(notes) > 0 {
+			fmt.Printf("metadata:     %s = %s (%s)\n", e.Tag, e.Value, strings.Join(notes, ", "))
+			continue
+		}
+		fmt.Printf("metadata:     %s = %s\n", e.Tag, e.Value)
+	}
+	fmt.Printf("layers:       %d (inferred from header size)\n", r.Layers)
+	fmt.Printf("payload size: %d bytes\n", r.PayloadSize)
+	fmt.Printf("\n")
+	fmt.Printf("%10s  %10s  %s\n", "OFFSET", "LENGTH", "FIELD")
+	for _, rg := range r.Regions {
+		fmt.Printf("%10d  %10d  %s\n", rg.Offset, rg.Length, rg.Name)
+	}
+
+	if r.Error != "" {
+		fmt.Printf("\nencrypted header: FAILED to authenticate: %s\n", r.Error)
+		return
+	}
+	if r.Encrypted == nil {
+		return
+	}
+
+	fmt.Printf("\nencrypted header (authenticated):\n")
+	fmt.Printf("  layers:   %d\n", r.Encrypted.Layers)
+	fmt.Printf("  data tag: %s\n", r.Encrypted.DataTag)
+	fmt.Printf("  DEK fingerprints:\n")
+	for i, fp := range r.Encrypted.DEKFingerprints {
+		fmt.Printf("    %d: %s\n", i, fp)
+	}
+}
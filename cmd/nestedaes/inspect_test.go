@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/etclab/nestedaes"
+)
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	plain := strings.Repeat("x", 1000)
+	writeFiles(t, dir, map[string]string{"foo.txt": plain})
+	mustRun(t, dir, "encrypt", "-aad", "tenant42", "-record-aad-hash", "-outkek", "k1.key", "-out", "foo.enc", "foo.txt")
+	mustRun(t, dir, "reencrypt", "-inkek", "k1.key", "-outkek", "k2.key", "foo.enc")
+	mustRun(t, dir, "keygen", "-out", "other.key")
+
+	inspect := func(args ...string) *inspectReport {
+		t.Helper()
+		out, _ := run(t, dir, append(append([]string{"inspect", "-json"}, args...), "foo.enc")...)
+		var r inspectReport
+		if err := json.Unmarshal([]byte(out), &r); err != nil {
+			t.Fatalf("can't parse the report: %v\n%s", err, out)
+		}
+		return &r
+	}
+
+	r := inspect()
+	if r.Layers != 2 || r.PayloadSize != len(plain) || r.FileSize != r.HeaderSize+len(plain) {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if len(r.Metadata) != 1 || r.Metadata[0].Tag != nestedaes.MetaAADHash.String() || r.MetadataAuthenticated || r.Encrypted != nil {
+		t.Fatalf("unexpected metadata in the report without a KEK: %+v", r)
+	}
+	last := r.Regions[len(r.Regions)-1]
+	if last.Name != "payload" || last.Offset != r.HeaderSize || last.Length != len(plain) {
+		t.Fatalf("unexpected payload region %+v", last)
+	}
+
+	r = inspect("-inkek", "k2.key")
+	if !r.MetadataAuthenticated || r.Encrypted == nil || len(r.Encrypted.DEKFingerprints) != 2 {
+		t.Fatalf("unexpected report with the KEK: %+v", r)
+	}
+
+	if _, status := run(t, dir, "inspect", "-inkek", "other.key", "foo.enc"); status != 1 {
+		t.Fatalf("expected exit status 1 with the wrong KEK, got %d", status)
+	}
+	writeFiles(t, dir, map[string]string{"short.enc": "abc"})
+	if _, status := run(t, dir, "inspect", "short.enc"); status != 1 {
+		t.Fatalf("expected exit status 1 for a truncated blob, got %d", status)
+	}
+}
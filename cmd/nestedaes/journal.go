@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// journalSuffix is appended to a blob's path to name the journal of an
+// operation that replaces the blob and its KEK.
+const journalSuffix = ".nestedaes-journal"
+
+// The states of a transaction.  A transaction in the prepare state is rolled
+// back by recovery; one in the commit state is rolled forward.
+const (
+	txnPrepare = "prepare"
+	txnCommit  = "commit"
+)
+
+// txnVersion is the version of the journal format.  Version 1 journals,
+// whose temporary files had fixed names (path + tempSuffix), are still
+// recovered.
+const txnVersion = 2
+
+// txn is a two-phase commit of new contents for a set of files (a blob and
+// its KEK).  The new contents are first written to temporary files (see
+// tempSuffix), whose names the journal records.  Once they are all durable,
+// the journal is switched to the commit state, and the temporary files are
+// renamed into place, in order.  The blob is listed first, so that the old
+// KEK is only replaced once the new blob is in place.
+type txn struct {
+	Version int      `json:"version"`
+	Op      string   `json:"op"`
+	State   string   `json:"state"`
+	Files   []string `json:"files"`
+	// Temps are the temporary files of Files, in the same order.
+	Temps []string `json:"temps"`
+
+	// path is the path of the journal
+	path string
+}
+
+func journalPath(blobPath string) string {
+	return blobPath + journalSuffix
+}
+
+// beginTxn durably records a transaction, in the prepare state, that will
+// replace files with the temporary files temps.  The journal is named after
+// the first file, and is created exclusively, so that two operations on the
+// same file can't interleave.
+func beginTxn(op string, files, temps []string) (*txn, error) {
+	t := &txn{
+		Version: txnVersion,
+		Op:      op,
+		State:   txnPrepare,
+		Files:   files,
+		Temps:   temps,
+		path:    journalPath(files[0]),
+	}
+
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	temp, err := writeTemp(t.path, data)
+	if err != nil {
+		return nil, fmt.Errorf("can't write journal: %w", err)
+	}
+	// linking, unlike renaming, fails if the journal exists
+	err = os.Link(temp, t.path)
+	os.Remove(temp)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%s exists: an interrupted operation on %s must be recovered first (see 'nestedaes recover -h')", t.path, files[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't write journal: %w", err)
+	}
+	if err := syncDir(t.path); err != nil {
+		return nil, fmt.Errorf("can't write journal: %w", err)
+	}
+	return t, nil
+}
+
+// loadTxn reads the journal at path.
+func loadTxn(path string) (*txn, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &txn{path: path}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("can't parse journal %s: %w", path, err)
+	}
+	if t.Version == 1 {
+		t.Temps = nil
+		for _, f := range t.Files {
+			t.Temps = append(t.Temps, f+tempSuffix)
+		}
+	}
+	if (t.Version != 1 && t.Version != txnVersion) || len(t.Files) == 0 || len(t.Temps) != len(t.Files) || (t.State != txnPrepare && t.State != txnCommit) {
+		return nil, fmt.Errorf("journal %s is invalid", path)
+	}
+	// never rename or remove anything but the files' temporary files
+	for i, temp := range t.Temps {
+		if !isTempFor(temp, t.Files[i]) {
+			return nil, fmt.Errorf("journal %s is invalid: %s is not a temporary file of %s", path, temp, t.Files[i])
+		}
+	}
+	return t, nil
+}
+
+func (t *txn) save() error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data)
+}
+
+// commit is the commit point of the transaction.  All of the temporary files
+// must be durable.  Once the commit state is recorded, the transaction can
+// only be rolled forward.
+func (t *txn) commit() error {
+	t.State = txnCommit
+	if err := t.save(); err != nil {
+		return fmt.Errorf("can't write journal: %w", err)
+	}
+	return t.rollForward()
+}
+
+// rollForward renames each temporary file into place.  A missing temporary
+// file was already renamed before an interruption.
+func (t *txn) rollForward() error {
+	for i, path := range t.Files {
+		err := renameTemp(t.Temps[i], path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return t.remove()
+}
+
+// rollback removes the transaction's temporary files, leaving the files as
+// they were.
+func (t *txn) rollback() error {
+	for _, temp := range t.Temps {
+		err := os.Remove(temp)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return t.remove()
+}
+
+func (t *txn) remove() error {
+	if err := os.Remove(t.path); err != nil {
+		return err
+	}
+	return syncDir(t.path)
+}
+
+// replaceBlobAndKEK writes a new blob with writeBlob and replaces outFile
+// and outKEK with the new blob and newKEK.  If outFile is a file, the
+// replacement is a [txn] (see [replaceFiles]).  If outFile is stdout, the new
+// KEK is written (atomically) first, so that no blob is output under a KEK
+// that wasn't saved; outKEK must then not be inKEK, the input's KEK file
+// (which is empty if there is none), as a failure to write the blob would
+// lose the input's only KEK.
+func replaceBlobAndKEK(op, outFile, inKEK, outKEK string, newKEK []byte, writeBlob func(f *os.File) error) {
+	if outFile == "-" {
+		if inKEK != "" && sameFile(inKEK, outKEK) {
+			fatalf("%s: -outkek must not be the -inkek file when the output is stdout", op)
+		}
+		writeKEK(outKEK, newKEK)
+		out := createOutput(outFile)
+		if err := writeBlob(out.f); err != nil {
+			out.abort()
+			fatalf("%s failed: %v (the new KEK was written to %s)", op, err, outKEK)
+		}
+		out.commit()
+		return
+	}
+
+	if err := replaceFiles(op, outFile, outKEK, newKEK, writeBlob); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// replaceFiles writes a new blob with writeBlob and replaces the files
+// outFile and outKEK with the new blob and newKEK, as a [txn]: after a crash,
+// 'nestedaes recover' leaves either both old files or both new ones.  On
+// failure, the transaction is rolled back, unless it failed after the commit
+// point.
+func replaceFiles(op, outFile, outKEK string, newKEK []byte, writeBlob func(f *os.File) error) error {
+	f, err := createTemp(outFile)
+	if err != nil {
+		return fmt.Errorf("%s failed: can't create output file: %w", op, err)
+	}
+	out := &output{f: f, path: outFile, temp: f.Name()}
+	kf, err := createTemp(outKEK)
+	if err != nil {
+		out.abort()
+		return fmt.Errorf("%s failed: can't create KEK file: %w", op, err)
+	}
+
+	t, err := beginTxn(op, []string{outFile, outKEK}, []string{out.temp, kf.Name()})
+	if err != nil {
+		out.abort()
+		kf.Close()
+		os.Remove(kf.Name())
+		return fmt.Errorf("%s failed: %w", op, err)
+	}
+	fail := func(format string, a ...any) error {
+		out.f.Close()
+		kf.Close()
+		t.rollback()
+		return fmt.Errorf(format, a...)
+	}
+
+	if err := writeBlob(out.f); err != nil {
+		return fail("%s failed: %w", op, err)
+	}
+	if err := out.finish(); err != nil {
+		return fail("%s failed: can't write output file: %w", op, err)
+	}
+	if err := writeAndClose(kf, newKEK); err != nil {
+		return fail("%s failed: can't write KEK file: %w", op, err)
+	}
+
+	if err := t.commit(); err != nil {
+		return fmt.Errorf("%s failed after the commit point: %w; run 'nestedaes recover %s' to finish it", op, err, outFile)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// prepareTxn creates a blob and its KEK file with old contents, and an
+// operation that replaces them with new contents, interrupted before its
+// commit point.
+func prepareTxn(t *testing.T) *txn {
+	t.Helper()
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "foo.enc"), filepath.Join(dir, "kek.key")}
+	var temps []string
+	for _, path := range files {
+		if err := os.WriteFile(path, []byte("old "+filepath.Base(path)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := createTemp(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeAndClose(f, []byte("new "+filepath.Base(path))); err != nil {
+			t.Fatal(err)
+		}
+		temps = append(temps, f.Name())
+	}
+	tx, err := beginTxn("reencrypt", files, temps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// checkFiles checks that the transaction's files have the old or new
+// contents, and that neither its journal nor any temporary file is left.
+func checkFiles(t *testing.T, tx *txn, want string) {
+	t.Helper()
+	for _, path := range tx.Files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want+" "+filepath.Base(path) {
+			t.Fatalf("%s has the contents %q, expected the %s ones", filepath.Base(path), data, want)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(tx.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(tx.Files) {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("expected only the files to be left, found %s", strings.Join(names, ", "))
+	}
+}
+
+func TestRecover(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// crash brings the prepared transaction to the point of the crash
+		crash func(t *testing.T, tx *txn)
+		want  string
+	}{
+		{
+			name:  "before the commit point",
+			crash: func(t *testing.T, tx *txn) {},
+			want:  "old",
+		},
+		{
+			name: "at the commit point",
+			crash: func(t *testing.T, tx *txn) {
+				tx.State = txnCommit
+				if err := tx.save(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "new",
+		},
+		{
+			name: "after the blob was replaced",
+			crash: func(t *testing.T, tx *txn) {
+				tx.State = txnCommit
+				if err := tx.save(); err != nil {
+					t.Fatal(err)
+				}
+				if err := renameTemp(tx.Temps[0], tx.Files[0]); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "new",
+		},
+		{
+			name: "after both files were replaced",
+			crash: func(t *testing.T, tx *txn) {
+				tx.State = txnCommit
+				if err := tx.save(); err != nil {
+					t.Fatal(err)
+				}
+				for i := range tx.Files {
+					if err := renameTemp(tx.Temps[i], tx.Files[i]); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			want: "new",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := prepareTxn(t)
+			tc.crash(t, tx)
+
+			// an operation on the same file must wait for the recovery
+			if _, err := beginTxn("compact", tx.Files, tx.Temps); err == nil {
+				t.Fatal("beginTxn succeeded with an interrupted operation's journal in place")
+			}
+
+			if _, err := recoverFile(tx.Files[0]); err != nil {
+				t.Fatalf("recoverFile failed: %v", err)
+			}
+			checkFiles(t, tx, tc.want)
+
+			msg, err := recoverFile(tx.Files[0])
+			if err != nil || msg != "nothing to recover" {
+				t.Fatalf("recovering again gave %q, %v", msg, err)
+			}
+		})
+	}
+}
+
+func TestRecoverV1(t *testing.T) {
+	for _, state := range []string{txnPrepare, txnCommit} {
+		t.Run(state, func(t *testing.T) {
+			tx := prepareTxn(t)
+			// the version 1 format had fixed temporary file names
+			for i, path := range tx.Files {
+				if err := os.Rename(tx.Temps[i], path+tempSuffix); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := json.Marshal(map[string]any{"version": 1, "op": "reencrypt", "state": state, "files": tx.Files})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(tx.path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := recoverFile(tx.Files[0]); err != nil {
+				t.Fatalf("recoverFile failed: %v", err)
+			}
+			want := "old"
+			if state == txnCommit {
+				want = "new"
+			}
+			checkFiles(t, tx, want)
+		})
+	}
+}
+
+func TestRecoverInvalidJournal(t *testing.T) {
+	tx := prepareTxn(t)
+	other := filepath.Join(filepath.Dir(tx.path), "other")
+	if err := os.WriteFile(other, []byte("other"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// a journal must not make recovery remove or rename other files
+	tx.Temps[1] = other
+	if err := tx.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := recoverFile(tx.Files[0]); err == nil {
+		t.Fatal("recoverFile accepted a journal that names another file")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("recoverFile removed another file: %v", err)
+	}
+}
+
+func TestRecoverLeftoverTemps(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.enc")
+	for _, name := range []string{"foo.enc", "foo.enc" + tempSuffix, "foo.enc" + tempSuffix + "-123", "bar.enc" + tempSuffix + "-456"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := recoverFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "removed 2 leftover temporary file(s)" {
+		t.Fatalf("unexpected result %q", msg)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected foo.enc and bar.enc's temporary file to be left, found %d files", len(entries))
+	}
+}
+
+func TestReplaceFiles(t *testing.T) {
+	tx := prepareTxn(t)
+	if _, err := recoverFile(tx.Files[0]); err != nil {
+		t.Fatal(err)
+	}
+	blob, kek := tx.Files[0], tx.Files[1]
+
+	// a failure to write the blob rolls the operation back
+	errWrite := errors.New("write failed")
+	err := replaceFiles("reencrypt", blob, kek, []byte("new kek.key"), func(f *os.File) error {
+		f.Write([]byte("partial"))
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	checkFiles(t, tx, "old")
+
+	err = replaceFiles("reencrypt", blob, kek, []byte("new kek.key"), func(f *os.File) error {
+		_, err := f.Write([]byte("new foo.enc"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("replaceFiles failed: %v", err)
+	}
+	checkFiles(t, tx, "new")
+}
@@ -0,0 +1,34 @@
+package main
+
+const keygenUsage = `Usage: nestedaes keygen [options]
+
+Generate a random key-encrypting key (KEK) and write it to a file.
+
+options:
+  -out OUT_FILE
+    The file to write the KEK to.
+
+    Default: kek.key
+
+  -h|-help
+    Display this usage statement and exit.
+
+example:
+  $ nestedaes keygen -out kek.key
+`
+
+func keygenMain(args []string) {
+	var outFile string
+
+	fs := newFlagSet("keygen", keygenUsage)
+	fs.StringVar(&outFile, "out", "kek.key", "")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fatalf("keygen: expected no positional arguments but got %d", fs.NArg())
+	}
+
+	kek := newKEK()
+	defer freeKey(kek)
+	writeKEK(outFile, kek)
+}
@@ -5,57 +5,71 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/etclab/aes256"
 	"github.com/etclab/mu"
 	"github.com/etclab/nestedaes"
 )
 
-const usage = `Usage: nestedaes [options] FILE
+const usage = `Usage: nestedaes COMMAND [options] [FILE...]
 
-Encrypt/decrypt a file using nested AES.
+Encrypt, re-encrypt, and decrypt files using nested AES.
 
-positional arguments:
-  FILE
-    The file to encrypt, re-encrypt, or decrypt
-    
-options:
-  -op OPERATION
-    OPERATION must either "encrypt", "reencrypt" or "decrypt"
+commands:
+  encrypt     Encrypt a file under a new KEK
+  reencrypt   Add a layer of encryption under a new KEK
+  decrypt     Decrypt a file
+  keygen      Generate a random KEK
+  inspect     Print the structure of an encrypted file
+  verify      Check that an encrypted file decrypts, without writing plaintext
+  rotate-kek  Re-wrap the header under a new KEK, without adding a layer
+  compact     Replace all layers with a single fresh layer
+  recover     Finish or roll back an interrupted operation
+  bench       Measure the library's operations and report the results
+  serve       Serve a blob store over HTTP, and apply re-encryption tokens
+  shred       Destroy the KEK of an encrypted file
+  audit       Verify an audit log, and print its events
+  rotate-daemon
+              Rotate and compact the blobs of a store by policy
 
-    Default: encrypt
+Run 'nestedaes COMMAND -h' for the options of a command.
 
-  -out OUT_FILE      
-    The output file for the operation.  If not given, then the modifications
-    are done on the input FILE
+For backward compatibility, nestedaes also accepts the form:
 
-  -inkek INPUT_KEK_FILE
-    The key-encrypting key file.
-      Must be specified for -reencrypt and -decrypt.
-      Must not be specified for -encrypt.
+  nestedaes [-op encrypt|reencrypt|decrypt] [-out OUT_FILE]
+            [-inkek INPUT_KEK_FILE] [-outkek OUTPUT_KEK_FILE] [-mlock] FILE
 
-    Default: kek.key
-
-  -outkek OUTPUT_KEK_FILE
-    The output key-encrypting key file.  The new KEK is written to this file.
-    If this is the same as -in-kek, the file is overwritten.
-      Must be specified for -encrypt and -reencrypt.
-      Must not be specified for -decrypt.
-
-    Default: kek.key
-
-  -h|-help
-    Display this usage statement and exit.
+which is equivalent to 'nestedaes OPERATION [options] FILE'.  The default
+OPERATION is encrypt.
 
 examples:
-  $ nestedaes -op encrypt -outkek kek.key -out foo.enc foo.txt
-  $ nestedaes -op reencrypt -inkek kek.key -outkek kek2.key -out foo.renc foo.enc
-  $ nestedaes -op decrypt -inkek kek2.key -out foo.txt foo.renc
+  $ nestedaes encrypt -outkek kek.key -out foo.enc foo.txt
+  $ nestedaes reencrypt -inkek kek.key -outkek kek2.key -out foo.renc foo.enc
+  $ nestedaes decrypt -inkek kek2.key -out foo.txt foo.renc
 `
 
 func printUsage() {
 	fmt.Fprintf(os.Stderr, "%s", usage)
 }
 
+// commands maps each subcommand name to its entry point.  Each entry point
+// takes the arguments that follow the subcommand name.
+var commands = map[string]func(args []string){
+	"encrypt":       encryptMain,
+	"reencrypt":     reencryptMain,
+	"decrypt":       decryptMain,
+	"keygen":        keygenMain,
+	"inspect":       inspectMain,
+	"verify":        verifyMain,
+	"rotate-kek":    rotateKEKMain,
+	"compact":       compactMain,
+	"recover":       recoverMain,
+	"bench":         benchMain,
+	"serve":         serveMain,
+	"shred":         shredMain,
+	"audit":         auditMain,
+	"rotate-daemon": rotateDaemonMain,
+}
+
+// Options are the options of the legacy, -op form of the command line.
 type Options struct {
 	// positional
 	inFile string
@@ -64,6 +78,7 @@ type Options struct {
 	outFile string
 	inKEK   string
 	outKEK  string
+	mlock   bool
 }
 
 func parseOptions() *Options {
@@ -74,16 +89,17 @@ func parseOptions() *Options {
 	flag.StringVar(&opts.outFile, "out", "", "")
 	flag.StringVar(&opts.inKEK, "inkek", "kek.key", "")
 	flag.StringVar(&opts.outKEK, "outkek", "kek.key", "")
+	flag.BoolVar(&opts.mlock, "mlock", false, "")
 
 	flag.Parse()
 
 	if flag.NArg() != 1 {
-		mu.Fatalf("expected one positional argument but got %d", flag.NArg())
+		fatalf("expected one positional argument but got %d", flag.NArg())
 	}
 	opts.inFile = flag.Arg(0)
 
 	if opts.op != "encrypt" && opts.op != "reencrypt" && opts.op != "decrypt" {
-		mu.Fatalf("invalid value for -op; must be \"encrypt\", \"reencrypt\", or \"decrypt\"")
+		fatalf("invalid value for -op; must be \"encrypt\", \"reencrypt\", or \"decrypt\"")
 	}
 
 	if opts.outFile == "" {
@@ -93,90 +109,39 @@ func parseOptions() *Options {
 	return &opts
 }
 
-func doEncrypt(inFile, outFile, outKEK string) {
-	plaintext, err := os.ReadFile(inFile)
-	if err != nil {
-		mu.Fatalf("encrypt failed: can't read input file: %v", err)
-	}
-
-	kek := aes256.NewRandomKey()
-	iv := aes256.NewRandomIV()
-	blob, err := nestedaes.Encrypt(plaintext, kek, iv, nil)
-	if err != nil {
-		mu.Fatalf("encrypt failed: %v", err)
-	}
-
-	err = os.WriteFile(outFile, blob, 0660)
-	if err != nil {
-		mu.Fatalf("encrypt failed: can't write output file: %v", err)
-	}
-
-	err = os.WriteFile(outKEK, kek[:], 0660)
-	if err != nil {
-		mu.Fatalf("encrypt failed: can't write KEK file: %v", err)
-	}
-}
-
-func doReencrypt(inFile, outFile, inKEK, outKEK string) {
-	blob, err := os.ReadFile(inFile)
-	if err != nil {
-		mu.Fatalf("can't read input file: %v", err)
-	}
-
-	kek, err := os.ReadFile(inKEK)
-	if err != nil {
-		mu.Fatalf("can't read input KEK file: %v", err)
-	}
-
-	newBlob, newKEK, err := nestedaes.Reencrypt(blob, kek)
-	if err != nil {
-		mu.Fatalf("reencrypt failed: %v", err)
-	}
-
-	err = os.WriteFile(outFile, newBlob, 0660)
-	if err != nil {
-		mu.Fatalf("can't write output file: %v", err)
-	}
-
-	err = os.WriteFile(outKEK, newKEK[:], 0660)
-	if err != nil {
-		mu.Fatalf("can't write KEK file: %v", err)
-	}
-}
-
-func doDecrypt(inFile, outFile, inKEK string) {
-	blob, err := os.ReadFile(inFile)
-	if err != nil {
-		mu.Fatalf("can't read input file: %v", err)
-	}
-
-	kek, err := os.ReadFile(inKEK)
-	if err != nil {
-		mu.Fatalf("can't read input KEK file: %v", err)
-	}
-
-	plaintext, err := nestedaes.Decrypt(blob, kek, nil)
-	if err != nil {
-		mu.Fatalf("decrypt failed: %v", err)
-	}
-
-	err = os.WriteFile(outFile, plaintext, 0660)
-	if err != nil {
-		mu.Fatalf("can't write output file: %v", err)
-	}
-}
-
-func main() {
+func legacyMain() {
 	opts := parseOptions()
+	enableMlock(opts.mlock)
 
 	switch opts.op {
 	case "encrypt":
-		doEncrypt(opts.inFile, opts.outFile, opts.outKEK)
+		doEncrypt(opts.inFile, opts.outFile, opts.outKEK, nil, nil, nil)
 	case "reencrypt":
-		doReencrypt(opts.inFile, opts.outFile, opts.inKEK, opts.outKEK)
+		doReencrypt(opts.inFile, opts.outFile, opts.inKEK, opts.outKEK, nil)
 	case "decrypt":
-		doDecrypt(opts.inFile, opts.outFile, opts.inKEK)
+		doDecrypt(opts.inFile, opts.outFile, opts.inKEK, nil)
 	default:
 		mu.BUG("invalid value for op: %s", opts.op)
 	}
 }
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+	legacyMain()
+}
+
+// enableMlock turns on the secure key allocator if the -mlock option was
+// given.
+func enableMlock(mlock bool) {
+	if !mlock {
+		return
+	}
+	if err := nestedaes.EnableSecureMemory(true); err != nil {
+		fatalf("can't enable -mlock: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// mainEnv, when set in the environment, makes the test binary run the
+// command instead of the tests, so that the tests can check its exit status.
+const mainEnv = "NESTEDAES_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args in dir, and returns its combined output and
+// exit status.
+func run(t *testing.T, dir string, args ...string) (string, int) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// mustRun is like run, but fails the test unless the command succeeds.
+func mustRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, status := run(t, dir, args...)
+	if status != 0 {
+		t.Fatalf("nestedaes %v exited with status %d:\n%s", args, status, out)
+	}
+	return out
+}
+
+// writeFiles creates files in dir, with the given contents by name.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"foo.txt": "hello"})
+
+	mustRun(t, dir, "keygen", "-out", "k0.key")
+	if data, err := os.ReadFile(filepath.Join(dir, "k0.key")); err != nil || len(data) != 32 {
+		t.Fatalf("keygen wrote a %d-byte key (%v)", len(data), err)
+	}
+
+	mustRun(t, dir, "encrypt", "-outkek", "k1.key", "-out", "foo.enc", "foo.txt")
+	mustRun(t, dir, "reencrypt", "-inkek", "k1.key", "-outkek", "k2.key", "foo.enc")
+	mustRun(t, dir, "rotate-kek", "-inkek", "k2.key", "-outkek", "k3.key", "foo.enc")
+	mustRun(t, dir, "compact", "-inkek", "k3.key", "-outkek", "k4.key", "foo.enc")
+	if out := mustRun(t, dir, "decrypt", "-inkek", "k4.key", "-out", "-", "foo.enc"); out != "hello" {
+		t.Fatalf("decrypt output %q", out)
+	}
+
+	// the legacy -op form
+	mustRun(t, dir, "-op", "encrypt", "-outkek", "k5.key", "-out", "bar.enc", "foo.txt")
+	mustRun(t, dir, "-op", "reencrypt", "-inkek", "k5.key", "-outkek", "k6.key", "bar.enc")
+	mustRun(t, dir, "-op", "decrypt", "-inkek", "k6.key", "-out", "bar.txt", "bar.enc")
+	if data, err := os.ReadFile(filepath.Join(dir, "bar.txt")); err != nil || string(data) != "hello" {
+		t.Fatalf("the legacy form decrypted to %q (%v)", data, err)
+	}
+	if _, status := run(t, dir, "-op", "shred", "bar.enc"); status != 1 {
+		t.Fatalf("expected exit status 1 for an invalid -op, got %d", status)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const recoverUsage = `Usage: nestedaes recover FILE [FILE...]
+
+Finish or roll back an interrupted operation on an encrypted file.
+
+The encrypt, reencrypt, rotate-kek, and compact commands replace both a file
+and its KEK file.  They write the new file and the new KEK to temporary files
+(named FILE.nestedaes-new-RANDOM, for each file), and record the operation,
+with the names of its temporary files, in a journal (named
+FILE.nestedaes-journal).  Only once both new files are durable is the
+operation committed and the files renamed into place; the old KEK is kept
+until then.  If the operation is interrupted (for instance, by a crash), the
+journal remains, and further operations on FILE are refused until recover
+is run:
+
+  - If the operation was committed, recover finishes it: both FILE and its
+    KEK file are replaced with the new versions.
+  - Otherwise, recover rolls it back: the operation's temporary files are
+    removed, and FILE and its KEK file are left as they were.
+
+Without a journal, recover removes the leftover temporary files for FILE
+(for instance, from an interrupted decrypt), which never hold committed
+data.
+
+Do not run recover while another nestedaes command is operating on FILE.
+
+positional arguments:
+  FILE
+    The file that was being written (the operation's output file), or its
+    journal
+
+options:
+  -h|-help
+    Display this usage statement and exit.
+
+example:
+  $ nestedaes recover foo.enc
+`
+
+func recoverMain(args []string) {
+	fs := newFlagSet("recover", recoverUsage)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fatalf("recover: expected at least one positional argument")
+	}
+
+	var failed bool
+	for _, path := range fs.Args() {
+		path = strings.TrimSuffix(path, journalSuffix)
+		msg, err := recoverFile(path)
+		if err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "%s: recover failed: %v\n", path, err)
+			continue
+		}
+		fmt.Printf("%s: %s\n", path, msg)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// recoverFile recovers the interrupted operation, if any, on path, and
+// describes what it did.
+func recoverFile(path string) (string, error) {
+	t, err := loadTxn(journalPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		n, err := removeTemps(path)
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return "nothing to recover", nil
+		}
+		return fmt.Sprintf("removed %d leftover temporary file(s)", n), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if t.State == txnCommit {
+		if err := t.rollForward(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("finished interrupted %s (replaced %s)", t.Op, strings.Join(t.Files, ", ")), nil
+	}
+
+	if err := t.rollback(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("rolled back interrupted %s", t.Op), nil
+}
+
+// removeTemps removes the temporary files for path, and returns how many it
+// removed.
+func removeTemps(path string) (int, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		temp := filepath.Join(filepath.Dir(path), e.Name())
+		if !e.Type().IsRegular() || !isTempFor(temp, path) {
+			continue
+		}
+		if err := os.Remove(temp); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
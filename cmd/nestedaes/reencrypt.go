@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+const reencryptUsage = `Usage: nestedaes reencrypt [options] FILE
+       nestedaes reencrypt -r DIR [batch options]
+
+Add a layer of encryption to an encrypted file under a newly generated
+key-encrypting key (KEK).
+
+With -r, every file in the directory tree DIR is re-encrypted in place, each
+under its own new KEK, by a pool of workers (see "batch options").
+
+positional arguments:
+  FILE
+    The file to re-encrypt, or "-" for stdin
+
+options:
+  -out OUT_FILE
+    The output file, or "-" for stdout.  If not given, then FILE is
+    re-encrypted in place (or, if FILE is "-", the output is written to
+    stdout).
+
+  -inkek INPUT_KEK_FILE
+    The file containing FILE's current KEK.
+
+    Default: kek.key
+
+  -outkek OUTPUT_KEK_FILE
+    The file to write the new KEK to.  If this is the same as -inkek, the file
+    is overwritten.  If the output is stdout, the new KEK is written before
+    the blob, and -outkek must differ from -inkek.
+
+    Default: kek.key
+
+` + auditOptionsUsage + `
+
+  -mlock
+    Keep keys in locked memory (see 'nestedaes encrypt -h').
+
+  -h|-help
+    Display this usage statement and exit.
+
+batch options:
+  -r DIR
+    Re-encrypt the files under DIR.  Each file's KEK is read from, and its
+    new KEK written to, its KEK file (see -keksuffix).  As with a single
+    file, each file and its KEK file are replaced together (see 'nestedaes
+    recover -h').  KEK files, and the temporary files and journals of
+    interrupted operations, are never re-encrypted.  With -audit, each file
+    that is re-encrypted is recorded in the audit log.
+
+  -keksuffix SUFFIX
+    The suffix that names a file's KEK file (for instance, foo.enc.key for
+    foo.enc).
+
+    Default: .key
+
+  -inkek INPUT_KEK_FILE
+    If given, the current KEK of every file is read from INPUT_KEK_FILE
+    instead of from the files' KEK files.  The new KEKs are still written to
+    the KEK files.
+
+  -include GLOB
+    Only re-encrypt files that match GLOB.  A GLOB without a "/" is matched
+    against the file's base name; otherwise, it is matched against the path
+    relative to DIR.
+
+    Default: *
+
+  -exclude GLOB
+    Skip files that match GLOB (as for -include).
+
+  -j N
+    The number of files to re-encrypt concurrently.
+
+    Default: the number of CPUs
+
+  -manifest MANIFEST_FILE
+    The file to record each file's outcome in: a line of JSON per file with
+    the file, its status ("ok" or "failed"), and, on success, its KEK file
+    and the fingerprint of its new KEK (the KEK itself is never recorded).
+    The manifest must not exist, unless -resume is given.
+
+    Default: reencrypt-manifest.jsonl
+
+  -resume
+    Continue an interrupted batch: files that the manifest records as "ok"
+    are skipped, interrupted operations are recovered (see 'nestedaes recover
+    -h'), and the rest (including those that failed) are re-encrypted.  New
+    entries are appended to the manifest.
+
+  -n
+    Dry run: list the files that would be re-encrypted, and check that each
+    one's header authenticates under its KEK, without changing anything.
+
+  -q
+    Only print the files that fail, and the summary.
+
+batch exit status:
+  0  Every file was re-encrypted
+  1  A usage or I/O error prevented the batch (for instance, the manifest
+     exists)
+  3  At least one file failed to re-encrypt
+
+examples:
+  $ nestedaes reencrypt -inkek kek.key -outkek kek2.key -out foo.renc foo.enc
+  $ nestedaes reencrypt -r archive -include '*.enc' -j 8 -n
+  $ nestedaes reencrypt -r archive -include '*.enc' -j 8
+  $ nestedaes reencrypt -r archive -include '*.enc' -j 8 -resume
+`
+
+func reencryptMain(args []string) {
+	var outFile, inKEK, outKEK string
+	var mlock bool
+	var batch batchOptions
+	var auditOpts auditOptions
+
+	fs := newFlagSet("reencrypt", reencryptUsage)
+	fs.StringVar(&outFile, "out", "", "")
+	fs.StringVar(&inKEK, "inkek", "kek.key", "")
+	fs.StringVar(&outKEK, "outkek", "kek.key", "")
+	fs.BoolVar(&mlock, "mlock", false, "")
+	auditOpts.register(fs)
+	fs.StringVar(&batch.dir, "r", "", "")
+	fs.StringVar(&batch.kekSuffix, "keksuffix", ".key", "")
+	fs.StringVar(&batch.include, "include", "*", "")
+	fs.StringVar(&batch.exclude, "exclude", "", "")
+	fs.IntVar(&batch.workers, "j", runtime.NumCPU(), "")
+	fs.StringVar(&batch.manifest, "manifest", "reencrypt-manifest.jsonl", "")
+	fs.BoolVar(&batch.resume, "resume", false, "")
+	fs.BoolVar(&batch.dryRun, "n", false, "")
+	fs.BoolVar(&batch.quiet, "q", false, "")
+
+	fs.Parse(args)
+	if batch.dir != "" {
+		if fs.NArg() != 0 {
+			fatalf("reencrypt: -r takes no positional arguments, but got %d", fs.NArg())
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "out", "outkek":
+				fatalf("reencrypt: -%s can't be used with -r", f.Name)
+			case "inkek":
+				batch.sharedKEK = inKEK
+			}
+		})
+		if batch.sharedKEK != "" {
+			checkKEKPath("-inkek", batch.sharedKEK)
+		}
+		if batch.kekSuffix == "" {
+			fatalf("reencrypt: -keksuffix must not be empty")
+		}
+		if !batch.dryRun {
+			batch.audit = auditOpts.open()
+		}
+		enableMlock(mlock)
+		batchReencrypt(&batch)
+		return
+	}
+
+	if fs.NArg() != 1 {
+		fatalf("reencrypt: expected one positional argument but got %d", fs.NArg())
+	}
+	inFile := fs.Arg(0)
+
+	if outFile == "" {
+		outFile = inFile
+	}
+	checkKEKPath("-inkek", inKEK)
+	checkKEKPath("-outkek", outKEK)
+
+	log := auditOpts.open()
+	enableMlock(mlock)
+	doReencrypt(inFile, outFile, inKEK, outKEK, log)
+}
+
+// doReencrypt re-encrypts inFile to outFile, and records the re-encryption
+// in log, if it is not nil.
+func doReencrypt(inFile, outFile, inKEK, outKEK string, log *audit.Log) {
+	in := openInput(inFile)
+	defer in.Close()
+
+	kek := readKEK(inKEK)
+	defer freeKey(kek)
+	nextKEK := newKEK()
+	defer freeKey(nextKEK)
+	newDEK := newKEK()
+	defer freeKey(newDEK)
+
+	replaceBlobAndKEK("reencrypt", outFile, inKEK, outKEK, nextKEK, func(f *os.File) error {
+		_, err := nestedaes.ReencryptStream(f, in, kek, nextKEK, newDEK)
+		return err
+	})
+	recordFile(log, audit.KindReEncrypt, outFile, nestedaes.Fingerprint(kek), nestedaes.Fingerprint(nextKEK))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/etclab/nestedaes/blobstore"
+	"github.com/etclab/nestedaes/httpstore"
+)
+
+const rotateDaemonUsage = `Usage: nestedaes rotate-daemon [options] STORE
+
+Apply rotation policies to the blobs of a store: rotate the blobs that have
+gone too long without a rotation, and compact the blobs that have too many
+layers, within a limit on the bytes re-encrypted per hour.  The time of each
+blob's last rotation is recorded in its header's authenticated metadata, so
+the daemon keeps no state besides the blobs' KEKs and the rate limit's state
+file; a blob that records no rotation is due at once.  Rotations only send the blobs' headers, and the
+tokens derived from them, to the store; compactions read and replace the
+whole blob.
+
+The daemon runs the policies right away, and then every -interval, until it
+is interrupted.  With -once, it runs them once and exits, for cron.
+
+positional arguments:
+  STORE
+    The blob store: a directory, or the URL of a server run with 'nestedaes
+    serve', such as https://storage.example.com.
+
+options:
+  -keks DIR
+    The directory of the blobs' KEKs: the KEK of the blob NAME is the key
+    file DIR/NAME (as written by 'nestedaes keygen').  Required.
+
+  -policy POLICY_FILE
+    The policy file, in JSON.  Each policy applies to the blobs whose names
+    start with its prefix (the longest matching prefix wins); max_age is a
+    duration, such as "36h" or "90d", and max_layers the most layers a blob
+    may have before it is compacted.  Blobs that no policy selects are left
+    alone.  max_bytes_per_hour, if given, limits the rate of re-encryption;
+    the blobs over the limit are left to a later run.  Required.  For
+    example:
+
+      {
+        "max_bytes_per_hour": 10737418240,
+        "policies": [
+          {"prefix": "", "max_age": "90d", "max_layers": 32},
+          {"prefix": "hot/", "max_age": "7d"}
+        ]
+      }
+
+  -interval DURATION
+    How often the policies are run.
+
+    Default: 1h
+
+  -once
+    Run the policies once, print the outcome, and exit.  If some blobs
+    failed, the exit status is 3.  The rate limit holds across runs, through
+    the -state file.
+
+  -state STATE_FILE
+    The file that records the bytes re-encrypted in the last hour, so that
+    max_bytes_per_hour holds across runs and restarts.  Runs that share a
+    KEK directory must not overlap.
+
+    Default: KEK_DIR/.rate-limit
+
+  -workers N
+    The number of blobs rotated or compacted concurrently.
+
+    Default: 1
+
+` + aadUsage + `
+
+    The AAD is needed to compact a blob; with -aad-from-filename, it is the
+    base name of the blob's name.
+
+  -signing-key KEY_FILE
+    For a STORE that is a URL, sign the tokens, and the headers and
+    compacted blobs uploaded, with the Ed25519 private key whose 32-byte
+    seed is in KEY_FILE, for a server run with -trust.  The public key to
+    trust is logged at startup.
+
+` + auditOptionsUsage + `
+
+  -h|-help
+    Display this usage statement and exit.
+
+examples:
+  $ nestedaes rotate-daemon -keks keks -policy policy.json /srv/blobs
+  $ nestedaes rotate-daemon -once -keks keks -policy policy.json https://storage.example.com
+`
+
+func rotateDaemonMain(args []string) {
+	var kekDir, policyFile, stateFile, signingKey string
+	var interval time.Duration
+	var once bool
+	var workers int
+	var aadOpts aadOptions
+	var auditOpts auditOptions
+
+	fs := newFlagSet("rotate-daemon", rotateDaemonUsage)
+	fs.StringVar(&kekDir, "keks", "", "")
+	fs.StringVar(&policyFile, "policy", "", "")
+	fs.DurationVar(&interval, "interval", time.Hour, "")
+	fs.BoolVar(&once, "once", false, "")
+	fs.StringVar(&stateFile, "state", "", "")
+	fs.IntVar(&workers, "workers", 1, "")
+	aadOpts.register(fs)
+	fs.StringVar(&signingKey, "signing-key", "", "")
+	auditOpts.register(fs)
+	storeArg := parseOneFile(fs, args)
+
+	if kekDir == "" || policyFile == "" {
+		fatalf("rotate-daemon: -keks and -policy are required")
+	}
+	if stateFile == "" {
+		stateFile = filepath.Join(kekDir, ".rate-limit")
+	}
+	if interval <= 0 {
+		fatalf("rotate-daemon: -interval must be positive")
+	}
+	if workers < 1 {
+		fatalf("rotate-daemon: -workers must be positive")
+	}
+	aadOpts.check()
+	remote := strings.HasPrefix(storeArg, "http://") || strings.HasPrefix(storeArg, "https://")
+	if signingKey != "" && !remote {
+		fatalf("rotate-daemon: -signing-key only applies to a STORE that is a URL")
+	}
+	if !remote && filepath.Clean(kekDir) == filepath.Clean(storeArg) {
+		fatalf("rotate-daemon: the KEK directory must not be the store's directory")
+	}
+
+	schedule, err := blobstore.ReadSchedule(policyFile)
+	if err != nil {
+		fatalf("can't read policy file: %v", err)
+	}
+	if len(schedule.Policies) == 0 {
+		fatalf("rotate-daemon: the policy file has no policies")
+	}
+
+	log := auditOpts.open()
+	keks, err := blobstore.OpenDirKEKs(kekDir)
+	if err != nil {
+		fatalf("can't open KEK directory: %v", err)
+	}
+	keks.Audit = log
+
+	var store blobstore.BlobStore
+	if remote {
+		c, err := httpstore.NewClient(storeArg)
+		if err != nil {
+			fatalf("rotate-daemon: %v", err)
+		}
+		if signingKey != "" {
+			c.Signer = readSigningKey(signingKey)
+			slog.Info("signing tokens and uploads", "public_key", base64.StdEncoding.EncodeToString(c.Signer.Public().(ed25519.PublicKey)))
+		}
+		store = c
+	} else {
+		d, err := blobstore.OpenDir(storeArg)
+		if err != nil {
+			fatalf("can't open blob store: %v", err)
+		}
+		d.Audit = log
+		store = d
+	}
+
+	sched := &blobstore.Scheduler{
+		Store:           store,
+		KEKs:            keks,
+		Policies:        schedule.Policies,
+		MaxBytesPerHour: schedule.MaxBytesPerHour,
+		StateFile:       stateFile,
+		Workers:         workers,
+		AdditionalData:  additionalDataFunc(&aadOpts),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !once {
+		sched.OnResult = func(res blobstore.ScheduleResult) {
+			if res.Err != nil {
+				slog.Error("rotate-daemon: failed", "blob", res.Name, "action", res.Action, "err", res.Err)
+				return
+			}
+			slog.Info("rotate-daemon: done", "blob", res.Name, "action", res.Action, "bytes", res.Size)
+		}
+		slog.Info("rotate-daemon started", "store", storeArg, "policies", len(schedule.Policies), "interval", interval)
+		sched.Run(ctx, interval)
+		return
+	}
+
+	sched.OnResult = func(res blobstore.ScheduleResult) {
+		if res.Err != nil {
+			fmt.Printf("%s: FAIL: %v\n", res.Name, res.Err)
+			return
+		}
+		fmt.Printf("%s: %s OK\n", res.Name, res.Action)
+	}
+	report, err := sched.RunOnce(ctx)
+	if err != nil {
+		fatalf("rotate-daemon: %v", err)
+	}
+	fmt.Printf("%d rotated, %d compacted, %d up to date, %d deferred, %d FAILED, %d unmanaged (%d bytes)\n",
+		report.Rotated, report.Compacted, report.UpToDate, report.Deferred, len(report.Failed), report.Unmanaged, report.Bytes)
+	if len(report.Failed) > 0 {
+		os.Exit(exitBatchFailed)
+	}
+}
+
+// additionalDataFunc returns the function that gives the AAD of a blob for
+// the AAD options, or nil if none was given.  With -aad-from-filename, the
+// AAD is the base name of the blob's name.
+func additionalDataFunc(o *aadOptions) func(name string) []byte {
+	if o.fromFilename {
+		return func(name string) []byte { return []byte(path.Base(name)) }
+	}
+	aad := o.mustResolve("")
+	if aad == nil {
+		return nil
+	}
+	return func(string) []byte { return aad }
+}
+
+// readSigningKey reads an Ed25519 private key from file, which
+// holds its 32-byte seed.
+func readSigningKey(file string) ed25519.PrivateKey {
+	seed, err := os.ReadFile(file)
+	if err != nil {
+		fatalf("can't read signing key file: %v", err)
+	}
+	defer freeKey(holdKey(seed))
+	if len(seed) != ed25519.SeedSize {
+		fatalf("invalid signing key file %s: expected %d bytes, got %d", file, ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+const rotateKEKUsage = `Usage: nestedaes rotate-kek [options] FILE
+
+Re-wrap the header of an encrypted file under a newly generated
+key-encrypting key (KEK), without adding a layer of encryption to the
+payload.  This is fast, but, unlike reencrypt, does not change the data keys.
+
+positional arguments:
+  FILE
+    The encrypted file
+
+options:
+  -out OUT_FILE
+    The output file.  If not given, then FILE is modified in place.
+
+  -inkek INPUT_KEK_FILE
+    The file containing FILE's current KEK.
+
+    Default: kek.key
+
+  -outkek OUTPUT_KEK_FILE
+    The file to write the new KEK to.  If this is the same as -inkek, the file
+    is overwritten.
+
+    Default: kek.key
+
+` + auditOptionsUsage + `
+
+  -mlock
+    Keep keys in locked memory (see 'nestedaes encrypt -h').
+
+  -h|-help
+    Display this usage statement and exit.
+
+example:
+  $ nestedaes rotate-kek -inkek kek.key -outkek kek2.key foo.enc
+`
+
+func rotateKEKMain(args []string) {
+	var outFile, inKEK, outKEK string
+	var mlock bool
+	var auditOpts auditOptions
+
+	fs := newFlagSet("rotate-kek", rotateKEKUsage)
+	fs.StringVar(&outFile, "out", "", "")
+	fs.StringVar(&inKEK, "inkek", "kek.key", "")
+	fs.StringVar(&outKEK, "outkek", "kek.key", "")
+	fs.BoolVar(&mlock, "mlock", false, "")
+	auditOpts.register(fs)
+	inFile := parseOneFile(fs, args)
+
+	if outFile == "" {
+		outFile = inFile
+	}
+	checkKEKPath("-inkek", inKEK)
+	checkKEKPath("-outkek", outKEK)
+
+	log := auditOpts.open()
+	enableMlock(mlock)
+
+	blob, err := os.ReadFile(inFile)
+	if err != nil {
+		fatalf("can't read input file: %v", err)
+	}
+
+	kek := readKEK(inKEK)
+	defer freeKey(kek)
+	nextKEK := newKEK()
+	defer freeKey(nextKEK)
+
+	blob, err = nestedaes.RotateKEK(blob, kek, nextKEK)
+	if err != nil {
+		fatalf("rotate-kek failed: %v", err)
+	}
+
+	replaceBlobAndKEK("rotate-kek", outFile, inKEK, outKEK, nextKEK, func(f *os.File) error {
+		_, err := f.Write(blob)
+		return err
+	})
+	recordFile(log, audit.KindRotateKEK, outFile, nestedaes.Fingerprint(kek), nestedaes.Fingerprint(nextKEK))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/blobstore"
+	"github.com/etclab/nestedaes/httpstore"
+)
+
+const serveUsage = `Usage: nestedaes serve [options] DIR
+
+Run the storage side of the re-encryption protocol: serve the blobs stored
+in the directory DIR over HTTP, and apply the re-encryption tokens that the
+key owner sends.  The server never holds a KEK; tokens are sealed for the
+server's X25519 key, and the key owner fetches only the blobs' headers to
+derive them.  Clients use the httpstore package.
+
+positional arguments:
+  DIR
+    The directory of the blob store.  It is created if it doesn't exist.
+
+options:
+  -addr ADDR
+    The address to listen on.
+
+    Default: localhost:8080
+
+  -key KEY_FILE
+    The file containing the server's X25519 private key (32 raw bytes).  If
+    the file doesn't exist, a new key is generated and written to it.
+
+    Default: server.key
+
+  -trust TRUST_FILE
+    Only accept tokens and uploads of blobs and headers signed by a key in
+    TRUST_FILE, a trust store with one base64 Ed25519 public key per line,
+    optionally followed by a name.  If not given, the server accepts sealed
+    tokens and uploads from anyone who can reach it.
+
+  -lazy
+    Queue tokens, and apply their layers to the payloads when the blobs are
+    next read, or by a background flusher.  The queued tokens are kept
+    under DIR/.pending, sealed for the server's key, so that their DEKs are
+    not stored in the clear; keep KEY_FILE outside of DIR.
+
+  -flush-interval DURATION
+    With -lazy, how often the background flusher applies pending layers.
+
+    Default: 1m
+
+  -max-blob-size BYTES
+    The largest blob the server accepts.
+
+    Default: 1073741824
+
+` + auditOptionsUsage + `
+
+  -tls-cert CERT_FILE
+  -tls-key KEY_FILE
+    Serve HTTPS with this certificate and private key, rather than HTTP.
+
+  -h|-help
+    Display this usage statement and exit.
+
+example:
+  $ nestedaes serve -addr :8443 -trust owners.txt -tls-cert cert.pem -tls-key key.pem /srv/blobs
+`
+
+func serveMain(args []string) {
+	var addr, keyFile, trustFile, tlsCert, tlsKey string
+	var lazy bool
+	var flushInterval time.Duration
+	var maxBlobSize int64
+	var auditOpts auditOptions
+
+	fs := newFlagSet("serve", serveUsage)
+	fs.StringVar(&addr, "addr", "localhost:8080", "")
+	fs.StringVar(&keyFile, "key", "server.key", "")
+	fs.StringVar(&trustFile, "trust", "", "")
+	fs.BoolVar(&lazy, "lazy", false, "")
+	fs.DurationVar(&flushInterval, "flush-interval", time.Minute, "")
+	fs.Int64Var(&maxBlobSize, "max-blob-size", httpstore.DefaultMaxBlobSize, "")
+	fs.StringVar(&tlsCert, "tls-cert", "", "")
+	fs.StringVar(&tlsKey, "tls-key", "", "")
+	auditOpts.register(fs)
+	dir := parseOneFile(fs, args)
+
+	if (tlsCert == "") != (tlsKey == "") {
+		fatalf("serve: -tls-cert and -tls-key must be given together")
+	}
+	if maxBlobSize < 1 {
+		fatalf("serve: -max-blob-size must be positive")
+	}
+	if lazy && flushInterval <= 0 {
+		fatalf("serve: -flush-interval must be positive")
+	}
+
+	store, err := blobstore.OpenDir(dir)
+	if err != nil {
+		fatalf("can't open blob store: %v", err)
+	}
+	store.Audit = auditOpts.open()
+	key := readServerKey(keyFile)
+	store.TokenKey = key
+
+	s := httpstore.NewServer(store, key)
+	s.Lazy = lazy
+	s.MaxBlobSize = maxBlobSize
+	if trustFile != "" {
+		s.Trust, err = nestedaes.ReadTrustStoreFile(trustFile)
+		if err != nil {
+			fatalf("can't read trust store: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if lazy {
+		go store.RunFlusher(ctx, flushInterval)
+	}
+
+	srv := &http.Server{Addr: addr, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("serving", "dir", dir, "addr", addr, "key", nestedaes.Fingerprint(key.PublicKey().Bytes()))
+	if tlsCert != "" {
+		err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatalf("serve: %v", err)
+	}
+}
+
+// readServerKey reads the server's X25519 private key from path, or, if the
+// file doesn't exist, generates a key and writes it there.
+func readServerKey(path string) *ecdh.PrivateKey {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			fatalf("can't generate server key: %v", err)
+		}
+		if err := writeFileAtomic(path, key.Bytes()); err != nil {
+			fatalf("can't write server key file: %v", err)
+		}
+		return key
+	}
+	if err != nil {
+		fatalf("can't read server key file: %v", err)
+	}
+	defer freeKey(holdKey(data))
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		fatalf("invalid server key file %s: %v", path, err)
+	}
+	return key
+}
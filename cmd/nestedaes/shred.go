@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+)
+
+const shredUsage = `Usage: nestedaes shred [options] FILE
+
+Crypto-shred an encrypted file: destroy its key-encrypting key (KEK), which
+makes the file unreadable.  The KEK file is overwritten with zeros, synced,
+and removed.  FILE itself is left in place.
+
+Overwriting doesn't erase the key from storage that keeps old data, such as
+SSDs, copy-on-write file systems, and snapshots; keep KEK files on encrypted
+storage, and make sure that no other copy of the KEK exists.
+
+positional arguments:
+  FILE
+    The encrypted file
+
+options:
+  -inkek INPUT_KEK_FILE
+    The file containing FILE's current KEK.
+
+    Default: kek.key
+
+  -force
+    Shred the KEK even if it doesn't open FILE's header (or FILE can't be
+    read).  Without -force, shred refuses, so that the wrong KEK isn't
+    destroyed.
+
+` + auditOptionsUsage + `
+
+  -h|-help
+    Display this usage statement and exit.
+
+example:
+  $ nestedaes shred -audit audit.log -inkek kek2.key foo.enc
+`
+
+func shredMain(args []string) {
+	var inKEK string
+	var force bool
+	var auditOpts auditOptions
+
+	fs := newFlagSet("shred", shredUsage)
+	fs.StringVar(&inKEK, "inkek", "kek.key", "")
+	fs.BoolVar(&force, "force", false, "")
+	auditOpts.register(fs)
+	inFile := parseOneFile(fs, args)
+
+	checkKEKPath("-inkek", inKEK)
+	if inFile == "-" {
+		fatalf("shred: FILE must be a file, not stdin")
+	}
+
+	log := auditOpts.open()
+
+	kek := readKEK(inKEK)
+	kekID := nestedaes.Fingerprint(kek)
+	err := headerAuthenticates(inFile, kek)
+	freeKey(kek)
+	if err != nil && !force {
+		fatalf("shred: refusing to shred %s: %v (use -force to shred it anyway)", inKEK, err)
+	}
+
+	if err := shredFile(inKEK); err != nil {
+		fatalf("shred failed: %v", err)
+	}
+	recordFile(log, audit.KindShred, inFile, kekID, "")
+}
+
+// shredFile overwrites the file path with zeros, syncs it, and removes it.
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(make([]byte, fi.Size())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/etclab/mu"
+	"github.com/etclab/nestedaes"
+)
+
+// newFlagSet creates the flag set for a subcommand.  The -h and -help options
+// print the subcommand's usage statement.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s", usage)
+	}
+	return fs
+}
+
+// parseOneFile parses the subcommand's arguments, which must include exactly
+// one positional argument, and returns that argument.
+func parseOneFile(fs *flag.FlagSet, args []string) string {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatalf("%s: expected one positional argument but got %d", fs.Name(), fs.NArg())
+	}
+	return fs.Arg(0)
+}
+
+// heldKeys are the keys that the command holds, by their first byte.
+// Deferred calls don't run when the command exits, so fatalf wipes these
+// keys itself.
+var heldKeys struct {
+	sync.Mutex
+	keys map[*byte][]byte
+}
+
+// holdKey records key as held until it is released with freeKey, and returns
+// it.
+func holdKey(key []byte) []byte {
+	if len(key) == 0 {
+		return key
+	}
+	heldKeys.Lock()
+	defer heldKeys.Unlock()
+	if heldKeys.keys == nil {
+		heldKeys.keys = make(map[*byte][]byte)
+	}
+	heldKeys.keys[&key[0]] = key
+	return key
+}
+
+// freeKey releases a key recorded by holdKey with [nestedaes.FreeKey].
+func freeKey(key []byte) {
+	if len(key) > 0 {
+		heldKeys.Lock()
+		delete(heldKeys.keys, &key[0])
+		heldKeys.Unlock()
+	}
+	nestedaes.FreeKey(key)
+}
+
+// fatalf is like [mu.Fatalf], but first wipes the keys that the command
+// holds.
+func fatalf(format string, a ...any) {
+	heldKeys.Lock()
+	for _, key := range heldKeys.keys {
+		nestedaes.Wipe(key)
+	}
+	heldKeys.Unlock()
+	mu.Fatalf(format, a...)
+}
+
+// newKEK generates a random KEK.  The caller should release it with freeKey.
+func newKEK() []byte {
+	kek := holdKey(nestedaes.AllocKey(nestedaes.KeySize))
+	if _, err := rand.Read(kek); err != nil {
+		fatalf("can't generate KEK: %v", err)
+	}
+	return kek
+}
+
+// readKeyFile is like [nestedaes.ReadKeyFile], but records the key as held
+// (see holdKey).  The caller should release it with freeKey.
+func readKeyFile(path string) ([]byte, error) {
+	key, err := nestedaes.ReadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return holdKey(key), nil
+}
+
+// readKEK reads a KEK file.  The caller should release the KEK with freeKey.
+func readKEK(path string) []byte {
+	kek, err := readKeyFile(path)
+	if err != nil {
+		fatalf("can't read input KEK file: %v", err)
+	}
+	return kek
+}
+
+// writeKEK atomically and durably writes a KEK file.
+func writeKEK(path string, kek []byte) {
+	err := writeFileAtomic(path, kek)
+	if err != nil {
+		fatalf("can't write KEK file: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/etclab/nestedaes"
+)
+
+const verifyUsage = `Usage: nestedaes verify [options] FILE [FILE...]
+
+Check that encrypted files decrypt and authenticate under their KEKs.  Each
+file is decrypted in a buffer the size of its payload, as its single GCM tag
+covers all of it (see 'nestedaes decrypt -h'); no plaintext is written, and
+the buffer is wiped after each file.
+
+A line is printed for each file, followed by a summary.
+
+positional arguments:
+  FILE
+    An encrypted file to verify, or "-" for stdin
+
+options:
+  -inkek INPUT_KEK_FILE
+    The file containing the KEK of every FILE.
+
+    Default: kek.key
+
+  -keksuffix SUFFIX
+    Instead of -inkek, use a separate KEK for each FILE, read from the file
+    named FILE with SUFFIX appended (for instance, "-keksuffix .key" reads the
+    KEK for foo.enc from foo.enc.key).  As stdin has no name, -keksuffix
+    can't be used with "-".
+
+` + aadUsage + `
+    With -aad-from-filename, each FILE is verified with its own name.
+
+  -q
+    Only print the files that fail, and the summary.
+
+  -mlock
+    Keep keys in locked memory (see 'nestedaes encrypt -h').
+
+  -h|-help
+    Display this usage statement and exit.
+
+exit status:
+  0  Every FILE verified
+  1  A usage or I/O error prevented verification (for instance, the -inkek
+     file could not be read)
+  3  At least one FILE failed to verify
+
+examples:
+  $ nestedaes verify -inkek kek.key foo.enc
+  $ nestedaes verify -keksuffix .key -q backups/*.enc
+  $ nestedaes verify -keksuffix .key -aad-from-filename objects/*
+`
+
+// exitVerifyFailed is the exit status when a file fails to verify.  It is
+// distinct from the status of [mu.Fatalf] (1) and of flag parsing errors (2).
+const exitVerifyFailed = 3
+
+func verifyMain(args []string) {
+	var inKEK, kekSuffix string
+	var quiet, mlock bool
+	var aadOpts aadOptions
+
+	fs := newFlagSet("verify", verifyUsage)
+	fs.StringVar(&inKEK, "inkek", "kek.key", "")
+	fs.StringVar(&kekSuffix, "keksuffix", "", "")
+	aadOpts.register(fs)
+	fs.BoolVar(&quiet, "q", false, "")
+	fs.BoolVar(&mlock, "mlock", false, "")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fatalf("verify: expected at least one positional argument")
+	}
+	aadOpts.check()
+	if kekSuffix != "" && slices.Contains(fs.Args(), "-") {
+		fatalf("verify: -keksuffix can't be used with \"-\" (stdin); use -inkek")
+	}
+
+	enableMlock(mlock)
+
+	var kek []byte
+	if kekSuffix == "" {
+		kek = readKEK(inKEK)
+		defer freeKey(kek)
+	}
+
+	var failed int
+	for _, inFile := range fs.Args() {
+		err := verifyFile(inFile, kek, kekSuffix, &aadOpts)
+		if err != nil {
+			failed++
+			fmt.Printf("%s: FAIL: %v\n", inFile, err)
+		} else if !quiet {
+			fmt.Printf("%s: OK\n", inFile)
+		}
+	}
+
+	fmt.Printf("verified %d file(s): %d OK, %d FAILED\n", fs.NArg(), fs.NArg()-failed, failed)
+	if failed > 0 {
+		os.Exit(exitVerifyFailed)
+	}
+}
+
+// verifyFile decrypts and authenticates inFile, discarding the plaintext.  If
+// kek is nil, the KEK is read from inFile+kekSuffix.
+func verifyFile(inFile string, kek []byte, kekSuffix string, aadOpts *aadOptions) error {
+	aad, err := aadOpts.resolve(inFile)
+	if err != nil {
+		return err
+	}
+
+	var in *os.File
+	if inFile == "-" {
+		in = os.Stdin
+	} else {
+		in, err = os.Open(inFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	if kek == nil {
+		kek, err = readKeyFile(inFile + kekSuffix)
+		if err != nil {
+			return fmt.Errorf("can't read KEK file: %w", err)
+		}
+		defer freeKey(kek)
+	}
+
+	_, err = nestedaes.DecryptStream(io.Discard, in, kek, aad)
+	return err
+}
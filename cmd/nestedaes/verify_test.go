@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "alpha", "b.txt": "bravo"})
+	mustRun(t, dir, "encrypt", "-outkek", "a.enc.key", "-out", "a.enc", "a.txt")
+	mustRun(t, dir, "encrypt", "-outkek", "b.enc.key", "-out", "b.enc", "b.txt")
+	mustRun(t, dir, "encrypt", "-outkek", "kek.key", "-out", "c.enc", "a.txt")
+
+	// corrupt the last byte of the payload of d.enc, a copy of a.enc
+	blob, err := os.ReadFile(filepath.Join(dir, "a.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob[len(blob)-1] ^= 1
+	writeFiles(t, dir, map[string]string{"d.enc": string(blob)})
+	if err := os.Link(filepath.Join(dir, "a.enc.key"), filepath.Join(dir, "d.enc.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		status int
+		output string
+	}{
+		{"ok", []string{"-keksuffix", ".key", "a.enc", "b.enc"}, 0, "2 OK, 0 FAILED"},
+		{"shared KEK", []string{"c.enc"}, 0, "1 OK, 0 FAILED"},
+		{"tampered", []string{"-keksuffix", ".key", "a.enc", "d.enc"}, exitVerifyFailed, "d.enc: FAIL"},
+		{"wrong KEK", []string{"a.enc"}, exitVerifyFailed, "a.enc: FAIL"},
+		{"missing file", []string{"-keksuffix", ".key", "e.enc"}, exitVerifyFailed, "e.enc: FAIL"},
+		{"missing KEK", []string{"-inkek", "none.key", "a.enc"}, 1, "can't read input KEK file"},
+		{"KEK suffix with stdin", []string{"-keksuffix", ".key", "-"}, 1, "-keksuffix can't be used"},
+		{"no files", nil, 1, "expected at least one"},
+		{"bad flag", []string{"-nosuchflag", "a.enc"}, 2, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, status := run(t, dir, append([]string{"verify"}, tc.args...)...)
+			if status != tc.status {
+				t.Fatalf("expected exit status %d, got %d:\n%s", tc.status, status, out)
+			}
+			if !strings.Contains(out, tc.output) {
+				t.Fatalf("expected the output to contain %q:\n%s", tc.output, out)
+			}
+		})
+	}
+}
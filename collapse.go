@@ -0,0 +1,220 @@
+package nestedaes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+
+	"github.com/etclab/aes256"
+)
+
+// collapseChunkSize is the size of the chunks in which [ApplyCollapseToken]
+// applies all the keystreams, so that each chunk stays in the cache.
+const collapseChunkSize = 64 * 1024
+
+// CollapseToken is a token that replaces all of a blob's CTR layers
+// (layers 1 to n-1) with a single new one, so that decrypting the blob
+// costs two passes over the payload again, however often it was
+// re-encrypted.  Unlike [Compact], the key owner only needs the blob's
+// header, and the server that applies the token never sees DEK[0] (which
+// protects the innermost, AES-GCM layer) or the plaintext.
+//
+// Security trade-off: the token holds every CTR-layer DEK, the stripped
+// ones and the new one, so that to anyone who holds it, only DEK[0] still
+// protects the payload.  DEK[0] never changes, and every KEK the blob ever
+// had reveals it (by opening the header that KEK sealed).  A holder of the
+// token thus needs only DEK[0] (or any old KEK) to decrypt the blob's new
+// ciphertext, or any old copy of its ciphertext: re-encryption no longer
+// protects the blob against the compromise of old KEKs.  With regular
+// tokens, the same adversary would also need the DEKs of the layers added
+// after that KEK was retired.  Prefer [Compact] (which replaces DEK[0] too)
+// when an old KEK may have been compromised.
+//
+// Collapse tokens are meant to be applied locally, or by a server that the
+// key owner reaches over a channel it already trusts, and that is trusted
+// not to keep them: unlike [Token], they have no sealed or signed wire form
+// (see [SealToken] and [SignToken]), and the httpstore server does not
+// accept them.
+type CollapseToken struct {
+	// Header is the blob's new marshaled header, with DEK[0] and the new
+	// DEK, sealed under the new KEK.
+	Header []byte
+	// DEKs are the DEKs of the layers to strip, DEK[1] to DEK[n-1].
+	DEKs [][]byte
+	// DEK is the DEK of the new layer (layer 1).
+	DEK []byte
+	// Layers is the number of layers the blob must have before the token is
+	// applied.
+	Layers int
+	// PrevHeaderHash is the [HeaderHash] of the header the token replaces.
+	// If it is set, [ApplyCollapseToken] only applies the token to a blob
+	// with that header.
+	PrevHeaderHash []byte
+}
+
+// CollapseKeyGen derives a collapse token from a blob's header (or the full
+// blob), the blob's current KEK, and a randomly generated new KEK and DEK.
+// On success, the function returns the token and the new KEK; the new KEK is
+// allocated with [AllocKey], and the caller should release it with [FreeKey]
+// once it has been stored.  See [CollapseToken] for the security trade-off.
+func CollapseKeyGen(header, kek []byte) (*CollapseToken, []byte, error) {
+	newKEK := newRandomKey()
+	newDEK := newRandomKey()
+	defer FreeKey(newDEK)
+
+	t, err := CollapseKeyGenWithKeys(header, kek, newKEK, newDEK)
+	if err != nil {
+		FreeKey(newKEK)
+		return nil, nil, err
+	}
+	return t, newKEK, nil
+}
+
+// CollapseKeyGenWithKeys is the same as [CollapseKeyGen], but it allows the
+// caller to specify the new KEK and DEK, rather than having them be randomly
+// generated.  The token holds copies of the DEKs.
+func CollapseKeyGenWithKeys(header, kek, newKEK, newDEK []byte) (*CollapseToken, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+	if len(newKEK) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newKEK))
+	}
+	if len(newDEK) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newDEK))
+	}
+
+	sp := getScratch()
+	defer putScratch(sp)
+
+	hSize, meta, dec, err := openHeader(kek, header, *sp)
+	if err != nil {
+		return nil, err
+	}
+	*sp = dec[:0]
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
+
+	newHSize := hSize - (numDEKs-2)*aes256.KeySize
+	t := &CollapseToken{
+		Header:         make([]byte, newHSize),
+		DEK:            AllocKey(aes256.KeySize),
+		Layers:         numDEKs,
+		PrevHeaderHash: hashHeader(header[:hSize]),
+	}
+	copy(t.DEK, newDEK)
+	// dec is DataTag || DEK[0] || DEK[1] || ...
+	for i := 1; i < numDEKs; i++ {
+		dek := AllocKey(aes256.KeySize)
+		copy(dek, dec[aes256.TagSize+i*aes256.KeySize:])
+		t.DEKs = append(t.DEKs, dek)
+	}
+	sealHeader(t.Header, header[4:plainHeaderSize], meta, newKEK, 1, dec[:aes256.TagSize+aes256.KeySize], newDEK)
+
+	return t, nil
+}
+
+// Wipe zeroes and releases the token's DEKs.  The token must not be used
+// afterwards.
+func (t *CollapseToken) Wipe() {
+	for _, dek := range t.DEKs {
+		FreeKey(dek)
+	}
+	FreeKey(t.DEK)
+	t.DEKs = nil
+	t.DEK = nil
+}
+
+// ApplyCollapseToken re-encrypts the blob in place with the collapse token:
+// it strips the blob's CTR layers, applies the token's new layer (in a
+// single pass over the payload), and replaces the header with the token's
+// header.  It neither needs nor checks any KEK.  A rejected token is
+// reported as a [*TokenError].
+//
+// The blob shrinks, unless it had a single layer (in which case the token
+// adds a layer, and ApplyCollapseToken allocates as [ApplyToken] does).  The
+// returned slice shares blob's storage when it can; in either case, the
+// contents of blob are overwritten.
+func ApplyCollapseToken(blob []byte, t *CollapseToken) ([]byte, error) {
+	hSize, newHSize, err := checkCollapseToken(blob, t)
+	if err != nil {
+		return nil, err
+	}
+
+	// XOR all the layers' keystreams with the payload, chunk by chunk
+	baseIV := t.Header[4:plainHeaderSize]
+	var iv [aes256.IVSize]byte
+	streams := make([]cipher.Stream, 0, len(t.DEKs)+1)
+	for i, dek := range t.DEKs {
+		layerIV(&iv, baseIV, i+1)
+		streams = append(streams, aes256.NewCTR(dek, iv[:]))
+	}
+	layerIV(&iv, baseIV, 1)
+	streams = append(streams, aes256.NewCTR(t.DEK, iv[:]))
+
+	payload := blob[hSize:]
+	for off := 0; off < len(payload); off += collapseChunkSize {
+		chunk := payload[off:min(off+collapseChunkSize, len(payload))]
+		for _, s := range streams {
+			s.XORKeyStream(chunk, chunk)
+		}
+	}
+
+	// move the payload next to the new header
+	var ret []byte
+	if newHSize > hSize {
+		ret, _ = sliceForAppend(blob, newHSize-hSize, 0)
+	} else {
+		ret = blob[:newHSize+len(payload)]
+	}
+	copy(ret[newHSize:], ret[hSize:hSize+len(payload)])
+	copy(ret, t.Header)
+	return ret, nil
+}
+
+// checkCollapseToken checks that the collapse token applies to blob, and
+// returns the sizes of the blob's current header and of the token's header.
+func checkCollapseToken(blob []byte, t *CollapseToken) (int, int, error) {
+	if len(t.DEK) != aes256.KeySize {
+		return 0, 0, aes.KeySizeError(len(t.DEK))
+	}
+	for _, dek := range t.DEKs {
+		if len(dek) != aes256.KeySize {
+			return 0, 0, aes.KeySizeError(len(dek))
+		}
+	}
+
+	hSize, _, numDEKs, err := parsePlainHeader(blob)
+	if err != nil {
+		return 0, 0, err
+	}
+	newHSize, _, newNumDEKs, err := parsePlainHeader(t.Header)
+	if err != nil {
+		return 0, 0, tokenError(ErrTokenMalformed, "invalid header: %v", err)
+	}
+	if newHSize != len(t.Header) {
+		return 0, 0, tokenError(ErrTokenMalformed, "header size field is %d but the header is %d bytes", newHSize, len(t.Header))
+	}
+	if newNumDEKs != 2 || len(t.DEKs) != t.Layers-1 {
+		return 0, 0, tokenError(ErrTokenMalformed, "token strips %d of %d layers, and its header has %d layers", len(t.DEKs), t.Layers, newNumDEKs)
+	}
+
+	if !bytes.Equal(blob[4:plainHeaderSize], t.Header[4:plainHeaderSize]) {
+		return 0, 0, tokenError(ErrTokenWrongBlob, "the blob has a different BaseIV")
+	}
+	// the blob may have fewer layers after the token was applied
+	if bytes.Equal(blob[:hSize], t.Header) {
+		return 0, 0, tokenError(ErrTokenApplied, "the blob already has the token's header")
+	}
+	if numDEKs > t.Layers {
+		return 0, 0, tokenError(ErrTokenApplied, "token collapses %d layers, but the blob has %d layers", t.Layers, numDEKs)
+	}
+	if numDEKs < t.Layers {
+		return 0, 0, tokenError(ErrTokenOutOfOrder, "token collapses %d layers, but the blob has %d layers", t.Layers, numDEKs)
+	}
+	if t.PrevHeaderHash != nil && subtle.ConstantTimeCompare(t.PrevHeaderHash, hashHeader(blob[:hSize])) != 1 {
+		return 0, 0, tokenError(ErrTokenWrongBlob, "token does not replace the blob's header")
+	}
+
+	return hSize, newHSize, nil
+}
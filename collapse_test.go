@@ -0,0 +1,105 @@
+package nestedaes
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/etclab/aes256"
+)
+
+func TestApplyCollapseToken(t *testing.T) {
+	plain := make([]byte, 3*collapseChunkSize+17)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	ad := []byte("object-name")
+
+	for _, layers := range []int{1, 2, 6} {
+		kek := aes256.NewRandomKey()
+		md := Metadata{MetaAADHash: AADHash(ad)}
+		blob, err := EncryptWithMetadata(plain, kek, aes256.NewRandomIV(), ad, md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < layers; i++ {
+			var newKEK []byte
+			blob, newKEK, err = Reencrypt(blob, kek)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kek = newKEK
+		}
+
+		tok, newKEK, err := CollapseKeyGen(blob, kek)
+		if err != nil {
+			t.Fatalf("layers=%d: CollapseKeyGen failed: %v", layers, err)
+		}
+		blob, err = ApplyCollapseToken(blob, tok)
+		if err != nil {
+			t.Fatalf("layers=%d: ApplyCollapseToken failed: %v", layers, err)
+		}
+		if _, err := ApplyCollapseToken(bytes.Clone(blob), tok); !errors.Is(err, ErrTokenApplied) {
+			t.Fatalf("layers=%d: expected %v, got %v", layers, ErrTokenApplied, err)
+		}
+		tok.Wipe()
+
+		ph, err := UnmarshalPlainHeader(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ph.Layers() != 2 {
+			t.Fatalf("layers=%d: expected 2 layers after collapsing, got %d", layers, ph.Layers())
+		}
+		if !bytes.Equal(ph.Metadata[MetaAADHash], md[MetaAADHash]) {
+			t.Fatalf("layers=%d: collapsing lost the metadata", layers)
+		}
+
+		// the collapsed blob can be re-encrypted as usual
+		blob, kek, err = Reencrypt(blob, newKEK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decrypt(blob, kek, ad)
+		if err != nil {
+			t.Fatalf("layers=%d: %v", layers, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("layers=%d: decrypt produced the wrong plaintext", layers)
+		}
+	}
+}
+
+func TestApplyCollapseTokenMismatch(t *testing.T) {
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, kek, err = Reencrypt(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, _, err := CollapseKeyGen(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tok.Wipe()
+	if _, err := ApplyCollapseToken(other, tok); !errors.Is(err, ErrTokenWrongBlob) {
+		t.Fatalf("expected %v, got %v", ErrTokenWrongBlob, err)
+	}
+
+	// a re-encryption after the token was derived supersedes it
+	blob, _, err = Reencrypt(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyCollapseToken(blob, tok); !errors.Is(err, ErrTokenApplied) {
+		t.Fatalf("expected %v, got %v", ErrTokenApplied, err)
+	}
+}
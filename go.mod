@@ -1,6 +1,6 @@
 module github.com/etclab/nestedaes
 
-go 1.22.3
+go 1.24
 
 require (
 	github.com/etclab/aes256 v0.1.0
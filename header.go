@@ -1,22 +1,31 @@
 package nestedaes
 
 import (
-	"bytes"
 	"crypto/aes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"log/slog"
 	"strings"
 
 	"github.com/etclab/aes256"
 	"github.com/etclab/mu"
 )
 
+// plainHeaderSize is the size of the marshaled [PlainHeader].
+const plainHeaderSize = 4 + aes256.IVSize
+
 // PlainHeader is the unencrypted part of the ciphertext header.
 type PlainHeader struct {
 	// The size of the entire blob (including the header)
 	Size uint32
 	// The BaseIV (size is [aes256.IVSize])
 	BaseIV []byte
+	// Metadata is optional, authenticated but unencrypted data about the
+	// blob.  It is nil if the header has none.
+	Metadata Metadata
 }
 
 // EncryptedHeader is the encrypted portion of the header
@@ -36,19 +45,43 @@ type Header struct {
 	PlainHeader
 	EncryptedHeader
 	//HeaderTag [aes256.TagSize]byte (exists only in encrypted header)
+
+	// owned holds the key regions that the header allocated with
+	// [AllocKey] (and that back some of the DEKs); Wipe releases only these
+	owned [][]byte
+}
+
+// String satisfies the [fmt.Stringer] interface.  The DEKs are redacted: only
+// their count and fingerprints (see [Fingerprint]) are shown.  Use
+// [Header.DebugString] to dump the raw key material.
+func (h Header) String() string {
+	return h.format(false)
+}
+
+// DebugString is like [Header.String], but includes the raw DEKs.  It is
+// intended only for debugging; the output must never be logged in
+// production.
+func (h Header) DebugString() string {
+	return h.format(true)
 }
 
-// String satisfies the [fmt.Stringer] interface.
-func (h *Header) String() string {
+func (h Header) format(debug bool) string {
 	var b strings.Builder
 
 	fmt.Fprintf(&b, "{\n")
 	fmt.Fprintf(&b, "\tSize: %d,\n", h.Size)
 	fmt.Fprintf(&b, "\tBaseIV: %x,\n", h.BaseIV)
+	for _, tag := range h.Metadata.tags() {
+		fmt.Fprintf(&b, "\tMetadata[%d]: %x,\n", tag, h.Metadata[tag])
+	}
 	fmt.Fprintf(&b, "\tDataTag: %x,\n", h.DataTag)
 	fmt.Fprintf(&b, "\tDEKs (%d): [\n", len(h.DEKs))
 	for i := 0; i < len(h.DEKs); i++ {
-		fmt.Fprintf(&b, "\t\t%d: %v,\n", i, h.DEKs[i])
+		if debug {
+			fmt.Fprintf(&b, "\t\t%d: %x,\n", i, h.DEKs[i])
+		} else {
+			fmt.Fprintf(&b, "\t\t%d: %s,\n", i, Fingerprint(h.DEKs[i]))
+		}
 	}
 	fmt.Fprintf(&b, "\t]\n")
 	fmt.Fprintf(&b, "}")
@@ -56,6 +89,63 @@ func (h *Header) String() string {
 	return b.String()
 }
 
+// Format satisfies the [fmt.Formatter] interface, so that every verb
+// (including %#v and %+v, which would otherwise print the raw fields)
+// produces the redacted output of [Header.String].
+func (h Header) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 'q':
+		fmt.Fprintf(f, "%q", h.String())
+	default:
+		io.WriteString(f, h.String())
+	}
+}
+
+// LogValue satisfies the [slog.LogValuer] interface.  As with
+// [Header.String], the DEKs are redacted to their fingerprints.  The
+// metadata, which isn't secret, is logged by tag name, with a rotation time
+// (see [MetaRotatedAt]) as a time, and other values in hex.
+func (h Header) LogValue() slog.Value {
+	fps := make([]string, len(h.DEKs))
+	for i, dek := range h.DEKs {
+		fps[i] = Fingerprint(dek)
+	}
+
+	attrs := []slog.Attr{
+		slog.Uint64("size", uint64(h.Size)),
+		slog.String("base_iv", hex.EncodeToString(h.BaseIV)),
+	}
+	if len(h.Metadata) > 0 {
+		var md []slog.Attr
+		for _, tag := range h.Metadata.tags() {
+			v := h.Metadata[tag]
+			if tag == MetaRotatedAt {
+				if t, err := ParseRotationTime(v); err == nil {
+					md = append(md, slog.Time(tag.String(), t))
+					continue
+				}
+			}
+			md = append(md, slog.String(tag.String(), hex.EncodeToString(v)))
+		}
+		attrs = append(attrs, slog.Attr{Key: "metadata", Value: slog.GroupValue(md...)})
+	}
+	attrs = append(attrs,
+		slog.String("data_tag", hex.EncodeToString(h.DataTag)),
+		slog.Int("layers", len(h.DEKs)),
+		slog.Any("dek_fingerprints", fps),
+	)
+	return slog.GroupValue(attrs...)
+}
+
+// Fingerprint returns a short, non-secret identifier for a key: the first 8
+// bytes of the key's SHA-256 digest, hex-encoded and prefixed with "sha256:".
+// Fingerprints let two keys be compared (for instance, in logs) without
+// revealing them.
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
 // NewHeader creates a new [Header] and initializes the BaseIV, DataTag, and
 // first DEK entry.
 func NewHeader(iv, dataTag, dek []byte) (*Header, error) {
@@ -76,15 +166,18 @@ func NewHeader(iv, dataTag, dek []byte) (*Header, error) {
 		return nil, aes.KeySizeError(len(dek))
 	}
 	h.DEKs = make([][]byte, 1)
-	h.DEKs[0] = make([]byte, aes256.KeySize)
+	h.DEKs[0] = AllocKey(aes256.KeySize)
 	copy(h.DEKs[0], dek)
+	h.owned = [][]byte{h.DEKs[0]}
 
 	// 4 for the Size field, tagsize for header tag
 	h.Size = uint32(4 + len(h.BaseIV) + len(h.DataTag) + aes256.KeySize + aes256.TagSize)
 	return h, nil
 }
 
-// AddDEK adds a new data key entry to the header.
+// AddDEK adds a new data key entry to the header.  The header does not take
+// ownership of dek: [Header.Wipe] zeroes it, but the caller remains
+// responsible for releasing it (for instance, with [FreeKey]).
 func (h *Header) AddDEK(dek []byte) {
 	if len(dek) != aes256.KeySize {
 		mu.Panicf("%v", aes.KeySizeError(len(dek)))
@@ -93,9 +186,46 @@ func (h *Header) AddDEK(dek []byte) {
 	h.DEKs = append(h.DEKs, dek)
 }
 
+// Wipe zeroes the header's DEKs and DataTag, and releases the key memory
+// that the header itself allocated (in [NewHeader] and [UnmarshalHeader]).
+// DEKs added with [Header.AddDEK], or otherwise supplied by the caller, are
+// zeroed but not released.  The header must not be used afterwards.
+//
+// If secure memory is enabled (see [EnableSecureMemory]), a header that is
+// never wiped keeps its locked memory until the process exits.
+func (h *Header) Wipe() {
+	for _, dek := range h.DEKs {
+		Wipe(dek)
+	}
+	for _, region := range h.owned {
+		FreeKey(region)
+	}
+	h.DEKs = nil
+	h.owned = nil
+	Wipe(h.DataTag)
+}
+
+// Close satisfies the [io.Closer] interface by calling [Header.Wipe].  It
+// always returns nil.
+func (h *Header) Close() error {
+	h.Wipe()
+	return nil
+}
+
 // Marshal marshals the header to a []byte.  As part of marshaling, this method
 // takes care of encrypting the "encrypted" portion of the header.
 func (h *Header) Marshal(kek []byte) ([]byte, error) {
+	return h.AppendMarshal(nil, kek)
+}
+
+// AppendMarshal is like [Header.Marshal], but appends the marshaled header to
+// dst and returns the updated slice.  If dst has at least h.Size+TagSize
+// bytes of spare capacity, AppendMarshal does not allocate (unless the header
+// has Metadata).
+//
+// The Size field is written as the actual size of the marshaled header, which
+// includes the encoded Metadata.
+func (h *Header) AppendMarshal(dst, kek []byte) ([]byte, error) {
 	if len(kek) != aes256.KeySize {
 		return nil, aes.KeySizeError(len(kek))
 	}
@@ -104,30 +234,54 @@ func (h *Header) Marshal(kek []byte) ([]byte, error) {
 		return nil, fmt.Errorf("header has zero DEKs")
 	}
 
+	meta, err := appendMetadata(nil, h.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	size := plainHeaderSize + len(meta) + len(h.DataTag) + len(h.DEKs)*aes256.KeySize + aes256.TagSize
+	ret, out := sliceForAppend(dst, size, aes256.TagSize)
+
 	// write the plaintext data for what will become the encrypted part of the
 	// header
-	ct := new(bytes.Buffer)
-	ct.Write(h.DataTag)
+	enc := out[plainHeaderSize+len(meta) : size-aes256.TagSize]
+	n := copy(enc, h.DataTag)
 	for _, dek := range h.DEKs {
-		ct.Write(dek)
+		n += copy(enc[n:], dek)
 	}
 
-	// encrypt it
-	iv := aes256.CopyIV(h.BaseIV)
-	aes256.AddIV(iv, len(h.DEKs)-1)
+	// write the plain portion of the header, and encrypt the rest in place
+	// with current KEK
+	sealHeader(out[:size], h.BaseIV, meta, kek, len(h.DEKs)-1)
 
-	// encrypt with current KEK
-	// TODO: should size or anything else be verified as additional data?
-	enc := aes256.EncryptGCM(kek, aes256.IVToNonce(iv), ct.Bytes(), nil)
+	return ret, nil
+}
+
+// UnmarshalPlainHeader parses the unencrypted part of the header at the start
+// of blob (which may be the full blob or just its header).  Unlike
+// [UnmarshalHeader], it does not need the KEK, and thus does not
+// authenticate the header.
+func UnmarshalPlainHeader(blob []byte) (*PlainHeader, error) {
+	size, meta, _, err := parsePlainHeader(blob)
+	if err != nil {
+		return nil, err
+	}
+	md, err := parseMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
 
-	// write the plain portion of the header and concatenate the encryption
-	// portion
-	b := new(bytes.Buffer)
-	binary.Write(b, binary.BigEndian, h.Size)
-	b.Write(h.BaseIV)
-	b.Write(enc)
+	p := &PlainHeader{Size: uint32(size), Metadata: md}
+	p.BaseIV = make([]byte, aes256.IVSize)
+	copy(p.BaseIV, blob[4:])
+	return p, nil
+}
 
-	return b.Bytes(), nil
+// Layers returns the number of layers of encryption (that is, the number of
+// DEKs) implied by the header size.
+func (p *PlainHeader) Layers() int {
+	encSize := int(p.Size) - plainHeaderSize - encodedMetadataSize(p.Metadata)
+	return (encSize - aes256.TagSize - aes256.TagSize) / aes256.KeySize
 }
 
 // Unmarshal takes a marshalled version of the header and the current Key
@@ -137,55 +291,145 @@ func UnmarshalHeader(kek, data []byte) (*Header, error) {
 		return nil, aes.KeySizeError(len(kek))
 	}
 
+	size, meta, dec, err := openHeader(kek, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if size != len(data) {
+		Wipe(dec)
+		return nil, fmt.Errorf("header size field is %d but marshalled data is %d bytes", size, len(data))
+	}
+	md, err := parseMetadata(meta)
+	if err != nil {
+		Wipe(dec)
+		return nil, err
+	}
+
 	h := &Header{}
-	r := bytes.NewReader(data)
+	h.Size = uint32(size)
+	h.Metadata = md
+	h.BaseIV = make([]byte, aes256.IVSize)
+	copy(h.BaseIV, data[4:])
 
-	err := binary.Read(r, binary.BigEndian, &h.Size)
-	if err != nil {
-		return nil, fmt.Errorf("can't read Size field: %w", err)
+	h.DataTag = make([]byte, aes256.TagSize)
+	copy(h.DataTag, dec)
+
+	// allocate the DEKs as a single region, so that the secure allocator
+	// (if enabled) doesn't need a separate mapping for each one
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
+	keys := AllocKey(numDEKs * aes256.KeySize)
+	copy(keys, dec[aes256.TagSize:])
+	Wipe(dec)
+	h.owned = [][]byte{keys}
+	h.DEKs = make([][]byte, numDEKs)
+	for i := 0; i < numDEKs; i++ {
+		h.DEKs[i] = keys[i*aes256.KeySize : (i+1)*aes256.KeySize : (i+1)*aes256.KeySize]
 	}
 
-	if h.Size != uint32(len(data)) {
-		return nil, fmt.Errorf("header size field is %d but marshalled data is %d bytes", h.Size, len(data))
+	return h, nil
+}
+
+// openHeader parses the plain header at the start of blob and authenticates
+// and decrypts the encrypted header into scratch, which is grown as needed.
+// It returns the header size, the metadata section (which aliases blob, and
+// is nil if the header has none), and the decrypted DataTag || DEKs..., which
+// shares scratch's storage when scratch has enough capacity.
+func openHeader(kek, blob, scratch []byte) (int, []byte, []byte, error) {
+	size, meta, numDEKs, err := parsePlainHeader(blob)
+	if err != nil {
+		return 0, nil, nil, err
 	}
+	encOff := plainHeaderSize + len(meta)
+	enc := blob[encOff:size]
 
-	h.BaseIV = make([]byte, aes256.IVSize)
-	n, err := r.Read(h.BaseIV)
+	var nonce [aes256.NonceSize]byte
+	layerNonce(&nonce, blob[4:plainHeaderSize], numDEKs-1)
+	dec, err := aes256.NewGCM(kek).Open(scratch[:0], nonce[:], enc, headerAD(blob[:encOff], meta))
 	if err != nil {
-		return nil, fmt.Errorf("can't read BaseIV: %w", err)
+		return 0, nil, nil, fmt.Errorf("failed to decrypt encrypted header segment: %w", err)
+	}
+
+	return size, meta, dec, nil
+}
+
+// headerSize returns the header size recorded in a Size field, and whether
+// the header has a metadata section.
+func headerSize(field uint32) (int, bool) {
+	return int(field &^ metadataFlag), field&metadataFlag != 0
+}
+
+// headerAD returns the additional data for the header's GCM encryption.  A
+// header without metadata has none (as in blobs that predate metadata); a
+// header with metadata authenticates its entire plain part.
+func headerAD(plain, meta []byte) []byte {
+	if len(meta) == 0 {
+		return nil
+	}
+	return plain
+}
+
+// parsePlainHeader validates the plain header at the start of blob, and
+// returns the header size, the metadata section (nil if there is none), and
+// the number of DEKs implied by the size.
+func parsePlainHeader(blob []byte) (int, []byte, int, error) {
+	if len(blob) < plainHeaderSize {
+		return 0, nil, 0, fmt.Errorf("blob (%d bytes) is too small to contain a header", len(blob))
 	}
-	if n != len(h.BaseIV) {
-		return nil, fmt.Errorf("BaseIV field is %d bytes but should be %d", h, len(h.BaseIV))
+
+	size, hasMeta := headerSize(binary.BigEndian.Uint32(blob))
+	if size > len(blob) {
+		return 0, nil, 0, fmt.Errorf("header size (%d bytes) is >= blob size (%d bytes)", size, len(blob))
+	}
+	if size < plainHeaderSize {
+		return 0, nil, 0, fmt.Errorf("header size (%d bytes) is too small", size)
+	}
+
+	var meta []byte
+	if hasMeta {
+		if size < plainHeaderSize+2 {
+			return 0, nil, 0, fmt.Errorf("header size (%d bytes) is too small for metadata", size)
+		}
+		metaSize := 2 + int(binary.BigEndian.Uint16(blob[plainHeaderSize:]))
+		if plainHeaderSize+metaSize > size {
+			return 0, nil, 0, fmt.Errorf("metadata (%d bytes) exceeds the header size (%d bytes)", metaSize, size)
+		}
+		meta = blob[plainHeaderSize : plainHeaderSize+metaSize]
 	}
 
-	enc := data[int(r.Size())-r.Len():]
-	mod := (len(enc) - aes256.TagSize - aes256.TagSize) % aes256.KeySize
+	encSize := size - plainHeaderSize - len(meta)
+	mod := (encSize - aes256.TagSize - aes256.TagSize) % aes256.KeySize
 	if mod != 0 {
-		return nil, fmt.Errorf("header has a partial entry")
+		return 0, nil, 0, fmt.Errorf("header has a partial entry")
 	}
-	numDEKs := (len(enc) - aes256.TagSize - aes256.TagSize) / aes256.KeySize
+	numDEKs := (encSize - aes256.TagSize - aes256.TagSize) / aes256.KeySize
 	if numDEKs <= 0 {
-		return nil, fmt.Errorf("header has 0 DEKs")
+		return 0, nil, 0, fmt.Errorf("header has 0 DEKs")
 	}
 
-	iv := aes256.CopyIV(h.BaseIV)
-	aes256.AddIV(iv, numDEKs-1)
-	dec, err := aes256.DecryptGCM(kek, aes256.IVToNonce(iv), enc, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt encrypted header segment: %w", err)
-	}
-	h.DEKs = make([][]byte, numDEKs)
+	return size, meta, numDEKs, nil
+}
 
-	for i := 0; i < numDEKs; i++ {
-		h.DEKs[i] = make([]byte, aes256.KeySize)
-		n := copy(h.DEKs[i], dec[aes256.TagSize+i*aes256.KeySize:])
-		if n != aes256.KeySize {
-			return nil, fmt.Errorf("can't read DEK %d/%d", i, numDEKs)
-		}
+// sealHeader writes a marshaled header to out, whose length must be the size
+// of the header: the plain header, the metadata section meta (if any), the
+// entries (DataTag || DEKs...), and the header tag.  The entries are
+// encrypted in place with kek, using the nonce for the given (outermost)
+// layer.  baseIV and meta may alias their positions in out.
+func sealHeader(out, baseIV, meta, kek []byte, layer int, entries ...[]byte) {
+	field := uint32(len(out))
+	if len(meta) > 0 {
+		field |= metadataFlag
 	}
+	binary.BigEndian.PutUint32(out, field)
+	copy(out[4:], baseIV)
+	encOff := plainHeaderSize + copy(out[plainHeaderSize:], meta)
 
-	h.DataTag = make([]byte, aes256.TagSize)
-	copy(h.DataTag, dec[:len(h.DataTag)])
+	enc := out[encOff : len(out)-aes256.TagSize]
+	n := 0
+	for _, e := range entries {
+		n += copy(enc[n:], e)
+	}
 
-	return h, nil
+	var nonce [aes256.NonceSize]byte
+	layerNonce(&nonce, out[4:plainHeaderSize], layer)
+	aes256.NewGCM(kek).Seal(enc[:0], nonce[:], enc, headerAD(out[:encOff], meta))
 }
@@ -2,8 +2,14 @@ package nestedaes
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
+	"log/slog"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/etclab/aes256"
 )
 
 func compareHeader(h1, h2 *Header) error {
@@ -74,3 +80,128 @@ func TestHeader(t *testing.T) {
 		t.Fatalf("h.Unmarshal: %v", err)
 	}
 }
+
+func TestHeaderRedacted(t *testing.T) {
+	dek := []byte("11111111111111111111111111111111")
+	iv := []byte("abcdefghijklmnop")
+	tag := []byte("qrstuvwxyzABCDEF")
+	h, err := NewHeader(iv, tag, dek)
+	if err != nil {
+		t.Fatalf("NewHeader failed: %v", err)
+	}
+	h.AddDEK([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	h.Metadata = Metadata{
+		MetaAADHash:   AADHash([]byte("tenant42")),
+		MetaRotatedAt: RotationTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+	}
+
+	leaks := func(s string) bool {
+		for _, dek := range h.DEKs {
+			if strings.Contains(s, string(dek)) ||
+				strings.Contains(s, hex.EncodeToString(dek)) ||
+				strings.Contains(s, fmt.Sprint(dek)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q"} {
+		for _, v := range []any{h, *h} {
+			s := fmt.Sprintf(format, v)
+			if leaks(s) {
+				t.Fatalf("formatting with %s leaks a DEK: %s", format, s)
+			}
+			if !strings.Contains(s, Fingerprint(h.DEKs[1])) {
+				t.Fatalf("formatting with %s is missing a DEK fingerprint: %s", format, s)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Info("header", "h", h)
+	if leaks(buf.String()) {
+		t.Fatalf("slog output leaks a DEK: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"layers":2`) {
+		t.Fatalf("slog output is missing the layer count: %s", buf.String())
+	}
+	for _, want := range []string{`"rotated-at":"2024-05-01T12:00:00Z"`, `"aad-hash":"` + hex.EncodeToString(AADHash([]byte("tenant42"))) + `"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("slog output is missing the metadata %s: %s", want, buf.String())
+		}
+	}
+
+	if !strings.Contains(h.DebugString(), hex.EncodeToString(h.DEKs[1])) {
+		t.Fatalf("DebugString is missing the raw DEK: %s", h.DebugString())
+	}
+}
+
+func TestHeaderWipe(t *testing.T) {
+	iv := []byte("abcdefghijklmnop")
+	tag := []byte("qrstuvwxyzABCDEF")
+	h, err := NewHeader(iv, tag, []byte("11111111111111111111111111111111"))
+	if err != nil {
+		t.Fatalf("NewHeader failed: %v", err)
+	}
+	h.AddDEK([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+
+	deks := h.DEKs
+	if err := h.Close(); err != nil {
+		t.Fatalf("h.Close failed: %v", err)
+	}
+
+	for i, dek := range deks {
+		if !isZero(dek) {
+			t.Fatalf("DEK %d was not wiped: %x", i, dek)
+		}
+	}
+	if !isZero(h.DataTag) {
+		t.Fatalf("DataTag was not wiped: %x", h.DataTag)
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUnmarshalPlainHeader(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+
+	kek := aes256.NewRandomKey()
+	iv := aes256.NewRandomIV()
+	blob, err := Encrypt(plain, kek, iv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		blob, kek, err = Reencrypt(blob, kek)
+		if err != nil {
+			t.Fatalf("reencrypt #%d failed: %v", i, err)
+		}
+	}
+
+	ph, err := UnmarshalPlainHeader(blob)
+	if err != nil {
+		t.Fatalf("UnmarshalPlainHeader failed: %v", err)
+	}
+	if !bytes.Equal(ph.BaseIV, iv) {
+		t.Fatalf("expected BaseIV %x, got %x", iv, ph.BaseIV)
+	}
+	if ph.Layers() != 5 {
+		t.Fatalf("expected 5 layers, got %d", ph.Layers())
+	}
+	if int(ph.Size) != len(blob)-len(plain) {
+		t.Fatalf("expected header size %d, got %d", len(blob)-len(plain), ph.Size)
+	}
+
+	if _, err := UnmarshalPlainHeader(blob[:10]); err == nil {
+		t.Fatalf("UnmarshalPlainHeader accepted a truncated header")
+	}
+}
@@ -0,0 +1,336 @@
+package httpstore
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/blobstore"
+)
+
+var (
+	_ blobstore.BlobStore = (*Client)(nil)
+	_ blobstore.Sizer     = (*Client)(nil)
+)
+
+// Client is a client of a [Server], for the key owner.  It implements
+// [blobstore.BlobStore]: its ApplyToken seals the token for the server (and
+// signs it, if the client has a Signer) before sending it.
+type Client struct {
+	base *url.URL
+
+	// HTTP is the client that sends the requests.  If it is nil,
+	// [http.DefaultClient] is used.
+	HTTP *http.Client
+	// ServerKey is the server's X25519 public key, for which tokens are
+	// sealed.  If it is nil, the client fetches it from the server on first
+	// use; set it to pin the key, so that a server that is impersonated
+	// can't learn the tokens' DEKs.
+	ServerKey *ecdh.PublicKey
+	// Signer, if not nil, signs the tokens and the uploads, for a server
+	// with a trust store.
+	Signer ed25519.PrivateKey
+	// MaxBlobSize is the largest blob that Get reads; if it is 0,
+	// [DefaultMaxBlobSize] is.  It doesn't limit Open.
+	MaxBlobSize int64
+
+	mu sync.Mutex
+}
+
+// NewClient returns a client of the server at baseURL, such as
+// "https://storage.example.com".
+func NewClient(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("httpstore: invalid base URL %q", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Client{base: u}, nil
+}
+
+// Get returns the blob stored under name, if it is no larger than the
+// MaxBlobSize.  For a large blob, use [Client.Open].
+func (c *Client) Get(name string) ([]byte, error) {
+	rc, err := c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	limit := c.MaxBlobSize
+	if limit == 0 {
+		limit = DefaultMaxBlobSize
+	}
+	return readAll(rc, limit, "blob")
+}
+
+// Open returns a reader of the blob stored under name, which streams it from
+// the server.  The caller must close it.
+func (c *Client) Open(name string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, c.blobURL("blobs", name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Size returns the size of the blob stored under name, which the server
+// reports without sending the blob.
+func (c *Client) Size(name string) (int64, error) {
+	resp, err := c.do(http.MethodHead, c.blobURL("blobs", name), nil, nil)
+	if err != nil {
+		// the response to a HEAD has no body to carry the error's code
+		var e *Error
+		if errors.As(err, &e) && e.Code == "" && e.StatusCode == http.StatusNotFound {
+			e.Code = "not_found"
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("httpstore: the server didn't report the size of %s", name)
+	}
+	return resp.ContentLength, nil
+}
+
+// Put stores a blob under name.
+func (c *Client) Put(name string, blob []byte) error {
+	return c.PutIf(name, blob, blobstore.Expect{})
+}
+
+// PutIf stores a blob under name if the blob stored there is as expected
+// (see [blobstore.BlobStore]).  A failed expectation is reported as an
+// [*Error] that wraps [blobstore.ErrConflict].
+func (c *Client) PutIf(name string, blob []byte, expect blobstore.Expect) error {
+	return c.send(http.MethodPut, c.blobURL("blobs", name), c.uploadHeader("blobs", name, expect, blob), blob)
+}
+
+// GetHeader returns the header of the blob stored under name.
+func (c *Client) GetHeader(name string) ([]byte, error) {
+	return c.fetch(c.blobURL("headers", name), nestedaes.MaxStreamHeaderSize, "header")
+}
+
+// PutHeader replaces the header of the blob stored under name (see
+// [blobstore.BlobStore]).
+func (c *Client) PutHeader(name string, header []byte) error {
+	return c.PutHeaderIf(name, header, blobstore.Expect{})
+}
+
+// PutHeaderIf replaces the header of the blob stored under name if the blob
+// is as expected (see [blobstore.BlobStore]).
+func (c *Client) PutHeaderIf(name string, header []byte, expect blobstore.Expect) error {
+	return c.send(http.MethodPut, c.blobURL("headers", name), c.uploadHeader("headers", name, expect, header), header)
+}
+
+// ApplyToken seals a token for the server, signs it if the client has a
+// Signer, and has the server apply it to the blob stored under name.  A
+// rejected token is reported as an [*Error] that wraps a
+// [*nestedaes.TokenError].  The token is not wiped.
+func (c *Client) ApplyToken(name string, t *nestedaes.Token) error {
+	key, err := c.serverKey()
+	if err != nil {
+		return err
+	}
+	sealed, err := nestedaes.SealToken(t, key)
+	if err != nil {
+		return err
+	}
+	if c.Signer == nil {
+		body, err := sealed.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return c.send(http.MethodPost, c.blobURL("tokens", name), contentType(SealedTokenType), body)
+	}
+	signed, err := nestedaes.SignToken(sealed, c.Signer)
+	if err != nil {
+		return err
+	}
+	body, err := signed.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.send(http.MethodPost, c.blobURL("tokens", name), contentType(SignedTokenType), body)
+}
+
+// List returns the names of the blobs whose names start with prefix, in
+// lexical order.
+func (c *Client) List(prefix string) ([]string, error) {
+	u := c.url("/v1/blobs")
+	u.RawQuery = url.Values{"prefix": {prefix}}.Encode()
+	resp, err := c.do(http.MethodGet, u, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Names []string `json:"names"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("httpstore: can't parse blob list: %w", err)
+	}
+	return body.Names, nil
+}
+
+// FetchServerKey fetches the server's X25519 public key.
+func (c *Client) FetchServerKey() (*ecdh.PublicKey, error) {
+	data, err := c.fetch(c.url("/v1/key"), maxKeySize, "key")
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("httpstore: invalid server key: %w", err)
+	}
+	return key, nil
+}
+
+// serverKey returns the ServerKey, which it fetches if it isn't set.
+func (c *Client) serverKey() (*ecdh.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ServerKey != nil {
+		return c.ServerKey, nil
+	}
+	key, err := c.FetchServerKey()
+	if err != nil {
+		return nil, err
+	}
+	c.ServerKey = key
+	return key, nil
+}
+
+func (c *Client) url(path string) *url.URL {
+	u := *c.base
+	u.Path += path
+	u.RawPath = ""
+	return &u
+}
+
+// blobURL returns the URL of a blob's resource.  (The url package escapes
+// the name, except for its slashes.)
+func (c *Client) blobURL(resource, name string) *url.URL {
+	return c.url("/v1/" + resource + "/" + name)
+}
+
+// maxKeySize bounds the body of GET /v1/key.
+const maxKeySize = 1024
+
+// fetch GETs a resource, and returns its body, which must be no larger than
+// limit; what is the resource's description, for errors.
+func (c *Client) fetch(u *url.URL, limit int64, what string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, u, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readAll(resp.Body, limit, what)
+}
+
+// readAll reads r to its end, unless it holds more than limit bytes.
+func readAll(r io.Reader, limit int64, what string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("httpstore: the %s exceeds %d bytes", what, limit)
+	}
+	return data, nil
+}
+
+// contentType returns the request header for a body of type t.
+func contentType(t string) http.Header {
+	return http.Header{"Content-Type": {t}}
+}
+
+// preconditions returns the request header for a PUT of an octet-stream
+// body, with the conditions that carry expect.
+func preconditions(expect blobstore.Expect) http.Header {
+	h := contentType("application/octet-stream")
+	if expect.HeaderHash != nil {
+		h.Set("If-Match", etag(expect.HeaderHash))
+	}
+	if expect.Layers > 0 {
+		h.Set(expectLayersHeader, strconv.Itoa(expect.Layers))
+	}
+	if expect.Absent {
+		h.Set("If-None-Match", "*")
+	}
+	return h
+}
+
+// uploadHeader returns the request header for a PUT of body to a blob's
+// resource: its preconditions, and its signature if the client has a
+// Signer.
+func (c *Client) uploadHeader(resource, name string, expect blobstore.Expect, body []byte) http.Header {
+	h := preconditions(expect)
+	if c.Signer != nil {
+		sum := sha256.Sum256(body)
+		h.Set(signatureHeader, signUpload(c.Signer, resource, name, h, time.Now(), sum[:]))
+	}
+	return h
+}
+
+// send sends a request with a body, whose response has no body.
+func (c *Client) send(method string, u *url.URL, header http.Header, body []byte) error {
+	resp, err := c.do(method, u, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request, and returns the response if it succeeded; otherwise,
+// it returns the server's [*Error].
+func (c *Client) do(method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	e := &Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(data, e) != nil || e.Message == "" {
+		e.Code, e.Detail = "", ""
+		e.Message = strings.TrimSpace(string(data))
+		if e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	return nil, e
+}
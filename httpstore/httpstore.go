@@ -0,0 +1,266 @@
+// Package httpstore serves a [blobstore.BlobStore] over HTTP, for the
+// storage side of the re-encryption protocol, and provides a client for it.
+//
+// The server ([Server]) never holds a KEK: it stores blobs, hands out their
+// headers, and applies the re-encryption tokens that the key owner derives
+// from those headers.  Tokens travel sealed for the server (see
+// [nestedaes.SealedToken]), and, if the server has a trust store, signed by
+// the key owner (see [nestedaes.SignedToken]).  The client ([Client])
+// implements [blobstore.BlobStore], so that a [blobstore.Rotator] can rotate
+// every blob of a remote store with only headers crossing the wire.
+//
+// The endpoints are
+//
+//	GET  /v1/key              the server's X25519 public key (32 bytes)
+//	GET  /v1/blobs?prefix=P   the names of the blobs, as JSON
+//	GET  /v1/blobs/NAME       the blob
+//	HEAD /v1/blobs/NAME       the blob's size, as the Content-Length
+//	PUT  /v1/blobs/NAME       store a blob
+//	GET  /v1/headers/NAME     the blob's header
+//	PUT  /v1/headers/NAME     replace the blob's header
+//	POST /v1/tokens/NAME      apply a sealed or signed token to the blob
+//
+// The responses to GET /v1/blobs/NAME and GET /v1/headers/NAME carry the
+// [nestedaes.HeaderHash] of the blob's latest header as their ETag, and the
+// PUTs accept the preconditions of a compare-and-swap update (see
+// [blobstore.Expect]): If-Match with that ETag, If-None-Match: * for a blob
+// that must not exist yet, and Nestedaes-Expect-Layers with the blob's
+// number of layers.  A failed precondition is reported with status 412
+// (Precondition Failed), and a token derived from an earlier header with
+// status 409 and "conflict": true (see [Error]).
+//
+// A server with a trust store (see [Server.Trust]) only accepts the PUTs
+// signed by one of its keys, with a Nestedaes-Signature request header of
+// three space-separated fields: the signer's Ed25519 public key in base64,
+// the time of the signature in Unix seconds, and the base64 signature.  The
+// signature covers the request's method, the blob's name and resource, the
+// time, the preconditions, and the SHA-256 of the body, and expires after
+// five minutes; within that time, the request can be replayed, which its
+// preconditions make fail once the blob has changed.
+//
+// Failures are reported with a JSON body (see [Error]).
+package httpstore
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/blobstore"
+)
+
+// The content types of the token bodies of POST /v1/tokens/NAME, which
+// carry the tokens' binary encodings.
+const (
+	SealedTokenType = "application/x-nestedaes-sealed-token"
+	SignedTokenType = "application/x-nestedaes-signed-token"
+)
+
+// expectLayersHeader is the request header with the expected number of
+// layers of a blob.
+const expectLayersHeader = "Nestedaes-Expect-Layers"
+
+// signatureHeader is the request header with the signature of an upload.
+const signatureHeader = "Nestedaes-Signature"
+
+// uploadContext prefixes the message that an upload's signature covers.
+const uploadContext = "nestedaes signed upload v1\x00"
+
+// maxUploadSkew is how far the time of an upload's signature may be from
+// the server's clock.
+const maxUploadSkew = 5 * time.Minute
+
+// ErrUnauthorized is the error of an upload to a server with a trust store
+// that is not signed by one of its keys.
+var ErrUnauthorized = errors.New("httpstore: the upload is not signed by a trusted key")
+
+// uploadMessage returns the message that the signature of a PUT to a blob's
+// resource ("blobs" or "headers") covers.  The fields are
+// length-prefixed, so that no two uploads have the same message.
+func uploadMessage(resource, name string, h http.Header, signedAt string, bodyHash []byte) []byte {
+	msg := []byte(uploadContext)
+	for _, field := range []string{http.MethodPut, resource, name, signedAt, h.Get("If-Match"), h.Get("If-None-Match"), h.Get(expectLayersHeader)} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(field)))
+		msg = append(msg, field...)
+	}
+	return append(msg, bodyHash...)
+}
+
+// signUpload returns the Nestedaes-Signature of an upload, signed by priv
+// at the given time.
+func signUpload(priv ed25519.PrivateKey, resource, name string, h http.Header, now time.Time, bodyHash []byte) string {
+	signedAt := strconv.FormatInt(now.Unix(), 10)
+	sig := ed25519.Sign(priv, uploadMessage(resource, name, h, signedAt, bodyHash))
+	pub := priv.Public().(ed25519.PublicKey)
+	return base64.StdEncoding.EncodeToString(pub) + " " + signedAt + " " + base64.StdEncoding.EncodeToString(sig)
+}
+
+// uploadSignature is the parsed Nestedaes-Signature of an upload.
+type uploadSignature struct {
+	signer   ed25519.PublicKey
+	signedAt string
+	sig      []byte
+}
+
+// parseUploadSignature parses the Nestedaes-Signature of an upload, and
+// checks that its signer is in the trust store and that it was made near
+// the time now.  The signature itself is checked by verify, once the body
+// is read.
+func parseUploadSignature(trust *nestedaes.TrustStore, h http.Header, now time.Time) (*uploadSignature, error) {
+	fields := strings.Fields(h.Get(signatureHeader))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("%w: missing or malformed %s", ErrUnauthorized, signatureHeader)
+	}
+	pub, err := base64.StdEncoding.DecodeString(fields[0])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid public key", ErrUnauthorized)
+	}
+	if !trust.Trusted(pub) {
+		return nil, fmt.Errorf("%w: untrusted signer %s", ErrUnauthorized, nestedaes.Fingerprint(pub))
+	}
+	signedAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature time", ErrUnauthorized)
+	}
+	if skew := now.Sub(time.Unix(signedAt, 0)); skew > maxUploadSkew || skew < -maxUploadSkew {
+		return nil, fmt.Errorf("%w: the signature is %v off the server's clock", ErrUnauthorized, skew.Round(time.Second))
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+	}
+	return &uploadSignature{signer: pub, signedAt: fields[1], sig: sig}, nil
+}
+
+// verify checks the signature of an upload to a blob's resource, whose body
+// has the SHA-256 bodyHash.
+func (us *uploadSignature) verify(resource, name string, h http.Header, bodyHash []byte) error {
+	if !ed25519.Verify(us.signer, uploadMessage(resource, name, h, us.signedAt, bodyHash), us.sig) {
+		return fmt.Errorf("%w: bad signature by %s", ErrUnauthorized, nestedaes.Fingerprint(us.signer))
+	}
+	return nil
+}
+
+// etag returns the ETag of a blob whose latest header has the given hash.
+func etag(headerHash []byte) string {
+	return `"` + hex.EncodeToString(headerHash) + `"`
+}
+
+// parseExpect returns the expectation that the preconditions of a request
+// carry.
+func parseExpect(h http.Header) (blobstore.Expect, error) {
+	var expect blobstore.Expect
+	if m := h.Get("If-Match"); m != "" {
+		hash, err := hex.DecodeString(strings.Trim(m, `"`))
+		if err != nil || len(hash) == 0 {
+			return expect, fmt.Errorf("%w: invalid If-Match %q", blobstore.ErrInvalid, m)
+		}
+		expect.HeaderHash = hash
+	}
+	if n := h.Get(expectLayersHeader); n != "" {
+		layers, err := strconv.Atoi(n)
+		if err != nil || layers < 1 {
+			return expect, fmt.Errorf("%w: invalid %s %q", blobstore.ErrInvalid, expectLayersHeader, n)
+		}
+		expect.Layers = layers
+	}
+	if m := h.Get("If-None-Match"); m != "" {
+		if m != "*" {
+			return expect, fmt.Errorf("%w: unsupported If-None-Match %q", blobstore.ErrInvalid, m)
+		}
+		expect.Absent = true
+	}
+	return expect, nil
+}
+
+// The error codes of the JSON error bodies, and the errors they stand for.
+var errorCodes = []struct {
+	code   string
+	err    error
+	status int
+	// token is true for the reasons of a [*nestedaes.TokenError]
+	token bool
+}{
+	{"token_malformed", nestedaes.ErrTokenMalformed, http.StatusBadRequest, true},
+	{"token_seal", nestedaes.ErrTokenSeal, http.StatusBadRequest, true},
+	{"token_untrusted", nestedaes.ErrTokenUntrusted, http.StatusForbidden, true},
+	{"token_signature", nestedaes.ErrTokenSignature, http.StatusForbidden, true},
+	{"token_wrong_blob", nestedaes.ErrTokenWrongBlob, http.StatusConflict, true},
+	{"token_applied", nestedaes.ErrTokenApplied, http.StatusConflict, true},
+	{"token_out_of_order", nestedaes.ErrTokenOutOfOrder, http.StatusConflict, true},
+	{"unauthorized", ErrUnauthorized, http.StatusForbidden, false},
+	// (a conflict may also wrap ErrNotFound)
+	{"conflict", blobstore.ErrConflict, http.StatusPreconditionFailed, false},
+	{"not_found", blobstore.ErrNotFound, http.StatusNotFound, false},
+	{"invalid", blobstore.ErrInvalid, http.StatusBadRequest, false},
+}
+
+// Error is a failure reported by the server.  It wraps the error that its
+// code stands for, if any, so that callers can check for, for instance,
+// [blobstore.ErrNotFound] or [nestedaes.ErrTokenApplied] with [errors.Is],
+// and get a token's rejection as a [*nestedaes.TokenError] with
+// [errors.As].
+type Error struct {
+	// StatusCode is the HTTP status code.
+	StatusCode int `json:"-"`
+	// Code identifies the kind of failure, such as "not_found"; it is empty
+	// for an unexpected failure.
+	Code string `json:"code,omitempty"`
+	// Message describes the failure.
+	Message string `json:"error"`
+	// Detail is the Detail of a token's rejection.
+	Detail string `json:"detail,omitempty"`
+	// Conflict is true for a token that was derived from an earlier header
+	// of the blob: the error then also wraps [blobstore.ErrConflict].
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("httpstore: %s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// Unwrap returns the error that the code stands for, and
+// [blobstore.ErrConflict] for a conflicting token.
+func (e *Error) Unwrap() []error {
+	var errs []error
+	for _, c := range errorCodes {
+		if c.code != e.Code {
+			continue
+		}
+		if c.token {
+			errs = append(errs, &nestedaes.TokenError{Reason: c.err, Detail: e.Detail})
+		} else {
+			errs = append(errs, c.err)
+		}
+		break
+	}
+	if e.Conflict && e.Code != "conflict" {
+		errs = append(errs, blobstore.ErrConflict)
+	}
+	return errs
+}
+
+// errorFor returns the Error that reports err.
+func errorFor(err error) *Error {
+	e := &Error{StatusCode: http.StatusInternalServerError, Message: err.Error()}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			e.StatusCode, e.Code = c.status, c.code
+			break
+		}
+	}
+	var te *nestedaes.TokenError
+	if errors.As(err, &te) {
+		e.Detail = te.Detail
+		e.Conflict = errors.Is(err, blobstore.ErrConflict)
+	}
+	return e
+}
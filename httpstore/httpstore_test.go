@@ -0,0 +1,491 @@
+package httpstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/audit"
+	"github.com/etclab/nestedaes/blobstore"
+)
+
+var testPlaintext = bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000)
+
+// newService starts a server over a blob store in a temporary directory,
+// and returns the server, its store, and a client of it.
+func newService(t *testing.T) (*Server, *blobstore.Dir, *Client) {
+	t.Helper()
+	d, err := blobstore.OpenDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.TokenKey = key
+	s := NewServer(d, key)
+	s.Logger = slog.New(slog.DiscardHandler)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	c, err := NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, d, c
+}
+
+func newBlob(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	kek := aes256.NewRandomKey()
+	blob, err := nestedaes.Encrypt(testPlaintext, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob, kek
+}
+
+func checkBlob(t *testing.T, s blobstore.BlobStore, name string, kek []byte) {
+	t.Helper()
+	blob, err := s.Get(name)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, err := nestedaes.Decrypt(blob, kek, nil)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if !bytes.Equal(got, testPlaintext) {
+		t.Fatalf("Decrypt produced the wrong plaintext")
+	}
+}
+
+// rekey derives a token from the latest header of name.
+func rekey(t *testing.T, s blobstore.BlobStore, name string, kek []byte) (*nestedaes.Token, []byte) {
+	t.Helper()
+	hdr, err := s.GetHeader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, newKEK, err := nestedaes.ReKeyGen(hdr, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok, newKEK
+}
+
+func TestClient(t *testing.T) {
+	_, d, c := newService(t)
+	blob, kek := newBlob(t)
+	for _, name := range []string{"tenant/a b", "tenant/c%3F", "other"} {
+		if err := c.Put(name, blob); err != nil {
+			t.Fatalf("Put(%q) failed: %v", name, err)
+		}
+	}
+	names, err := c.List("tenant/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"tenant/a b", "tenant/c%3F"}; !slices.Equal(names, want) {
+		t.Fatalf("List returned %q, expected %q", names, want)
+	}
+	// the names reach the store unchanged
+	checkBlob(t, d, "tenant/c%3F", kek)
+
+	hdr, err := c.GetHeader("tenant/a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _, _ := nestedaes.SplitHeaderPayload(blob); !bytes.Equal(hdr, want) {
+		t.Fatal("GetHeader returned the wrong header")
+	}
+
+	tok, newKEK := rekey(t, c, "tenant/a b", kek)
+	if err := c.ApplyToken("tenant/a b", tok); err != nil {
+		t.Fatalf("ApplyToken failed: %v", err)
+	}
+	checkBlob(t, c, "tenant/a b", newKEK)
+	checkBlob(t, d, "tenant/a b", newKEK)
+
+	rc, err := c.Open("tenant/a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nestedaes.Decrypt(streamed, newKEK, nil); err != nil {
+		t.Fatalf("Decrypt of the streamed blob failed: %v", err)
+	}
+
+	// a replayed token
+	err = c.ApplyToken("tenant/a b", tok)
+	var te *nestedaes.TokenError
+	if !errors.Is(err, nestedaes.ErrTokenApplied) || !errors.As(err, &te) {
+		t.Fatalf("expected a TokenError for ErrTokenApplied, got %v", err)
+	}
+	var he *Error
+	if !errors.As(err, &he) || he.StatusCode != http.StatusConflict {
+		t.Fatalf("expected HTTP 409, got %v", err)
+	}
+
+	if _, err := c.Get("missing"); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := c.Put("x", []byte("not a blob")); !errors.Is(err, blobstore.ErrInvalid) {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestRotatorOverHTTP(t *testing.T) {
+	_, d, c := newService(t)
+	keks := blobstore.NewMemoryKEKs()
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		blob, kek := newBlob(t)
+		if err := d.Put(name, blob); err != nil {
+			t.Fatal(err)
+		}
+		if err := keks.PutKEK(name, kek); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &blobstore.Rotator{Store: c, KEKs: keks, Workers: 2}
+	report, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Rotated != len(names) || len(report.Failed) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, name := range names {
+		kek, _, err := keks.GetKEK(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkBlob(t, d, name, kek)
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	s, d, c := newService(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Trust = nestedaes.NewTrustStore(pub)
+
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, newKEK := rekey(t, c, "a", kek)
+
+	// a sealed token that isn't signed
+	if err := c.ApplyToken("a", tok); !errors.Is(err, nestedaes.ErrTokenUntrusted) {
+		t.Fatalf("expected ErrTokenUntrusted for an unsigned token, got %v", err)
+	}
+	c.Signer = other
+	if err := c.ApplyToken("a", tok); !errors.Is(err, nestedaes.ErrTokenUntrusted) {
+		t.Fatalf("expected ErrTokenUntrusted for an untrusted signer, got %v", err)
+	}
+	checkBlob(t, d, "a", kek)
+
+	c.Signer = priv
+	if err := c.ApplyToken("a", tok); err != nil {
+		t.Fatalf("ApplyToken failed: %v", err)
+	}
+	checkBlob(t, d, "a", newKEK)
+}
+
+func TestTokenActor(t *testing.T) {
+	s, d, c := newService(t)
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	log.Actor = "server-process"
+	d.Audit = log
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Trust = nestedaes.NewTrustStore()
+	s.Trust.Add(pub, "alice")
+	c.Signer = priv
+
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, kek := rekey(t, c, "a", kek)
+	if err := c.ApplyToken("a", tok); err != nil {
+		t.Fatal(err)
+	}
+	s.Lazy = true
+	s.Trust.Add(pub, "")
+	tok, _ = rekey(t, c, "a", kek)
+	if err := c.ApplyToken("a", tok); err != nil {
+		t.Fatal(err)
+	}
+
+	var actors []string
+	if _, err := audit.VerifyFile(logPath, "", func(e *audit.Event) error {
+		if e.Kind == audit.KindApplyToken {
+			actors = append(actors, e.Actor)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"alice", nestedaes.Fingerprint(pub)}
+	if !slices.Equal(actors, want) {
+		t.Fatalf("expected the actors %q, got %q", want, actors)
+	}
+}
+
+func TestSignedUploads(t *testing.T) {
+	s, d, c := newService(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Trust = nestedaes.NewTrustStore(pub)
+	blob, kek := newBlob(t)
+
+	var he *Error
+	if err := c.Put("a", blob); !errors.Is(err, ErrUnauthorized) || !errors.As(err, &he) || he.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected ErrUnauthorized with HTTP 403 for an unsigned upload, got %v", err)
+	}
+	c.Signer = other
+	if err := c.Put("a", blob); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized for an untrusted signer, got %v", err)
+	}
+	c.Signer = priv
+	if err := c.Put("a", blob); err != nil {
+		t.Fatalf("signed Put failed: %v", err)
+	}
+	checkBlob(t, d, "a", kek)
+
+	// the signature covers the body, the blob's name, and the preconditions
+	hdr, _, _ := nestedaes.SplitHeaderPayload(blob)
+	rotated, err := nestedaes.RotateKEK(bytes.Clone(hdr), kek, aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.uploadHeader("headers", "a", blobstore.Expect{}, hdr)
+	for _, tc := range []struct {
+		name string
+		body []byte
+		h    http.Header
+	}{
+		{"a", rotated, h},
+		{"b", hdr, h},
+		{"a", hdr, func() http.Header { h := h.Clone(); h.Set("If-None-Match", "*"); return h }()},
+	} {
+		err := c.send(http.MethodPut, c.blobURL("headers", tc.name), tc.h, tc.body)
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("expected ErrUnauthorized for a tampered upload, got %v", err)
+		}
+	}
+
+	// an expired signature
+	sum := sha256.Sum256(hdr)
+	h.Set(signatureHeader, signUpload(priv, "headers", "a", h, time.Now().Add(-time.Hour), sum[:]))
+	if err := c.send(http.MethodPut, c.blobURL("headers", "a"), h, hdr); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized for an expired signature, got %v", err)
+	}
+	checkBlob(t, d, "a", kek)
+}
+
+func TestPinnedServerKey(t *testing.T) {
+	_, d, c := newService(t)
+	wrong, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ServerKey = wrong.PublicKey()
+
+	blob, kek := newBlob(t)
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, _ := rekey(t, c, "a", kek)
+	if err := c.ApplyToken("a", tok); !errors.Is(err, nestedaes.ErrTokenSeal) {
+		t.Fatalf("expected ErrTokenSeal for a token sealed for another key, got %v", err)
+	}
+	checkBlob(t, d, "a", kek)
+}
+
+func TestLazyServer(t *testing.T) {
+	s, d, c := newService(t)
+	s.Lazy = true
+	blob, kek := newBlob(t)
+	if err := c.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	tok, newKEK := rekey(t, c, "a", kek)
+	if err := c.ApplyToken("a", tok); err != nil {
+		t.Fatalf("ApplyToken failed: %v", err)
+	}
+	if n, err := d.Pending("a"); err != nil || n != 1 {
+		t.Fatalf("expected 1 pending layer, got %d (err %v)", n, err)
+	}
+	// the size counts the pending layer, without applying it
+	size, err := c.Size("a")
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	}
+	if n, err := d.Pending("a"); err != nil || n != 1 {
+		t.Fatalf("Size applied the pending layer (err %v)", err)
+	}
+	checkBlob(t, c, "a", newKEK)
+	if got, err := c.Get("a"); err != nil || size != int64(len(got)) {
+		t.Fatalf("Size returned %d, expected %d (err %v)", size, len(got), err)
+	}
+	if _, err := c.Size("missing"); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMaxBlobSize(t *testing.T) {
+	s, d, c := newService(t)
+	s.MaxBlobSize = 1024
+	blob, _ := newBlob(t)
+	var he *Error
+	if err := c.Put("a", blob); !errors.As(err, &he) || he.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected HTTP 413, got %v", err)
+	}
+
+	if err := d.Put("a", blob); err != nil {
+		t.Fatal(err)
+	}
+	c.MaxBlobSize = 1024
+	if _, err := c.Get("a"); err == nil {
+		t.Fatal("expected Get of a blob over the client's MaxBlobSize to fail")
+	}
+}
+
+// A store that can't stream blobs is read and written in memory.
+func TestMemoryServer(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := blobstore.NewMemory()
+	s := NewServer(m, key)
+	s.Logger = slog.New(slog.DiscardHandler)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	c, err := NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, kek := newBlob(t)
+	if err := c.Put("a", blob); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	checkBlob(t, m, "a", kek)
+	checkBlob(t, c, "a", kek)
+}
+
+func TestConflicts(t *testing.T) {
+	_, _, c := newService(t)
+	blob, kek := newBlob(t)
+	if err := c.PutIf("a", blob, blobstore.Expect{Absent: true}); err != nil {
+		t.Fatalf("PutIf of a new blob failed: %v", err)
+	}
+	var he *Error
+	err := c.PutIf("a", blob, blobstore.Expect{Absent: true})
+	if !errors.Is(err, blobstore.ErrConflict) || !errors.As(err, &he) || he.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected ErrConflict with HTTP 412, got %v", err)
+	}
+
+	hdr, err := c.GetHeader("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := blobstore.ExpectHeader(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok1, kek1, err := nestedaes.ReKeyGen(hdr, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok2, _, err := nestedaes.ReKeyGen(hdr, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ApplyToken("a", tok1); err != nil {
+		t.Fatal(err)
+	}
+	// the losing token of a race
+	err = c.ApplyToken("a", tok2)
+	var te *nestedaes.TokenError
+	if !errors.Is(err, blobstore.ErrConflict) || !errors.As(err, &te) {
+		t.Fatalf("expected ErrConflict and a TokenError, got %v", err)
+	}
+	// a header update from the stale header
+	rotated, err := nestedaes.RotateKEK(bytes.Clone(hdr), kek, aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutHeaderIf("a", rotated, blobstore.Expect{HeaderHash: expect.HeaderHash}); !errors.Is(err, blobstore.ErrConflict) {
+		t.Fatalf("expected ErrConflict for a stale header, got %v", err)
+	}
+	checkBlob(t, c, "a", kek1)
+
+	// the ETag of the latest header
+	resp, err := http.Get(c.blobURL("headers", "a").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	latest, err := c.GetHeader("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := nestedaes.HeaderHash(latest)
+	if got := resp.Header.Get("ETag"); got != etag(h) {
+		t.Fatalf("ETag is %s, expected %s", got, etag(h))
+	}
+	kek2 := aes256.NewRandomKey()
+	rotated, err = nestedaes.RotateKEK(bytes.Clone(latest), kek1, kek2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutHeaderIf("a", rotated, blobstore.Expect{HeaderHash: h, Layers: 2}); err != nil {
+		t.Fatalf("PutHeaderIf failed: %v", err)
+	}
+	checkBlob(t, c, "a", kek2)
+}
@@ -0,0 +1,394 @@
+package httpstore
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/blobstore"
+)
+
+// DefaultMaxBlobSize is the largest blob that a [Server] accepts, unless its
+// MaxBlobSize says otherwise.
+const DefaultMaxBlobSize = 1 << 30
+
+// maxTokenSize bounds the body of a token: the header, and the token's
+// other fields.
+const maxTokenSize = nestedaes.MaxStreamHeaderSize + 4096
+
+// queuer is implemented by the stores that can apply tokens lazily, such as
+// [blobstore.Dir].
+type queuer interface {
+	QueueTokenAs(name string, t *nestedaes.Token, actor string) error
+}
+
+// actorApplier is implemented by the stores that can record who applied a
+// token, such as [blobstore.Dir].
+type actorApplier interface {
+	ApplyTokenAs(name string, t *nestedaes.Token, actor string) error
+}
+
+// anonymousActor is the actor recorded for the tokens that aren't signed.
+const anonymousActor = "anonymous"
+
+// Server is the HTTP handler of the re-encryption service, over a blob
+// store.  It holds the server's X25519 key, for which tokens are sealed, but
+// never a KEK.
+type Server struct {
+	store blobstore.BlobStore
+	key   *ecdh.PrivateKey
+	mux   *http.ServeMux
+
+	// Trust, if not nil, is the set of keys whose tokens and uploads the
+	// server accepts: the server then only accepts signed tokens, and PUTs
+	// of blobs and headers that carry a signature (see the package
+	// documentation).  If it is nil, the server accepts sealed tokens and
+	// uploads from anyone who can reach it.
+	Trust *nestedaes.TrustStore
+	// Lazy makes the server queue tokens rather than apply them right away,
+	// if the store can (see [blobstore.Dir.QueueToken]).  A Dir seals the
+	// queued tokens at rest for its TokenKey, which is typically the
+	// server's key.
+	Lazy bool
+	// MaxBlobSize is the largest blob the server accepts; if it is 0,
+	// [DefaultMaxBlobSize] is.
+	MaxBlobSize int64
+	// Logger logs the requests that fail.  If it is nil, [slog.Default] is
+	// used.
+	Logger *slog.Logger
+}
+
+// NewServer returns a server for the blobs of store, that opens the tokens
+// sealed for key.
+func NewServer(store blobstore.BlobStore, key *ecdh.PrivateKey) *Server {
+	s := &Server{store: store, key: key, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /v1/key", s.getKey)
+	s.mux.HandleFunc("GET /v1/blobs", s.list)
+	s.mux.HandleFunc("GET /v1/blobs/{name...}", s.getBlob)
+	s.mux.HandleFunc("HEAD /v1/blobs/{name...}", s.headBlob)
+	s.mux.HandleFunc("PUT /v1/blobs/{name...}", s.putBlob)
+	s.mux.HandleFunc("GET /v1/headers/{name...}", s.getHeader)
+	s.mux.HandleFunc("PUT /v1/headers/{name...}", s.putHeader)
+	s.mux.HandleFunc("POST /v1/tokens/{name...}", s.applyToken)
+	return s
+}
+
+// ServeHTTP implements [http.Handler].
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request) {
+	writeBytes(w, s.key.PublicKey().Bytes())
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	names, err := s.store.List(r.URL.Query().Get("prefix"))
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Names []string `json:"names"`
+	}{names})
+}
+
+// getBlob streams the blob from the store, if it is a [blobstore.Streamer];
+// otherwise, it reads the whole blob.
+func (s *Server) getBlob(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	st, ok := s.store.(blobstore.Streamer)
+	if !ok {
+		blob, err := s.store.Get(name)
+		if err != nil {
+			s.fail(w, r, err)
+			return
+		}
+		setETag(w, blob)
+		writeBytes(w, blob)
+		return
+	}
+
+	rc, err := st.Open(name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	defer rc.Close()
+	hdr, err := nestedaes.ReadHeader(rc)
+	if err != nil {
+		s.fail(w, r, fmt.Errorf("httpstore: %s: %w", name, err))
+		return
+	}
+	setETag(w, hdr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if f, ok := rc.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		}
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		// the status is sent: the client sees a truncated body
+		s.logger().Warn("httpstore: can't send blob", "path", r.URL.Path, "err", err)
+	}
+}
+
+// headBlob reports the size of a blob without reading it, if the store is a
+// [blobstore.Sizer]; otherwise, it falls back to getBlob, whose body the
+// http package discards.
+func (s *Server) headBlob(w http.ResponseWriter, r *http.Request) {
+	sizer, ok := s.store.(blobstore.Sizer)
+	if !ok {
+		s.getBlob(w, r)
+		return
+	}
+	name := r.PathValue("name")
+	hdr, err := s.store.GetHeader(name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	size, err := sizer.Size(name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	setETag(w, hdr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+}
+
+func (s *Server) putBlob(w http.ResponseWriter, r *http.Request) {
+	expect, err := parseExpect(r.Header)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	limit := s.MaxBlobSize
+	if limit == 0 {
+		limit = DefaultMaxBlobSize
+	}
+	body, err := s.uploadBody(r, "blobs", http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	name := r.PathValue("name")
+	if st, ok := s.store.(blobstore.Streamer); ok {
+		err = st.PutStreamIf(name, body, expect)
+	} else {
+		var blob []byte
+		if blob, err = readBody(r, body, limit); err == nil {
+			err = s.store.PutIf(name, blob, expect)
+		}
+	}
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getHeader(w http.ResponseWriter, r *http.Request) {
+	hdr, err := s.store.GetHeader(r.PathValue("name"))
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	setETag(w, hdr)
+	writeBytes(w, hdr)
+}
+
+func (s *Server) putHeader(w http.ResponseWriter, r *http.Request) {
+	expect, err := parseExpect(r.Header)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	body, err := s.uploadBody(r, "headers", http.MaxBytesReader(w, r.Body, nestedaes.MaxStreamHeaderSize))
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	hdr, err := readBody(r, body, nestedaes.MaxStreamHeaderSize)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	if err := s.store.PutHeaderIf(r.PathValue("name"), hdr, expect); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) applyToken(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r, http.MaxBytesReader(w, r.Body, maxTokenSize), maxTokenSize)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	t, actor, err := s.openToken(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	defer t.Wipe()
+
+	name := r.PathValue("name")
+	if q, ok := s.store.(queuer); ok && s.Lazy {
+		err = q.QueueTokenAs(name, t, actor)
+	} else if a, ok := s.store.(actorApplier); ok {
+		err = a.ApplyTokenAs(name, t, actor)
+	} else {
+		err = s.store.ApplyToken(name, t)
+	}
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openToken decodes, verifies, and opens a token of the given content type.
+// It also returns the actor to record for the token: the name of its signer
+// in the trust store, or the signer's fingerprint if the key has no name.
+func (s *Server) openToken(contentType string, body []byte) (*nestedaes.Token, string, error) {
+	var sealed *nestedaes.SealedToken
+	actor := anonymousActor
+	switch contentType {
+	case SignedTokenType:
+		var st nestedaes.SignedToken
+		if err := st.UnmarshalBinary(body); err != nil {
+			return nil, "", err
+		}
+		var err error
+		if sealed, err = nestedaes.VerifyToken(&st, s.Trust); err != nil {
+			return nil, "", err
+		}
+		actor = nestedaes.Fingerprint(st.Signer)
+		if name, _ := s.Trust.Name(st.Signer); name != "" {
+			actor = name
+		}
+	case SealedTokenType:
+		if s.Trust != nil {
+			return nil, "", &nestedaes.TokenError{Reason: nestedaes.ErrTokenUntrusted, Detail: "the server only accepts signed tokens"}
+		}
+		sealed = new(nestedaes.SealedToken)
+		if err := sealed.UnmarshalBinary(body); err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", &nestedaes.TokenError{Reason: nestedaes.ErrTokenMalformed, Detail: fmt.Sprintf("unsupported content type %q", contentType)}
+	}
+	t, err := nestedaes.OpenToken(sealed, s.key)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, actor, nil
+}
+
+// uploadBody returns the reader of the body of an upload to a blob's
+// resource.  If the server has a trust store, it checks the upload's
+// signature: its signer and time right away, and the signature itself
+// when the body is read to its end, where the reader fails rather than
+// return io.EOF if the signature is bad.
+func (s *Server) uploadBody(r *http.Request, resource string, body io.Reader) (io.Reader, error) {
+	if s.Trust == nil {
+		return body, nil
+	}
+	us, err := parseUploadSignature(s.Trust, r.Header, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: body, h: sha256.New(), verify: func(sum []byte) error {
+		return us.verify(resource, r.PathValue("name"), r.Header, sum)
+	}}, nil
+}
+
+// verifyingReader hashes what it reads, and calls verify with the hash at
+// the end of its input.
+type verifyingReader struct {
+	r      io.Reader
+	h      hash.Hash
+	verify func(sum []byte) error
+	err    error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if verr := v.verify(v.h.Sum(nil)); verr != nil {
+			err = verr
+		}
+	}
+	v.err = err
+	return n, err
+}
+
+// fail reports err to the client, as an [Error].
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, err error) {
+	e := errorFor(err)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		e.StatusCode, e.Code = http.StatusRequestEntityTooLarge, ""
+	}
+	s.logger().Warn("httpstore: request failed", "method", r.Method, "path", r.URL.Path, "status", e.StatusCode, "err", err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.StatusCode)
+	json.NewEncoder(w).Encode(e)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// readBody reads the body of r from body, which is limited to limit bytes.
+func readBody(r *http.Request, body io.Reader, limit int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if r.ContentLength > 0 && r.ContentLength <= limit {
+		buf.Grow(int(r.ContentLength))
+	}
+	_, err := buf.ReadFrom(body)
+	return buf.Bytes(), err
+}
+
+// setETag sets the ETag of a response with a blob, or its header (see
+// [etag]).
+func setETag(w http.ResponseWriter, blob []byte) {
+	if h, err := nestedaes.HeaderHash(blob); err == nil {
+		w.Header().Set("ETag", etag(h))
+	}
+}
+
+func writeBytes(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
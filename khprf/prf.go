@@ -0,0 +1,87 @@
+package khprf
+
+import (
+	"crypto/rand"
+	"crypto/sha3"
+	"encoding/binary"
+
+	"github.com/etclab/mu"
+)
+
+// The PRF is F(k, x) = round_p(a_x * k), where a_x is a public element of R_q
+// derived from x by hashing, and round_p maps Z_q to Z_p by
+// round_p(v) = floor(v * p / q).  It is almost key-homomorphic:
+//
+//	F(k1 + k2, x) = F(k1, x) + F(k2, x) + e, with each coefficient of e in {0, 1}
+//
+// Since a_x is uniform in R_q, it is sampled directly in the NTT domain, and
+// keys are kept in the NTT domain (the NTT is linear, so key addition is
+// unaffected).
+const (
+	// p is the modulus of the PRF's output
+	p = 1 << 16
+	// coeffMask masks 4 bytes of SHAKE output to a candidate coefficient
+	coeffMask = 1<<30 - 1
+)
+
+// prfDomain separates the hashing of a_x from other uses of SHAKE128.
+var prfDomain = []byte("nestedaes/khprf a_x v1")
+
+// sampleA sets a to a_x, in the NTT domain, by rejection sampling SHAKE128
+// output.
+func sampleA(a *poly, x uint64) {
+	h := sha3.NewSHAKE128()
+	h.Write(prfDomain)
+	var xb [8]byte
+	binary.BigEndian.PutUint64(xb[:], x)
+	h.Write(xb[:])
+
+	var buf [4 * 64]byte
+	for i := 0; i < n; {
+		h.Read(buf[:])
+		for j := 0; j < len(buf) && i < n; j += 4 {
+			v := binary.LittleEndian.Uint32(buf[j:]) & coeffMask
+			if v < q {
+				a[i] = v
+				i++
+			}
+		}
+	}
+}
+
+// randomKey sets k to a uniformly random key (in the NTT domain).
+func randomKey(k *poly) {
+	var buf [4 * 64]byte
+	for i := 0; i < n; {
+		if _, err := rand.Read(buf[:]); err != nil {
+			mu.Panicf("khprf: rand.Read failed: %v", err)
+		}
+		for j := 0; j < len(buf) && i < n; j += 4 {
+			v := binary.LittleEndian.Uint32(buf[j:]) & coeffMask
+			if v < q {
+				k[i] = v
+				i++
+			}
+		}
+	}
+}
+
+// evaluator evaluates the PRF, reusing its scratch space.  The scratch holds
+// secret values; wipe wipes it.
+type evaluator struct {
+	a poly
+}
+
+// eval sets out to F(k, x), where k is in the NTT domain.
+func (e *evaluator) eval(out *[n]uint16, k *poly, x uint64) {
+	sampleA(&e.a, x)
+	e.a.mulNTT(&e.a, k)
+	e.a.invNTT()
+	for i, v := range e.a {
+		out[i] = uint16(uint64(v) * p / q)
+	}
+}
+
+func (e *evaluator) wipe() {
+	clear(e.a[:])
+}
@@ -0,0 +1,39 @@
+package khprf
+
+import (
+	"testing"
+)
+
+func TestAlmostKeyHomomorphic(t *testing.T) {
+	var k1, k2, k poly
+	randomKey(&k1)
+	randomKey(&k2)
+	k.add(&k1, &k2)
+
+	var e evaluator
+	var f1, f2, f [n]uint16
+	for x := uint64(0); x < 4; x++ {
+		e.eval(&f1, &k1, x)
+		e.eval(&f2, &k2, x)
+		e.eval(&f, &k, x)
+		for i := range f {
+			// F(k1 + k2, x) - F(k1, x) - F(k2, x) is in {0, 1}
+			if d := f[i] - f1[i] - f2[i]; d > 1 {
+				t.Fatalf("x=%d, coefficient %d: error %d is not in {0, 1}", x, i, d)
+			}
+		}
+	}
+}
+
+func TestSampleADeterministic(t *testing.T) {
+	var a1, a2, a3 poly
+	sampleA(&a1, 7)
+	sampleA(&a2, 7)
+	sampleA(&a3, 8)
+	if a1 != a2 {
+		t.Fatalf("sampleA is not deterministic")
+	}
+	if a1 == a3 {
+		t.Fatalf("sampleA gave the same element for different inputs")
+	}
+}
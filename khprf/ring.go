@@ -0,0 +1,133 @@
+package khprf
+
+// The ring is R_q = Z_q[X]/(X^n + 1).  The modulus q is a prime with
+// q = 1 (mod 2n), so that multiplication in R_q can be done with a
+// negacyclic number-theoretic transform (NTT).
+const (
+	// n is the degree of the ring
+	n = 1024
+	// q is the modulus of the ring (just under 2^30)
+	q = 1073707009
+	// psi is a primitive 2n-th root of unity mod q
+	psi = 110668061
+)
+
+// poly is an element of R_q, either in coefficient form or in the NTT
+// domain.  Each coefficient is in [0, q).
+type poly [n]uint32
+
+var (
+	// psiPows[i] is psi^i, which twists a polynomial before the cyclic NTT
+	psiPows [n]uint32
+	// invTwist[i] is n^-1 * psi^-i, which undoes the twist and scales the
+	// inverse NTT
+	invTwist [n]uint32
+	// omega and omegaInv are the n-th root of unity psi^2 and its inverse
+	omega, omegaInv uint32
+)
+
+func init() {
+	psiInv := powMod(psi, 2*n-1)
+	nInv := powMod(n, q-2)
+	pw, pwInv := uint32(1), nInv
+	for i := 0; i < n; i++ {
+		psiPows[i] = pw
+		invTwist[i] = pwInv
+		pw = mulMod(pw, psi)
+		pwInv = mulMod(pwInv, psiInv)
+	}
+	omega = mulMod(psi, psi)
+	omegaInv = powMod(omega, n-1)
+}
+
+func mulMod(a, b uint32) uint32 {
+	return uint32(uint64(a) * uint64(b) % q)
+}
+
+// addMod and subMod don't overflow, since q < 2^31.
+func addMod(a, b uint32) uint32 {
+	s := a + b
+	if s >= q {
+		s -= q
+	}
+	return s
+}
+
+func subMod(a, b uint32) uint32 {
+	if a >= b {
+		return a - b
+	}
+	return a + q - b
+}
+
+func powMod(a uint32, e uint64) uint32 {
+	r := uint32(1)
+	for ; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			r = mulMod(r, a)
+		}
+		a = mulMod(a, a)
+	}
+	return r
+}
+
+// add sets z = x + y.
+func (z *poly) add(x, y *poly) {
+	for i := range z {
+		z[i] = addMod(x[i], y[i])
+	}
+}
+
+// mulNTT sets z to the pointwise product of x and y, which must be in the
+// NTT domain.
+func (z *poly) mulNTT(x, y *poly) {
+	for i := range z {
+		z[i] = mulMod(x[i], y[i])
+	}
+}
+
+// ntt transforms a from coefficient form to the NTT domain, in place.
+func (a *poly) ntt() {
+	for i := range a {
+		a[i] = mulMod(a[i], psiPows[i])
+	}
+	a.cyclicNTT(omega)
+}
+
+// invNTT transforms a from the NTT domain to coefficient form, in place.
+func (a *poly) invNTT() {
+	a.cyclicNTT(omegaInv)
+	for i := range a {
+		a[i] = mulMod(a[i], invTwist[i])
+	}
+}
+
+// cyclicNTT is the iterative radix-2 Cooley-Tukey transform with the n-th
+// root of unity w.
+func (a *poly) cyclicNTT(w uint32) {
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+
+	for length := 2; length <= n; length <<= 1 {
+		wLen := powMod(w, uint64(n/length))
+		half := length / 2
+		for i := 0; i < n; i += length {
+			wj := uint32(1)
+			for j := 0; j < half; j++ {
+				u := a[i+j]
+				v := mulMod(a[i+j+half], wj)
+				a[i+j] = addMod(u, v)
+				a[i+j+half] = subMod(u, v)
+				wj = mulMod(wj, wLen)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package khprf
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func randomPoly(r *rand.Rand) *poly {
+	var a poly
+	for i := range a {
+		a[i] = r.Uint32N(q)
+	}
+	return &a
+}
+
+// schoolbookMul returns x*y in R_q, computed directly.
+func schoolbookMul(x, y *poly) *poly {
+	var z poly
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			prod := mulMod(x[i], y[j])
+			if k := i + j; k < n {
+				z[k] = addMod(z[k], prod)
+			} else {
+				// X^n = -1
+				z[k-n] = subMod(z[k-n], prod)
+			}
+		}
+	}
+	return &z
+}
+
+func TestRootOfUnity(t *testing.T) {
+	if powMod(psi, n) != q-1 {
+		t.Fatalf("psi^n != -1 mod q")
+	}
+}
+
+func TestNTTMul(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	x, y := randomPoly(r), randomPoly(r)
+	want := schoolbookMul(x, y)
+
+	xh, yh := *x, *y
+	xh.ntt()
+	yh.ntt()
+	var z poly
+	z.mulNTT(&xh, &yh)
+	z.invNTT()
+
+	if z != *want {
+		t.Fatalf("NTT multiplication differs from schoolbook multiplication")
+	}
+
+	// the transform is invertible
+	xh.invNTT()
+	if xh != *x {
+		t.Fatalf("invNTT(ntt(x)) != x")
+	}
+}
@@ -0,0 +1,378 @@
+// Package khprf implements the updatable encryption scheme of section 5 of
+// Boneh et al. ("Improving Speed and Security in Updatable Encryption
+// Schemes"), which is built from an almost key-homomorphic PRF, as a
+// [nestedaes.UpdatableScheme].
+//
+// Unlike the nested construction, re-encryption does not add a layer:
+// decryption costs the same however many times a ciphertext was updated.
+// The price is a ciphertext twice the size of the plaintext, a fixed header
+// of a few KiB, and a PRF that is much slower than AES.
+//
+// The PRF is F(k, x) = round_p(a_x * k) in the ring Z_q[X]/(X^n + 1), which
+// is secure under the Ring Learning With Rounding assumption.  Each
+// plaintext byte is encoded as a 16-bit coefficient whose low byte is
+// padding, and is encrypted by adding a coefficient of F(k, j), for the
+// block number j.  An update with the token Δ adds F(Δ, j), which gives a
+// ciphertext under k + Δ up to an error of at most one per coefficient; the
+// errors accumulate in the padding, so that a ciphertext can be updated at
+// most [MaxUpdates] times.
+//
+// The header, sealed with AES-GCM under the key (a KEK), holds the PRF key,
+// the plaintext's length, and a hash of the plaintext and the additional
+// data, which decryption checks.  Since the padding absorbs errors, integrity
+// is relaxed: a change to the padding of a ciphertext may go undetected, but
+// then the ciphertext still decrypts to the original plaintext.
+//
+// Ciphertexts are linkable across updates: the header's BlobID is chosen
+// when the plaintext is first encrypted, is kept by every update (tokens are
+// bound to it), and is not encrypted, as is the count of updates.  Anyone
+// who sees a ciphertext before and after an update can thus tell that both
+// are the same blob, as with the BaseIV of a nested blob.  The scheme hides
+// the plaintext, and makes old keys useless for new ciphertexts, but does
+// not hide which ciphertexts are updates of one another.
+package khprf
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/mu"
+	"github.com/etclab/nestedaes"
+)
+
+// MaxUpdates is the number of times a ciphertext can be updated.
+const MaxUpdates = 255
+
+// The header is
+//
+//	BlobID || Updates || Nonce || GCM_kek(Key || Hash || Length) || Tag
+//
+// where BlobID is random (and fixed for the blob's lifetime, which makes its
+// ciphertexts linkable), Updates is the number of updates (a uint32), and
+// Key is the PRF key, in the NTT domain (n uint32 coefficients).  BlobID,
+// Updates, and Nonce are the additional data of the GCM encryption.
+const (
+	blobIDSize     = 16
+	plainHeaderLen = blobIDSize + 4 + aes256.NonceSize
+	keyLen         = 4 * n
+	sealedLen      = keyLen + sha256.Size + 8
+	headerSize     = plainHeaderLen + sealedLen + aes256.TagSize
+
+	// blockSize is the number of plaintext bytes per block, and
+	// blockCiphertextSize its size in the ciphertext.
+	blockSize           = n
+	blockCiphertextSize = 2 * n
+)
+
+// ErrAuth is returned when a ciphertext fails to authenticate.
+var ErrAuth = errors.New("khprf: message authentication failed")
+
+// Scheme is the updatable encryption scheme.  Its keys are AES-256 keys,
+// and its tokens are [*Token]s.
+type Scheme struct{}
+
+// Token is the token of the [Scheme]: the header of the updated ciphertext
+// and the difference between the PRF keys, in the NTT domain.
+type Token struct {
+	Header []byte
+	Delta  []uint32
+}
+
+// Wipe satisfies the [nestedaes.UpdateToken] interface.
+func (t *Token) Wipe() {
+	clear(t.Delta)
+	t.Header = nil
+	t.Delta = nil
+}
+
+// header is an opened header.
+type header struct {
+	blobID  []byte
+	updates uint32
+	key     poly
+	hash    []byte
+	length  uint64
+}
+
+func (h *header) wipe() {
+	clear(h.key[:])
+}
+
+// Name satisfies the [nestedaes.UpdatableScheme] interface.
+func (Scheme) Name() string {
+	return "khprf"
+}
+
+// KeyGen satisfies the [nestedaes.UpdatableScheme] interface.
+func (Scheme) KeyGen() ([]byte, error) {
+	key := nestedaes.AllocKey(aes256.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		mu.Panicf("khprf: rand.Read failed: %v", err)
+	}
+	return key, nil
+}
+
+// Encrypt satisfies the [nestedaes.UpdatableScheme] interface.  The PRF key
+// and the BlobID are randomly generated.
+func (Scheme) Encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	if len(key) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(key))
+	}
+
+	blocks := (len(plaintext) + blockSize - 1) / blockSize
+	out := make([]byte, headerSize+blocks*blockCiphertextSize)
+
+	h := header{blobID: make([]byte, blobIDSize), length: uint64(len(plaintext))}
+	defer h.wipe()
+	if _, err := rand.Read(h.blobID); err != nil {
+		mu.Panicf("khprf: rand.Read failed: %v", err)
+	}
+	randomKey(&h.key)
+	h.hash = plaintextHash(plaintext, additionalData)
+	sealHeader(out[:headerSize], key, &h)
+
+	var e evaluator
+	defer e.wipe()
+	var f [n]uint16
+	defer clear(f[:])
+	body := out[headerSize:]
+	for j := 0; j < blocks; j++ {
+		e.eval(&f, &h.key, uint64(j))
+		block := body[j*blockCiphertextSize : (j+1)*blockCiphertextSize]
+		for i := range f {
+			var m uint16
+			if k := j*blockSize + i; k < len(plaintext) {
+				m = uint16(plaintext[k])
+			}
+			binary.BigEndian.PutUint16(block[2*i:], (m<<8|0xFF)+f[i])
+		}
+	}
+	return out, nil
+}
+
+// Header satisfies the [nestedaes.UpdatableScheme] interface.
+func (Scheme) Header(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < headerSize {
+		return nil, fmt.Errorf("khprf: ciphertext (%d bytes) is smaller than the header (%d bytes)", len(ciphertext), headerSize)
+	}
+	return ciphertext[:headerSize], nil
+}
+
+// ReKeyGen satisfies the [nestedaes.UpdatableScheme] interface.  The
+// difference of the PRF keys is randomly generated, and the token's header
+// is sealed under newKey.  ReKeyGen fails if the ciphertext was already
+// updated [MaxUpdates] times.
+func (s Scheme) ReKeyGen(key, newKey, hdr []byte) (nestedaes.UpdateToken, error) {
+	if len(newKey) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newKey))
+	}
+	h, err := openHeader(key, hdr)
+	if err != nil {
+		return nil, err
+	}
+	defer h.wipe()
+	if h.updates >= MaxUpdates {
+		return nil, fmt.Errorf("khprf: ciphertext was already updated %d times", h.updates)
+	}
+
+	var delta poly
+	randomKey(&delta)
+	h.key.add(&h.key, &delta)
+	h.updates++
+
+	t := &Token{Header: make([]byte, headerSize), Delta: make([]uint32, n)}
+	sealHeader(t.Header, newKey, h)
+	copy(t.Delta, delta[:])
+	clear(delta[:])
+	return t, nil
+}
+
+// ReEncrypt satisfies the [nestedaes.UpdatableScheme] interface.  The
+// ciphertext is updated in place.  The token must have been derived from
+// the ciphertext's current header.  The additionalData is not needed, and is
+// ignored.
+func (Scheme) ReEncrypt(token nestedaes.UpdateToken, ciphertext, additionalData []byte) ([]byte, error) {
+	t, ok := token.(*Token)
+	if !ok {
+		return nil, fmt.Errorf("khprf: token of type %T is not a *khprf.Token", token)
+	}
+	if len(t.Header) != headerSize || len(t.Delta) != n {
+		return nil, fmt.Errorf("khprf: malformed token")
+	}
+	if err := checkSize(ciphertext); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(ciphertext[:blobIDSize], t.Header[:blobIDSize]) != 1 {
+		return nil, fmt.Errorf("khprf: token is for another ciphertext")
+	}
+	if got, want := headerUpdates(t.Header), headerUpdates(ciphertext)+1; got != want {
+		return nil, fmt.Errorf("khprf: token is for update %d, but the ciphertext is at update %d", got, want-1)
+	}
+
+	var delta poly
+	defer clear(delta[:])
+	copy(delta[:], t.Delta)
+	for _, v := range delta {
+		if v >= q {
+			return nil, fmt.Errorf("khprf: malformed token")
+		}
+	}
+
+	var e evaluator
+	defer e.wipe()
+	var f [n]uint16
+	defer clear(f[:])
+	body := ciphertext[headerSize:]
+	for j := 0; j < len(body)/blockCiphertextSize; j++ {
+		e.eval(&f, &delta, uint64(j))
+		block := body[j*blockCiphertextSize : (j+1)*blockCiphertextSize]
+		for i := range f {
+			c := binary.BigEndian.Uint16(block[2*i:])
+			binary.BigEndian.PutUint16(block[2*i:], c+f[i])
+		}
+	}
+	copy(ciphertext, t.Header)
+	return ciphertext, nil
+}
+
+// Decrypt satisfies the [nestedaes.UpdatableScheme] interface.  The
+// plaintext shares the ciphertext's storage.
+func (Scheme) Decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	if err := checkSize(ciphertext); err != nil {
+		return nil, err
+	}
+	h, err := openHeader(key, ciphertext[:headerSize])
+	if err != nil {
+		return nil, err
+	}
+	defer h.wipe()
+
+	body := ciphertext[headerSize:]
+	blocks := len(body) / blockCiphertextSize
+	if uint64(blocks) != (h.length+blockSize-1)/blockSize {
+		return nil, fmt.Errorf("khprf: ciphertext has %d blocks, but the plaintext has %d bytes", blocks, h.length)
+	}
+
+	// the padding is at least 0xFF minus the number of updates, since each
+	// update subtracts at most one
+	minPad := uint16(0xFF - h.updates)
+	var bad uint16
+	var e evaluator
+	defer e.wipe()
+	var f [n]uint16
+	defer clear(f[:])
+	plaintext := ciphertext[:h.length]
+	for j := 0; j < blocks; j++ {
+		e.eval(&f, &h.key, uint64(j))
+		// the plaintext is written behind the block being read
+		block := body[j*blockCiphertextSize : (j+1)*blockCiphertextSize]
+		for i := range f {
+			v := binary.BigEndian.Uint16(block[2*i:]) - f[i]
+			m, pad := v>>8, v&0xFF
+			if pad < minPad {
+				bad |= 1
+			}
+			if k := j*blockSize + i; k < len(plaintext) {
+				plaintext[k] = byte(m)
+			} else {
+				bad |= m
+			}
+		}
+	}
+
+	hash := plaintextHash(plaintext, additionalData)
+	if bad != 0 || subtle.ConstantTimeCompare(hash, h.hash) != 1 {
+		nestedaes.Wipe(plaintext)
+		return nil, ErrAuth
+	}
+	return plaintext, nil
+}
+
+// checkSize checks that ciphertext has a header and whole blocks.
+func checkSize(ciphertext []byte) error {
+	if len(ciphertext) < headerSize || (len(ciphertext)-headerSize)%blockCiphertextSize != 0 {
+		return fmt.Errorf("khprf: invalid ciphertext size (%d bytes)", len(ciphertext))
+	}
+	return nil
+}
+
+func headerUpdates(hdr []byte) uint32 {
+	return binary.BigEndian.Uint32(hdr[blobIDSize:])
+}
+
+// plaintextHash returns SHA-256(LEN(additionalData) || additionalData ||
+// plaintext).
+func plaintextHash(plaintext, additionalData []byte) []byte {
+	d := sha256.New()
+	var l [8]byte
+	binary.BigEndian.PutUint64(l[:], uint64(len(additionalData)))
+	d.Write(l[:])
+	d.Write(additionalData)
+	d.Write(plaintext)
+	return d.Sum(nil)
+}
+
+// sealHeader marshals h into out, which is headerSize bytes, and seals it
+// under kek with a random nonce.
+func sealHeader(out, kek []byte, h *header) {
+	copy(out, h.blobID)
+	binary.BigEndian.PutUint32(out[blobIDSize:], h.updates)
+	nonce := out[blobIDSize+4 : plainHeaderLen]
+	if _, err := rand.Read(nonce); err != nil {
+		mu.Panicf("khprf: rand.Read failed: %v", err)
+	}
+
+	sealed := out[plainHeaderLen:plainHeaderLen]
+	for _, v := range h.key {
+		sealed = binary.BigEndian.AppendUint32(sealed, v)
+	}
+	sealed = append(sealed, h.hash...)
+	sealed = binary.BigEndian.AppendUint64(sealed, h.length)
+	aes256.NewGCM(kek).Seal(sealed[:0], nonce, sealed, out[:plainHeaderLen])
+}
+
+// openHeader opens the header hdr with kek.  hdr is not modified.
+func openHeader(kek, hdr []byte) (*header, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+	if len(hdr) != headerSize {
+		return nil, fmt.Errorf("khprf: invalid header size (%d bytes)", len(hdr))
+	}
+
+	sealed := nestedaes.AllocKey(sealedLen + aes256.TagSize)
+	defer nestedaes.FreeKey(sealed)
+	copy(sealed, hdr[plainHeaderLen:])
+	nonce := hdr[blobIDSize+4 : plainHeaderLen]
+	dec, err := aes256.NewGCM(kek).Open(sealed[:0], nonce, sealed, hdr[:plainHeaderLen])
+	if err != nil {
+		return nil, err
+	}
+
+	h := &header{
+		blobID:  hdr[:blobIDSize],
+		updates: headerUpdates(hdr),
+		hash:    append([]byte(nil), dec[keyLen:keyLen+sha256.Size]...),
+		length:  binary.BigEndian.Uint64(dec[keyLen+sha256.Size:]),
+	}
+	for i := range h.key {
+		h.key[i] = binary.BigEndian.Uint32(dec[4*i:])
+		if h.key[i] >= q {
+			h.wipe()
+			return nil, fmt.Errorf("khprf: malformed header")
+		}
+	}
+	if h.updates > MaxUpdates {
+		h.wipe()
+		return nil, fmt.Errorf("khprf: malformed header")
+	}
+	return h, nil
+}
+
+var _ nestedaes.UpdatableScheme = Scheme{}
@@ -0,0 +1,88 @@
+package khprf_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/etclab/nestedaes/khprf"
+	"github.com/etclab/nestedaes/schemetest"
+)
+
+func TestConformance(t *testing.T) {
+	schemetest.Run(t, khprf.Scheme{}, schemetest.RelaxedIntegrity())
+}
+
+// A ciphertext decrypts after the maximum number of updates, and can't be
+// updated again.
+func TestMaxUpdates(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	var s khprf.Scheme
+	plaintext := bytes.Repeat([]byte{0x00, 0xFF, 0x80}, 400)
+	key, _ := s.KeyGen()
+	ct, err := s.Encrypt(key, plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < khprf.MaxUpdates; i++ {
+		newKey, _ := s.KeyGen()
+		hdr, err := s.Header(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := s.ReKeyGen(key, newKey, hdr)
+		if err != nil {
+			t.Fatalf("update %d: ReKeyGen failed: %v", i, err)
+		}
+		if ct, err = s.ReEncrypt(tok, ct, nil); err != nil {
+			t.Fatalf("update %d: ReEncrypt failed: %v", i, err)
+		}
+		tok.Wipe()
+		key = newKey
+	}
+
+	got, err := s.Decrypt(key, bytes.Clone(ct), nil)
+	if err != nil {
+		t.Fatalf("Decrypt failed after %d updates: %v", khprf.MaxUpdates, err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("Decrypt returned the wrong plaintext after %d updates", khprf.MaxUpdates)
+	}
+
+	newKey, _ := s.KeyGen()
+	hdr, _ := s.Header(ct)
+	if _, err := s.ReKeyGen(key, newKey, hdr); err == nil {
+		t.Fatalf("ReKeyGen accepted a ciphertext updated %d times", khprf.MaxUpdates)
+	}
+}
+
+func TestReEncryptMismatch(t *testing.T) {
+	var s khprf.Scheme
+	key, _ := s.KeyGen()
+	newKey, _ := s.KeyGen()
+	ct, err := s.Encrypt(key, []byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Encrypt(key, []byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, _ := s.Header(ct)
+	tok, err := s.ReKeyGen(key, newKey, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReEncrypt(tok, other, nil); err == nil {
+		t.Fatalf("ReEncrypt accepted a token for another ciphertext")
+	}
+	if ct, err = s.ReEncrypt(tok, ct, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReEncrypt(tok, ct, nil); err == nil {
+		t.Fatalf("ReEncrypt applied the same token twice")
+	}
+}
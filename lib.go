@@ -2,8 +2,11 @@ package nestedaes
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"maps"
 
 	"github.com/etclab/aes256"
 	"github.com/etclab/mu"
@@ -11,20 +14,26 @@ import (
 
 const KeySize = aes256.KeySize
 
+// Overhead is the number of bytes a freshly encrypted (single-layer) blob
+// adds to the plaintext: the marshaled header with a single DEK.  Each
+// re-encryption grows the header by another [KeySize] bytes.
+const Overhead = 4 + aes256.IVSize + aes256.TagSize + aes256.KeySize + aes256.TagSize
+
 // SplitHeaderPayload takes a nestedaes encrypted slice of bytes and returns
 // it's two components: the header bytes and the payload bytes.  If the slice
 // is too small to contain a valid heaeder, Split HeaderPayload returns an
 // error.
 func SplitHeaderPayload(blob []byte) ([]byte, []byte, error) {
-	var hSize uint32
+	var field uint32
 	r := bytes.NewReader(blob)
-	binary.Read(r, binary.BigEndian, &hSize)
+	binary.Read(r, binary.BigEndian, &field)
 
-	if hSize > uint32(len(blob)) {
+	hSize, _ := headerSize(field)
+	if hSize > len(blob) {
 		return nil, nil, fmt.Errorf("header size (%d bytes) is >= blob size (%d bytes)", hSize, len(blob))
 	}
 
-	return blob[:int(hSize)], blob[int(hSize):], nil
+	return blob[:hSize], blob[hSize:], nil
 }
 
 // Encrypt encrypts the plaintext and returns the encrypted blob.  The function
@@ -34,99 +43,148 @@ func SplitHeaderPayload(blob []byte) ([]byte, []byte, error) {
 // subsequent layer of encryption uses a different IV derived from the BaseIV.
 // The same IV must never be passed to this function more than once.
 //
-// Note that this function overwriets the plaintext slice to hold the new
-// ciphertext.  On success, the functoin outputs the new blob; otherwise, it
-// returns an error.
+// The blob is written to a single, newly allocated buffer; the plaintext
+// slice is not modified.  To control the allocation, use [AppendEncrypt].  On
+// success, the function outputs the new blob; otherwise, it returns an error.
 func Encrypt(plaintext, kek, iv, additionalData []byte) ([]byte, error) {
-	// encrypt the plaintext
-	dek := aes256.NewRandomKey()
-	nonce := aes256.NewZeroNonce()
-	payload := aes256.EncryptGCM(dek, nonce, plaintext, additionalData)
+	return AppendEncrypt(nil, plaintext, kek, iv, additionalData)
+}
 
-	// separate the ciphertext from the AEAD tag
-	payload, tag, err := aes256.SplitCiphertextTag(payload)
-	if err != nil {
-		mu.Panicf("nestedaes.Encrypt: %v", err)
-	}
+// AppendEncrypt is like [Encrypt], but appends the blob to dst and returns
+// the updated slice.  If dst has at least Overhead+len(plaintext)+TagSize
+// bytes of spare capacity, AppendEncrypt does not allocate a buffer for the
+// blob.  To reuse plaintext's storage for the blob, use plaintext[:0] as dst;
+// otherwise, the spare capacity of dst must not overlap plaintext.
+func AppendEncrypt(dst, plaintext, kek, iv, additionalData []byte) ([]byte, error) {
+	return AppendEncryptWithMetadata(dst, plaintext, kek, iv, additionalData, nil)
+}
 
-	// create the ciphertext header
-	h, err := NewHeader(iv, tag, dek)
-	if err != nil {
-		return nil, err
+// EncryptWithMetadata is like [Encrypt], but records md in the blob's header.
+// The metadata is authenticated under the KEK, but is not encrypted: anyone
+// can read it with [UnmarshalPlainHeader].  Re-encryption and KEK rotation
+// preserve it.  For instance, to make decryption with the wrong additional
+// data fail with [ErrAADMismatch], record its hash:
+//
+//	md := nestedaes.Metadata{nestedaes.MetaAADHash: nestedaes.AADHash(ad)}
+//	blob, err := nestedaes.EncryptWithMetadata(plaintext, kek, iv, ad, md)
+func EncryptWithMetadata(plaintext, kek, iv, additionalData []byte, md Metadata) ([]byte, error) {
+	return AppendEncryptWithMetadata(nil, plaintext, kek, iv, additionalData, md)
+}
+
+// AppendEncryptWithMetadata is like [AppendEncrypt], but records md in the
+// blob's header (see [EncryptWithMetadata]).  The header grows by the size of
+// the encoded metadata.
+func AppendEncryptWithMetadata(dst, plaintext, kek, iv, additionalData []byte, md Metadata) ([]byte, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+	if len(iv) != aes256.IVSize {
+		return nil, aes256.IVSizeError(len(iv))
+	}
+	metaSize := encodedMetadataSize(md)
+	if metaSize > maxMetadataSize {
+		return nil, fmt.Errorf("metadata (%d bytes) exceeds %d bytes", metaSize, maxMetadataSize)
 	}
 
-	// concat header and payload
-	hData, err := h.Marshal(kek)
-	if err != nil {
-		return nil, err
+	// the extra TagSize bytes of capacity hold the GCM tag of the payload
+	// until it is moved into the header
+	hSize := Overhead + metaSize
+	ret, out := sliceForAppend(dst, hSize+len(plaintext), aes256.TagSize)
+	hdr, payload := out[:hSize], out[hSize:]
+
+	// move the plaintext into place first, so that writing the header can't
+	// clobber a plaintext that shares storage with dst
+	copy(payload, plaintext)
+
+	// encrypt the plaintext
+	var dek [aes256.KeySize]byte
+	defer Wipe(dek[:])
+	if _, err := rand.Read(dek[:]); err != nil {
+		mu.Panicf("nestedaes.AppendEncrypt: rand.Read failed: %v", err)
 	}
-	w := new(bytes.Buffer)
-	w.Write(hData)
-	w.Write(payload)
-	return w.Bytes(), nil
+	var nonce [aes256.NonceSize]byte
+	sealed := aes256.NewGCM(dek[:]).Seal(payload[:0], nonce[:], payload, additionalData)
+	tag := sealed[len(payload):]
+
+	// create the ciphertext header: DataTag || DEK, encrypted in place with
+	// the KEK.  The metadata is encoded into its place in the header.
+	meta, _ := appendMetadata(hdr[plainHeaderSize:plainHeaderSize], md)
+	sealHeader(hdr, iv, meta, kek, 0, tag, dek[:])
+
+	return ret, nil
 }
 
 // Reencrypt reencrypts the blob by generating a new random KEK and DEK.  On
 // success, the function returns th new blobl and KEK; otherwise, it returns an
-// error.
+// error.  The new KEK is allocated with [AllocKey]; the caller should release
+// it with [FreeKey] once it has been stored.
 //
-// NOte taht this function modifies the input blob slice.
+// Note that this function modifies the input blob slice; see [ReencryptInto].
 func Reencrypt(blob, kek []byte) ([]byte, []byte, error) {
-	hData, payload, err := SplitHeaderPayload(blob)
-	if err != nil {
-		return nil, nil, err
-	}
+	newKEK := newRandomKey()
+	newDEK := newRandomKey()
+	defer FreeKey(newDEK)
 
-	h, err := UnmarshalHeader(kek, hData)
+	blob, err := ReencryptInto(blob, kek, newKEK, newDEK)
 	if err != nil {
+		FreeKey(newKEK)
 		return nil, nil, err
 	}
-
-	newKEK := aes256.NewRandomKey()
-	newDEK := aes256.NewRandomKey()
-	h.AddDEK(newDEK)
-
-	iv := aes256.CopyIV(h.BaseIV)
-	aes256.AddIV(iv, len(h.DEKs)-1)
-	aes256.EncryptCTR(newDEK, iv, payload)
-
-	hData, err = h.Marshal(newKEK)
-	if err != nil {
-		return nil, nil, err
-	}
-	w := new(bytes.Buffer)
-	w.Write(hData)
-	w.Write(payload)
-	return w.Bytes(), newKEK, nil
+	return blob, newKEK, nil
 }
 
 // ReencryptWithKeys is the same as [Rencrypt], but it allows the caller to
 // specify the new KEK and DEK, rather than having them be randomly generated.
 func ReencryptWithKeys(blob, kek, newKEK, newDEK []byte) ([]byte, error) {
-	hData, payload, err := SplitHeaderPayload(blob)
-	if err != nil {
-		return nil, err
+	return ReencryptInto(blob, kek, newKEK, newDEK)
+}
+
+// ReencryptInto reencrypts the blob in place with the caller-specified KEK and
+// DEK, and returns the updated blob.  Each layer of encryption grows the
+// header by [KeySize] bytes; if blob has at least that much spare capacity,
+// ReencryptInto does not allocate a buffer for the new blob, and the returned
+// slice shares blob's storage.  In either case, the contents of blob are
+// overwritten.
+func ReencryptInto(blob, kek, newKEK, newDEK []byte) ([]byte, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+	if len(newKEK) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newKEK))
+	}
+	if len(newDEK) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newDEK))
 	}
 
-	h, err := UnmarshalHeader(kek, hData)
+	sp := getScratch()
+	defer putScratch(sp)
+
+	hSize, meta, dec, err := openHeader(kek, blob, *sp)
 	if err != nil {
 		return nil, err
 	}
+	*sp = dec[:0]
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
 
-	h.AddDEK(newDEK)
+	var baseIV [aes256.IVSize]byte
+	copy(baseIV[:], blob[4:])
 
-	iv := aes256.CopyIV(h.BaseIV)
-	aes256.AddIV(iv, len(h.DEKs)-1)
-	aes256.EncryptCTR(newDEK, iv, payload)
+	// make room for the new DEK entry by shifting the payload
+	newHSize := hSize + aes256.KeySize
+	ret, _ := sliceForAppend(blob, aes256.KeySize, 0)
+	payload := ret[newHSize:]
+	copy(payload, ret[hSize:len(blob)])
 
-	hData, err = h.Marshal(newKEK)
-	if err != nil {
-		return nil, err
-	}
-	w := new(bytes.Buffer)
-	w.Write(hData)
-	w.Write(payload)
-	return w.Bytes(), nil
+	// add the new layer of encryption
+	var iv [aes256.IVSize]byte
+	layerIV(&iv, baseIV[:], numDEKs)
+	aes256.NewCTR(newDEK, iv[:]).XORKeyStream(payload, payload)
+
+	// rewrite the header; the metadata, if any, stays in place (or is read
+	// from the old storage, if sliceForAppend reallocated)
+	sealHeader(ret[:newHSize], baseIV[:], meta, newKEK, numDEKs, dec, newDEK)
+
+	return ret, nil
 }
 
 // Decrypt performed the nexted decryption of blob.  The function returns the
@@ -134,36 +192,140 @@ func ReencryptWithKeys(blob, kek, newKEK, newDEK []byte) ([]byte, error) {
 // represents any additionalData passed as part of the original call to
 // [Encrypt] which is included in the GCM tag.
 //
-// Note that this function modifies the blob input parameter.
+// Note that this function modifies the blob input parameter: the returned
+// plaintext shares blob's storage.
 func Decrypt(blob, kek []byte, additionalData []byte) ([]byte, error) {
-	hData, payload, err := SplitHeaderPayload(blob)
+	return DecryptTo(blob[:0], blob, kek, additionalData)
+}
+
+// DecryptTo is like [Decrypt], but appends the plaintext to dst and returns
+// the updated slice.  If dst has at least len(payload)+TagSize bytes of spare
+// capacity, DecryptTo does not allocate a buffer for the plaintext.  The blob
+// is not modified unless it shares storage with dst; to decrypt in place, use
+// blob[:0] as dst.
+func DecryptTo(dst, blob, kek, additionalData []byte) ([]byte, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+
+	sp := getScratch()
+	defer putScratch(sp)
+
+	hSize, meta, dec, err := openHeader(kek, blob, *sp)
 	if err != nil {
 		return nil, err
 	}
+	*sp = dec[:0]
+	if err := checkAAD(meta, additionalData); err != nil {
+		return nil, err
+	}
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
+
+	// save the parts of the header we still need, as dst may overlap blob
+	var baseIV [aes256.IVSize]byte
+	copy(baseIV[:], blob[4:])
+	var tag [aes256.TagSize]byte
+	copy(tag[:], dec)
+
+	// the extra TagSize bytes hold the DataTag, which GCM expects to follow
+	// the ciphertext
+	payload := blob[hSize:]
+	ret, out := sliceForAppend(dst, len(payload), aes256.TagSize)
+	copy(out, payload)
+
+	// peel off the CTR layers, starting from the outermost
+	var iv [aes256.IVSize]byte
+	for i := numDEKs - 1; i > 0; i-- {
+		layerIV(&iv, baseIV[:], i)
+		dek := dec[aes256.TagSize+i*aes256.KeySize : aes256.TagSize+(i+1)*aes256.KeySize]
+		aes256.NewCTR(dek, iv[:]).XORKeyStream(out, out)
+	}
+
+	dek := dec[aes256.TagSize : aes256.TagSize+aes256.KeySize]
+	ct := out[:len(out)+aes256.TagSize]
+	copy(ct[len(out):], tag[:])
+	var nonce [aes256.NonceSize]byte
+	if _, err := aes256.NewGCM(dek).Open(out[:0], nonce[:], ct, additionalData); err != nil {
+		// don't leave the unauthenticated, partially decrypted payload
+		// behind
+		Wipe(ct)
+		return nil, err
+	}
+	Wipe(ct[len(out):])
+
+	return ret, nil
+}
+
+// RotateKEK re-wraps the blob's encrypted header under newKEK, without adding
+// a layer of encryption to the payload.  This is cheap (the payload is
+// untouched), but unlike [Reencrypt] it does not change the DEKs; an
+// adversary that learned the old DEKs can still decrypt the blob.
+//
+// Note that this function modifies the blob in place and returns it.
+func RotateKEK(blob, kek, newKEK []byte) ([]byte, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+	if len(newKEK) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newKEK))
+	}
 
-	h, err := UnmarshalHeader(kek, hData)
+	sp := getScratch()
+	defer putScratch(sp)
+
+	hSize, meta, dec, err := openHeader(kek, blob, *sp)
 	if err != nil {
 		return nil, err
 	}
+	*sp = dec[:0]
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
+
+	sealHeader(blob[:hSize], blob[4:plainHeaderSize], meta, newKEK, numDEKs-1, dec)
 
-	iv := aes256.CopyIV(h.BaseIV)
-	aes256.AddIV(iv, len(h.DEKs)-1) // fast-forward to largest IV
+	return blob, nil
+}
 
-	i := len(h.DEKs) - 1
-	for i > 0 {
-		dek := h.DEKs[i]
-		aes256.DecryptCTR(dek, iv, payload)
-		aes256.DecIV(iv)
-		i--
+// Compact replaces a multi-layer blob with a fresh, single-layer encryption
+// of the same plaintext under newKEK and the new BaseIV iv.  Decrypting a
+// blob costs one pass over the payload per layer; compacting resets that
+// cost.  The additionalData must match the value passed to [Encrypt].  The
+// header's metadata, if any, is carried over to the new blob.
+//
+// Note that this function modifies the blob input parameter; the plaintext is
+// wiped before Compact returns.
+func Compact(blob, kek, newKEK, iv, additionalData []byte) ([]byte, error) {
+	return CompactWithMetadata(blob, kek, newKEK, iv, additionalData, nil)
+}
+
+// CompactWithMetadata is like [Compact], but md's entries are added to the
+// metadata carried over to the new blob, replacing the entries with the same
+// tags.
+func CompactWithMetadata(blob, kek, newKEK, iv, additionalData []byte, md Metadata) ([]byte, error) {
+	ph, err := UnmarshalPlainHeader(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(md) > 0 {
+		merged := make(Metadata, len(ph.Metadata)+len(md))
+		maps.Copy(merged, ph.Metadata)
+		maps.Copy(merged, md)
+		ph.Metadata = merged
 	}
 
-	dek := h.DEKs[i]
-	nonce := aes256.NewZeroNonce()
-	payload = append(payload, h.DataTag...)
-	plaintext, err := aes256.DecryptGCM(dek, nonce, payload, additionalData)
+	plaintext, err := Decrypt(blob, kek, additionalData)
 	if err != nil {
 		return nil, err
 	}
 
-	return plaintext, nil
+	ret, err := AppendEncryptWithMetadata(plaintext[:0], plaintext, newKEK, iv, additionalData, ph.Metadata)
+	if err != nil {
+		Wipe(plaintext)
+		return nil, err
+	}
+	// if AppendEncrypt had to allocate, the plaintext was left behind
+	if len(plaintext) > 0 && &ret[0] != &plaintext[0] {
+		Wipe(plaintext)
+	}
+
+	return ret, nil
 }
@@ -89,6 +89,210 @@ func TestReencryptMany(t *testing.T) {
 	}
 }
 
+func TestAppendEncryptInPlace(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	want := bytes.Clone(plain)
+
+	kek := aes256.NewRandomKey()
+	iv := aes256.NewRandomIV()
+
+	buf := make([]byte, len(plain), len(plain)+Overhead+aes256.TagSize)
+	copy(buf, plain)
+	blob, err := AppendEncrypt(buf[:0], buf, kek, iv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &blob[0] != &buf[0] {
+		t.Fatalf("AppendEncrypt allocated despite sufficient capacity")
+	}
+
+	h, err := UnmarshalHeader(kek, blob[:Overhead])
+	if err != nil {
+		t.Fatalf("UnmarshalHeader failed: %v", err)
+	}
+	if !bytes.Equal(h.BaseIV, iv) {
+		t.Fatalf("expected BaseIV %x, got %x", iv, h.BaseIV)
+	}
+
+	got, err := DecryptTo(nil, blob, kek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("expected decrypt to produce %x, got %x", want, got)
+	}
+}
+
+func TestReencryptInto(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+
+	kek := aes256.NewRandomKey()
+	iv := aes256.NewRandomIV()
+	const layers = 10
+
+	buf := make([]byte, 0, len(plain)+Overhead+aes256.TagSize+layers*KeySize)
+	blob, err := AppendEncrypt(buf, plain, kek, iv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < layers; i++ {
+		newKEK := aes256.NewRandomKey()
+		blob, err = ReencryptInto(blob, kek, newKEK, aes256.NewRandomKey())
+		if err != nil {
+			t.Fatalf("reencrypt #%d failed: %v", i, err)
+		}
+		if &blob[0] != &buf[:1][0] {
+			t.Fatalf("ReencryptInto allocated despite sufficient capacity")
+		}
+		kek = newKEK
+	}
+
+	if len(blob) != len(plain)+Overhead+layers*KeySize {
+		t.Fatalf("expected blob of %d bytes, got %d", len(plain)+Overhead+layers*KeySize, len(blob))
+	}
+
+	got, err := Decrypt(blob, kek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, got) {
+		t.Fatalf("expected decrypt to produce %x, got %x", plain, got)
+	}
+}
+
+func TestDecryptToConstantAllocs(t *testing.T) {
+	kek := aes256.NewRandomKey()
+
+	allocs := func(size int) float64 {
+		blob, err := Encrypt(make([]byte, size), kek, aes256.NewRandomIV(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			newKEK := aes256.NewRandomKey()
+			blob, err = ReencryptWithKeys(blob, kek, newKEK, aes256.NewRandomKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			kek = newKEK
+		}
+		dst := make([]byte, 0, size+aes256.TagSize)
+		return testing.AllocsPerRun(10, func() {
+			if _, err := DecryptTo(dst, blob, kek, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	small, large := allocs(KiB), allocs(MiB)
+	if small != large {
+		t.Fatalf("DecryptTo allocations depend on payload size: %v for 1 KiB, %v for 1 MiB", small, large)
+	}
+}
+
+func TestRotateKEK(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, kek, err = Reencrypt(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(blob)
+
+	newKEK := aes256.NewRandomKey()
+	blob, err = RotateKEK(blob, kek, newKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blob) != size {
+		t.Fatalf("expected RotateKEK to keep the blob at %d bytes, got %d", size, len(blob))
+	}
+
+	if _, err := Decrypt(bytes.Clone(blob), kek, nil); err == nil {
+		t.Fatalf("decrypt succeeded with the old KEK")
+	}
+	got, err := Decrypt(blob, newKEK, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, got) {
+		t.Fatalf("expected decrypt to produce %x, got %x", plain, got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	ad := []byte("object-name")
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		blob, kek, err = Reencrypt(blob, kek)
+		if err != nil {
+			t.Fatalf("reencrypt #%d failed: %v", i, err)
+		}
+	}
+
+	newKEK := aes256.NewRandomKey()
+	blob, err = Compact(blob, kek, newKEK, aes256.NewRandomIV(), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blob) != len(plain)+Overhead {
+		t.Fatalf("expected compacted blob of %d bytes, got %d", len(plain)+Overhead, len(blob))
+	}
+
+	got, err := Decrypt(blob, newKEK, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, got) {
+		t.Fatalf("expected decrypt to produce %x, got %x", plain, got)
+	}
+}
+
+func TestScratchWiped(t *testing.T) {
+	sp := getScratch()
+	*sp = append(*sp, "decrypted header material"...)
+	buf := (*sp)[:cap(*sp)]
+	putScratch(sp)
+
+	if !isZero(buf) {
+		t.Fatalf("scratch buffer was not wiped")
+	}
+}
+
+func TestDecryptToWipesOnFailure(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), []byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, kek, err = Reencrypt(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := make([]byte, 0, len(plain)+aes256.TagSize)
+	if _, err := DecryptTo(dst, blob, kek, []byte("wrong")); err == nil {
+		t.Fatalf("DecryptTo succeeded with the wrong additional data")
+	}
+	if !isZero(dst[:cap(dst)]) {
+		t.Fatalf("DecryptTo left intermediate plaintext in dst: %x", dst[:cap(dst)])
+	}
+}
+
 func createFileOfSizeB(b *testing.B, path string, size int) {
 	f, err := os.Create(path)
 	if err != nil {
@@ -184,3 +388,76 @@ func BenchmarkDecrypt(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkAppendEncrypt(b *testing.B) {
+	kek := aes256.NewRandomKey()
+	for _, size := range [...]int{KiB, MiB, 10 * MiB} {
+		b.Run(fmt.Sprintf("size:%d", size), func(b *testing.B) {
+			plain := make([]byte, size)
+			dst := make([]byte, 0, size+Overhead+aes256.TagSize)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				_, err := AppendEncrypt(dst, plain, kek, aes256.NewRandomIV(), nil)
+				if err != nil {
+					b.Fatalf("nestedaes.AppendEncrypt failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecryptTo(b *testing.B) {
+	kek := aes256.NewRandomKey()
+	for _, size := range [...]int{KiB, MiB, 10 * MiB} {
+		b.Run(fmt.Sprintf("size:%d", size), func(b *testing.B) {
+			blob, err := Encrypt(make([]byte, size), kek, aes256.NewRandomIV(), nil)
+			if err != nil {
+				b.Fatalf("encrypt failed: %v", err)
+			}
+			dst := make([]byte, 0, size+aes256.TagSize)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				_, err := DecryptTo(dst, blob, kek, nil)
+				if err != nil {
+					b.Fatalf("nestedaes.DecryptTo failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReencryptInto(b *testing.B) {
+	for _, size := range [...]int{KiB, MiB, 10 * MiB} {
+		b.Run(fmt.Sprintf("size:%d", size), func(b *testing.B) {
+			// the blob grows by one DEK per iteration, so size its buffer
+			// for a bounded number of layers and start over when it is full
+			const maxLayers = 256
+			buf := make([]byte, 0, size+Overhead+aes256.TagSize+maxLayers*KeySize)
+			plain := make([]byte, size)
+			kek, newKEK := aes256.NewRandomKey(), aes256.NewRandomKey()
+			newDEK := aes256.NewRandomKey()
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			var blob []byte
+			layers := maxLayers
+			for b.Loop() {
+				if layers == maxLayers {
+					b.StopTimer()
+					blob, _ = AppendEncrypt(buf, plain, kek, aes256.NewRandomIV(), nil)
+					layers = 1
+					b.StartTimer()
+				}
+				var err error
+				blob, err = ReencryptInto(blob, kek, newKEK, newDEK)
+				if err != nil {
+					b.Fatalf("nestedaes.ReencryptInto failed: %v", err)
+				}
+				kek, newKEK = newKEK, kek
+				layers++
+			}
+		})
+	}
+}
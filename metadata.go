@@ -0,0 +1,198 @@
+package nestedaes
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// metadataFlag is set in the header's Size field when the plain header
+// includes a metadata section.  The remaining bits are the header size.
+const metadataFlag = 1 << 31
+
+// maxMetadataSize is the largest encoded metadata section (its length field
+// is 16 bits).
+const maxMetadataSize = 1<<16 - 1
+
+// MetadataTag identifies an entry of a header's [Metadata].
+type MetadataTag uint8
+
+const (
+	// MetaAADHash is the SHA-256 hash of the additional data passed to
+	// [Encrypt] (see [AADHash]).  When present, decryption checks the
+	// additional data against it, and fails with [ErrAADMismatch] rather
+	// than a generic authentication error.
+	MetaAADHash MetadataTag = 1
+	// MetaRotatedAt is the time of the blob's last rotation, as recorded by
+	// the key owner (see [RotationTime]).  Since metadata is authenticated
+	// under the KEK, the time can be trusted once the header is opened
+	// with [UnmarshalHeader].
+	MetaRotatedAt MetadataTag = 2
+)
+
+// String returns the name of a known tag, such as "aad-hash", or
+// "MetadataTag(N)" for an unknown one.
+func (t MetadataTag) String() string {
+	switch t {
+	case MetaAADHash:
+		return "aad-hash"
+	case MetaRotatedAt:
+		return "rotated-at"
+	default:
+		return fmt.Sprintf("MetadataTag(%d)", uint8(t))
+	}
+}
+
+// Metadata is optional header data that is authenticated (as additional
+// data of the header's GCM encryption) but not encrypted, and thus can be
+// read without the KEK.  Metadata must never hold secrets.  Entries with
+// tags this package doesn't know are preserved.
+type Metadata map[MetadataTag][]byte
+
+// ErrAADMismatch is returned by decryption when the blob's header records an
+// AAD hash (see [MetaAADHash]) that doesn't match the given additional data.
+var ErrAADMismatch = errors.New("nestedaes: additional data does not match the AAD hash recorded in the header")
+
+// AADHash returns the hash of additionalData that the [MetaAADHash] entry
+// records.
+//
+// The hash is not secret, so an adversary can test guesses of
+// low-entropy additional data (such as a file name) against it.
+func AADHash(additionalData []byte) []byte {
+	sum := sha256.Sum256(additionalData)
+	return sum[:]
+}
+
+// RotationTime returns the value of the [MetaRotatedAt] entry that records
+// t: the Unix time in seconds, as an 8-byte big-endian integer.
+func RotationTime(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.Unix()))
+}
+
+// ParseRotationTime parses the value of a [MetaRotatedAt] entry.
+func ParseRotationTime(v []byte) (time.Time, error) {
+	if len(v) != 8 {
+		return time.Time{}, fmt.Errorf("rotation time is %d bytes, expected 8", len(v))
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(v)), 0).UTC(), nil
+}
+
+// tags returns the tags of md in order.
+func (md Metadata) tags() []MetadataTag {
+	tags := make([]MetadataTag, 0, len(md))
+	for tag := range md {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// encodedMetadataSize is the size of the metadata section for md: a 2-byte
+// length followed by the entries, each a 1-byte tag, 2-byte length, and
+// value.  It is 0 when md is empty, since the section is then omitted.
+func encodedMetadataSize(md Metadata) int {
+	if len(md) == 0 {
+		return 0
+	}
+	n := 2
+	for _, v := range md {
+		n += 3 + len(v)
+	}
+	return n
+}
+
+// appendMetadata appends the metadata section for md, with the entries in
+// tag order.
+func appendMetadata(dst []byte, md Metadata) ([]byte, error) {
+	size := encodedMetadataSize(md)
+	if size == 0 {
+		return dst, nil
+	}
+	if size > maxMetadataSize {
+		return nil, fmt.Errorf("metadata (%d bytes) exceeds %d bytes", size, maxMetadataSize)
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, uint16(size-2))
+	for _, tag := range md.tags() {
+		v := md[tag]
+		dst = append(dst, byte(tag))
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(v)))
+		dst = append(dst, v...)
+	}
+	return dst, nil
+}
+
+// mergeMetadata returns the encoded metadata section of meta (a metadata
+// section, possibly nil) with the entries of md added, replacing the entries
+// with the same tags.
+func mergeMetadata(meta []byte, md Metadata) ([]byte, error) {
+	if len(md) == 0 {
+		return meta, nil
+	}
+	merged, err := parseMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	if merged == nil {
+		merged = make(Metadata)
+	}
+	maps.Copy(merged, md)
+	return appendMetadata(nil, merged)
+}
+
+// parseMetadata parses a metadata section (including its length field).
+func parseMetadata(section []byte) (Metadata, error) {
+	if len(section) == 0 {
+		return nil, nil
+	}
+
+	md := make(Metadata)
+	entries := section[2:]
+	for len(entries) > 0 {
+		if len(entries) < 3 {
+			return nil, fmt.Errorf("metadata has a partial entry")
+		}
+		tag := MetadataTag(entries[0])
+		n := int(binary.BigEndian.Uint16(entries[1:]))
+		if len(entries) < 3+n {
+			return nil, fmt.Errorf("metadata entry %d is truncated", tag)
+		}
+		if _, ok := md[tag]; ok {
+			return nil, fmt.Errorf("metadata has duplicate entry %d", tag)
+		}
+		md[tag] = slices.Clone(entries[3 : 3+n])
+		entries = entries[3+n:]
+	}
+	return md, nil
+}
+
+// checkAAD checks additionalData against the AAD hash, if any, in a metadata
+// section.  It does not allocate.
+func checkAAD(section, additionalData []byte) error {
+	if len(section) == 0 {
+		return nil
+	}
+
+	entries := section[2:]
+	for len(entries) >= 3 {
+		tag := MetadataTag(entries[0])
+		n := int(binary.BigEndian.Uint16(entries[1:]))
+		if len(entries) < 3+n {
+			break
+		}
+		if tag == MetaAADHash {
+			sum := sha256.Sum256(additionalData)
+			if subtle.ConstantTimeCompare(sum[:], entries[3:3+n]) != 1 {
+				return ErrAADMismatch
+			}
+			return nil
+		}
+		entries = entries[3+n:]
+	}
+	return nil
+}
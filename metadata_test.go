@@ -0,0 +1,205 @@
+package nestedaes
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/etclab/aes256"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	ad := []byte("tenant-42/object-7")
+	md := Metadata{MetaAADHash: AADHash(ad), 200: []byte("unknown")}
+
+	kek := aes256.NewRandomKey()
+	blob, err := EncryptWithMetadata(plain, kek, aes256.NewRandomIV(), ad, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// re-encryption, KEK rotation, and compaction all preserve the metadata
+	blob, kek, err = Reencrypt(blob, kek)
+	if err != nil {
+		t.Fatalf("Reencrypt failed: %v", err)
+	}
+	newKEK := aes256.NewRandomKey()
+	blob, err = RotateKEK(blob, kek, newKEK)
+	if err != nil {
+		t.Fatalf("RotateKEK failed: %v", err)
+	}
+	kek = newKEK
+	var out bytes.Buffer
+	if _, err := ReencryptStream(&out, bytes.NewReader(blob), kek, newKEK, aes256.NewRandomKey()); err != nil {
+		t.Fatalf("ReencryptStream failed: %v", err)
+	}
+	blob = out.Bytes()
+
+	ph, err := UnmarshalPlainHeader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ph.Layers() != 3 {
+		t.Fatalf("expected 3 layers, got %d", ph.Layers())
+	}
+	if len(ph.Metadata) != 2 || !bytes.Equal(ph.Metadata[MetaAADHash], md[MetaAADHash]) || !bytes.Equal(ph.Metadata[200], md[200]) {
+		t.Fatalf("expected metadata %x, got %x", md, ph.Metadata)
+	}
+
+	blob, err = Compact(blob, kek, kek, aes256.NewRandomIV(), ad)
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	ph, err = UnmarshalPlainHeader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ph.Layers() != 1 || len(ph.Metadata) != 2 {
+		t.Fatalf("expected a single layer and 2 metadata entries after Compact, got %d and %d", ph.Layers(), len(ph.Metadata))
+	}
+
+	got, err := Decrypt(blob, kek, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("expected decrypt to produce %x, got %x", plain, got)
+	}
+}
+
+func TestAADMismatch(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	ad := []byte("foo.enc")
+
+	kek := aes256.NewRandomKey()
+	md := Metadata{MetaAADHash: AADHash(ad)}
+	blob, err := EncryptWithMetadata(plain, kek, aes256.NewRandomIV(), ad, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decrypt(bytes.Clone(blob), kek, []byte("bar.enc")); !errors.Is(err, ErrAADMismatch) {
+		t.Fatalf("expected ErrAADMismatch from Decrypt, got %v", err)
+	}
+	if _, err := DecryptStream(io.Discard, bytes.NewReader(blob), kek, nil); !errors.Is(err, ErrAADMismatch) {
+		t.Fatalf("expected ErrAADMismatch from DecryptStream, got %v", err)
+	}
+	if _, err := DecryptStream(io.Discard, bytes.NewReader(blob), kek, ad); err != nil {
+		t.Fatalf("DecryptStream failed: %v", err)
+	}
+
+	// without a recorded hash, a mismatch is a generic authentication failure
+	blob, err = Encrypt(plain, kek, aes256.NewRandomIV(), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(blob, kek, []byte("bar.enc")); err == nil || errors.Is(err, ErrAADMismatch) {
+		t.Fatalf("expected an authentication failure, got %v", err)
+	}
+}
+
+func TestMetadataAuthenticated(t *testing.T) {
+	ad := []byte("foo.enc")
+	kek := aes256.NewRandomKey()
+	md := Metadata{MetaAADHash: AADHash(ad)}
+	blob, err := EncryptWithMetadata([]byte("hello"), kek, aes256.NewRandomIV(), ad, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// swap in the hash of other additional data: the header no longer
+	// authenticates, so the substitution can't go unnoticed
+	other := AADHash([]byte("bar.enc"))
+	copy(blob[plainHeaderSize+2+3:], other)
+	_, err = Decrypt(blob, kek, []byte("bar.enc"))
+	if err == nil {
+		t.Fatalf("Decrypt accepted tampered metadata")
+	}
+	if errors.Is(err, ErrAADMismatch) {
+		t.Fatalf("expected a header authentication failure, got %v", err)
+	}
+}
+
+func TestHeaderMetadata(t *testing.T) {
+	kek := aes256.NewRandomKey()
+	h, err := NewHeader(aes256.NewRandomIV(), make([]byte, aes256.TagSize), aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Metadata = Metadata{MetaAADHash: AADHash(nil)}
+
+	data, err := h.Marshal(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Overhead + encodedMetadataSize(h.Metadata); len(data) != want {
+		t.Fatalf("expected a %d-byte header, got %d bytes", want, len(data))
+	}
+
+	h2, err := UnmarshalHeader(kek, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(h2.Size) != len(data) {
+		t.Fatalf("expected Size %d, got %d", len(data), h2.Size)
+	}
+	if !bytes.Equal(h2.Metadata[MetaAADHash], h.Metadata[MetaAADHash]) {
+		t.Fatalf("expected metadata %x, got %x", h.Metadata, h2.Metadata)
+	}
+	if len(h2.DEKs) != 1 || !bytes.Equal(h2.DEKs[0], h.DEKs[0]) {
+		t.Fatalf("expected DEK %x, got %x", h.DEKs, h2.DEKs)
+	}
+}
+
+func TestRotationTime(t *testing.T) {
+	want := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	got, err := ParseRotationTime(RotationTime(want.Add(500 * time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if _, err := ParseRotationTime([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected a short rotation time to fail")
+	}
+}
+
+func TestCompactWithMetadata(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	ad := []byte("object-name")
+	kek := aes256.NewRandomKey()
+	blob, err := EncryptWithMetadata(plain, kek, aes256.NewRandomIV(), ad, Metadata{MetaAADHash: AADHash(ad)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	newKEK := aes256.NewRandomKey()
+	md := Metadata{MetaRotatedAt: RotationTime(now)}
+	blob, err = CompactWithMetadata(blob, kek, newKEK, aes256.NewRandomIV(), ad, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, _, err := SplitHeaderPayload(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := UnmarshalHeader(newKEK, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Metadata[MetaAADHash], AADHash(ad)) {
+		t.Fatal("compaction dropped the AAD hash")
+	}
+	if got, err := ParseRotationTime(h.Metadata[MetaRotatedAt]); err != nil || !got.Equal(now) {
+		t.Fatalf("expected rotation time %v, got %v (%v)", now, got, err)
+	}
+	if got, err := Decrypt(blob, newKEK, ad); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+}
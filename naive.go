@@ -0,0 +1,119 @@
+package nestedaes
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/mu"
+)
+
+// NaiveScheme is the baseline [UpdatableScheme] that updatable encryption
+// improves on: a ciphertext is a single AES-GCM encryption (NONCE ||
+// CIPHERTEXT || TAG), and re-encryption fully decrypts it and encrypts the
+// plaintext again under the new key.  Decryption therefore costs a single
+// pass, however many times the ciphertext was re-encrypted, but the token
+// holds both the old and the new key: whoever applies it can decrypt the
+// ciphertext.
+type NaiveScheme struct{}
+
+// NaiveToken is the token of the [NaiveScheme]: the old and the new key.
+type NaiveToken struct {
+	Key    []byte
+	NewKey []byte
+}
+
+// Wipe satisfies the [UpdateToken] interface.
+func (t *NaiveToken) Wipe() {
+	FreeKey(t.Key)
+	FreeKey(t.NewKey)
+	t.Key = nil
+	t.NewKey = nil
+}
+
+// Name satisfies the [UpdatableScheme] interface.
+func (NaiveScheme) Name() string {
+	return "naive"
+}
+
+// KeyGen satisfies the [UpdatableScheme] interface.
+func (NaiveScheme) KeyGen() ([]byte, error) {
+	return newRandomKey(), nil
+}
+
+// Encrypt satisfies the [UpdatableScheme] interface.  The nonce is randomly
+// generated.
+func (NaiveScheme) Encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	if len(key) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(key))
+	}
+	return naiveSeal(key, plaintext, additionalData), nil
+}
+
+// Header satisfies the [UpdatableScheme] interface.  The token does not
+// depend on the ciphertext, so the header is empty.
+func (NaiveScheme) Header(ciphertext []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// ReKeyGen satisfies the [UpdatableScheme] interface.  The token holds
+// copies of key and newKey; the header is ignored.
+func (NaiveScheme) ReKeyGen(key, newKey, header []byte) (UpdateToken, error) {
+	if len(key) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(key))
+	}
+	if len(newKey) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newKey))
+	}
+	t := &NaiveToken{Key: AllocKey(aes256.KeySize), NewKey: AllocKey(aes256.KeySize)}
+	copy(t.Key, key)
+	copy(t.NewKey, newKey)
+	return t, nil
+}
+
+// ReEncrypt satisfies the [UpdatableScheme] interface.  It decrypts the
+// ciphertext with the token's old key, and encrypts the plaintext under the
+// new key with a fresh nonce.  The plaintext is wiped.
+func (s NaiveScheme) ReEncrypt(token UpdateToken, ciphertext, additionalData []byte) ([]byte, error) {
+	t, ok := token.(*NaiveToken)
+	if !ok {
+		return nil, fmt.Errorf("nestedaes: token of type %T is not a *nestedaes.NaiveToken", token)
+	}
+	if len(t.NewKey) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(t.NewKey))
+	}
+
+	plaintext, err := s.Decrypt(t.Key, ciphertext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(plaintext)
+	return naiveSeal(t.NewKey, plaintext, additionalData), nil
+}
+
+// Decrypt satisfies the [UpdatableScheme] interface.  The plaintext shares
+// the ciphertext's storage.
+func (NaiveScheme) Decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(key) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(key))
+	}
+	if len(ciphertext) < aes256.NonceSize+aes256.TagSize {
+		return nil, fmt.Errorf("ciphertext (%d bytes) is too small", len(ciphertext))
+	}
+
+	nonce, ct := ciphertext[:aes256.NonceSize], ciphertext[aes256.NonceSize:]
+	return aes256.NewGCM(key).Open(ct[:0], nonce, ct, additionalData)
+}
+
+// naiveSeal returns NONCE || GCM(key, NONCE, plaintext, additionalData) for
+// a random NONCE.
+func naiveSeal(key, plaintext, additionalData []byte) []byte {
+	out := make([]byte, aes256.NonceSize, aes256.NonceSize+len(plaintext)+aes256.TagSize)
+	if _, err := rand.Read(out); err != nil {
+		mu.Panicf("nestedaes: rand.Read failed: %v", err)
+	}
+	return aes256.NewGCM(key).Seal(out, out, plaintext, additionalData)
+}
+
+var _ UpdatableScheme = NaiveScheme{}
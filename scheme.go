@@ -0,0 +1,102 @@
+package nestedaes
+
+import (
+	"fmt"
+
+	"github.com/etclab/aes256"
+)
+
+// UpdatableScheme is an updatable encryption scheme, in the syntax of Boneh
+// et al.: the key owner encrypts under a key, and later derives an update
+// token from a ciphertext's header and a new key, with which whoever stores
+// the ciphertext re-encrypts it under the new key.  Schemes implementing the
+// interface can be checked with the conformance suite in the schemetest
+// package, and compared side by side.
+//
+// Keys are allocated with [AllocKey]; the caller should release them with
+// [FreeKey].  The methods may modify the ciphertext passed to them (as
+// [Decrypt] and [ApplyToken] do); callers that still need it should pass a
+// copy.
+type UpdatableScheme interface {
+	// Name is a short name for the scheme, for reports.
+	Name() string
+	// KeyGen returns a new random key.
+	KeyGen() ([]byte, error)
+	// Encrypt encrypts and authenticates plaintext and additionalData under
+	// key.
+	Encrypt(key, plaintext, additionalData []byte) ([]byte, error)
+	// Header returns the part of the ciphertext that ReKeyGen needs: the
+	// only part that must be sent to the key owner to derive a token.
+	Header(ciphertext []byte) ([]byte, error)
+	// ReKeyGen derives a token that re-encrypts the ciphertext with the
+	// given header from key to newKey.
+	ReKeyGen(key, newKey, header []byte) (UpdateToken, error)
+	// ReEncrypt applies a token to the ciphertext, and returns the
+	// ciphertext under the token's new key.  The additionalData must match
+	// the value passed to Encrypt, for schemes that need it to re-encrypt.
+	ReEncrypt(token UpdateToken, ciphertext, additionalData []byte) ([]byte, error)
+	// Decrypt decrypts and authenticates the ciphertext under key.
+	Decrypt(key, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// UpdateToken is a token derived by [UpdatableScheme.ReKeyGen].  Its
+// concrete type depends on the scheme.
+type UpdateToken interface {
+	// Wipe zeroes the token's secrets.  The token must not be used
+	// afterwards.
+	Wipe()
+}
+
+// NestedScheme is the nested AES construction of this package (section 4.1
+// of Boneh et al.) as an [UpdatableScheme].  Its tokens are [*Token]s, and a
+// ciphertext's header is the blob's header (see [SplitHeaderPayload]).
+// Decryption costs one pass over the payload per re-encryption, until the
+// blob is compacted.
+type NestedScheme struct{}
+
+// Name satisfies the [UpdatableScheme] interface.
+func (NestedScheme) Name() string {
+	return "nested"
+}
+
+// KeyGen satisfies the [UpdatableScheme] interface.
+func (NestedScheme) KeyGen() ([]byte, error) {
+	return newRandomKey(), nil
+}
+
+// Encrypt satisfies the [UpdatableScheme] interface.  The BaseIV is randomly
+// generated.
+func (NestedScheme) Encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	return Encrypt(plaintext, key, aes256.NewRandomIV(), additionalData)
+}
+
+// Header satisfies the [UpdatableScheme] interface.
+func (NestedScheme) Header(ciphertext []byte) ([]byte, error) {
+	hdr, _, err := SplitHeaderPayload(ciphertext)
+	return hdr, err
+}
+
+// ReKeyGen satisfies the [UpdatableScheme] interface.  The DEK of the new
+// layer is randomly generated.
+func (NestedScheme) ReKeyGen(key, newKey, header []byte) (UpdateToken, error) {
+	newDEK := newRandomKey()
+	defer FreeKey(newDEK)
+	return ReKeyGenWithKeys(header, key, newKey, newDEK)
+}
+
+// ReEncrypt satisfies the [UpdatableScheme] interface.  The additionalData is
+// not needed (it is only authenticated by Decrypt), and is ignored.
+func (NestedScheme) ReEncrypt(token UpdateToken, ciphertext, additionalData []byte) ([]byte, error) {
+	t, ok := token.(*Token)
+	if !ok {
+		return nil, fmt.Errorf("nestedaes: token of type %T is not a *nestedaes.Token", token)
+	}
+	return ApplyToken(ciphertext, t)
+}
+
+// Decrypt satisfies the [UpdatableScheme] interface.
+func (NestedScheme) Decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	return Decrypt(ciphertext, key, additionalData)
+}
+
+var _ UpdatableScheme = NestedScheme{}
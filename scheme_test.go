@@ -0,0 +1,26 @@
+package nestedaes_test
+
+import (
+	"testing"
+
+	"github.com/etclab/nestedaes"
+	"github.com/etclab/nestedaes/khprf"
+	"github.com/etclab/nestedaes/schemetest"
+)
+
+func TestNestedSchemeConformance(t *testing.T) {
+	schemetest.Run(t, nestedaes.NestedScheme{})
+}
+
+func TestNaiveSchemeConformance(t *testing.T) {
+	schemetest.Run(t, nestedaes.NaiveScheme{})
+}
+
+func BenchmarkSchemes(b *testing.B) {
+	schemes := []nestedaes.UpdatableScheme{nestedaes.NestedScheme{}, nestedaes.NaiveScheme{}, khprf.Scheme{}}
+	for _, s := range schemes {
+		for _, updates := range []int{0, 8, 32} {
+			schemetest.Benchmark(b, s, 1024*1024, updates)
+		}
+	}
+}
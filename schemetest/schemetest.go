@@ -0,0 +1,277 @@
+// Package schemetest implements a conformance suite and benchmarks for
+// implementations of [nestedaes.UpdatableScheme].
+//
+// A scheme's tests call [Run]:
+//
+//	func TestConformance(t *testing.T) {
+//		schemetest.Run(t, myScheme{})
+//	}
+package schemetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/etclab/nestedaes"
+)
+
+// sizes are the plaintext sizes the suite encrypts.
+var sizes = []int{0, 1, 15, 16, 17, 1000, 64*1024 + 3}
+
+// An Option changes what [Run] checks.
+type Option func(*options)
+
+type options struct {
+	relaxedIntegrity bool
+}
+
+// RelaxedIntegrity makes [Run] accept a modified ciphertext that still
+// decrypts to the original plaintext, for schemes with relaxed integrity
+// (such as schemes built from almost key-homomorphic PRFs, whose ciphertexts
+// absorb small errors).
+func RelaxedIntegrity() Option {
+	return func(o *options) { o.relaxedIntegrity = true }
+}
+
+// Run checks that s behaves as an updatable encryption scheme: ciphertexts
+// decrypt to their plaintext under the current key, after any number of
+// updates, and fail to decrypt under any other key, with other additional
+// data, or after any modification.
+func Run(t *testing.T, s nestedaes.UpdatableScheme, opts ...Option) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, s) })
+	t.Run("Randomized", func(t *testing.T) { testRandomized(t, s) })
+	t.Run("WrongKey", func(t *testing.T) { testWrongKey(t, s) })
+	t.Run("WrongAdditionalData", func(t *testing.T) { testWrongAdditionalData(t, s) })
+	t.Run("Tamper", func(t *testing.T) { testTamper(t, s, &o) })
+	t.Run("Updates", func(t *testing.T) { testUpdates(t, s) })
+	t.Run("TokenFromHeader", func(t *testing.T) { testTokenFromHeader(t, s) })
+}
+
+func keyGen(t testing.TB, s nestedaes.UpdatableScheme) []byte {
+	t.Helper()
+	key, err := s.KeyGen()
+	if err != nil {
+		t.Fatalf("%s: KeyGen failed: %v", s.Name(), err)
+	}
+	t.Cleanup(func() { nestedaes.FreeKey(key) })
+	return key
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func encrypt(t testing.TB, s nestedaes.UpdatableScheme, key, plaintext, ad []byte) []byte {
+	t.Helper()
+	ct, err := s.Encrypt(key, plaintext, ad)
+	if err != nil {
+		t.Fatalf("%s: Encrypt failed: %v", s.Name(), err)
+	}
+	return ct
+}
+
+// update re-encrypts ct from key to newKey, the way a key owner and a server
+// would: the token is derived from the header only.
+func update(t testing.TB, s nestedaes.UpdatableScheme, key, newKey, ct, ad []byte) []byte {
+	t.Helper()
+	hdr, err := s.Header(ct)
+	if err != nil {
+		t.Fatalf("%s: Header failed: %v", s.Name(), err)
+	}
+	tok, err := s.ReKeyGen(key, newKey, bytes.Clone(hdr))
+	if err != nil {
+		t.Fatalf("%s: ReKeyGen failed: %v", s.Name(), err)
+	}
+	defer tok.Wipe()
+	ct, err = s.ReEncrypt(tok, ct, ad)
+	if err != nil {
+		t.Fatalf("%s: ReEncrypt failed: %v", s.Name(), err)
+	}
+	return ct
+}
+
+func checkDecrypt(t testing.TB, s nestedaes.UpdatableScheme, key, ct, ad, want []byte) {
+	t.Helper()
+	got, err := s.Decrypt(key, bytes.Clone(ct), ad)
+	if err != nil {
+		t.Fatalf("%s: Decrypt failed: %v", s.Name(), err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: Decrypt returned the wrong plaintext", s.Name())
+	}
+}
+
+func testRoundTrip(t *testing.T, s nestedaes.UpdatableScheme) {
+	key := keyGen(t, s)
+	for _, size := range sizes {
+		for _, ad := range [][]byte{nil, []byte("object-name")} {
+			plaintext := randomBytes(size)
+			ct := encrypt(t, s, key, bytes.Clone(plaintext), ad)
+			checkDecrypt(t, s, key, ct, ad, plaintext)
+		}
+	}
+}
+
+func testRandomized(t *testing.T, s nestedaes.UpdatableScheme) {
+	key := keyGen(t, s)
+	plaintext := randomBytes(100)
+	ct1 := encrypt(t, s, key, plaintext, nil)
+	ct2 := encrypt(t, s, key, plaintext, nil)
+	if bytes.Equal(ct1, ct2) {
+		t.Fatalf("%s: encrypting the same plaintext twice gave the same ciphertext", s.Name())
+	}
+}
+
+func testWrongKey(t *testing.T, s nestedaes.UpdatableScheme) {
+	key := keyGen(t, s)
+	other := keyGen(t, s)
+	ct := encrypt(t, s, key, randomBytes(100), nil)
+	if _, err := s.Decrypt(other, ct, nil); err == nil {
+		t.Fatalf("%s: Decrypt succeeded with the wrong key", s.Name())
+	}
+}
+
+func testWrongAdditionalData(t *testing.T, s nestedaes.UpdatableScheme) {
+	key := keyGen(t, s)
+	ct := encrypt(t, s, key, randomBytes(100), []byte("foo"))
+	if _, err := s.Decrypt(key, bytes.Clone(ct), []byte("bar")); err == nil {
+		t.Fatalf("%s: Decrypt succeeded with the wrong additional data", s.Name())
+	}
+	if _, err := s.Decrypt(key, ct, nil); err == nil {
+		t.Fatalf("%s: Decrypt succeeded without the additional data", s.Name())
+	}
+}
+
+func testTamper(t *testing.T, s nestedaes.UpdatableScheme, o *options) {
+	key := keyGen(t, s)
+	newKey := keyGen(t, s)
+	plaintext := randomBytes(1000)
+	ct := encrypt(t, s, key, plaintext, nil)
+	ct = update(t, s, key, newKey, ct, nil)
+
+	for _, i := range []int{0, 1, len(ct) / 3, len(ct) / 2, len(ct) - 1} {
+		tampered := bytes.Clone(ct)
+		tampered[i] ^= 0x01
+		got, err := s.Decrypt(newKey, tampered, nil)
+		if err == nil && !(o.relaxedIntegrity && bytes.Equal(got, plaintext)) {
+			t.Fatalf("%s: Decrypt accepted a ciphertext with byte %d modified", s.Name(), i)
+		}
+	}
+	if _, err := s.Decrypt(newKey, bytes.Clone(ct[:len(ct)-1]), nil); err == nil {
+		t.Fatalf("%s: Decrypt accepted a truncated ciphertext", s.Name())
+	}
+}
+
+func testUpdates(t *testing.T, s nestedaes.UpdatableScheme) {
+	plaintext := randomBytes(5000)
+	ad := []byte("object-name")
+
+	key := keyGen(t, s)
+	ct := encrypt(t, s, key, plaintext, ad)
+	for i := 0; i < 8; i++ {
+		newKey := keyGen(t, s)
+		ct = update(t, s, key, newKey, ct, ad)
+		checkDecrypt(t, s, newKey, ct, ad, plaintext)
+		if _, err := s.Decrypt(key, bytes.Clone(ct), ad); err == nil {
+			t.Fatalf("%s: update %d: Decrypt succeeded with the old key", s.Name(), i)
+		}
+		key = newKey
+	}
+}
+
+// testTokenFromHeader checks that a token only depends on what Header
+// returns: deriving it from the full ciphertext gives the same result.
+func testTokenFromHeader(t *testing.T, s nestedaes.UpdatableScheme) {
+	key := keyGen(t, s)
+	newKey := keyGen(t, s)
+	plaintext := randomBytes(300)
+	ct := encrypt(t, s, key, plaintext, nil)
+
+	hdr, err := s.Header(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr) > len(ct) {
+		t.Fatalf("%s: header (%d bytes) is larger than the ciphertext (%d bytes)", s.Name(), len(hdr), len(ct))
+	}
+
+	tok, err := s.ReKeyGen(key, newKey, bytes.Clone(hdr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tok.Wipe()
+	ct, err = s.ReEncrypt(tok, ct, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecrypt(t, s, newKey, ct, nil, plaintext)
+}
+
+// Benchmark measures s's operations on a plaintext of the given size that
+// has been re-encrypted updates times, as sub-benchmarks named after the
+// operations.
+func Benchmark(b *testing.B, s nestedaes.UpdatableScheme, size, updates int) {
+	plaintext := randomBytes(size)
+	key := keyGen(b, s)
+	ct := encrypt(b, s, key, plaintext, nil)
+	for i := 0; i < updates; i++ {
+		newKey := keyGen(b, s)
+		ct = update(b, s, key, newKey, ct, nil)
+		key = newKey
+	}
+	name := fmt.Sprintf("%s/size=%d/updates=%d", s.Name(), size, updates)
+
+	b.Run(name+"/Encrypt", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		for b.Loop() {
+			if _, err := s.Encrypt(key, plaintext, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run(name+"/ReEncrypt", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		newKey := keyGen(b, s)
+		hdr, err := s.Header(ct)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tok, err := s.ReKeyGen(key, newKey, bytes.Clone(hdr))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer tok.Wipe()
+		work := make([]byte, len(ct), 2*len(ct))
+		for b.Loop() {
+			b.StopTimer()
+			work = append(work[:0], ct...)
+			b.StartTimer()
+			if _, err := s.ReEncrypt(tok, work, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run(name+"/Decrypt", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		work := make([]byte, len(ct), 2*len(ct))
+		for b.Loop() {
+			b.StopTimer()
+			work = append(work[:0], ct...)
+			b.StartTimer()
+			if _, err := s.Decrypt(key, work, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
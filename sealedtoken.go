@@ -0,0 +1,233 @@
+package nestedaes
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/etclab/aes256"
+)
+
+// SealedTokenVersion is the version of the [SealedToken] format.
+const SealedTokenVersion = 1
+
+// sealedDEKSize is the size of a DEK sealed with AES-GCM.
+const sealedDEKSize = aes256.KeySize + aes256.TagSize
+
+// sealedTokenInfo is the HKDF info string for the key that seals the DEK.
+const sealedTokenInfo = "nestedaes sealed token DEK v1"
+
+// x25519KeySize is the size of an X25519 public key.
+const x25519KeySize = 32
+
+// SealedToken is the wire form of a [Token], for sending it from the key
+// owner to the server that applies it.  The token's DEK is sealed for the
+// server: it is encrypted with AES-GCM under a key agreed (with X25519 and
+// HKDF-SHA256) between an ephemeral key and the server's long-term X25519
+// key, so that only that server can apply the token.  The other fields are
+// authenticated as the additional data of that encryption.
+//
+// The binary encoding (see [SealedToken.MarshalBinary]) is
+//
+//	Version (1 byte) || Layer (uint32) || PrevHeaderHash (32 bytes) ||
+//	HeaderLen (uint32) || Header || EphemeralKey (32 bytes) || SealedDEK (48 bytes)
+//
+// with integers in big-endian order; the JSON encoding has the same fields,
+// with byte strings in base64.
+type SealedToken struct {
+	// Version is [SealedTokenVersion].
+	Version int `json:"version"`
+	// Layer is the number of layers the blob has before the token is
+	// applied.
+	Layer int `json:"layer"`
+	// PrevHeaderHash is the [HeaderHash] of the header the token replaces.
+	PrevHeaderHash []byte `json:"prev_header_hash"`
+	// Header is the blob's new marshaled header.
+	Header []byte `json:"header"`
+	// EphemeralKey is the sender's ephemeral X25519 public key.
+	EphemeralKey []byte `json:"ephemeral_key"`
+	// SealedDEK is the DEK of the new layer, sealed for the server.
+	SealedDEK []byte `json:"sealed_dek"`
+}
+
+// SealToken seals a token for the server with the X25519 public key
+// serverKey.  The token must have a PrevHeaderHash (as the tokens from
+// [ReKeyGen] do), so that the server can refuse it for any blob other than
+// the one it was derived from.
+func SealToken(t *Token, serverKey *ecdh.PublicKey) (*SealedToken, error) {
+	if len(t.DEK) != aes256.KeySize {
+		return nil, fmt.Errorf("token DEK is %d bytes, expected %d", len(t.DEK), aes256.KeySize)
+	}
+	if len(t.PrevHeaderHash) != sha256.Size {
+		return nil, fmt.Errorf("token has no PrevHeaderHash")
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	st := &SealedToken{
+		Version:        SealedTokenVersion,
+		Layer:          t.Layer,
+		PrevHeaderHash: t.PrevHeaderHash,
+		Header:         t.Header,
+		EphemeralKey:   eph.PublicKey().Bytes(),
+	}
+
+	key, err := sealedTokenKey(eph, serverKey, st.EphemeralKey, serverKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer FreeKey(key)
+	// the key is used once, so the nonce can be fixed
+	var nonce [aes256.NonceSize]byte
+	st.SealedDEK = aes256.NewGCM(key).Seal(nil, nonce[:], t.DEK, st.appendFields(nil))
+	return st, nil
+}
+
+// OpenToken checks and opens a sealed token with the server's X25519 private
+// key serverKey, and returns the token.  It fails with a [*TokenError] if the
+// token was sealed for another server, or if any of its fields was modified.
+func OpenToken(st *SealedToken, serverKey *ecdh.PrivateKey) (*Token, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().NewPublicKey(st.EphemeralKey)
+	if err != nil {
+		return nil, tokenError(ErrTokenMalformed, "%v", err)
+	}
+
+	key, err := sealedTokenKey(serverKey, eph, st.EphemeralKey, serverKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer FreeKey(key)
+
+	t := &Token{
+		Header:         st.Header,
+		DEK:            AllocKey(aes256.KeySize),
+		Layer:          st.Layer,
+		PrevHeaderHash: st.PrevHeaderHash,
+	}
+	var nonce [aes256.NonceSize]byte
+	if _, err := aes256.NewGCM(key).Open(t.DEK[:0], nonce[:], st.SealedDEK, st.appendFields(nil)); err != nil {
+		t.Wipe()
+		return nil, &TokenError{Reason: ErrTokenSeal}
+	}
+	return t, nil
+}
+
+// ApplySealedToken opens a sealed token with the server's X25519 private key
+// (see [OpenToken]), and applies it to the blob (see [ApplyToken]).  The
+// opened token is wiped.  The blob must be at the header the token replaces:
+// the function refuses a token derived from another blob, one that was
+// already applied, and one that was derived from a later header.
+func ApplySealedToken(blob []byte, st *SealedToken, serverKey *ecdh.PrivateKey) ([]byte, error) {
+	t, err := OpenToken(st, serverKey)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Wipe()
+	return ApplyToken(blob, t)
+}
+
+// sealedTokenKey derives the key that seals a token's DEK from one party's
+// private key and the other's public key.  The HKDF salt is the ephemeral
+// public key followed by the server's public key.
+func sealedTokenKey(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, ephemeralKey, serverKey []byte) ([]byte, error) {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("X25519 key agreement failed: %w", err)
+	}
+	defer Wipe(shared)
+
+	salt := append(append(make([]byte, 0, len(ephemeralKey)+len(serverKey)), ephemeralKey...), serverKey...)
+	k, err := hkdf.Key(sha256.New, shared, salt, sealedTokenInfo, aes256.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(k)
+	key := AllocKey(aes256.KeySize)
+	copy(key, k)
+	return key, nil
+}
+
+// check checks the version and the sizes of the fields.
+func (st *SealedToken) check() error {
+	if st.Version != SealedTokenVersion {
+		return tokenError(ErrTokenMalformed, "unsupported sealed token version %d", st.Version)
+	}
+	if st.Layer < 1 || uint64(st.Layer) > math.MaxUint32 {
+		return tokenError(ErrTokenMalformed, "invalid layer %d", st.Layer)
+	}
+	if len(st.PrevHeaderHash) != sha256.Size {
+		return tokenError(ErrTokenMalformed, "PrevHeaderHash is %d bytes, expected %d", len(st.PrevHeaderHash), sha256.Size)
+	}
+	if len(st.EphemeralKey) != x25519KeySize {
+		return tokenError(ErrTokenMalformed, "EphemeralKey is %d bytes, expected %d", len(st.EphemeralKey), x25519KeySize)
+	}
+	if len(st.SealedDEK) != sealedDEKSize {
+		return tokenError(ErrTokenMalformed, "SealedDEK is %d bytes, expected %d", len(st.SealedDEK), sealedDEKSize)
+	}
+	return nil
+}
+
+// appendFields appends the encoding of the fields that precede SealedDEK,
+// which are the additional data of its encryption.
+func (st *SealedToken) appendFields(dst []byte) []byte {
+	dst = append(dst, byte(st.Version))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(st.Layer))
+	dst = append(dst, st.PrevHeaderHash...)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(st.Header)))
+	dst = append(dst, st.Header...)
+	return append(dst, st.EphemeralKey...)
+}
+
+// MarshalBinary returns the binary encoding of the sealed token.
+func (st *SealedToken) MarshalBinary() ([]byte, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	size := 1 + 4 + sha256.Size + 4 + len(st.Header) + x25519KeySize + sealedDEKSize
+	out := st.appendFields(make([]byte, 0, size))
+	return append(out, st.SealedDEK...), nil
+}
+
+// UnmarshalBinary decodes a sealed token from its binary encoding.  The
+// fields are copied from data.
+func (st *SealedToken) UnmarshalBinary(data []byte) error {
+	const fixed = 1 + 4 + sha256.Size + 4
+	if len(data) < 1 {
+		return tokenError(ErrTokenMalformed, "sealed token is empty")
+	}
+	if data[0] != SealedTokenVersion {
+		return tokenError(ErrTokenMalformed, "unsupported sealed token version %d", data[0])
+	}
+	if len(data) < fixed {
+		return tokenError(ErrTokenMalformed, "sealed token (%d bytes) is truncated", len(data))
+	}
+	hLen := binary.BigEndian.Uint32(data[fixed-4:])
+	if uint64(len(data)) != fixed+uint64(hLen)+x25519KeySize+sealedDEKSize {
+		return tokenError(ErrTokenMalformed, "sealed token is %d bytes, but its header length implies %d", len(data), fixed+uint64(hLen)+x25519KeySize+sealedDEKSize)
+	}
+
+	rest := data[fixed:]
+	next := func(n int) []byte {
+		b := append([]byte(nil), rest[:n]...)
+		rest = rest[n:]
+		return b
+	}
+	*st = SealedToken{
+		Version:        int(data[0]),
+		Layer:          int(binary.BigEndian.Uint32(data[1:])),
+		PrevHeaderHash: append([]byte(nil), data[5:5+sha256.Size]...),
+		Header:         next(int(hLen)),
+		EphemeralKey:   next(x25519KeySize),
+		SealedDEK:      next(sealedDEKSize),
+	}
+	return st.check()
+}
@@ -0,0 +1,131 @@
+package nestedaes
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/etclab/aes256"
+)
+
+func newServerKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// sealedToken derives a token for blob and seals it for server.
+func sealedToken(t *testing.T, blob, kek []byte, server *ecdh.PrivateKey) (*SealedToken, []byte) {
+	t.Helper()
+	tok, newKEK, err := ReKeyGen(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tok.Wipe()
+	st, err := SealToken(tok, server.PublicKey())
+	if err != nil {
+		t.Fatalf("SealToken failed: %v", err)
+	}
+	return st, newKEK
+}
+
+func TestSealedTokenEncoding(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	server := newServerKey(t)
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, newKEK := sealedToken(t, blob, kek, server)
+
+	bin, err := st.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	var fromBin SealedToken
+	if err := fromBin.UnmarshalBinary(bin); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	js, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON SealedToken
+	if err := json.Unmarshal(js, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, st := range map[string]*SealedToken{"binary": &fromBin, "JSON": &fromJSON} {
+		applied, err := ApplySealedToken(bytes.Clone(blob), st, server)
+		if err != nil {
+			t.Fatalf("%s: ApplySealedToken failed: %v", name, err)
+		}
+		got, err := Decrypt(applied, newKEK, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%s: expected decrypt to produce %x, got %x", name, plain, got)
+		}
+	}
+
+	if err := fromBin.UnmarshalBinary(bin[:len(bin)-1]); err == nil {
+		t.Fatalf("UnmarshalBinary accepted a truncated token")
+	}
+	bin[0] = SealedTokenVersion + 1
+	if err := fromBin.UnmarshalBinary(bin); err == nil {
+		t.Fatalf("UnmarshalBinary accepted an unknown version")
+	}
+}
+
+func TestSealedTokenRefused(t *testing.T) {
+	server := newServerKey(t)
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, newKEK := sealedToken(t, blob, kek, server)
+
+	if _, err := ApplySealedToken(bytes.Clone(blob), st, newServerKey(t)); err == nil {
+		t.Fatalf("ApplySealedToken accepted a token sealed for another server")
+	}
+	tampered := *st
+	tampered.PrevHeaderHash = bytes.Clone(st.PrevHeaderHash)
+	tampered.PrevHeaderHash[0] ^= 1
+	if _, err := ApplySealedToken(bytes.Clone(blob), &tampered, server); err == nil {
+		t.Fatalf("ApplySealedToken accepted a modified token")
+	}
+	if _, err := ApplySealedToken(other, st, server); err == nil {
+		t.Fatalf("ApplySealedToken accepted a token for another blob")
+	}
+
+	// derive the next token before the first one is applied
+	hdr := bytes.Clone(st.Header)
+	next, _ := sealedToken(t, hdr, newKEK, server)
+	if _, err := ApplySealedToken(bytes.Clone(blob), next, server); err == nil {
+		t.Fatalf("ApplySealedToken accepted an out-of-order token")
+	}
+
+	blob, err = ApplySealedToken(blob, st, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplySealedToken(bytes.Clone(blob), st, server); err == nil {
+		t.Fatalf("ApplySealedToken applied the same token twice")
+	}
+	if _, err := ApplySealedToken(blob, next, server); err != nil {
+		t.Fatalf("ApplySealedToken failed for the next token: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package nestedaes
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"os"
+	"sync/atomic"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/mu"
+)
+
+// secureMemory reports whether key material should be allocated from the
+// platform's secure allocator; see [EnableSecureMemory].
+var secureMemory atomic.Bool
+
+// EnableSecureMemory turns the secure key allocator on or off.  When on, keys
+// allocated with [AllocKey] (including the KEKs returned by [Reencrypt] and
+// [ReadKeyFile], and the DEKs of an unmarshaled [Header]) are placed in
+// memory that is locked into RAM and excluded from core dumps, so that they
+// are never swapped to disk.
+//
+// The secure allocator is only available on Linux; on other platforms,
+// EnableSecureMemory(true) returns an error and leaves it off.  Even when
+// enabled, an individual allocation falls back to ordinary heap memory if
+// the memory cannot be locked (for instance, because RLIMIT_MEMLOCK is too
+// small).
+func EnableSecureMemory(on bool) error {
+	if on {
+		if err := secureMemorySupported(); err != nil {
+			return err
+		}
+	}
+	secureMemory.Store(on)
+	return nil
+}
+
+// SecureMemoryEnabled reports whether the secure key allocator is on.
+func SecureMemoryEnabled() bool {
+	return secureMemory.Load()
+}
+
+// AllocKey allocates an n-byte, zeroed buffer for key material.  If the secure
+// allocator is enabled (see [EnableSecureMemory]), the buffer is locked into
+// RAM; otherwise, it is ordinary heap memory.  The caller should release the
+// buffer with [FreeKey].
+func AllocKey(n int) []byte {
+	if secureMemory.Load() {
+		if b := secureAlloc(n); b != nil {
+			return b
+		}
+	}
+	return make([]byte, n)
+}
+
+// FreeKey wipes a buffer obtained from [AllocKey] and, if it was allocated
+// from the secure allocator, releases it.  For any other slice, FreeKey is
+// equivalent to [Wipe].  The buffer must not be used afterwards.
+func FreeKey(b []byte) {
+	Wipe(b)
+	secureFree(b)
+}
+
+// newRandomKey is like [aes256.NewRandomKey], but allocates the key with
+// [AllocKey].
+func newRandomKey() []byte {
+	key := AllocKey(aes256.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		mu.Panicf("nestedaes.newRandomKey: rand.Read failed: %v", err)
+	}
+	return key
+}
+
+// ReadKeyFile is like [aes256.ReadKeyFile], but reads the key into a buffer
+// allocated with [AllocKey], and wipes any intermediate copies.  The caller
+// should release the key with [FreeKey].
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(data)
+
+	if len(data) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(data))
+	}
+
+	key := AllocKey(aes256.KeySize)
+	copy(key, data)
+	return key, nil
+}
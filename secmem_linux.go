@@ -0,0 +1,90 @@
+//go:build linux
+
+package nestedaes
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// madvise(2) advice values that the syscall package does not define.  They
+// have the same values on all Linux architectures.
+const (
+	madvDontDump   = 16
+	madvWipeOnFork = 18
+)
+
+// secureRegions maps the address of each buffer returned by secureAlloc to
+// its underlying mapping (including the guard pages).
+var (
+	secureMu      sync.Mutex
+	secureRegions = make(map[uintptr][]byte)
+)
+
+func secureMemorySupported() error {
+	return nil
+}
+
+// secureAlloc maps a fresh region for an n-byte buffer, surrounded by
+// inaccessible guard pages.  The buffer is placed at the end of its pages,
+// so that an overrun faults on the trailing guard page.  The pages are
+// locked into RAM, excluded from core dumps, and wiped in the child on
+// fork.  secureAlloc returns nil if any of this fails, in which case the
+// caller falls back to the heap.
+func secureAlloc(n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+
+	pageSize := os.Getpagesize()
+	size := (n + pageSize - 1) / pageSize * pageSize
+	mem, err := syscall.Mmap(-1, 0, size+2*pageSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil
+	}
+
+	data := mem[pageSize : pageSize+size]
+	if syscall.Mprotect(mem[:pageSize], syscall.PROT_NONE) != nil ||
+		syscall.Mprotect(mem[pageSize+size:], syscall.PROT_NONE) != nil ||
+		syscall.Mlock(data) != nil {
+		// most likely, RLIMIT_MEMLOCK is too small
+		syscall.Munmap(mem)
+		return nil
+	}
+
+	// these are best-effort: older kernels don't support MADV_WIPEONFORK
+	syscall.Madvise(data, madvDontDump)
+	syscall.Madvise(data, madvWipeOnFork)
+
+	b := data[size-n : size : size]
+
+	secureMu.Lock()
+	secureRegions[uintptr(unsafe.Pointer(&b[0]))] = mem
+	secureMu.Unlock()
+
+	return b
+}
+
+// secureFree unmaps a buffer returned by secureAlloc.  It is a no-op for any
+// other slice.
+func secureFree(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	addr := uintptr(unsafe.Pointer(&b[0]))
+
+	secureMu.Lock()
+	mem, ok := secureRegions[addr]
+	delete(secureRegions, addr)
+	secureMu.Unlock()
+
+	if !ok {
+		return
+	}
+	pageSize := os.Getpagesize()
+	syscall.Munlock(mem[pageSize : len(mem)-pageSize])
+	syscall.Munmap(mem)
+}
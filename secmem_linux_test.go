@@ -0,0 +1,120 @@
+//go:build linux
+
+package nestedaes
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"github.com/etclab/aes256"
+)
+
+func enableSecureMemory(t *testing.T) {
+	if err := EnableSecureMemory(true); err != nil {
+		t.Fatalf("EnableSecureMemory failed: %v", err)
+	}
+	t.Cleanup(func() { EnableSecureMemory(false) })
+}
+
+func isSecure(b []byte) bool {
+	secureMu.Lock()
+	defer secureMu.Unlock()
+	_, ok := secureRegions[uintptr(unsafe.Pointer(&b[0]))]
+	return ok
+}
+
+func TestAllocKeySecure(t *testing.T) {
+	enableSecureMemory(t)
+
+	key := AllocKey(KeySize)
+	if len(key) != KeySize || cap(key) != KeySize {
+		t.Fatalf("expected a key of len and cap %d, got %d and %d", KeySize, len(key), cap(key))
+	}
+	if !isSecure(key) {
+		t.Skip("memory could not be locked (RLIMIT_MEMLOCK too small?)")
+	}
+	if !isZero(key) {
+		t.Fatalf("AllocKey returned a non-zero key")
+	}
+
+	copy(key, "11111111111111111111111111111111")
+	FreeKey(key)
+	secureMu.Lock()
+	n := len(secureRegions)
+	secureMu.Unlock()
+	if n != 0 {
+		t.Fatalf("FreeKey did not release the secure region")
+	}
+}
+
+func TestAllocKeyDisabled(t *testing.T) {
+	key := AllocKey(KeySize)
+	if isSecure(key) {
+		t.Fatalf("AllocKey used the secure allocator while disabled")
+	}
+	FreeKey(key)
+}
+
+func TestHeaderSecureMemory(t *testing.T) {
+	enableSecureMemory(t)
+
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, kek, err = Reencrypt(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer FreeKey(kek)
+
+	hData, _, err := SplitHeaderPayload(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := UnmarshalHeader(kek, hData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSecure(h.DEKs[0]) {
+		t.Skip("memory could not be locked (RLIMIT_MEMLOCK too small?)")
+	}
+	h.Wipe()
+
+	got, err := Decrypt(bytes.Clone(blob), kek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, got) {
+		t.Fatalf("expected decrypt to produce %x, got %x", plain, got)
+	}
+}
+
+func TestHeaderWipeCallerDEK(t *testing.T) {
+	enableSecureMemory(t)
+
+	h, err := NewHeader(aes256.NewRandomIV(), make([]byte, aes256.TagSize), aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dek := AllocKey(KeySize)
+	if !isSecure(dek) || !isSecure(h.DEKs[0]) {
+		t.Skip("memory could not be locked (RLIMIT_MEMLOCK too small?)")
+	}
+	h.AddDEK(dek)
+	owned := h.DEKs[0]
+	h.Wipe()
+
+	if isSecure(owned) {
+		t.Fatalf("Wipe did not release the header's own DEK")
+	}
+	if !isSecure(dek) {
+		t.Fatalf("Wipe released a DEK that the caller owns")
+	}
+	// the caller's DEK must still be usable
+	copy(dek, "11111111111111111111111111111111")
+	FreeKey(dek)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package nestedaes
+
+import "errors"
+
+func secureMemorySupported() error {
+	return errors.New("nestedaes: secure memory is only supported on Linux")
+}
+
+func secureAlloc(n int) []byte {
+	return nil
+}
+
+func secureFree(b []byte) {}
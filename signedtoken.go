@@ -0,0 +1,265 @@
+package nestedaes
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SignedTokenVersion is the version of the [SignedToken] format.
+const SignedTokenVersion = 1
+
+// signedTokenContext prefixes the message that a token's signature covers,
+// so that the signature can't be taken for that of another kind of message.
+const signedTokenContext = "nestedaes signed token\x00"
+
+// SignedToken is a [SealedToken] signed by the key owner with Ed25519.  A
+// server that applies tokens only if they verify against its [TrustStore]
+// (see [ApplySignedToken]) can't be made to corrupt its blobs by whoever can
+// reach it: a token with an unknown DEK would add a layer that nobody can
+// remove.
+//
+// The signature covers the message
+//
+//	"nestedaes signed token" || 0x00 || Version (1 byte) || Token
+//
+// so that neither the token nor the version it is labeled with can be
+// changed without invalidating the signature.  The binary encoding of the
+// signed token (see [SignedToken.MarshalBinary]) is
+//
+//	Version (1 byte) || Signer (32 bytes) || Signature (64 bytes) || Token
+//
+// where Token is the binary encoding of the sealed token; the JSON encoding
+// has the same fields, with byte strings in base64, and the sealed token as
+// a nested object.
+type SignedToken struct {
+	// Version is [SignedTokenVersion].
+	Version int `json:"version"`
+	// Signer is the signer's Ed25519 public key.
+	Signer ed25519.PublicKey `json:"signer"`
+	// Signature is the Ed25519 signature of the token.
+	Signature []byte `json:"signature"`
+	// Token is the signed token.
+	Token *SealedToken `json:"token"`
+}
+
+// SignToken signs a sealed token with the Ed25519 private key priv.
+func SignToken(st *SealedToken, priv ed25519.PrivateKey) (*SignedToken, error) {
+	msg, err := signedTokenMessage(SignedTokenVersion, st)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedToken{
+		Version:   SignedTokenVersion,
+		Signer:    priv.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(priv, msg),
+		Token:     st,
+	}, nil
+}
+
+// VerifyToken checks that the signed token was signed by a signer in the
+// trust store, and returns the sealed token.  A rejected token is reported
+// as a [*TokenError].
+func VerifyToken(st *SignedToken, trust *TrustStore) (*SealedToken, error) {
+	if st.Version != SignedTokenVersion {
+		return nil, tokenError(ErrTokenMalformed, "unsupported signed token version %d", st.Version)
+	}
+	if len(st.Signer) != ed25519.PublicKeySize {
+		return nil, tokenError(ErrTokenMalformed, "Signer is %d bytes, expected %d", len(st.Signer), ed25519.PublicKeySize)
+	}
+	if st.Token == nil {
+		return nil, tokenError(ErrTokenMalformed, "signed token has no token")
+	}
+	if !trust.Trusted(st.Signer) {
+		return nil, tokenError(ErrTokenUntrusted, "signer %s", Fingerprint(st.Signer))
+	}
+
+	msg, err := signedTokenMessage(st.Version, st.Token)
+	if err != nil {
+		return nil, err
+	}
+	if len(st.Signature) != ed25519.SignatureSize || !ed25519.Verify(st.Signer, msg, st.Signature) {
+		return nil, tokenError(ErrTokenSignature, "signer %s", Fingerprint(st.Signer))
+	}
+	return st.Token, nil
+}
+
+// ApplySignedToken verifies the signed token against the trust store (see
+// [VerifyToken]) before it touches the blob, and then applies it as
+// [ApplySealedToken] does.  A rejected token is reported as a [*TokenError].
+func ApplySignedToken(blob []byte, st *SignedToken, trust *TrustStore, serverKey *ecdh.PrivateKey) ([]byte, error) {
+	sealed, err := VerifyToken(st, trust)
+	if err != nil {
+		return nil, err
+	}
+	return ApplySealedToken(blob, sealed, serverKey)
+}
+
+// signedTokenMessage returns the message that the signature of a signed
+// token of the given version covers.
+func signedTokenMessage(version int, st *SealedToken) ([]byte, error) {
+	bin, err := st.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 0, len(signedTokenContext)+1+len(bin))
+	msg = append(msg, signedTokenContext...)
+	msg = append(msg, byte(version))
+	return append(msg, bin...), nil
+}
+
+// MarshalBinary returns the binary encoding of the signed token.
+func (st *SignedToken) MarshalBinary() ([]byte, error) {
+	if len(st.Signer) != ed25519.PublicKeySize || len(st.Signature) != ed25519.SignatureSize || st.Token == nil {
+		return nil, tokenError(ErrTokenMalformed, "incomplete signed token")
+	}
+	bin, err := st.Token.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 1+ed25519.PublicKeySize+ed25519.SignatureSize+len(bin))
+	out = append(out, byte(st.Version))
+	out = append(out, st.Signer...)
+	out = append(out, st.Signature...)
+	return append(out, bin...), nil
+}
+
+// UnmarshalBinary decodes a signed token from its binary encoding.  The
+// fields are copied from data.  It does not verify the signature.
+func (st *SignedToken) UnmarshalBinary(data []byte) error {
+	const fixed = 1 + ed25519.PublicKeySize + ed25519.SignatureSize
+	if len(data) < 1 {
+		return tokenError(ErrTokenMalformed, "signed token is empty")
+	}
+	if data[0] != SignedTokenVersion {
+		return tokenError(ErrTokenMalformed, "unsupported signed token version %d", data[0])
+	}
+	if len(data) < fixed {
+		return tokenError(ErrTokenMalformed, "signed token (%d bytes) is truncated", len(data))
+	}
+
+	var sealed SealedToken
+	if err := sealed.UnmarshalBinary(data[fixed:]); err != nil {
+		return err
+	}
+	*st = SignedToken{
+		Version:   int(data[0]),
+		Signer:    bytes.Clone(data[1 : 1+ed25519.PublicKeySize]),
+		Signature: bytes.Clone(data[1+ed25519.PublicKeySize : fixed]),
+		Token:     &sealed,
+	}
+	return nil
+}
+
+// TrustStore is the set of Ed25519 public keys whose signed tokens a server
+// accepts, each with an optional name.  It is safe for concurrent use.  The
+// zero value is an empty trust store, ready to use; a nil TrustStore trusts
+// nobody.
+type TrustStore struct {
+	mu    sync.RWMutex
+	names map[string]string // name by public key
+}
+
+// NewTrustStore returns a trust store of the given keys.
+func NewTrustStore(keys ...ed25519.PublicKey) *TrustStore {
+	ts := &TrustStore{names: make(map[string]string)}
+	for _, k := range keys {
+		ts.Add(k, "")
+	}
+	return ts
+}
+
+// Add adds a key to the trust store, with an optional name.
+func (ts *TrustStore) Add(key ed25519.PublicKey, name string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.names == nil {
+		ts.names = make(map[string]string)
+	}
+	ts.names[string(key)] = name
+}
+
+// Remove removes a key from the trust store.
+func (ts *TrustStore) Remove(key ed25519.PublicKey) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.names, string(key))
+}
+
+// Trusted reports whether the key is in the trust store.
+func (ts *TrustStore) Trusted(key ed25519.PublicKey) bool {
+	if ts == nil {
+		return false
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	_, ok := ts.names[string(key)]
+	return ok
+}
+
+// Name returns the name of a key in the trust store, and whether the key is
+// in it.
+func (ts *TrustStore) Name(key ed25519.PublicKey) (string, bool) {
+	if ts == nil {
+		return "", false
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	name, ok := ts.names[string(key)]
+	return name, ok
+}
+
+// Len returns the number of keys in the trust store.
+func (ts *TrustStore) Len() int {
+	if ts == nil {
+		return 0
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return len(ts.names)
+}
+
+// ReadTrustStore reads a trust store from r.  Each line holds a base64
+// Ed25519 public key, optionally followed by whitespace and a name; empty
+// lines and lines that start with '#' are ignored.
+func ReadTrustStore(r io.Reader) (*TrustStore, error) {
+	ts := NewTrustStore()
+	sc := bufio.NewScanner(r)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		key, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("trust store line %d: invalid Ed25519 public key", lineno)
+		}
+		ts.Add(key, strings.Join(fields[1:], " "))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// ReadTrustStoreFile reads a trust store from a file (see [ReadTrustStore]).
+func ReadTrustStoreFile(path string) (*TrustStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ts, err := ReadTrustStore(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ts, nil
+}
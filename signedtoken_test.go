@@ -0,0 +1,187 @@
+package nestedaes
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/etclab/aes256"
+)
+
+func newSigner(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestApplySignedToken(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	server := newServerKey(t)
+	pub, priv := newSigner(t)
+	trust := NewTrustStore(pub)
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, newKEK := sealedToken(t, blob, kek, server)
+	signed, err := SignToken(sealed, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip through both encodings
+	bin, err := signed.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromBin SignedToken
+	if err := fromBin.UnmarshalBinary(bin); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	js, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON SignedToken
+	if err := json.Unmarshal(js, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, st := range map[string]*SignedToken{"binary": &fromBin, "JSON": &fromJSON} {
+		applied, err := ApplySignedToken(bytes.Clone(blob), st, trust, server)
+		if err != nil {
+			t.Fatalf("%s: ApplySignedToken failed: %v", name, err)
+		}
+		got, err := Decrypt(applied, newKEK, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%s: expected decrypt to produce %x, got %x", name, plain, got)
+		}
+	}
+}
+
+func TestSignedTokenRejected(t *testing.T) {
+	server := newServerKey(t)
+	pub, priv := newSigner(t)
+	_, otherPriv := newSigner(t)
+	trust := NewTrustStore(pub)
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := sealedToken(t, blob, kek, server)
+
+	untrusted, err := SignToken(sealed, otherPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignToken(sealed, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a valid signature over another token
+	other, _ := sealedToken(t, blob, kek, server)
+	forged := *signed
+	forged.Token = other
+	// a valid signature for another version of the format, relabeled
+	msg, err := signedTokenMessage(SignedTokenVersion+1, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabeled := *signed
+	relabeled.Signature = ed25519.Sign(priv, msg)
+
+	tests := []struct {
+		name   string
+		st     *SignedToken
+		trust  *TrustStore
+		reason error
+	}{
+		{"untrusted signer", untrusted, trust, ErrTokenUntrusted},
+		{"empty trust store", signed, NewTrustStore(), ErrTokenUntrusted},
+		{"nil trust store", signed, nil, ErrTokenUntrusted},
+		{"forged", &forged, trust, ErrTokenSignature},
+		{"relabeled", &relabeled, trust, ErrTokenSignature},
+	}
+	for _, tt := range tests {
+		orig := bytes.Clone(blob)
+		_, err := ApplySignedToken(orig, tt.st, tt.trust, server)
+		if !errors.Is(err, tt.reason) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.reason, err)
+		}
+		var te *TokenError
+		if !errors.As(err, &te) {
+			t.Fatalf("%s: error %v is not a *TokenError", tt.name, err)
+		}
+		if !bytes.Equal(orig, blob) {
+			t.Fatalf("%s: the rejected token modified the blob", tt.name)
+		}
+	}
+
+	blob, err = ApplySignedToken(blob, signed, trust, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplySignedToken(blob, signed, trust, server); !errors.Is(err, ErrTokenApplied) {
+		t.Fatalf("expected %v, got %v", ErrTokenApplied, err)
+	}
+}
+
+func TestReadTrustStore(t *testing.T) {
+	pub1, _ := newSigner(t)
+	pub2, _ := newSigner(t)
+	pub3, _ := newSigner(t)
+	data := "# key owners\n\n" +
+		base64.StdEncoding.EncodeToString(pub1) + " alice laptop\n" +
+		base64.StdEncoding.EncodeToString(pub2) + "\n"
+
+	ts, err := ReadTrustStore(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Len() != 2 {
+		t.Fatalf("expected 2 keys, got %d", ts.Len())
+	}
+	if name, ok := ts.Name(pub1); !ok || name != "alice laptop" {
+		t.Fatalf("expected key 1 to be trusted as %q, got %q, %v", "alice laptop", name, ok)
+	}
+	if !ts.Trusted(pub2) || ts.Trusted(pub3) {
+		t.Fatalf("Trusted gave the wrong answer")
+	}
+
+	if _, err := ReadTrustStore(strings.NewReader("bm90IGEga2V5\n")); err == nil {
+		t.Fatalf("ReadTrustStore accepted an invalid key")
+	}
+}
+
+func TestTrustStoreZeroValue(t *testing.T) {
+	pub1, _ := newSigner(t)
+	pub2, _ := newSigner(t)
+
+	var ts TrustStore
+	if ts.Trusted(pub1) || ts.Len() != 0 {
+		t.Fatalf("an empty trust store trusts a key")
+	}
+	ts.Remove(pub1)
+	ts.Add(pub1, "alice")
+	if name, ok := ts.Name(pub1); !ok || name != "alice" {
+		t.Fatalf("expected key 1 to be trusted as %q, got %q, %v", "alice", name, ok)
+	}
+	if ts.Trusted(pub2) || ts.Len() != 1 {
+		t.Fatalf("Trusted gave the wrong answer")
+	}
+}
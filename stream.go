@@ -0,0 +1,275 @@
+package nestedaes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/mu"
+)
+
+// streamChunkSize is the size of the buffer through which the streaming
+// functions pass the payload.
+const streamChunkSize = 64 * 1024
+
+// MaxStreamHeaderSize is the largest header that the streaming functions
+// accept (about 32 thousand layers).  It keeps a corrupt or malicious size
+// field from making them allocate an arbitrary amount of memory.
+const MaxStreamHeaderSize = 1 << 20
+
+// gcmMaxPayload is the largest plaintext GCM can encrypt under one nonce:
+// the 32-bit block counter allows 2^32-2 blocks.
+const gcmMaxPayload = (1<<32 - 2) * 16
+
+// The payload's innermost layer is AES-GCM with a single tag, and the
+// standard library's GCM is one-shot: it needs the whole message in memory.
+// So, while the CTR layers are streamed in chunks, [EncryptStream] and
+// [DecryptStream] hold the payload in memory: a single buffer the size of the
+// payload (plus the tag), which is sealed or opened in place, and wiped when
+// they return.  They refuse payloads beyond the GCM limit of about 64 GiB,
+// but for a payload that doesn't fit in memory, use the in-memory functions
+// on pieces of it, or encrypt it in several blobs.  Only [ReencryptStream],
+// which never touches the GCM layer, runs in a bounded amount of memory.  In
+// exchange, [DecryptStream] authenticates the payload before writing any of
+// it.
+
+// EncryptStream is like [Encrypt], but reads the plaintext from r and writes
+// the blob to w.  The plaintext is buffered in memory, as the GCM tag in the
+// header depends on all of it; the buffer is encrypted in place, and wiped
+// before EncryptStream returns.  EncryptStream returns the size of the blob.
+func EncryptStream(w io.Writer, r io.Reader, kek, iv, additionalData []byte) (int64, error) {
+	return EncryptStreamWithMetadata(w, r, kek, iv, additionalData, nil)
+}
+
+// EncryptStreamWithMetadata is like [EncryptStream], but records md in the
+// blob's header (see [EncryptWithMetadata]).
+func EncryptStreamWithMetadata(w io.Writer, r io.Reader, kek, iv, additionalData []byte, md Metadata) (int64, error) {
+	if len(kek) != aes256.KeySize {
+		return 0, aes.KeySizeError(len(kek))
+	}
+	if len(iv) != aes256.IVSize {
+		return 0, aes256.IVSizeError(len(iv))
+	}
+	meta, err := appendMetadata(nil, md)
+	if err != nil {
+		return 0, err
+	}
+
+	buf, err := readPayload(r)
+	if err != nil {
+		return 0, err
+	}
+	defer Wipe(buf[:cap(buf)])
+
+	var dek [aes256.KeySize]byte
+	defer Wipe(dek[:])
+	if _, err := rand.Read(dek[:]); err != nil {
+		mu.Panicf("nestedaes.EncryptStream: rand.Read failed: %v", err)
+	}
+	var nonce [aes256.NonceSize]byte
+	ct := aes256.NewGCM(dek[:]).Seal(buf[:0], nonce[:], buf, additionalData)
+	payload, tag := ct[:len(buf)], ct[len(buf):]
+
+	hdr := make([]byte, Overhead+len(meta))
+	sealHeader(hdr, iv, meta, kek, 0, tag, dek[:])
+	if _, err := w.Write(hdr); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return 0, err
+	}
+
+	return int64(len(hdr) + len(payload)), nil
+}
+
+// ReencryptStream is like [ReencryptWithKeys], but reads the blob from r and
+// writes the new blob to w, using a bounded amount of memory.  It returns the
+// size of the new blob.
+func ReencryptStream(w io.Writer, r io.Reader, kek, newKEK, newDEK []byte) (int64, error) {
+	if len(kek) != aes256.KeySize {
+		return 0, aes.KeySizeError(len(kek))
+	}
+	if len(newKEK) != aes256.KeySize {
+		return 0, aes.KeySizeError(len(newKEK))
+	}
+	if len(newDEK) != aes256.KeySize {
+		return 0, aes.KeySizeError(len(newDEK))
+	}
+
+	hdr, err := readHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	hSize, meta, dec, err := openHeader(kek, hdr, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer Wipe(dec)
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
+	baseIV := hdr[4:plainHeaderSize]
+
+	newHdr := make([]byte, hSize+aes256.KeySize)
+	sealHeader(newHdr, baseIV, meta, newKEK, numDEKs, dec, newDEK)
+	if _, err := w.Write(newHdr); err != nil {
+		return 0, err
+	}
+
+	var iv [aes256.IVSize]byte
+	layerIV(&iv, baseIV, numDEKs)
+	ctr := aes256.NewCTR(newDEK, iv[:])
+
+	buf := make([]byte, streamChunkSize)
+	n, err := copyChunks(w, r, buf, func(dst, src []byte) error {
+		ctr.XORKeyStream(dst, src)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(newHdr)) + n, nil
+}
+
+// DecryptStream is like [Decrypt], but reads the blob from r and writes the
+// plaintext to w.  It returns the size of the plaintext.  The payload is
+// buffered in memory, so that it can be authenticated before any plaintext is
+// written to w; it is decrypted in place, and the buffer is wiped before
+// DecryptStream returns.  If DecryptStream fails, nothing has been written to
+// w, unless w itself returned the error.
+func DecryptStream(w io.Writer, r io.Reader, kek, additionalData []byte) (int64, error) {
+	if len(kek) != aes256.KeySize {
+		return 0, aes.KeySizeError(len(kek))
+	}
+
+	hdr, err := readHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	_, meta, dec, err := openHeader(kek, hdr, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer Wipe(dec)
+	if err := checkAAD(meta, additionalData); err != nil {
+		return 0, err
+	}
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
+	baseIV := hdr[4:plainHeaderSize]
+
+	// since the CTR layers are XORs, they can be peeled off in any order
+	var iv [aes256.IVSize]byte
+	layers := make([]cipher.Stream, 0, numDEKs-1)
+	for i := 1; i < numDEKs; i++ {
+		layerIV(&iv, baseIV, i)
+		dek := dec[aes256.TagSize+i*aes256.KeySize : aes256.TagSize+(i+1)*aes256.KeySize]
+		layers = append(layers, aes256.NewCTR(dek, iv[:]))
+	}
+
+	buf, err := readPayload(r)
+	if err != nil {
+		return 0, err
+	}
+	defer Wipe(buf[:cap(buf)])
+	for _, layer := range layers {
+		layer.XORKeyStream(buf, buf)
+	}
+
+	// GCM expects the tag to follow the ciphertext
+	ct := append(buf, dec[:aes256.TagSize]...)
+	var nonce [aes256.NonceSize]byte
+	plain, err := aes256.NewGCM(dec[aes256.TagSize:aes256.TagSize+aes256.KeySize]).Open(ct[:0], nonce[:], ct, additionalData)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(plain)
+	return int64(n), err
+}
+
+// ReadHeader reads a blob's marshaled header from the start of r, without
+// reading any of the payload.  Headers larger than [MaxStreamHeaderSize] are
+// rejected.
+func ReadHeader(r io.Reader) ([]byte, error) {
+	return readHeader(r)
+}
+
+// readHeader reads a marshaled header from the start of r.
+func readHeader(r io.Reader) ([]byte, error) {
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		return nil, fmt.Errorf("can't read Size field: %w", err)
+	}
+
+	size, _ := headerSize(binary.BigEndian.Uint32(sizeBuf[:]))
+	if size > MaxStreamHeaderSize {
+		return nil, fmt.Errorf("header size (%d bytes) exceeds the streaming limit of %d bytes", size, MaxStreamHeaderSize)
+	}
+	if size < plainHeaderSize {
+		return nil, fmt.Errorf("header size (%d bytes) is too small", size)
+	}
+
+	hdr := make([]byte, size)
+	copy(hdr, sizeBuf[:])
+	if _, err := io.ReadFull(r, hdr[4:]); err != nil {
+		return nil, fmt.Errorf("can't read header: %w", err)
+	}
+	return hdr, nil
+}
+
+// readPayload reads r to EOF into a buffer with room for a GCM tag after the
+// data, so that the payload can be sealed or opened in place.  As the buffer
+// grows, the outgrown buffers are wiped, so that only the returned buffer
+// holds the data; the caller should wipe it, up to its capacity.  Payloads
+// beyond the GCM limit are rejected before they are read in full.
+func readPayload(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 0, streamChunkSize+aes256.TagSize)
+	for {
+		if cap(buf)-len(buf) == aes256.TagSize {
+			grown := make([]byte, len(buf), 2*cap(buf))
+			copy(grown, buf)
+			Wipe(buf)
+			buf = grown
+		}
+		n, err := r.Read(buf[len(buf) : cap(buf)-aes256.TagSize])
+		buf = buf[:len(buf)+n]
+		if uint64(len(buf)) > gcmMaxPayload {
+			Wipe(buf)
+			return nil, fmt.Errorf("payload exceeds the AES-GCM limit of %d bytes", uint64(gcmMaxPayload))
+		}
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			Wipe(buf)
+			return nil, err
+		}
+	}
+}
+
+// copyChunks reads r to EOF in chunks of buf, transforms each chunk in place
+// with fn, and writes it to w.  It returns the number of bytes copied.
+func copyChunks(w io.Writer, r io.Reader, buf []byte, fn func(dst, src []byte) error) (int64, error) {
+	var total int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := fn(buf[:n], buf[:n]); err != nil {
+				return total, err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package nestedaes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/etclab/aes256"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	plain := make([]byte, 3*streamChunkSize+123)
+	rand.Read(plain)
+	ad := []byte("object-name")
+
+	kek := aes256.NewRandomKey()
+	f, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n, err := EncryptStream(f, bytes.NewReader(plain), kek, aes256.NewRandomIV(), ad)
+	if err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+	if n != int64(len(plain)+Overhead) {
+		t.Fatalf("expected EncryptStream to write %d bytes, got %d", len(plain)+Overhead, n)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the streamed blob is a regular blob
+	got, err := Decrypt(bytes.Clone(blob), kek, ad)
+	if err != nil {
+		t.Fatalf("Decrypt of streamed blob failed: %v", err)
+	}
+	if !bytes.Equal(plain, got) {
+		t.Fatalf("Decrypt of streamed blob produced the wrong plaintext")
+	}
+
+	for i := 0; i < 3; i++ {
+		var out bytes.Buffer
+		newKEK := aes256.NewRandomKey()
+		if _, err := ReencryptStream(&out, bytes.NewReader(blob), kek, newKEK, aes256.NewRandomKey()); err != nil {
+			t.Fatalf("ReencryptStream #%d failed: %v", i, err)
+		}
+		blob, kek = out.Bytes(), newKEK
+	}
+
+	var out bytes.Buffer
+	n, err = DecryptStream(&out, bytes.NewReader(blob), kek, ad)
+	if err != nil {
+		t.Fatalf("DecryptStream failed: %v", err)
+	}
+	if n != int64(len(plain)) || !bytes.Equal(plain, out.Bytes()) {
+		t.Fatalf("DecryptStream produced the wrong plaintext")
+	}
+
+	got, err = Decrypt(bytes.Clone(blob), kek, ad)
+	if err != nil {
+		t.Fatalf("Decrypt of stream-reencrypted blob failed: %v", err)
+	}
+	if !bytes.Equal(plain, got) {
+		t.Fatalf("Decrypt of stream-reencrypted blob produced the wrong plaintext")
+	}
+}
+
+func TestReadPayload(t *testing.T) {
+	for _, size := range []int{0, 1, streamChunkSize, streamChunkSize + 1, 5*streamChunkSize - 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		buf, err := readPayload(iotest.HalfReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("readPayload of %d bytes failed: %v", size, err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("readPayload of %d bytes read the wrong data", size)
+		}
+		if cap(buf)-len(buf) < aes256.TagSize {
+			t.Fatalf("readPayload of %d bytes left no room for the tag", size)
+		}
+	}
+
+	if _, err := readPayload(iotest.ErrReader(io.ErrClosedPipe)); err != io.ErrClosedPipe {
+		t.Fatalf("expected readPayload to return the reader's error, got %v", err)
+	}
+}
+
+func TestDecryptStreamTampered(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, kek, err = Reencrypt(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob[len(blob)-1] ^= 1
+	var out bytes.Buffer
+	if _, err := DecryptStream(&out, bytes.NewReader(blob), kek, nil); err == nil {
+		t.Fatalf("DecryptStream accepted a tampered payload")
+	}
+	if out.Len() != 0 {
+		t.Fatalf("DecryptStream wrote %d bytes of unauthenticated plaintext", out.Len())
+	}
+}
@@ -0,0 +1,262 @@
+package nestedaes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/etclab/aes256"
+)
+
+// Token is a re-encryption token: what a storage server needs to add a layer
+// of encryption to a blob without learning any KEK.  The key owner fetches
+// only the blob's header, and derives a token from it with [ReKeyGen]; the
+// server applies the token to the stored blob with [ApplyToken].  The result
+// is the same as that of [Reencrypt], but the payload never leaves the server,
+// and the server never sees the plaintext.
+//
+// A token's DEK is secret: anyone who holds it and the blob can strip the new
+// layer.  Wipe the token once it has been applied.
+type Token struct {
+	// Header is the blob's new marshaled header, sealed under the new KEK.
+	Header []byte
+	// DEK is the DEK of the new layer (size is [aes256.KeySize]).
+	DEK []byte
+	// Layer is the index of the new layer, which is the number of layers the
+	// blob must have before the token is applied.
+	Layer int
+	// PrevHeaderHash is the [HeaderHash] of the header the token replaces.
+	// If it is set, [ApplyToken] only applies the token to a blob with that
+	// header, which rules out applying the token to another blob, twice, or
+	// out of order.
+	PrevHeaderHash []byte
+}
+
+// Reasons for rejecting a token, as the Reason of a [*TokenError].  Check
+// for them with [errors.Is].
+var (
+	// ErrTokenMalformed is returned for a token that can't be decoded.
+	ErrTokenMalformed = errors.New("nestedaes: malformed token")
+	// ErrTokenUntrusted is returned for a signed token whose signer isn't in
+	// the trust store.
+	ErrTokenUntrusted = errors.New("nestedaes: token signer is not trusted")
+	// ErrTokenSignature is returned for a signed token whose signature
+	// doesn't verify.
+	ErrTokenSignature = errors.New("nestedaes: invalid token signature")
+	// ErrTokenSeal is returned for a sealed token that can't be opened: it
+	// was sealed for another server, or modified.
+	ErrTokenSeal = errors.New("nestedaes: can't open sealed token")
+	// ErrTokenWrongBlob is returned for a token derived from another blob.
+	ErrTokenWrongBlob = errors.New("nestedaes: token is for another blob")
+	// ErrTokenApplied is returned for a token whose layer the blob already
+	// has: the token was already applied, or superseded.
+	ErrTokenApplied = errors.New("nestedaes: token was already applied")
+	// ErrTokenOutOfOrder is returned for a token derived from a later header
+	// of the blob: earlier tokens must be applied first.
+	ErrTokenOutOfOrder = errors.New("nestedaes: token is out of order")
+)
+
+// TokenError is the error returned when a token is rejected.
+type TokenError struct {
+	// Reason is one of the ErrToken errors.
+	Reason error
+	// Detail describes the rejection; it may be empty.
+	Detail string
+}
+
+func tokenError(reason error, format string, a ...any) *TokenError {
+	return &TokenError{Reason: reason, Detail: fmt.Sprintf(format, a...)}
+}
+
+func (e *TokenError) Error() string {
+	if e.Detail == "" {
+		return e.Reason.Error()
+	}
+	return e.Reason.Error() + ": " + e.Detail
+}
+
+// Unwrap returns the Reason.
+func (e *TokenError) Unwrap() error {
+	return e.Reason
+}
+
+// ReKeyGen derives a re-encryption token from a blob's header (or the full
+// blob), the blob's current KEK, and a randomly generated new KEK and DEK.
+// On success, the function returns the token and the new KEK; the new KEK is
+// allocated with [AllocKey], and the caller should release it with [FreeKey]
+// once it has been stored.
+func ReKeyGen(header, kek []byte) (*Token, []byte, error) {
+	return ReKeyGenWithMetadata(header, kek, nil)
+}
+
+// ReKeyGenWithMetadata is like [ReKeyGen], but the token's header also
+// records md: its entries are added to the header's metadata, replacing the
+// entries with the same tags.  For instance, a key owner records the time of
+// a rotation with:
+//
+//	md := nestedaes.Metadata{nestedaes.MetaRotatedAt: nestedaes.RotationTime(time.Now())}
+//	t, newKEK, err := nestedaes.ReKeyGenWithMetadata(header, kek, md)
+//
+// Since applying a token can't shrink the blob's header, md must not replace
+// an entry with a shorter value.
+func ReKeyGenWithMetadata(header, kek []byte, md Metadata) (*Token, []byte, error) {
+	newKEK := newRandomKey()
+	newDEK := newRandomKey()
+	defer FreeKey(newDEK)
+
+	t, err := reKeyGen(header, kek, newKEK, newDEK, md)
+	if err != nil {
+		FreeKey(newKEK)
+		return nil, nil, err
+	}
+	return t, newKEK, nil
+}
+
+// ReKeyGenWithKeys is the same as [ReKeyGen], but it allows the caller to
+// specify the new KEK and DEK, rather than having them be randomly generated.
+// The token holds a copy of newDEK.
+func ReKeyGenWithKeys(header, kek, newKEK, newDEK []byte) (*Token, error) {
+	return reKeyGen(header, kek, newKEK, newDEK, nil)
+}
+
+// reKeyGen derives a token that adds a layer under newKEK and newDEK, and
+// merges md into the header's metadata.
+func reKeyGen(header, kek, newKEK, newDEK []byte, md Metadata) (*Token, error) {
+	if len(kek) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(kek))
+	}
+	if len(newKEK) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newKEK))
+	}
+	if len(newDEK) != aes256.KeySize {
+		return nil, aes.KeySizeError(len(newDEK))
+	}
+
+	sp := getScratch()
+	defer putScratch(sp)
+
+	hSize, meta, dec, err := openHeader(kek, header, *sp)
+	if err != nil {
+		return nil, err
+	}
+	*sp = dec[:0]
+	numDEKs := (len(dec) - aes256.TagSize) / aes256.KeySize
+
+	newMeta, err := mergeMetadata(meta, md)
+	if err != nil {
+		return nil, err
+	}
+	if len(newMeta) < len(meta) {
+		return nil, fmt.Errorf("metadata (%d bytes) is smaller than the header's (%d bytes)", len(newMeta), len(meta))
+	}
+
+	t := &Token{
+		Header:         make([]byte, hSize+len(newMeta)-len(meta)+aes256.KeySize),
+		DEK:            AllocKey(aes256.KeySize),
+		Layer:          numDEKs,
+		PrevHeaderHash: hashHeader(header[:hSize]),
+	}
+	copy(t.DEK, newDEK)
+	sealHeader(t.Header, header[4:plainHeaderSize], newMeta, newKEK, numDEKs, dec, newDEK)
+
+	return t, nil
+}
+
+// Wipe zeroes and releases the token's DEK.  The token must not be used
+// afterwards.
+func (t *Token) Wipe() {
+	FreeKey(t.DEK)
+	t.DEK = nil
+}
+
+// ApplyToken re-encrypts the blob in place with the token: it adds the
+// token's layer of encryption to the payload, and replaces the header with
+// the token's header.  It neither needs nor checks any KEK; it only checks
+// that the token was derived from a header with the blob's BaseIV and number
+// of layers, and, if the token has a PrevHeaderHash, from the blob's current
+// header.
+//
+// A rejected token is reported as a [*TokenError].
+//
+// As with [ReencryptInto], if blob has at least [KeySize] bytes of spare
+// capacity, ApplyToken does not allocate, and the returned slice shares
+// blob's storage.  In either case, the contents of blob are overwritten.
+func ApplyToken(blob []byte, t *Token) ([]byte, error) {
+	hSize, newHSize, err := checkToken(blob, t)
+	if err != nil {
+		return nil, err
+	}
+
+	// make room for the new header by shifting the payload
+	ret, _ := sliceForAppend(blob, newHSize-hSize, 0)
+	payload := ret[newHSize:]
+	copy(payload, ret[hSize:len(blob)])
+
+	// add the new layer of encryption
+	var iv [aes256.IVSize]byte
+	layerIV(&iv, t.Header[4:plainHeaderSize], t.Layer)
+	aes256.NewCTR(t.DEK, iv[:]).XORKeyStream(payload, payload)
+
+	copy(ret, t.Header)
+	return ret, nil
+}
+
+// checkToken checks that the token applies to blob, and returns the sizes of
+// the blob's current header and of the token's header.
+func checkToken(blob []byte, t *Token) (int, int, error) {
+	if len(t.DEK) != aes256.KeySize {
+		return 0, 0, aes.KeySizeError(len(t.DEK))
+	}
+
+	hSize, _, numDEKs, err := parsePlainHeader(blob)
+	if err != nil {
+		return 0, 0, err
+	}
+	newHSize, _, newNumDEKs, err := parsePlainHeader(t.Header)
+	if err != nil {
+		return 0, 0, tokenError(ErrTokenMalformed, "invalid header: %v", err)
+	}
+	if newHSize != len(t.Header) {
+		return 0, 0, tokenError(ErrTokenMalformed, "header size field is %d but the header is %d bytes", newHSize, len(t.Header))
+	}
+	if newNumDEKs != t.Layer+1 {
+		return 0, 0, tokenError(ErrTokenMalformed, "token adds layer %d, but its header has %d layers", t.Layer, newNumDEKs)
+	}
+
+	if !bytes.Equal(blob[4:plainHeaderSize], t.Header[4:plainHeaderSize]) {
+		return 0, 0, tokenError(ErrTokenWrongBlob, "the blob has a different BaseIV")
+	}
+	if numDEKs > t.Layer {
+		return 0, 0, tokenError(ErrTokenApplied, "token adds layer %d, but the blob has %d layers", t.Layer, numDEKs)
+	}
+	if numDEKs < t.Layer {
+		return 0, 0, tokenError(ErrTokenOutOfOrder, "token adds layer %d, but the blob has %d layers", t.Layer, numDEKs)
+	}
+	if t.PrevHeaderHash != nil && subtle.ConstantTimeCompare(t.PrevHeaderHash, hashHeader(blob[:hSize])) != 1 {
+		return 0, 0, tokenError(ErrTokenWrongBlob, "token does not replace the blob's header")
+	}
+	if newHSize < hSize {
+		return 0, 0, tokenError(ErrTokenMalformed, "token header (%d bytes) is smaller than the blob's (%d bytes)", newHSize, hSize)
+	}
+
+	return hSize, newHSize, nil
+}
+
+// HeaderHash returns the SHA-256 hash of a blob's header (the blob may also
+// be just the header).  The hash identifies a blob at a given layer: it
+// changes with every re-encryption.
+func HeaderHash(blob []byte) ([]byte, error) {
+	hSize, _, _, err := parsePlainHeader(blob)
+	if err != nil {
+		return nil, err
+	}
+	return hashHeader(blob[:hSize]), nil
+}
+
+func hashHeader(header []byte) []byte {
+	sum := sha256.Sum256(header)
+	return sum[:]
+}
@@ -0,0 +1,185 @@
+package nestedaes
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/etclab/aes256"
+)
+
+func TestApplyToken(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	ad := []byte("object-name")
+
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt(plain, kek, aes256.NewRandomIV(), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		hdr, _, err := SplitHeaderPayload(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, newKEK, err := ReKeyGen(hdr, kek)
+		if err != nil {
+			t.Fatalf("ReKeyGen failed: %v", err)
+		}
+		if tok.Layer != i+1 {
+			t.Fatalf("expected token for layer %d, got %d", i+1, tok.Layer)
+		}
+
+		blob, err = ApplyToken(blob, tok)
+		if err != nil {
+			t.Fatalf("ApplyToken failed: %v", err)
+		}
+		tok.Wipe()
+		kek = newKEK
+	}
+
+	got, err := Decrypt(blob, kek, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("expected decrypt to produce %x, got %x", plain, got)
+	}
+}
+
+// ReKeyGenWithKeys followed by ApplyToken gives the same blob as
+// ReencryptWithKeys.
+func TestApplyTokenMatchesReencrypt(t *testing.T) {
+	kek := aes256.NewRandomKey()
+	newKEK := aes256.NewRandomKey()
+	newDEK := aes256.NewRandomKey()
+	blob, err := Encrypt(make([]byte, 1000), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := ReKeyGenWithKeys(blob, kek, newKEK, newDEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := ApplyToken(bytes.Clone(blob), tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := ReencryptWithKeys(bytes.Clone(blob), kek, newKEK, newDEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(applied, want) {
+		t.Fatalf("ApplyToken and ReencryptWithKeys differ")
+	}
+}
+
+func TestApplyTokenMismatch(t *testing.T) {
+	kek := aes256.NewRandomKey()
+	blob, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Encrypt([]byte("hello"), kek, aes256.NewRandomIV(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, _, err := ReKeyGen(blob, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyToken(other, tok); err == nil {
+		t.Fatalf("ApplyToken accepted a token for another blob")
+	}
+
+	blob, err = ApplyToken(blob, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyToken(blob, tok); err == nil {
+		t.Fatalf("ApplyToken applied the same token twice")
+	}
+}
+
+// A token whose header is smaller than the blob's, such as one derived from
+// a blob without metadata, is rejected rather than corrupting the payload.
+func TestApplyTokenShorterHeader(t *testing.T) {
+	kek := aes256.NewRandomKey()
+	iv := aes256.NewRandomIV()
+	ad := []byte("object-name")
+	blob, err := EncryptWithMetadata([]byte("hello"), kek, iv, ad, Metadata{MetaAADHash: AADHash(ad)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare, err := Encrypt([]byte("hello"), kek, iv, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, _, err := ReKeyGen(bare, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok.PrevHeaderHash = nil
+	if _, err := ApplyToken(blob, tok); err == nil {
+		t.Fatal("ApplyToken accepted a token with a shorter header")
+	}
+}
+
+func TestReKeyGenWithMetadata(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	ad := []byte("object-name")
+	kek := aes256.NewRandomKey()
+	blob, err := EncryptWithMetadata(plain, kek, aes256.NewRandomIV(), ad, Metadata{MetaAADHash: AADHash(ad)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first rotation adds an entry, and the second replaces it
+	for i, when := range []time.Time{time.Unix(1700000000, 0), time.Unix(1800000000, 0)} {
+		hdr, _, err := SplitHeaderPayload(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, newKEK, err := ReKeyGenWithMetadata(hdr, kek, Metadata{MetaRotatedAt: RotationTime(when)})
+		if err != nil {
+			t.Fatalf("ReKeyGenWithMetadata #%d failed: %v", i, err)
+		}
+		if blob, err = ApplyToken(blob, tok); err != nil {
+			t.Fatalf("ApplyToken #%d failed: %v", i, err)
+		}
+		tok.Wipe()
+		kek = newKEK
+
+		if hdr, _, err = SplitHeaderPayload(blob); err != nil {
+			t.Fatal(err)
+		}
+		h, err := UnmarshalHeader(kek, hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ParseRotationTime(h.Metadata[MetaRotatedAt]); err != nil || !got.Equal(when) {
+			t.Fatalf("expected rotation time %v, got %v (%v)", when, got, err)
+		}
+		if !bytes.Equal(h.Metadata[MetaAADHash], AADHash(ad)) {
+			t.Fatal("the token dropped the AAD hash")
+		}
+	}
+
+	got, err := Decrypt(blob, kek, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("expected decrypt to produce %x, got %x", plain, got)
+	}
+
+	// a token can't shrink the header
+	if _, _, err := ReKeyGenWithMetadata(blob, kek, Metadata{MetaRotatedAt: nil}); err == nil {
+		t.Fatal("expected a shorter metadata entry to fail")
+	}
+}
@@ -0,0 +1,16 @@
+package nestedaes
+
+import "runtime"
+
+// Wipe overwrites b with zeros.  Callers should wipe key material and
+// plaintext buffers once they are no longer needed, rather than leaving them
+// on the heap until the garbage collector frees them.
+//
+// Note that Go offers no guarantee that copies of b (for instance, made by
+// the runtime when growing a slice, or the expanded key schedules inside
+// [crypto/aes] ciphers) are wiped; Wipe only scrubs the memory b refers to.
+func Wipe(b []byte) {
+	clear(b)
+	// keep the writes from being optimized away as dead stores
+	runtime.KeepAlive(b)
+}